@@ -42,3 +42,32 @@ CREATE TABLE IF NOT EXISTS user_badges (
   unlocked_at TIMESTAMP DEFAULT now(),
   PRIMARY KEY(user_id,badge_id)
 );
+
+-- Run jobs handed from the exec-engine API to exec-engine workers (JOB_QUEUE=postgres)
+CREATE TABLE IF NOT EXISTS run_jobs (
+  id BIGSERIAL PRIMARY KEY,
+  user_id TEXT NOT NULL DEFAULT '',
+  tier TEXT NOT NULL DEFAULT 'free',
+  request JSONB NOT NULL,
+  status TEXT NOT NULL DEFAULT 'queued',
+  result JSONB,
+  error TEXT,
+  worker_id TEXT,
+  attempts INT NOT NULL DEFAULT 0,
+  sort_key TIMESTAMPTZ NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  claimed_at TIMESTAMPTZ,
+  heartbeat_at TIMESTAMPTZ,
+  finished_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS run_jobs_queued_idx ON run_jobs (sort_key) WHERE status = 'queued';
+CREATE INDEX IF NOT EXISTS run_jobs_running_idx ON run_jobs (heartbeat_at) WHERE status = 'running';
+
+-- Daily execution usage per user, for exec-engine tier quotas (QUOTA_STORE=postgres)
+CREATE TABLE IF NOT EXISTS user_usage (
+  user_id TEXT NOT NULL,
+  day DATE NOT NULL,
+  runs INT NOT NULL DEFAULT 0,
+  cpu_ms BIGINT NOT NULL DEFAULT 0,
+  PRIMARY KEY (user_id, day)
+);
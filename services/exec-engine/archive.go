@@ -0,0 +1,186 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// ProjectArchive is a whole project uploaded as a zip or tar.gz, either as the "archive" part of
+// a multipart request or base64 in JSON. Its files are extracted into RunRequest.Files when the
+// request is decoded; the archive itself is kept so k8s mode can forward it unchanged.
+type ProjectArchive struct {
+	Format string `json:"format,omitempty"` // zip or tar.gz, detected from the data
+	Data   []byte `json:"data"`
+}
+
+// decodeRunRequest reads a /run body: JSON, or multipart/form-data with a "manifest" part
+// holding the JSON request without files and an "archive" part with the project.
+func decodeRunRequest(r *http.Request, l requestLimits) (RunRequest, error) {
+	var req RunRequest
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return req, err
+		}
+	} else {
+		mr, err := r.MultipartReader()
+		if err != nil {
+			return req, invalid("multipart body: %v", err)
+		}
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return req, err
+			}
+			switch part.FormName() {
+			case "manifest":
+				err = json.NewDecoder(part).Decode(&req)
+			case "archive":
+				var data []byte
+				if data, err = io.ReadAll(part); err == nil {
+					req.Archive = &ProjectArchive{Data: data}
+				}
+			default:
+				err = invalid("unexpected multipart field %q (want manifest and archive)", part.FormName())
+			}
+			if err != nil {
+				return req, err
+			}
+		}
+		if req.Archive == nil {
+			return req, invalid("multipart requests need an archive part")
+		}
+	}
+	if req.Archive == nil {
+		return req, nil
+	}
+	if len(req.Files) > 0 {
+		return req, invalid("send files either in the archive or as JSON, not both")
+	}
+	files, err := req.Archive.extract(l)
+	if err != nil {
+		return req, err
+	}
+	req.Files = files
+	return req, nil
+}
+
+// extract returns the files of the archive and sets its Format. Entry names are validated like
+// JSON file names, so nothing lands outside the submission directory, and only regular files
+// and directories are accepted. The file count and sizes are enforced while reading, so an
+// archive that expands far beyond its size stops at the limits.
+func (a *ProjectArchive) extract(l requestLimits) (map[string]string, error) {
+	files := map[string]string{}
+	var total int64
+	add := func(name string, r io.Reader) error {
+		name = strings.TrimPrefix(name, "./")
+		if err := validateFileName(name); err != nil {
+			return err
+		}
+		if _, ok := files[name]; ok {
+			return invalid("archive has %q twice", name)
+		}
+		if len(files) == l.maxFiles {
+			return tooLarge("archive has more than %d files", l.maxFiles)
+		}
+		content, err := io.ReadAll(io.LimitReader(r, l.maxFileBytes+1))
+		if err != nil {
+			return invalid("archive entry %q: %v", name, err)
+		}
+		if int64(len(content)) > l.maxFileBytes {
+			return tooLarge("file %q is larger than %d bytes", name, l.maxFileBytes)
+		}
+		if total += int64(len(content)); total > l.maxTotalBytes {
+			return tooLarge("archive expands to more than %d bytes", l.maxTotalBytes)
+		}
+		files[name] = string(content)
+		return nil
+	}
+	var err error
+	switch {
+	case bytes.HasPrefix(a.Data, []byte("PK\x03\x04")):
+		a.Format = "zip"
+		err = extractZip(a.Data, add)
+	case bytes.HasPrefix(a.Data, []byte("\x1f\x8b")):
+		a.Format = "tar.gz"
+		err = extractTarGz(a.Data, add)
+	default:
+		return nil, invalid("archive must be a zip or tar.gz")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, invalid("archive has no files")
+	}
+	return files, nil
+}
+
+func extractZip(data []byte, add func(string, io.Reader) error) error {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return invalid("zip: %v", err)
+	}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			return invalid("archive entry %q is not a regular file", f.Name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return invalid("archive entry %q: %v", f.Name, err)
+		}
+		err = add(f.Name, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractTarGz(data []byte, add func(string, io.Reader) error) error {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return invalid("gzip: %v", err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return invalid("tar: %v", err)
+		}
+		switch h.Typeflag {
+		case tar.TypeDir, tar.TypeXGlobalHeader:
+		case tar.TypeReg:
+			if err := add(h.Name, tr); err != nil {
+				return err
+			}
+		default:
+			return invalid("archive entry %q is not a regular file", h.Name)
+		}
+	}
+}
+
+// archiveMediaType is the content type of an archive format, for object storage.
+func archiveMediaType(format string) string {
+	if format == "zip" {
+		return "application/zip"
+	}
+	return "application/gzip"
+}
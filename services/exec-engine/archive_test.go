@@ -0,0 +1,128 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"mime/multipart"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type archiveEntry struct {
+	name, content string
+	typeflag      byte // tar only; 0 = regular file
+}
+
+func zipArchive(t *testing.T, entries ...archiveEntry) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(e.content))
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func tarGzArchive(t *testing.T, entries ...archiveEntry) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		h := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.content)), Typeflag: tar.TypeReg}
+		switch e.typeflag {
+		case tar.TypeDir:
+			h.Typeflag, h.Size, h.Mode = tar.TypeDir, 0, 0755
+		case tar.TypeSymlink:
+			h.Typeflag, h.Size, h.Linkname = tar.TypeSymlink, 0, e.content
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(e.content[:h.Size]))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestExtractArchive(t *testing.T) {
+	limits := requestLimits{maxFiles: 3, maxFileBytes: 10, maxTotalBytes: 15}
+	cases := []struct {
+		name   string
+		data   []byte
+		files  map[string]string
+		status int // 0 = valid
+	}{
+		{"zip", zipArchive(t, archiveEntry{name: "main.py", content: "x"}, archiveEntry{name: "pkg/", content: ""}, archiveEntry{name: "pkg/util.py", content: "y"}), map[string]string{"main.py": "x", "pkg/util.py": "y"}, 0},
+		{"tar.gz", tarGzArchive(t, archiveEntry{name: "./", typeflag: tar.TypeDir}, archiveEntry{name: "./main.py", content: "x"}, archiveEntry{name: "./pkg/util.py", content: "y"}), map[string]string{"main.py": "x", "pkg/util.py": "y"}, 0},
+		{"zip slip", zipArchive(t, archiveEntry{name: "../../etc/cron.d/x", content: "x"}), nil, 400},
+		{"absolute", tarGzArchive(t, archiveEntry{name: "/etc/passwd", content: "x"}), nil, 400},
+		{"symlink", tarGzArchive(t, archiveEntry{name: "link", content: "/etc/passwd", typeflag: tar.TypeSymlink}), nil, 400},
+		{"file too large", zipArchive(t, archiveEntry{name: "a", content: strings.Repeat("x", 11)}), nil, 413},
+		{"total too large", tarGzArchive(t, archiveEntry{name: "a", content: strings.Repeat("x", 8)}, archiveEntry{name: "b", content: strings.Repeat("x", 8)}), nil, 413},
+		{"too many files", zipArchive(t, archiveEntry{name: "a"}, archiveEntry{name: "b"}, archiveEntry{name: "c"}, archiveEntry{name: "d"}), nil, 413},
+		{"duplicate", tarGzArchive(t, archiveEntry{name: "a"}, archiveEntry{name: "./a"}), nil, 400},
+		{"empty", zipArchive(t), nil, 400},
+		{"not an archive", []byte("print(1)"), nil, 400},
+	}
+	for _, c := range cases {
+		a := &ProjectArchive{Data: c.data}
+		files, err := a.extract(limits)
+		rec := httptest.NewRecorder()
+		if err != nil {
+			writeRequestError(rec, err)
+		}
+		switch {
+		case c.status == 0 && err != nil:
+			t.Errorf("%s: unexpected error %v", c.name, err)
+		case c.status == 0 && (len(files) != len(c.files) || files["main.py"] != c.files["main.py"] || files["pkg/util.py"] != c.files["pkg/util.py"]):
+			t.Errorf("%s: got files %v, want %v", c.name, files, c.files)
+		case c.status == 0 && a.Format != c.name:
+			t.Errorf("%s: detected format %q", c.name, a.Format)
+		case c.status != 0 && rec.Code != c.status:
+			t.Errorf("%s: got %d (%v), want %d", c.name, rec.Code, err, c.status)
+		}
+	}
+}
+
+func TestRunHandlerAcceptsMultipartArchive(t *testing.T) {
+	tp := mustTierPolicies(t)
+	rs := &runners{mode: "native", queue: newRunQueue("native", tp.weights())}
+	h := runHandler(rs, tp, &quotas{store: newMemoryQuotaStore(), now: time.Now}, nil, loadRequestLimits())
+
+	post := func(manifest string, archive []byte) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("manifest", manifest)
+		w, _ := mw.CreateFormFile("archive", "project.zip")
+		w.Write(archive)
+		mw.Close()
+		req := httptest.NewRequest("POST", "/run", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	project := zipArchive(t,
+		archiveEntry{name: "main.py", content: "from pkg import util\nprint(util.greet())\n"},
+		archiveEntry{name: "pkg/__init__.py"},
+		archiveEntry{name: "pkg/util.py", content: "def greet():\n    return 'hi from pkg'\n"})
+	if rec := post(`{"language":"python"}`, project); rec.Code != 200 || !strings.Contains(rec.Body.String(), "hi from pkg") {
+		t.Fatalf("got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := post(`{"language":"python","files":{"main.py":"print(1)"}}`, project); rec.Code != 400 {
+		t.Fatalf("files in both the manifest and the archive: got %d, want 400", rec.Code)
+	}
+	if rec := post(`{"language":"python"}`, zipArchive(t, archiveEntry{name: "../main.py", content: "print(1)"})); rec.Code != 400 {
+		t.Fatalf("zip slip: got %d, want 400", rec.Code)
+	}
+}
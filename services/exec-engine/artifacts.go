@@ -0,0 +1,254 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	minio "github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Artifact is a file written by a run that matches one of the request's outputs.
+type Artifact struct {
+	Path string `json:"path"` // relative to the workspace
+	Size int64  `json:"size"`
+	// URL is a time-limited download link when object storage is configured; otherwise the
+	// file is returned inline as base64 Content
+	URL     string `json:"url,omitempty"`
+	Content string `json:"content,omitempty"`
+	// Skipped says why a matching file was not collected, e.g. the size limits
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// outputDir is the directory, relative to the workspace, that runs with outputs get for their
+// files. Its path is in CODERIPPER_OUTPUT_DIR.
+const outputDir = "output"
+
+const maxOutputs = 20
+
+// outputGlob is the character set of outputs patterns; they end up in a shell case pattern.
+var outputGlob = regexp.MustCompile(`^[A-Za-z0-9_.*?\[\]/-]+$`)
+
+// validateOutputs checks the output globs of a request. Patterns use path.Match syntax on paths
+// relative to the workspace, e.g. "output/*.png" or "*.csv".
+func validateOutputs(globs []string) error {
+	if len(globs) > maxOutputs {
+		return tooLarge("at most %d outputs", maxOutputs)
+	}
+	for _, g := range globs {
+		if len(g) > 255 || !outputGlob.MatchString(g) {
+			return invalid("output %q must be a relative glob of letters, digits and _ . - / * ? [ ]", g)
+		}
+		if _, err := path.Match(g, ""); err != nil {
+			return invalid("output %q: %v", g, err)
+		}
+		for _, seg := range strings.Split(g, "/") {
+			if seg == "" || seg == "." || seg == ".." {
+				return invalid("output %q must stay inside the workspace", g)
+			}
+		}
+	}
+	return nil
+}
+
+func matchOutput(globs []string, name string) bool {
+	for _, g := range globs {
+		if ok, _ := path.Match(g, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// artifactLimits caps what a run may return: ARTIFACT_MAX_FILES (20), ARTIFACT_MAX_FILE_MB (5)
+// and ARTIFACT_MAX_TOTAL_MB (20).
+type artifactLimits struct {
+	maxFiles      int
+	maxFileBytes  int64
+	maxTotalBytes int64
+}
+
+func loadArtifactLimits() artifactLimits {
+	return artifactLimits{
+		maxFiles:      envInt("ARTIFACT_MAX_FILES", 20),
+		maxFileBytes:  int64(envInt("ARTIFACT_MAX_FILE_MB", 5)) << 20,
+		maxTotalBytes: int64(envInt("ARTIFACT_MAX_TOTAL_MB", 20)) << 20,
+	}
+}
+
+// artifactCollector gathers the files of a run that match its outputs, within the limits, and
+// uploads them or encodes them inline.
+type artifactCollector struct {
+	globs  []string
+	limits artifactLimits
+	store  *artifactStore // nil: inline
+	prefix string         // object key prefix of the run
+	total  int64
+	files  int
+	out    []Artifact
+}
+
+func newArtifactCollector(globs []string) *artifactCollector {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &artifactCollector{globs: globs, limits: loadArtifactLimits(), store: artifactStorage(), prefix: "runs/" + hex.EncodeToString(id) + "/"}
+}
+
+// add considers one regular file of the workspace.
+func (c *artifactCollector) add(name string, size int64, r io.Reader) {
+	if !matchOutput(c.globs, name) {
+		return
+	}
+	a := Artifact{Path: name, Size: size}
+	switch {
+	case c.files >= c.limits.maxFiles:
+		a.Skipped = fmt.Sprintf("more than %d files", c.limits.maxFiles)
+	case size > c.limits.maxFileBytes:
+		a.Skipped = fmt.Sprintf("larger than %d bytes", c.limits.maxFileBytes)
+	case c.total+size > c.limits.maxTotalBytes:
+		a.Skipped = fmt.Sprintf("artifacts exceed %d bytes in total", c.limits.maxTotalBytes)
+	}
+	if a.Skipped != "" {
+		c.out = append(c.out, a)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		a.Skipped = "read failed: " + err.Error()
+		c.out = append(c.out, a)
+		return
+	}
+	c.files++
+	c.total += size
+	if c.store == nil {
+		a.Content = base64.StdEncoding.EncodeToString(data)
+	} else if a.URL, err = c.store.put(context.Background(), c.prefix+name, data); err != nil {
+		log.Printf("artifact upload %s: %v", name, err)
+		a.Skipped = "upload failed"
+	}
+	c.out = append(c.out, a)
+}
+
+// collectDir adds the regular files under dir, a workspace on this host. Symlinks are not
+// followed, so a run cannot return files from outside its workspace.
+func (c *artifactCollector) collectDir(dir string) {
+	filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, p)
+		if !matchOutput(c.globs, filepath.ToSlash(rel)) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return nil
+		}
+		defer f.Close()
+		c.add(filepath.ToSlash(rel), info.Size(), f)
+		return nil
+	})
+}
+
+// collectTar adds the regular files of a tar stream made by collectScript.
+func (c *artifactCollector) collectTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if h.Typeflag == tar.TypeReg {
+			c.add(strings.TrimPrefix(h.Name, "./"), h.Size, tr)
+		}
+	}
+}
+
+// collectScript writes a tar of the workspace files that may match globs to stdout. The shell
+// case pattern is looser than path.Match ("*" also matches "/"); the collector filters exactly.
+func collectScript(globs []string) string {
+	return "cd " + workspaceDir + " && find . -type f | while IFS= read -r f; do f=${f#./}; case \"$f\" in " +
+		strings.Join(globs, "|") + ") printf '%s\\n' \"$f\";; esac; done | tar -cf - -T - 2>/dev/null"
+}
+
+// artifactStore uploads artifacts to the S3/MinIO bucket ARTIFACT_BUCKET
+// (coderipper-artifacts) and returns presigned links valid for ARTIFACT_URL_TTL_SECONDS (3600).
+type artifactStore struct {
+	client *minio.Client
+	bucket string
+	ttl    time.Duration
+}
+
+// artifactStorage is the process's artifact store, or nil without S3_ENDPOINT.
+var artifactStorage = sync.OnceValue(func() *artifactStore {
+	if os.Getenv("S3_ENDPOINT") == "" {
+		return nil
+	}
+	client, err := newS3Client()
+	if err != nil {
+		log.Printf("artifacts are returned inline: %v", err)
+		return nil
+	}
+	bucket := os.Getenv("ARTIFACT_BUCKET")
+	if bucket == "" {
+		bucket = "coderipper-artifacts"
+	}
+	// best-effort, as for submissions
+	_ = client.MakeBucket(context.Background(), bucket, minio.MakeBucketOptions{})
+	return &artifactStore{client: client, bucket: bucket, ttl: time.Duration(envInt("ARTIFACT_URL_TTL_SECONDS", 3600)) * time.Second}
+})
+
+func (s *artifactStore) put(ctx context.Context, key string, data []byte) (string, error) {
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	if _, err := s.client.PutObject(ctx, s.bucket, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{ContentType: contentType}); err != nil {
+		return "", fmt.Errorf("put object: %w", err)
+	}
+	u, err := s.client.PresignedGetObject(ctx, s.bucket, key, s.ttl, nil)
+	if err != nil {
+		return "", fmt.Errorf("presign: %w", err)
+	}
+	return u.String(), nil
+}
+
+// newS3Client connects to the object storage at S3_ENDPOINT with S3_ACCESS_KEY and
+// S3_SECRET_KEY, over TLS unless S3_USE_SSL=false.
+func newS3Client() (*minio.Client, error) {
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		return nil, errors.New("S3_ENDPOINT is not set")
+	}
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(os.Getenv("S3_ACCESS_KEY"), os.Getenv("S3_SECRET_KEY"), ""),
+		Secure: os.Getenv("S3_USE_SSL") != "false",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("minio client: %w", err)
+	}
+	return client, nil
+}
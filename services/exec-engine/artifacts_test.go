@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/base64"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateOutputs(t *testing.T) {
+	for _, ok := range [][]string{{"output/*"}, {"*.csv", "plots/fig-[0-9].png"}, nil} {
+		if err := validateOutputs(ok); err != nil {
+			t.Errorf("%q: %v", ok, err)
+		}
+	}
+	for _, bad := range [][]string{{"/etc/*"}, {"../*"}, {"a//b"}, {"out/$(id)"}, {"[a"}, make([]string, maxOutputs+1)} {
+		if err := validateOutputs(bad); err == nil {
+			t.Errorf("%q: accepted", bad)
+		}
+	}
+}
+
+func TestNativeRunReturnsArtifacts(t *testing.T) {
+	t.Setenv("ARTIFACT_MAX_FILES", "2")
+	script := `echo '{"x":1}' > "$CODERIPPER_OUTPUT_DIR/plot.json"
+printf 'a,b\n' > data.csv
+printf 'c\n' > zz.csv
+ln -s /etc/passwd "$CODERIPPER_OUTPUT_DIR/passwd"
+exit 3`
+	res := executeNative(RunRequest{Language: "bash", Files: map[string]string{"main.sh": script}, TimeLimit: 5, Outputs: []string{"output/*", "*.csv"}}, nil)
+	if res.ExitCode != 3 {
+		t.Fatalf("run: %+v", res)
+	}
+	got := map[string]Artifact{}
+	for _, a := range res.Artifacts {
+		got[a.Path] = a
+	}
+	if len(got) != 3 {
+		t.Fatalf("artifacts of a failed run: %+v", res.Artifacts)
+	}
+	if b, _ := base64.StdEncoding.DecodeString(got["data.csv"].Content); string(b) != "a,b\n" {
+		t.Errorf("data.csv = %+v", got["data.csv"])
+	}
+	if got["output/plot.json"].Content == "" {
+		t.Errorf("output dir file missing: %+v", got["output/plot.json"])
+	}
+	if a := got["zz.csv"]; a.Content != "" || !strings.Contains(a.Skipped, "more than 2 files") {
+		t.Errorf("file over the limit: %+v", a)
+	}
+	if _, ok := got["output/passwd"]; ok {
+		t.Error("symlink was followed")
+	}
+}
+
+func TestStepScriptReturnsArtifacts(t *testing.T) {
+	if _, err := exec.LookPath("base64"); err != nil {
+		t.Skip("no base64")
+	}
+	sub, dir := t.TempDir(), t.TempDir()
+	plan := pipelinePlan{outputs: []string{"output/*.txt"}, steps: []planStep{
+		{name: "run", argv: []string{"/bin/sh", "-c", "echo result > output/r.txt; echo other > output/r.log; echo '::coderipper-artifacts'; exit 1"}, timeout: 5 * time.Second},
+	}}
+	script := strings.NewReplacer("/submission", sub, workspaceDir, dir).Replace(stepScript(plan))
+	out, _ := exec.Command("/bin/sh", "-c", script).CombinedOutput()
+	if steps := parseStepLogs(plan, string(out)); len(steps) != 1 || steps[0].ExitCode != 1 {
+		t.Fatalf("steps = %+v from %q", steps, out)
+	}
+	tarball, err := parseArtifactLogs(string(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &artifactCollector{globs: plan.outputs, limits: loadArtifactLimits()}
+	if err := c.collectTar(strings.NewReader(string(tarball))); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.out) != 1 || c.out[0].Path != "output/r.txt" || c.out[0].Content != base64.StdEncoding.EncodeToString([]byte("result\n")) {
+		t.Fatalf("artifacts = %+v", c.out)
+	}
+}
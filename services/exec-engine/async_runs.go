@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// asyncRuns keeps the state of runs accepted with "Prefer: respond-async". Their callers get
+// 202 right away and poll GET /runs/{id} for the queue position and, once finished, the
+// result. Without a job queue, state lives in this process; finished runs are forgotten after
+// ttl, and only the newest maxFinished of them are kept. With a job queue, it is read from the
+// run_jobs table, so that any API replica can answer and accepted runs survive restarts.
+type asyncRuns struct {
+	ttl         time.Duration
+	maxFinished int
+	jobs        *jobQueue
+
+	mu       sync.Mutex
+	runs     map[string]*asyncRun
+	finished []*asyncRun // in the order they finished, for expiry
+}
+
+// asyncRun is one accepted run as reported by GET /runs/{id}.
+type asyncRun struct {
+	ID       string        `json:"id"`
+	Status   string        `json:"status"`   // queued, running, done or failed
+	Position int           `json:"position"` // place in the queue while queued
+	WaitMs   int64         `json:"waitMs"`
+	Result   *NativeResult `json:"result,omitempty"`
+	Error    string        `json:"error,omitempty"`
+
+	userID     string
+	finishedAt time.Time
+}
+
+// newAsyncRuns reads ASYNC_RUN_TTL_SECONDS (default 600) and ASYNC_RUN_MAX_FINISHED (10000),
+// which apply without a job queue only.
+func newAsyncRuns(jobs *jobQueue) *asyncRuns {
+	return &asyncRuns{
+		ttl:         time.Duration(envInt("ASYNC_RUN_TTL_SECONDS", 600)) * time.Second,
+		maxFinished: envInt("ASYNC_RUN_MAX_FINISHED", 10000),
+		jobs:        jobs,
+		runs:        map[string]*asyncRun{},
+	}
+}
+
+// preferAsync reports whether the caller asked not to wait for the result (RFC 7240).
+func preferAsync(r *http.Request) bool {
+	for _, v := range r.Header.Values("Prefer") {
+		for _, p := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(p), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func newAsyncID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (ar *asyncRuns) add(userID string) *asyncRun {
+	run := &asyncRun{ID: newAsyncID(), Status: "queued", userID: userID}
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	ar.expireLocked()
+	ar.runs[run.ID] = run
+	return run
+}
+
+func (ar *asyncRuns) remove(run *asyncRun) {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	delete(ar.runs, run.ID)
+}
+
+// update changes a run under the lock.
+func (ar *asyncRuns) update(run *asyncRun, f func(*asyncRun)) {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	f(run)
+}
+
+// finish records the outcome of a run and schedules it for expiry.
+func (ar *asyncRuns) finish(run *asyncRun, res NativeResult, err error) {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	run.Position = 0
+	if err != nil {
+		run.Status, run.Error = "failed", err.Error()
+	} else {
+		run.Status, run.Result = "done", &res
+	}
+	run.finishedAt = time.Now()
+	ar.finished = append(ar.finished, run)
+	ar.expireLocked()
+}
+
+// expireLocked forgets finished runs past their ttl or beyond maxFinished, oldest first.
+func (ar *asyncRuns) expireLocked() {
+	n := 0
+	for n < len(ar.finished) && (len(ar.finished)-n > ar.maxFinished || time.Since(ar.finished[n].finishedAt) > ar.ttl) {
+		delete(ar.runs, ar.finished[n].ID)
+		n++
+	}
+	ar.finished = ar.finished[n:]
+}
+
+// get returns a copy of a run. Runs of other users are not found.
+func (ar *asyncRuns) get(ctx context.Context, id, userID string) (asyncRun, bool, error) {
+	if ar.jobs != nil {
+		return ar.jobs.asyncRun(ctx, id, userID)
+	}
+	ar.mu.Lock()
+	ar.expireLocked()
+	run, ok := ar.runs[id]
+	var snap asyncRun
+	if ok {
+		snap = *run
+	}
+	ar.mu.Unlock()
+	if !ok || snap.userID != userID {
+		return asyncRun{}, false, nil
+	}
+	return snap, true, nil
+}
+
+// startAsync queues a run and returns once it is queued or started; the run then finishes in
+// the background, where finish is called with the result if it executed and done afterwards.
+// Errors are those of enqueueing, such as errQueueFull; done has been called by then.
+func (rs *runners) startAsync(ctx context.Context, req RunRequest, userID, tier string, weight int, finish func(NativeResult, time.Time), done func()) (asyncRun, error) {
+	if rs.jobs != nil {
+		// the job row holds the run's state; the position is read in the same statement that
+		// inserts it
+		asyncID := newAsyncID()
+		id, position, err := rs.jobs.submit(ctx, req, userID, tier, weight, asyncID)
+		if err != nil {
+			done()
+			return asyncRun{}, err
+		}
+		go func() {
+			defer done()
+			start := time.Now()
+			res, _, err := rs.jobs.wait(context.Background(), id, jobWaitTimeout(req))
+			if err == nil {
+				finish(res, start)
+			}
+		}()
+		return asyncRun{ID: asyncID, Status: "queued", Position: position}, nil
+	}
+
+	run := rs.async.add(userID)
+	accepted := make(chan error, 1)
+	var once sync.Once
+	accept := func(err error) { once.Do(func() { accepted <- err }) }
+	go func() {
+		defer done()
+		// called under the queue lock whenever the run's position may have changed
+		moved := func(p int) {
+			rs.async.update(run, func(r *asyncRun) { r.Position = p })
+			accept(nil)
+		}
+		_, wait, err := rs.queue.acquire(context.Background(), tier, moved)
+		accept(err)
+		if err != nil {
+			rs.async.remove(run)
+			return
+		}
+		rs.async.update(run, func(r *asyncRun) { r.Status, r.Position, r.WaitMs = "running", 0, wait.Milliseconds() })
+		start := time.Now()
+		res, err := rs.execute(req, tier)
+		rs.queue.release(time.Since(start))
+		if err == nil {
+			finish(res, start)
+		}
+		rs.async.finish(run, res, err)
+	}()
+	if err := <-accepted; err != nil {
+		return asyncRun{}, err
+	}
+	return rs.async.snapshot(run), nil
+}
+
+func (ar *asyncRuns) snapshot(run *asyncRun) asyncRun {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	return *run
+}
+
+// runStatusHandler serves GET /runs/{id} for runs accepted with "Prefer: respond-async".
+func runStatusHandler(ar *asyncRuns) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		userID, _ := r.Context().Value("user_id").(string)
+		run, ok, err := ar.get(r.Context(), strings.TrimPrefix(r.URL.Path, "/runs/"), userID)
+		if err != nil {
+			log.Println("async run:", err)
+			http.Error(w, "failed to read run", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "run not found", http.StatusNotFound)
+			return
+		}
+		if run.Status == "queued" {
+			w.Header().Set("Retry-After", "1")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(run)
+	}
+}
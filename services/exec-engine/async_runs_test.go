@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAsyncRunReportsPositionWhileQueued(t *testing.T) {
+	tp, _ := loadTierPolicies()
+	rs := &runners{mode: "native", queue: newTestQueue(1, 10), async: newAsyncRuns(nil)}
+	h := runHandler(rs, tp, &quotas{store: newMemoryQuotaStore(), now: time.Now}, nil, loadRequestLimits())
+	status := runStatusHandler(rs.async)
+
+	// occupy the only worker so the run has to queue
+	rs.queue.acquire(context.Background(), "free", nil)
+	req := httptest.NewRequest("POST", "/run", strings.NewReader(`{"language":"bash","files":{"main.sh":"echo hi"}}`))
+	req.Header.Set("Prefer", "respond-async")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusAccepted || rec.Header().Get("X-Queue-Position") != "1" {
+		t.Fatalf("got %d position=%q", rec.Code, rec.Header().Get("X-Queue-Position"))
+	}
+	location := rec.Header().Get("Location")
+
+	poll := func() asyncRun {
+		rec := httptest.NewRecorder()
+		status.ServeHTTP(rec, httptest.NewRequest("GET", location, nil))
+		var run asyncRun
+		if rec.Code != http.StatusOK || json.NewDecoder(rec.Body).Decode(&run) != nil {
+			t.Fatalf("status %d for %s", rec.Code, location)
+		}
+		return run
+	}
+	if run := poll(); run.Status != "queued" || run.Position != 1 {
+		t.Fatalf("while queued: %+v", run)
+	}
+	rs.queue.release(time.Millisecond)
+	var run asyncRun
+	waitFor(t, func() bool { run = poll(); return run.Status == "done" })
+	if run.Result == nil || run.Result.Stdout != "hi\n" {
+		t.Fatalf("finished run: %+v", run)
+	}
+
+	other := httptest.NewRequest("GET", location, nil)
+	other = other.WithContext(context.WithValue(other.Context(), "user_id", "someone-else"))
+	rec = httptest.NewRecorder()
+	status.ServeHTTP(rec, other)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("another user's run: %d", rec.Code)
+	}
+}
+
+func TestAsyncRunsExpire(t *testing.T) {
+	ar := newAsyncRuns(nil)
+	ar.maxFinished = 1
+	first, second := ar.add(""), ar.add("")
+	ar.finish(first, NativeResult{}, nil)
+	ar.finish(second, NativeResult{}, nil)
+	if _, ok, _ := ar.get(context.Background(), first.ID, ""); ok {
+		t.Fatal("oldest finished run kept beyond the bound")
+	}
+	if _, ok, _ := ar.get(context.Background(), second.ID, ""); !ok {
+		t.Fatal("newest finished run dropped")
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BenchmarkOptions configure mode "benchmark".
+type BenchmarkOptions struct {
+	// Runs is the number of measured runs, 10 by default. Warmup runs come first and are not
+	// measured, 1 by default.
+	Runs   int  `json:"runs,omitempty"`
+	Warmup *int `json:"warmup,omitempty"`
+	// PinCPU runs the program on a single CPU, BENCHMARK_CPU. Only native mode pins.
+	PinCPU bool `json:"pinCpu,omitempty"`
+}
+
+const (
+	defaultBenchmarkRuns = 10
+	maxBenchmarkRuns     = 100
+	maxBenchmarkWarmup   = 20
+)
+
+// counts returns the measured and warmup runs of o, which may be nil.
+func (o *BenchmarkOptions) counts() (runs, warmup int) {
+	runs, warmup = defaultBenchmarkRuns, 1
+	if o == nil {
+		return runs, warmup
+	}
+	if o.Runs > 0 {
+		runs = o.Runs
+	}
+	if o.Warmup != nil {
+		warmup = *o.Warmup
+	}
+	return runs, warmup
+}
+
+// validateBenchmark checks the benchmark options of a request.
+func validateBenchmark(req RunRequest) error {
+	if req.Benchmark == nil {
+		return nil
+	}
+	if req.Mode != modeBenchmark {
+		return invalid("benchmark options need mode %q", modeBenchmark)
+	}
+	if req.Benchmark.Runs < 0 || req.Benchmark.Runs > maxBenchmarkRuns {
+		return invalid("benchmark runs must be between 1 and %d", maxBenchmarkRuns)
+	}
+	if w := req.Benchmark.Warmup; w != nil && (*w < 0 || *w > maxBenchmarkWarmup) {
+		return invalid("benchmark warmup must be between 0 and %d", maxBenchmarkWarmup)
+	}
+	return nil
+}
+
+// benchmarkSeconds is how long the runs of a benchmark may take together: the time limit for
+// every warmup and measured run.
+func benchmarkSeconds(req RunRequest) int {
+	runs, warmup := req.Benchmark.counts()
+	return (runs + warmup) * req.TimeLimit
+}
+
+// checkBenchmarkBudget rejects benchmarks that could hold a sandbox longer than the tier
+// allows. req has its limits applied.
+func checkBenchmarkBudget(req RunRequest, p tierPolicy) error {
+	if req.Mode != modeBenchmark {
+		return nil
+	}
+	if s := benchmarkSeconds(req); s > p.MaxBenchmarkSeconds {
+		runs, warmup := req.Benchmark.counts()
+		return invalid("benchmark of %d runs at %d seconds each exceeds the tier's %d seconds; lower runs, warmup or timeLimitSeconds", runs+warmup, req.TimeLimit, p.MaxBenchmarkSeconds)
+	}
+	return nil
+}
+
+// pinnedBenchmarks serializes the benchmarks pinned to benchmarkCPU, which would otherwise
+// share it and disturb each other's numbers.
+var pinnedBenchmarks sync.Mutex
+
+// pinned reports whether a step of p runs on benchmarkCPU.
+func (p pipelinePlan) pinned() bool {
+	for _, step := range p.steps {
+		if step.pin {
+			return true
+		}
+	}
+	return false
+}
+
+// planBenchmark repeats the run step of the default pipeline, warmup runs first; the build
+// runs once. Each run gets the request's time limit.
+func planBenchmark(req RunRequest, p *pipelinePlan, limit time.Duration) {
+	runs, warmup := req.Benchmark.counts()
+	run := p.steps[len(p.steps)-1]
+	run.pin = req.Benchmark != nil && req.Benchmark.PinCPU
+	p.steps = p.steps[:len(p.steps)-1]
+	for i := 0; i < warmup+runs; i++ {
+		step := run
+		if i < warmup {
+			step.name = "warmup"
+		}
+		p.steps = append(p.steps, step)
+	}
+	p.total = limit * time.Duration(len(p.steps))
+}
+
+// BenchmarkResult summarizes the measured runs of mode "benchmark". CPU time and peak memory
+// are measured in native mode only.
+type BenchmarkResult struct {
+	Runs            int             `json:"runs"`
+	Warmup          int             `json:"warmup"`
+	WallTimeMs      BenchmarkStats  `json:"wallTimeMs"`
+	CPUTimeMs       *BenchmarkStats `json:"cpuTimeMs,omitempty"`
+	PeakMemoryBytes *BenchmarkStats `json:"peakMemoryBytes,omitempty"`
+	// HighVariance is set when the wall or CPU time varies too much between runs to rank by:
+	// its standard deviation is over BENCHMARK_MAX_CV_PERCENT (5) of the mean
+	HighVariance bool `json:"highVariance"`
+	// PinnedCPU is the CPU the runs were pinned to
+	PinnedCPU *int `json:"pinnedCpu,omitempty"`
+}
+
+// BenchmarkStats describe one measurement over the runs. StdDev is the sample standard deviation.
+type BenchmarkStats struct {
+	Min    float64 `json:"min"`
+	Median float64 `json:"median"`
+	P95    float64 `json:"p95"`
+	Mean   float64 `json:"mean"`
+	StdDev float64 `json:"stdDev"`
+}
+
+// benchmarkResult computes the statistics of the measured runs, or nil when a run failed.
+func benchmarkResult(req RunRequest, steps []StepResult) *BenchmarkResult {
+	runs, warmup := req.Benchmark.counts()
+	var wall, cpu, mem []float64
+	pinned := true
+	for _, s := range steps {
+		if s.Name != "run" {
+			continue
+		}
+		if s.ExitCode != 0 {
+			return nil
+		}
+		wall = append(wall, float64(s.wall)/float64(time.Millisecond))
+		cpu = append(cpu, float64(s.usage.cpu)/float64(time.Millisecond))
+		mem = append(mem, float64(s.usage.peakMemory))
+		pinned = pinned && s.usage.pinned
+	}
+	if len(wall) != runs {
+		return nil
+	}
+	res := &BenchmarkResult{Runs: runs, Warmup: warmup, WallTimeMs: benchmarkStats(wall)}
+	maxCV := float64(envInt("BENCHMARK_MAX_CV_PERCENT", 5)) / 100
+	res.HighVariance = highVariance(res.WallTimeMs, maxCV)
+	if measured(cpu) {
+		s := benchmarkStats(cpu)
+		res.CPUTimeMs = &s
+		res.HighVariance = res.HighVariance || highVariance(s, maxCV)
+	}
+	if measured(mem) {
+		s := benchmarkStats(mem)
+		res.PeakMemoryBytes = &s
+	}
+	if pinned {
+		c := benchmarkCPU()
+		res.PinnedCPU = &c
+	}
+	return res
+}
+
+// measured reports whether the sandbox measured a value; it reports zero when it cannot.
+func measured(values []float64) bool {
+	for _, v := range values {
+		if v > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func highVariance(s BenchmarkStats, maxCV float64) bool {
+	return s.Mean > 0 && s.StdDev/s.Mean > maxCV
+}
+
+// benchmarkStats computes the statistics of at least one value. P95 uses the nearest rank.
+func benchmarkStats(values []float64) BenchmarkStats {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	s := BenchmarkStats{Min: sorted[0], P95: sorted[int(math.Ceil(0.95*float64(n)))-1]}
+	if n%2 == 1 {
+		s.Median = sorted[n/2]
+	} else {
+		s.Median = (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+	for _, v := range sorted {
+		s.Mean += v
+	}
+	s.Mean /= float64(n)
+	if n > 1 {
+		var sq float64
+		for _, v := range sorted {
+			sq += (v - s.Mean) * (v - s.Mean)
+		}
+		s.StdDev = math.Sqrt(sq / float64(n-1))
+	}
+	return s
+}
@@ -0,0 +1,67 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// peakMemory is the peak resident set size of a finished command, in bytes.
+func peakMemory(cmd *exec.Cmd) int64 {
+	if cmd.ProcessState == nil {
+		return 0
+	}
+	if ru, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage); ok {
+		// kilobytes on Linux
+		return ru.Maxrss * 1024
+	}
+	return 0
+}
+
+// startPinned starts cmd on a single CPU. The thread that forks is pinned for the moment, and
+// the child inherits its affinity.
+func startPinned(cmd *exec.Cmd, cpu int) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	var old, set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &old); err != nil {
+		return err
+	}
+	set.Set(cpu)
+	if err := unix.SchedSetaffinity(0, &set); err != nil {
+		return err
+	}
+	defer unix.SchedSetaffinity(0, &old)
+	return cmd.Start()
+}
+
+// benchmarkCPU is the CPU pinned benchmarks run on: BENCHMARK_CPU, by default the last CPU
+// the engine may use, since the scheduler tends to fill the first ones. -1 disables pinning.
+var benchmarkCPU = sync.OnceValue(func() int {
+	if v := os.Getenv("BENCHMARK_CPU"); v != "" {
+		cpu, err := strconv.Atoi(v)
+		if err != nil {
+			return -1
+		}
+		return cpu
+	}
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		return -1
+	}
+	last := -1
+	// a CPUSet holds 1024 CPUs
+	for cpu := 0; cpu < 1024; cpu++ {
+		if set.IsSet(cpu) {
+			last = cpu
+		}
+	}
+	return last
+})
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "os/exec"
+
+// Memory measurement and CPU pinning are only implemented on Linux.
+
+func peakMemory(*exec.Cmd) int64 { return 0 }
+
+func startPinned(cmd *exec.Cmd, _ int) error { return cmd.Start() }
+
+func benchmarkCPU() int { return -1 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBenchmarkStats(t *testing.T) {
+	s := benchmarkStats([]float64{12, 10, 11, 13, 30, 10, 11, 12, 11, 10})
+	if s.Min != 10 || s.Median != 11 || s.P95 != 30 || s.Mean != 13 {
+		t.Fatalf("stats: %+v", s)
+	}
+	if math.Abs(s.StdDev-6.055) > 0.001 {
+		t.Fatalf("stddev: %v", s.StdDev)
+	}
+	if !highVariance(s, 0.05) || highVariance(benchmarkStats([]float64{100, 101, 99}), 0.05) {
+		t.Fatal("high variance")
+	}
+	if one := benchmarkStats([]float64{7}); one != (BenchmarkStats{Min: 7, Median: 7, P95: 7, Mean: 7}) {
+		t.Fatalf("one run: %+v", one)
+	}
+}
+
+func TestValidateBenchmark(t *testing.T) {
+	two := 2
+	tooMany := maxBenchmarkWarmup + 1
+	cases := []struct {
+		name string
+		req  RunRequest
+		ok   bool
+	}{
+		{"defaults", RunRequest{Mode: modeBenchmark}, true},
+		{"options", RunRequest{Mode: modeBenchmark, Benchmark: &BenchmarkOptions{Runs: 50, Warmup: &two, PinCPU: true}}, true},
+		{"other mode", RunRequest{Mode: modeRun, Benchmark: &BenchmarkOptions{Runs: 5}}, false},
+		{"too many runs", RunRequest{Mode: modeBenchmark, Benchmark: &BenchmarkOptions{Runs: maxBenchmarkRuns + 1}}, false},
+		{"too much warmup", RunRequest{Mode: modeBenchmark, Benchmark: &BenchmarkOptions{Warmup: &tooMany}}, false},
+	}
+	for _, c := range cases {
+		if err := validateBenchmark(c.req); (err == nil) != c.ok {
+			t.Errorf("%s: err = %v", c.name, err)
+		}
+	}
+}
+
+func TestBenchmarkBudget(t *testing.T) {
+	free := defaultTierPolicies[defaultTier]
+	req := RunRequest{Mode: modeBenchmark, TimeLimit: 5}
+	if err := checkBenchmarkBudget(req, free); err != nil {
+		t.Fatalf("default benchmark rejected: %v", err)
+	}
+	req.Benchmark = &BenchmarkOptions{Runs: maxBenchmarkRuns}
+	if err := checkBenchmarkBudget(req, free); err == nil {
+		t.Fatal("benchmark over the tier's budget accepted")
+	}
+	if err := checkBenchmarkBudget(RunRequest{Mode: modeRun, TimeLimit: 60}, free); err != nil {
+		t.Fatalf("run rejected: %v", err)
+	}
+}
+
+func TestPlanBenchmark(t *testing.T) {
+	zero := 0
+	req := RunRequest{Language: "c", Mode: modeBenchmark, TimeLimit: 2, Benchmark: &BenchmarkOptions{Runs: 3, Warmup: &zero}, Files: map[string]string{"main.c": "int main(void) { return 0; }"}}
+	p, err := planPipeline(req, "main.c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, s := range p.steps {
+		names = append(names, s.name)
+	}
+	if len(names) != 4 || names[0] != "build" || names[3] != "run" || p.total != 8*time.Second {
+		t.Fatalf("steps %v, total %v", names, p.total)
+	}
+}
+
+func TestNativeBenchmark(t *testing.T) {
+	rs := &runners{mode: "native"}
+	res, err := rs.execute(RunRequest{Language: "c", Mode: modeBenchmark, TimeLimit: 10, Benchmark: &BenchmarkOptions{Runs: 5, PinCPU: true}, Files: map[string]string{
+		"main.c": "#include <stdio.h>\n#include <stdlib.h>\nint main(void) { char *p = malloc(8 << 20); long s = 0; for (long i = 0; i < (8 << 20); i++) { p[i] = i; s += p[i]; } printf(\"%ld\\n\", s); return 0; }\n",
+	}}, "")
+	if err != nil || !res.Success || res.Benchmark == nil {
+		t.Fatalf("benchmark: %+v, %v", res, err)
+	}
+	b := res.Benchmark
+	if b.Runs != 5 || b.Warmup != 1 || b.WallTimeMs.Min <= 0 || b.WallTimeMs.Min > b.WallTimeMs.Median || b.WallTimeMs.Median > b.WallTimeMs.P95 {
+		t.Fatalf("wall time: %+v", b)
+	}
+	if b.CPUTimeMs == nil || b.PeakMemoryBytes == nil || b.PeakMemoryBytes.Min < 8<<20 {
+		t.Fatalf("usage: %+v %+v", b.CPUTimeMs, b.PeakMemoryBytes)
+	}
+	if b.PinnedCPU == nil || *b.PinnedCPU != benchmarkCPU() {
+		t.Fatalf("pinned: %v", b.PinnedCPU)
+	}
+
+	res, err = rs.execute(RunRequest{Language: "c", Mode: modeBenchmark, TimeLimit: 10, Files: map[string]string{"main.c": "int main(void) { return 3; }"}}, "")
+	if err != nil || res.Success || res.ExitCode != 3 || res.Benchmark != nil {
+		t.Fatalf("failing run: %+v, %v", res, err)
+	}
+}
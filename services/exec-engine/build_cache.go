@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	buildCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: "coderipper", Name: "build_cache_requests_total", Help: "Build cache lookups by language and outcome (hit, miss)"}, []string{"language", "result"})
+	buildCacheBytes    = prometheus.NewGauge(prometheus.GaugeOpts{Namespace: "coderipper", Name: "build_cache_bytes", Help: "Size of cached build artifacts"})
+)
+
+func init() {
+	prometheus.MustRegister(buildCacheRequests, buildCacheBytes)
+}
+
+// buildCache keeps compiled artifacts (binaries, class files) of native builds, keyed by
+// sources, compiler version and compiler command line, so a program that is run again with
+// other stdin is not recompiled. Entries are directories under dir; the least recently used
+// are removed once the cache grows past maxBytes. The dependency cache uses the same storage.
+type buildCache struct {
+	dir      string
+	maxBytes int64
+	versions sync.Map         // compiler versions by language
+	bytes    prometheus.Gauge // reports total
+
+	mu      sync.Mutex
+	entries map[string]*buildCacheEntry
+	total   int64
+}
+
+type buildCacheEntry struct {
+	size int64
+	used time.Time
+}
+
+// newBuildCache opens the cache in BUILD_CACHE_DIR (default: coderipper/build in the user cache
+// dir, away from the per-run temp dirs), bounded to BUILD_CACHE_MAX_MB (1024).
+// BUILD_CACHE_DIR=off disables it. The directory is only accessible to the engine's user.
+func newBuildCache() *buildCache {
+	return openCacheDir(os.Getenv("BUILD_CACHE_DIR"), "build", int64(envInt("BUILD_CACHE_MAX_MB", 1024))<<20, buildCacheBytes)
+}
+
+// openCacheDir opens a cache directory, defaulting to coderipper/<name> in the user cache dir.
+// It returns nil if dir is "off" or cannot be used.
+func openCacheDir(dir, name string, maxBytes int64, bytes prometheus.Gauge) *buildCache {
+	if dir == "off" {
+		return nil
+	}
+	if dir == "" {
+		base, err := os.UserCacheDir()
+		if err != nil {
+			log.Printf("%s cache disabled: %v", name, err)
+			return nil
+		}
+		dir = filepath.Join(base, "coderipper", name)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Printf("%s cache disabled: %v", name, err)
+		return nil
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		log.Printf("%s cache disabled: %v", name, err)
+		return nil
+	}
+	bc := &buildCache{dir: dir, maxBytes: maxBytes, bytes: bytes, entries: map[string]*buildCacheEntry{}}
+	// pick up entries from previous runs; leftovers of interrupted stores are removed
+	dirents, _ := os.ReadDir(dir)
+	for _, d := range dirents {
+		p := filepath.Join(dir, d.Name())
+		if strings.Contains(d.Name(), ".tmp") || !d.IsDir() {
+			os.RemoveAll(p)
+			continue
+		}
+		info, err := d.Info()
+		if err != nil {
+			continue
+		}
+		e := &buildCacheEntry{size: dirSize(p), used: info.ModTime()}
+		bc.entries[d.Name()] = e
+		bc.total += e.size
+	}
+	bc.mu.Lock()
+	bc.evictLocked()
+	bc.mu.Unlock()
+	return bc
+}
+
+// key hashes everything that affects the build output. args must not contain the
+// per-run temp dir.
+func (bc *buildCache) key(language string, args []string, files map[string]string) string {
+	version, ok := bc.versions.Load(language)
+	if !ok {
+		version = nativeToolchainVersion(language)
+		bc.versions.Store(language, version)
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00", language, version, strings.Join(args, "\x00"))
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "%s\x00%d\x00%s", name, len(files[name]), files[name])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// restore copies the artifacts stored under key into dir and reports whether there were any.
+// The copy happens outside the lock so builds do not wait on each other; an entry evicted
+// meanwhile is treated as a miss.
+func (bc *buildCache) restore(language, key, dir string) bool {
+	bc.mu.Lock()
+	e, ok := bc.entries[key]
+	if ok {
+		e.used = time.Now()
+	}
+	bc.mu.Unlock()
+	if ok {
+		src := filepath.Join(bc.dir, key)
+		if err := copyTree(src, dir); err != nil {
+			log.Printf("build cache restore %s: %v", key, err)
+			ok = false
+		} else {
+			now := time.Now()
+			os.Chtimes(src, now, now) // survives restarts
+		}
+	}
+	result := "miss"
+	if ok {
+		result = "hit"
+	}
+	buildCacheRequests.WithLabelValues(language, result).Inc()
+	return ok
+}
+
+// store saves the artifacts (paths relative to dir) of a successful build under key.
+func (bc *buildCache) store(key, dir string, artifacts []string) error {
+	tmp, err := os.MkdirTemp(bc.dir, key+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	for _, a := range artifacts {
+		dst := filepath.Join(tmp, a)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := copyFile(filepath.Join(dir, a), dst); err != nil {
+			return err
+		}
+	}
+	return bc.add(key, tmp)
+}
+
+// add moves tmp, a directory made with MkdirTemp(bc.dir, key+".tmp"), into the cache as the
+// entry for key.
+func (bc *buildCache) add(key, tmp string) error {
+	size := dirSize(tmp)
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if _, ok := bc.entries[key]; ok {
+		// stored by a concurrent build of the same sources
+		return nil
+	}
+	if err := os.Rename(tmp, filepath.Join(bc.dir, key)); err != nil {
+		return err
+	}
+	bc.entries[key] = &buildCacheEntry{size: size, used: time.Now()}
+	bc.total += size
+	bc.evictLocked()
+	return nil
+}
+
+// lookup returns the directory of the entry for key, for use in place, and marks it used.
+func (bc *buildCache) lookup(key string) (string, bool) {
+	bc.mu.Lock()
+	e, ok := bc.entries[key]
+	if ok {
+		e.used = time.Now()
+	}
+	bc.mu.Unlock()
+	if !ok {
+		return "", false
+	}
+	p := filepath.Join(bc.dir, key)
+	now := time.Now()
+	os.Chtimes(p, now, now) // survives restarts
+	return p, true
+}
+
+func (bc *buildCache) evictLocked() {
+	if bc.total > bc.maxBytes {
+		keys := make([]string, 0, len(bc.entries))
+		for k := range bc.entries {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return bc.entries[keys[i]].used.Before(bc.entries[keys[j]].used) })
+		for _, k := range keys {
+			if bc.total <= bc.maxBytes {
+				break
+			}
+			os.RemoveAll(filepath.Join(bc.dir, k))
+			bc.total -= bc.entries[k].size
+			delete(bc.entries, k)
+		}
+	}
+	bc.bytes.Set(float64(bc.total))
+}
+
+func dirSize(dir string) int64 {
+	var n int64
+	filepath.WalkDir(dir, func(_ string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				n += info.Size()
+			}
+		}
+		return nil
+	})
+	return n
+}
+
+// copyTree copies the regular files under src into dst, keeping relative paths and modes.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(src, p)
+		target := filepath.Join(dst, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		return copyFile(p, target)
+	})
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	// replace rather than truncate, so dst gets src's mode even if it existed
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
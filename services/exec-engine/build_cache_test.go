@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestExecuteNativeReusesBuild(t *testing.T) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not installed")
+	}
+	t.Setenv("BUILD_CACHE_DIR", t.TempDir())
+	bc := newBuildCache()
+	src := "#include <stdio.h>\nint main(){int n; scanf(\"%d\", &n); printf(\"%d\\n\", n*2); return 0;}\n"
+	hits := testutil.ToFloat64(buildCacheRequests.WithLabelValues("c", "hit"))
+
+	for i, in := range []string{"2", "21"} {
+		res := executeNative(RunRequest{Language: "c", Files: map[string]string{"main.c": src}, Stdin: in, TimeLimit: 10}, bc)
+		want := map[string]string{"2": "4\n", "21": "42\n"}[in]
+		if !res.Success || res.Stdout != want {
+			t.Fatalf("run %d: %+v", i, res)
+		}
+	}
+	if got := testutil.ToFloat64(buildCacheRequests.WithLabelValues("c", "hit")) - hits; got != 1 {
+		t.Fatalf("expected the second run to reuse the build, hits=%v", got)
+	}
+
+	// a compile error is reported and not cached
+	res := executeNative(RunRequest{Language: "c", Files: map[string]string{"main.c": "int main( {"}, TimeLimit: 10}, bc)
+	if res.Success || !strings.Contains(res.Stderr, "Compilation failed") {
+		t.Fatalf("expected compile failure, got %+v", res)
+	}
+	if len(bc.entries) != 1 {
+		t.Fatalf("expected one cache entry, got %d", len(bc.entries))
+	}
+}
+
+func TestBuildCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	t.Setenv("BUILD_CACHE_DIR", t.TempDir())
+	t.Setenv("BUILD_CACHE_MAX_MB", "1")
+	bc := newBuildCache()
+	if info, err := os.Stat(bc.dir); err != nil || info.Mode().Perm() != 0700 {
+		t.Fatalf("cache dir must be private: %v %v", info.Mode(), err)
+	}
+	work := t.TempDir()
+	os.WriteFile(filepath.Join(work, "bin"), make([]byte, 400<<10), 0755)
+
+	for _, k := range []string{"a", "b"} {
+		if err := bc.store(k, work, []string{"bin"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bc.restore("c", "a", t.TempDir()) // a is now the most recently used
+	bc.store("c", work, []string{"bin"})
+	if _, ok := bc.entries["b"]; ok {
+		t.Fatal("least recently used entry was not evicted")
+	}
+	if _, err := os.Stat(filepath.Join(bc.dir, "b")); !os.IsNotExist(err) {
+		t.Fatal("evicted entry is still on disk")
+	}
+	if bc.total > bc.maxBytes || len(bc.entries) != 2 {
+		t.Fatalf("total=%d entries=%d", bc.total, len(bc.entries))
+	}
+
+	// entries survive a restart
+	if again := newBuildCache(); len(again.entries) != 2 {
+		t.Fatalf("reloaded %d entries", len(again.entries))
+	}
+}
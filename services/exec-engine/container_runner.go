@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// containerEngine describes the OCI engine (docker or podman) used by the container runner mode,
+// together with the capabilities detected at startup. It is reported as-is on /readyz.
+type containerEngine struct {
+	Name           string   `json:"name"`
+	Binary         string   `json:"binary"`
+	Host           string   `json:"host,omitempty"`
+	Version        string   `json:"version,omitempty"`
+	Rootless       bool     `json:"rootless"`
+	CgroupVersion  string   `json:"cgroupVersion,omitempty"`
+	DefaultRuntime string   `json:"defaultRuntime,omitempty"`
+	Runtimes       []string `json:"runtimes,omitempty"`
+	Available      bool     `json:"available"`
+	Warnings       []string `json:"warnings,omitempty"`
+
+	// configured OCI runtimes: process default, per language and per tier
+	runtime           string
+	runtimeByLanguage map[string]string
+	runtimeByTier     map[string]string
+}
+
+// newContainerEngine reads the container configuration from the environment.
+// RUNNER_MODE=podman is shorthand for RUNNER_MODE=docker with CONTAINER_ENGINE=podman.
+func newContainerEngine(mode string) *containerEngine {
+	name := os.Getenv("CONTAINER_ENGINE")
+	if name == "" {
+		name = "docker"
+		if mode == "podman" {
+			name = "podman"
+		}
+	}
+	binary := os.Getenv("CONTAINER_BINARY")
+	if binary == "" {
+		binary = name
+	}
+	return &containerEngine{
+		Name:              name,
+		Binary:            binary,
+		Host:              os.Getenv("CONTAINER_HOST"),
+		runtime:           os.Getenv("OCI_RUNTIME"),
+		runtimeByLanguage: parseKeyValueList(os.Getenv("OCI_RUNTIME_BY_LANGUAGE")),
+		runtimeByTier:     parseKeyValueList(os.Getenv("OCI_RUNTIME_BY_TIER")),
+	}
+}
+
+// parseKeyValueList parses "a=x,b=y" into a map. Malformed entries are skipped.
+func parseKeyValueList(s string) map[string]string {
+	m := map[string]string{}
+	for _, part := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || k == "" || v == "" {
+			continue
+		}
+		m[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return m
+}
+
+// runtimeFor picks the OCI runtime for a run. A per-language override wins over a per-tier one,
+// since some languages (e.g. the JVM) do not work under every runtime. An empty result means
+// the engine's default runtime.
+func (ce *containerEngine) runtimeFor(language, tier string) string {
+	if rt, ok := ce.runtimeByLanguage[language]; ok {
+		return rt
+	}
+	if rt, ok := ce.runtimeByTier[tier]; ok {
+		return rt
+	}
+	return ce.runtime
+}
+
+// baseArgs returns the global flags that select the engine socket, if one is configured.
+func (ce *containerEngine) baseArgs() []string {
+	if ce.Host == "" {
+		return nil
+	}
+	if ce.Name == "podman" {
+		return []string{"--url", ce.Host}
+	}
+	return []string{"-H", ce.Host}
+}
+
+// detect queries the engine for its version, rootless mode and available OCI runtimes.
+func (ce *containerEngine) detect(ctx context.Context) {
+	args := append(ce.baseArgs(), "info", "--format")
+	if ce.Name == "podman" {
+		args = append(args, "json")
+	} else {
+		args = append(args, "{{json .}}")
+	}
+	out, err := exec.CommandContext(ctx, ce.Binary, args...).Output()
+	if err != nil {
+		ce.Available = false
+		ce.Warnings = append(ce.Warnings, fmt.Sprintf("%s info failed: %v", ce.Binary, err))
+		return
+	}
+	if ce.Name == "podman" {
+		err = ce.parsePodmanInfo(out)
+	} else {
+		err = ce.parseDockerInfo(out)
+	}
+	if err != nil {
+		ce.Available = false
+		ce.Warnings = append(ce.Warnings, "cannot parse engine info: "+err.Error())
+		return
+	}
+	ce.Available = true
+	if ce.Rootless && ce.CgroupVersion == "1" {
+		ce.Warnings = append(ce.Warnings, "rootless engine on cgroup v1: --memory and --cpus are not enforced")
+	}
+	for _, rt := range ce.configuredRuntimes() {
+		if !ce.hasRuntime(rt) {
+			ce.Warnings = append(ce.Warnings, fmt.Sprintf("OCI runtime %q is configured but not available", rt))
+		}
+	}
+}
+
+func (ce *containerEngine) parseDockerInfo(b []byte) error {
+	var info struct {
+		ServerVersion   string
+		DefaultRuntime  string
+		CgroupVersion   string
+		Runtimes        map[string]json.RawMessage
+		SecurityOptions []string
+	}
+	if err := json.Unmarshal(b, &info); err != nil {
+		return err
+	}
+	ce.Version = info.ServerVersion
+	ce.DefaultRuntime = info.DefaultRuntime
+	ce.CgroupVersion = info.CgroupVersion
+	ce.Runtimes = nil
+	for name := range info.Runtimes {
+		ce.Runtimes = append(ce.Runtimes, name)
+	}
+	sort.Strings(ce.Runtimes)
+	for _, opt := range info.SecurityOptions {
+		if opt == "name=rootless" {
+			ce.Rootless = true
+		}
+	}
+	return nil
+}
+
+func (ce *containerEngine) parsePodmanInfo(b []byte) error {
+	var info struct {
+		Host struct {
+			CgroupVersion string `json:"cgroupVersion"`
+			OCIRuntime    struct {
+				Name string `json:"name"`
+			} `json:"ociRuntime"`
+			Security struct {
+				Rootless bool `json:"rootless"`
+			} `json:"security"`
+		} `json:"host"`
+		Version struct {
+			Version string `json:"Version"`
+		} `json:"version"`
+	}
+	if err := json.Unmarshal(b, &info); err != nil {
+		return err
+	}
+	ce.Version = info.Version.Version
+	ce.DefaultRuntime = info.Host.OCIRuntime.Name
+	ce.CgroupVersion = strings.TrimPrefix(info.Host.CgroupVersion, "v")
+	ce.Rootless = info.Host.Security.Rootless
+	// podman does not list its runtimes; it resolves --runtime from containers.conf or $PATH
+	ce.Runtimes = []string{ce.DefaultRuntime}
+	for _, rt := range ce.configuredRuntimes() {
+		if rt != ce.DefaultRuntime {
+			if _, err := exec.LookPath(rt); err == nil {
+				ce.Runtimes = append(ce.Runtimes, rt)
+			}
+		}
+	}
+	sort.Strings(ce.Runtimes)
+	return nil
+}
+
+// configuredRuntimes lists every distinct OCI runtime referenced by the configuration.
+func (ce *containerEngine) configuredRuntimes() []string {
+	seen := map[string]bool{}
+	var out []string
+	add := func(rt string) {
+		if rt != "" && !seen[rt] {
+			seen[rt] = true
+			out = append(out, rt)
+		}
+	}
+	add(ce.runtime)
+	for _, rt := range ce.runtimeByLanguage {
+		add(rt)
+	}
+	for _, rt := range ce.runtimeByTier {
+		add(rt)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (ce *containerEngine) hasRuntime(rt string) bool {
+	for _, r := range ce.Runtimes {
+		if r == rt {
+			return true
+		}
+	}
+	return false
+}
+
+// runnerImage returns the runner image for a language.
+func runnerImage(language string) string {
+	if language == "go" {
+		return "coderipper/runner-go:latest"
+	}
+	return "coderipper/runner-python:latest"
+}
+
+// startArgs builds the engine command line that starts the sandbox container for a run. The
+// hardening flags are the same for every engine and runtime: no network, memory and CPU limits,
+// read-only submission mount. The container only sleeps; steps run in it with exec, in a tmpfs
+// workspace that starts as a copy of the submission.
+func (ce *containerEngine) startArgs(req RunRequest, plan pipelinePlan, dir, runtime string) []string {
+	mount := dir + ":/submission:ro"
+	if ce.Name == "podman" {
+		// relabel for SELinux hosts (Fedora laptops); harmless elsewhere
+		mount += ",Z"
+	}
+	args := append(ce.baseArgs(), "run", "-d", "--rm", "--network", "none", "-v", mount,
+		"--memory", fmt.Sprintf("%dm", req.MemoryLimit/(1024*1024)), "--cpus", "1")
+	if runtime != "" {
+		args = append(args, "--runtime", runtime)
+	}
+	args = append(args, "--tmpfs", workspaceDir+":exec,size="+strconv.Itoa(envInt("WORKSPACE_SIZE_MB", 256))+"m", "-w", workspaceDir,
+		"-e", "HOME="+workspaceDir)
+	for _, l := range plan.deps {
+		layer := l.path + ":" + l.mount() + ":ro"
+		if ce.Name == "podman" {
+			// shared label: concurrent runs mount the same layer
+			layer += ",z"
+		}
+		args = append(args, "-v", layer)
+	}
+	env := append(append([]string{}, plan.env...), depsEnv(plan.deps, false)...)
+	if len(plan.outputs) > 0 {
+		env = append(env, "CODERIPPER_OUTPUT_DIR="+workspaceDir+"/"+outputDir)
+	}
+	for _, kv := range env {
+		args = append(args, "-e", kv)
+	}
+	// the container outlives the pipeline's deadline by a margin, in case close is never reached
+	lifetime := int(plan.total.Seconds()) + 30
+	return append(args, "--entrypoint", "/bin/sh", runnerImage(req.Language), "-c", "exec sleep "+strconv.Itoa(lifetime))
+}
+
+// execArgs builds the engine command line that runs one step in the sandbox container id.
+func (ce *containerEngine) execArgs(id string, step planStep) []string {
+	args := append(ce.baseArgs(), "exec", "-w", workspaceDir)
+	if step.stdin != "" || step.input != nil {
+		args = append(args, "-i")
+	}
+	return append(append(args, id), step.argv...)
+}
+
+// workspaceDir is where runner containers and pods build and run a submission. /submission is
+// read-only, so it is copied here first.
+const workspaceDir = "/workspace"
+
+// prepareWorkspace is the command that fills the workspace from the submission mount, links
+// dependency layers into it and creates the output directory.
+func prepareWorkspace(plan pipelinePlan) []string {
+	script := "set -e\ncp -R /submission/. " + workspaceDir + "/\n" + depsLinks(plan.deps)
+	if len(plan.outputs) > 0 {
+		script += "mkdir -p " + workspaceDir + "/" + outputDir + "\n"
+	}
+	return []string{"/bin/sh", "-c", script}
+}
+
+// containerSandbox is a running container whose steps run with "docker exec".
+type containerSandbox struct {
+	ce *containerEngine
+	id string
+}
+
+// startSandbox starts the sandbox container for a run and copies the submission in dir into
+// its workspace.
+func (ce *containerEngine) startSandbox(req RunRequest, plan pipelinePlan, dir, runtime string) (*containerSandbox, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(ce.Binary, ce.startArgs(req, plan, dir, runtime)...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s run: %w: %s", ce.Binary, err, strings.TrimSpace(stderr.String()))
+	}
+	sb := &containerSandbox{ce: ce, id: strings.TrimSpace(string(out))}
+	var copyErr bytes.Buffer
+	code, _, err := sb.run(context.Background(), planStep{argv: prepareWorkspace(plan)}, nil, io.Discard, &copyErr)
+	if err == nil && code != 0 {
+		err = fmt.Errorf("exit code %d: %s", code, strings.TrimSpace(copyErr.String()))
+	}
+	if err != nil {
+		sb.close()
+		return nil, fmt.Errorf("copy submission: %w", err)
+	}
+	return sb, nil
+}
+
+// run executes a step with exec. When ctx expires the engine client is killed; the process in
+// the container keeps running until close removes the container.
+func (sb *containerSandbox) run(ctx context.Context, step planStep, _ []string, stdout, stderr io.Writer) (int, stepUsage, error) {
+	cmd := exec.CommandContext(ctx, sb.ce.Binary, sb.ce.execArgs(sb.id, step)...)
+	if step.stdin != "" {
+		cmd.Stdin = strings.NewReader(step.stdin)
+	}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if err := pipeInput(cmd, step.input); err != nil {
+		return 0, stepUsage{}, err
+	}
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		// CPU time of the engine client says nothing about the step, so none is reported
+		return exitErr.ExitCode(), stepUsage{}, nil
+	}
+	return 0, stepUsage{}, err
+}
+
+// collect streams the files that may match the outputs out of the container as a tar.
+func (sb *containerSandbox) collect(c *artifactCollector) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := sb.run(ctx, planStep{argv: []string{"/bin/sh", "-c", collectScript(c.globs)}}, nil, pw, io.Discard)
+		pw.Close()
+		done <- err
+	}()
+	err := c.collectTar(pr)
+	// drain what the collector did not read so the exec can finish
+	io.Copy(io.Discard, pr)
+	if runErr := <-done; err == nil {
+		err = runErr
+	}
+	return err
+}
+
+// hostDir is empty: the workspace is a tmpfs inside the container.
+func (sb *containerSandbox) hostDir() string { return "" }
+
+func (sb *containerSandbox) close() {
+	args := append(sb.ce.baseArgs(), "rm", "-f", sb.id)
+	if out, err := exec.Command(sb.ce.Binary, args...).CombinedOutput(); err != nil {
+		log.Printf("%s rm %s: %v: %s", sb.ce.Binary, sb.id, err, out)
+	}
+}
+
+// shellJoin quotes every word of argv for sh.
+func shellJoin(argv []string) string {
+	quoted := make([]string, len(argv))
+	for i, a := range argv {
+		quoted[i] = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+// executeContainer runs a submission in a container via docker or podman.
+func executeContainer(req RunRequest, ce *containerEngine, runtime string) NativeResult {
+	tmpDir, err := os.MkdirTemp("", "submission-*")
+	if err != nil {
+		log.Println("temp dir error:", err)
+		return NativeResult{Stderr: "Failed to create temp directory: " + err.Error(), ExitCode: 1, Success: false, InfraError: true, Language: req.Language}
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if _, err := writeSubmissionFiles(tmpDir, req.Files); err != nil {
+		return NativeResult{Stderr: "Failed to write files: " + err.Error(), ExitCode: 1, Success: false, InfraError: true, Language: req.Language}
+	}
+	plan, err := planPipeline(req, mainFileName(req.Files))
+	if err != nil {
+		return NativeResult{Stderr: fmt.Sprintf("Cannot run %s: %v", req.Language, err), ExitCode: 1, Success: false, Language: req.Language}
+	}
+	sb, err := ce.startSandbox(req, plan, tmpDir, runtime)
+	if err != nil {
+		log.Printf("container sandbox: %v", err)
+		return NativeResult{Stderr: "Failed to start container: " + err.Error(), ExitCode: 1, Success: false, InfraError: true, Language: req.Language}
+	}
+	defer sb.close()
+	return runPipeline(context.Background(), sb, plan, nil, req)
+}
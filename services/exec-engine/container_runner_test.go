@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContainerRuntimeSelection(t *testing.T) {
+	ce := &containerEngine{
+		runtime:           "runc",
+		runtimeByLanguage: parseKeyValueList("java=runc, python=runsc"),
+		runtimeByTier:     parseKeyValueList("free=runsc,internal=crun,bad"),
+	}
+	cases := []struct{ lang, tier, want string }{
+		{"java", "free", "runc"},
+		{"python", "internal", "runsc"},
+		{"c", "internal", "crun"},
+		{"c", "pro", "runc"},
+	}
+	for _, c := range cases {
+		if got := ce.runtimeFor(c.lang, c.tier); got != c.want {
+			t.Errorf("runtimeFor(%q,%q) = %q, want %q", c.lang, c.tier, got, c.want)
+		}
+	}
+}
+
+func TestContainerRunArgsKeepHardening(t *testing.T) {
+	req := RunRequest{Language: "python", MemoryLimit: 128 * 1024 * 1024, TimeLimit: 5}
+	for _, ce := range []*containerEngine{
+		{Name: "docker", Binary: "docker"},
+		{Name: "podman", Binary: "podman", Host: "unix:///run/user/1000/podman/podman.sock"},
+	} {
+		plan := pipelinePlan{steps: []planStep{{name: "run", argv: []string{"python", "main.py"}}}, total: 5 * time.Second}
+		args := strings.Join(ce.startArgs(req, plan, "/tmp/sub", "runsc"), " ")
+		for _, want := range []string{"--network none", "--memory 128m", "--cpus 1", "--runtime runsc", "/tmp/sub:/submission:ro"} {
+			if !strings.Contains(args, want) {
+				t.Errorf("%s args %q missing %q", ce.Name, args, want)
+			}
+		}
+		if ce.Name == "podman" && !strings.HasPrefix(args, "--url unix://") {
+			t.Errorf("podman args should select the socket: %q", args)
+		}
+		exec := strings.Join(ce.execArgs("c1", planStep{argv: []string{"./a.out", "x"}, stdin: "1"}), " ")
+		if !strings.HasSuffix(exec, "exec -w /workspace -i c1 ./a.out x") {
+			t.Errorf("%s exec args %q", ce.Name, exec)
+		}
+	}
+}
+
+func TestParseEngineInfo(t *testing.T) {
+	docker := &containerEngine{Name: "docker", runtime: "runsc"}
+	err := docker.parseDockerInfo([]byte(`{"ServerVersion":"24.0.7","DefaultRuntime":"runc","CgroupVersion":"2",
+		"Runtimes":{"runc":{},"runsc":{"path":"/usr/local/bin/runsc"}},"SecurityOptions":["name=seccomp,profile=builtin","name=rootless"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if docker.Version != "24.0.7" || !docker.Rootless || !docker.hasRuntime("runsc") {
+		t.Fatalf("unexpected docker capabilities: %+v", docker)
+	}
+
+	podman := &containerEngine{Name: "podman"}
+	err = podman.parsePodmanInfo([]byte(`{"host":{"cgroupVersion":"v2","ociRuntime":{"name":"crun"},"security":{"rootless":true}},"version":{"Version":"4.9.3"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if podman.Version != "4.9.3" || !podman.Rootless || podman.CgroupVersion != "2" || podman.DefaultRuntime != "crun" {
+		t.Fatalf("unexpected podman capabilities: %+v", podman)
+	}
+}
+
+func TestStepScriptQuotesCommands(t *testing.T) {
+	plan := pipelinePlan{steps: []planStep{
+		{name: "build", argv: []string{"gcc", "main.c"}, timeout: 5 * time.Second},
+		{name: "run", argv: []string{"./a.out", "it's", "$HOME"}, timeout: 3 * time.Second},
+	}}
+	script := stepScript(plan)
+	for _, want := range []string{"cp -R /submission/. /workspace/", "timeout -k 5 5 'gcc' 'main.c';", `timeout -k 5 3 './a.out' 'it'\''s' '$HOME';`, "echo '::coderipper-step 1'"} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script %q missing %q", script, want)
+		}
+	}
+}
+
+func TestStepScriptRunsAndParses(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	sub, dir := t.TempDir(), t.TempDir()
+	plan := pipelinePlan{steps: []planStep{
+		{name: "setup", argv: []string{"/bin/sh", "-c", "printf 'no newline'"}, timeout: 5 * time.Second},
+		{name: "build", argv: []string{"/bin/sh", "-c", "echo broken; exit 3"}, timeout: 5 * time.Second},
+		{name: "run", argv: []string{"/bin/sh", "-c", "echo unreachable"}, timeout: 5 * time.Second},
+	}}
+	// run the script outside a pod: point the workspace paths at a temp dir
+	script := strings.NewReplacer("/submission", sub, workspaceDir, dir).Replace(stepScript(plan))
+	out, _ := exec.Command("/bin/sh", "-c", script).CombinedOutput()
+	steps := parseStepLogs(plan, string(out))
+	if len(steps) != 2 {
+		t.Fatalf("steps = %+v from %q", steps, out)
+	}
+	if steps[0].Name != "setup" || steps[0].Stdout != "no newline" || steps[0].ExitCode != 0 {
+		t.Errorf("setup step = %+v", steps[0])
+	}
+	if steps[1].Name != "build" || steps[1].Stdout != "broken\n" || steps[1].ExitCode != 3 {
+		t.Errorf("build step = %+v", steps[1])
+	}
+	if parseStepLogs(plan, "exec format error\n") != nil {
+		t.Error("logs without markers should yield no steps")
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// FileCoverage is the line coverage of one submission file.
+type FileCoverage struct {
+	Path string `json:"path"`
+	// Lines maps each line with code to the number of times it ran; 0 marks lines that never
+	// ran. Go and Python only report whether a line ran, as 1.
+	Lines   map[int]int `json:"lines"`
+	Covered int         `json:"covered"`
+	Total   int         `json:"total"`
+}
+
+// coverageDir holds the coverage data of a run in the workspace. The tools leave their report
+// in coverageReport, which is collected like the outputs.
+const (
+	coverageDir       = ".coderipper-coverage"
+	coverageReport    = coverageDir + "/report"
+	maxCoverageReport = 16 << 20
+)
+
+// coverageTool measures the coverage of a language's runs and tests.
+type coverageTool struct {
+	// build instruments the build command; run the command that starts the program. Either
+	// may be nil; both are for languages without run coverage.
+	build func(argv []string) []string
+	run   func(argv []string) []string
+	// test instruments the command of a test framework; nil when tests are not measured
+	test func(fw testFramework, cmd string) string
+	// report turns the coverage data into coverageReport after the program or tests exit
+	report string
+	parse  func(report []byte) (map[string]map[int]int, error)
+}
+
+// c8 runs a node command and writes an lcov report; it measures the child processes too.
+var c8 = []string{"c8", "--reporter=lcovonly", "--report-dir=" + coverageDir, "--temp-directory=" + coverageDir + "/v8"}
+
+var gcov = coverageTool{
+	build: func(argv []string) []string {
+		return append([]string{argv[0], "--coverage"}, argv[1:]...)
+	},
+	// the program writes .gcda files next to the build's .gcno files
+	report: "gcov -t *.gcda > " + coverageReport + " 2>/dev/null",
+	parse:  parseGcov,
+}
+
+var coverageTools = map[string]coverageTool{
+	"python": {
+		run: func(argv []string) []string {
+			// after the interpreter flags, before the main file
+			i := 1
+			for i < len(argv) && strings.HasPrefix(argv[i], "-") {
+				i++
+			}
+			return append(append(append([]string{}, argv[:i]...), "-m", "coverage", "run", "--data-file="+coverageDir+"/data"), argv[i:]...)
+		},
+		test: func(_ testFramework, cmd string) string {
+			return strings.Replace(cmd, "python -m pytest", "python -m coverage run --data-file="+coverageDir+"/data -m pytest", 1)
+		},
+		report: "python -m coverage json -q --data-file=" + coverageDir + "/data -o " + coverageReport,
+		parse:  parseCoveragePyJSON,
+	},
+	"javascript": {
+		run:    func(argv []string) []string { return append(append([]string{}, c8...), argv...) },
+		test:   jsTestCoverage,
+		report: "mv -f " + coverageDir + "/lcov.info " + coverageReport + " 2>/dev/null",
+		parse:  parseLcov,
+	},
+	"typescript": {
+		test:   jsTestCoverage,
+		report: "mv -f " + coverageDir + "/lcov.info " + coverageReport + " 2>/dev/null",
+		parse:  parseLcov,
+	},
+	"go": {
+		build: func(argv []string) []string {
+			return append([]string{argv[0], argv[1], "-cover"}, argv[2:]...)
+		},
+		run: func(argv []string) []string {
+			return append([]string{"env", "GOCOVERDIR=" + coverageDir}, argv...)
+		},
+		test: func(_ testFramework, cmd string) string {
+			return strings.Replace(cmd, "go test -json", "go test -json -coverprofile="+coverageReport, 1)
+		},
+		// go test writes the report itself, a program built with -cover only its raw data
+		report: "[ -f " + coverageReport + " ] || go tool covdata textfmt -i=" + coverageDir + " -o=" + coverageReport,
+		parse:  parseGoCoverProfile,
+	},
+	"c":   gcov,
+	"cpp": gcov,
+}
+
+// jsTestCoverage has jest write an lcov report of its own; node --test runs under c8.
+func jsTestCoverage(fw testFramework, cmd string) string {
+	if fw.name == jest.name {
+		return cmd + " --coverage --coverageReporters=lcovonly --coverageDirectory=" + coverageDir
+	}
+	return shellJoin(c8) + " " + cmd
+}
+
+// validateCoverage checks that coverage can be measured for a request's language and mode.
+func validateCoverage(req RunRequest) error {
+	if !req.Coverage {
+		return nil
+	}
+	if len(req.Steps) > 0 {
+		return invalid("coverage cannot be combined with steps")
+	}
+	tool, ok := coverageTools[canonicalLanguage(req.Language)]
+	switch req.Mode {
+	case "", modeRun:
+		ok = ok && (tool.build != nil || tool.run != nil)
+	case modeTest:
+		ok = ok && tool.test != nil
+	default:
+		return invalid("coverage is not supported in mode %q", req.Mode)
+	}
+	if !ok {
+		return invalid("coverage is not supported for %s in mode %q", req.Language, modeOrRun(req.Mode))
+	}
+	return nil
+}
+
+func modeOrRun(mode string) string {
+	if mode == "" {
+		return modeRun
+	}
+	return mode
+}
+
+// instrumentRun adds coverage to the build and run steps of the default pipeline. The run
+// step writes the report when the program exits, keeping its exit code.
+func instrumentRun(req RunRequest, p *pipelinePlan) {
+	tool := coverageTools[canonicalLanguage(req.Language)]
+	for i := range p.steps {
+		step := &p.steps[i]
+		switch step.name {
+		case "build":
+			if tool.build != nil {
+				step.argv = tool.build(step.argv)
+			}
+			// the build cache keeps the binary but not the coverage notes next to it
+			step.cacheable = false
+		case "run":
+			argv := step.argv
+			if tool.run != nil {
+				argv = tool.run(argv)
+			}
+			script := "rm -rf " + coverageDir + " && mkdir -p " + coverageDir + "\n\"$@\"\nc=$?\n" + tool.report + "\nexit $c"
+			step.argv = append([]string{"/bin/sh", "-c", script, "sh"}, argv...)
+		}
+	}
+	p.coverage = true
+}
+
+// collectCoverage reads the coverage report from the workspace, the way outputs are collected,
+// and returns the coverage of the submission files.
+func collectCoverage(req RunRequest, collect func(*artifactCollector) error) []FileCoverage {
+	c := &artifactCollector{globs: []string{coverageReport}, limits: artifactLimits{maxFiles: 1, maxFileBytes: maxCoverageReport, maxTotalBytes: maxCoverageReport}}
+	if err := collect(c); err != nil {
+		log.Printf("collect coverage: %v", err)
+		return nil
+	}
+	for _, a := range c.out {
+		if a.Skipped != "" {
+			log.Printf("collect coverage: %s", a.Skipped)
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(a.Content)
+		if err != nil {
+			return nil
+		}
+		return coverageResult(req, data)
+	}
+	return nil
+}
+
+// coverageResult parses a coverage report and keeps the submission files in it, sorted by path.
+// Tools report paths relative to the workspace, absolute, or under the Go module path.
+func coverageResult(req RunRequest, report []byte) []FileCoverage {
+	raw, err := coverageTools[canonicalLanguage(req.Language)].parse(report)
+	if err != nil {
+		log.Printf("parse coverage: %v", err)
+		return nil
+	}
+	byFile := map[string]map[int]int{}
+	for p, lines := range raw {
+		name := strings.TrimPrefix(p, "./")
+		if _, ok := req.Files[name]; !ok {
+			name = submissionSuffix(req.Files, "/"+name)
+		}
+		if _, ok := req.Files[name]; !ok {
+			// libraries, the standard library and the test framework
+			continue
+		}
+		if byFile[name] == nil {
+			byFile[name] = map[int]int{}
+		}
+		for line, hits := range lines {
+			byFile[name][line] += hits
+		}
+	}
+	var out []FileCoverage
+	for _, name := range sortedKeys(byFile) {
+		fc := FileCoverage{Path: name, Lines: byFile[name], Total: len(byFile[name])}
+		for _, hits := range fc.Lines {
+			if hits > 0 {
+				fc.Covered++
+			}
+		}
+		out = append(out, fc)
+	}
+	return out
+}
+
+// parseGoCoverProfile reads a Go cover profile: "file:line.col,line.col statements count" per
+// block. Every line of a block gets its count; lines in several blocks the highest.
+func parseGoCoverProfile(report []byte) (map[string]map[int]int, error) {
+	out := map[string]map[int]int{}
+	sc := bufio.NewScanner(strings.NewReader(string(report)))
+	for sc.Scan() {
+		file, block, ok := strings.Cut(sc.Text(), ":")
+		if !ok || file == "mode" {
+			continue
+		}
+		var startLine, startCol, endLine, endCol, stmts, count int
+		if _, err := fmt.Sscanf(block, "%d.%d,%d.%d %d %d", &startLine, &startCol, &endLine, &endCol, &stmts, &count); err != nil {
+			continue
+		}
+		if out[file] == nil {
+			out[file] = map[int]int{}
+		}
+		for l := startLine; l <= endLine; l++ {
+			if c, seen := out[file][l]; !seen || count > c {
+				out[file][l] = count
+			}
+		}
+	}
+	return out, sc.Err()
+}
+
+// parseCoveragePyJSON reads the report of coverage json, which lists executed and missing lines.
+func parseCoveragePyJSON(report []byte) (map[string]map[int]int, error) {
+	var r struct {
+		Files map[string]struct {
+			ExecutedLines []int `json:"executed_lines"`
+			MissingLines  []int `json:"missing_lines"`
+		} `json:"files"`
+	}
+	if err := json.Unmarshal(report, &r); err != nil {
+		return nil, err
+	}
+	out := map[string]map[int]int{}
+	for name, f := range r.Files {
+		lines := map[int]int{}
+		for _, l := range f.MissingLines {
+			lines[l] = 0
+		}
+		for _, l := range f.ExecutedLines {
+			lines[l] = 1
+		}
+		out[name] = lines
+	}
+	return out, nil
+}
+
+// parseLcov reads the SF and DA records of an lcov tracefile, as c8 and jest write them.
+func parseLcov(report []byte) (map[string]map[int]int, error) {
+	out := map[string]map[int]int{}
+	var lines map[int]int
+	sc := bufio.NewScanner(strings.NewReader(string(report)))
+	for sc.Scan() {
+		rec := sc.Text()
+		switch {
+		case strings.HasPrefix(rec, "SF:"):
+			name := strings.TrimPrefix(rec, "SF:")
+			if out[name] == nil {
+				out[name] = map[int]int{}
+			}
+			lines = out[name]
+		case strings.HasPrefix(rec, "DA:") && lines != nil:
+			fields := strings.Split(strings.TrimPrefix(rec, "DA:"), ",")
+			if len(fields) < 2 {
+				continue
+			}
+			line, err1 := strconv.Atoi(fields[0])
+			hits, err2 := strconv.Atoi(fields[1])
+			if err1 == nil && err2 == nil {
+				lines[line] += hits
+			}
+		case rec == "end_of_record":
+			lines = nil
+		}
+	}
+	return out, sc.Err()
+}
+
+// parseGcov reads the text output of gcov -t: a "Source:" header per file, then
+// "count:line:source" for each line, with "-" for lines without code and "#####" for lines
+// that never ran.
+func parseGcov(report []byte) (map[string]map[int]int, error) {
+	out := map[string]map[int]int{}
+	var lines map[int]int
+	sc := bufio.NewScanner(strings.NewReader(string(report)))
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		count, rest, ok := strings.Cut(sc.Text(), ":")
+		if !ok {
+			continue
+		}
+		lineNo, src, _ := strings.Cut(rest, ":")
+		line, err := strconv.Atoi(strings.TrimSpace(lineNo))
+		if err != nil {
+			continue
+		}
+		if line == 0 {
+			if name, ok := strings.CutPrefix(src, "Source:"); ok {
+				if out[name] == nil {
+					out[name] = map[int]int{}
+				}
+				lines = out[name]
+			}
+			continue
+		}
+		// "*" marks lines with a block that never ran
+		count = strings.TrimSuffix(strings.TrimSpace(count), "*")
+		if lines == nil || count == "-" {
+			continue
+		}
+		hits, err := strconv.Atoi(count)
+		if err != nil {
+			// ##### and ===== (reached only by exceptions)
+			hits = 0
+		}
+		lines[line] += hits
+	}
+	return out, sc.Err()
+}
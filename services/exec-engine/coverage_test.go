@@ -0,0 +1,104 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCoverageResult(t *testing.T) {
+	cases := []struct {
+		name     string
+		language string
+		files    map[string]string
+		report   string
+		want     []FileCoverage
+	}{
+		{"go profile", "go", map[string]string{"calc.go": "", "calc_test.go": ""}, `mode: set
+submission/calc.go:3.24,4.12 1 1
+submission/calc.go:4.12,6.3 1 0
+submission/calc.go:7.2,7.10 1 1
+fmt/print.go:1.1,2.2 1 1
+`, []FileCoverage{{Path: "calc.go", Lines: map[int]int{3: 1, 4: 1, 5: 0, 6: 0, 7: 1}, Covered: 3, Total: 5}}},
+		{"coverage.py", "python", map[string]string{"main.py": "", "pkg/util.py": ""}, `{"meta": {"version": "7.4.0"}, "files": {
+"main.py": {"executed_lines": [1, 2], "missing_lines": []},
+"pkg/util.py": {"executed_lines": [1, 2], "missing_lines": [4, 5]}}}`, []FileCoverage{
+			{Path: "main.py", Lines: map[int]int{1: 1, 2: 1}, Covered: 2, Total: 2},
+			{Path: "pkg/util.py", Lines: map[int]int{1: 1, 2: 1, 4: 0, 5: 0}, Covered: 2, Total: 4},
+		}},
+		{"lcov", "javascript", map[string]string{"main.js": ""}, `TN:
+SF:/tmp/coderipper-native-1/main.js
+FN:1,add
+DA:1,3
+DA:2,3
+DA:4,0
+end_of_record
+SF:/tmp/coderipper-native-1/node_modules/lib/index.js
+DA:1,1
+end_of_record
+`, []FileCoverage{{Path: "main.js", Lines: map[int]int{1: 3, 2: 3, 4: 0}, Covered: 2, Total: 3}}},
+		{"gcov", "c", map[string]string{"main.c": "", "sub/u.c": ""}, `        -:    0:Source:main.c
+        -:    0:Graph:a-main.gcno
+        -:    1:#include <stdio.h>
+        1:    3:int main(){
+       4*:    4:  for(int i=0;i<3;i++) printf("%d\n", f(i));
+    #####:    5:  return 1;
+        -:    6:}
+        -:    0:Source:sub/u.c
+        3:    1:int f(int x){
+        3:    2:  if (x) return 1;
+    =====:    3:  return 2;
+`, []FileCoverage{
+			{Path: "main.c", Lines: map[int]int{3: 1, 4: 4, 5: 0}, Covered: 2, Total: 3},
+			{Path: "sub/u.c", Lines: map[int]int{1: 3, 2: 3, 3: 0}, Covered: 2, Total: 3},
+		}},
+	}
+	for _, c := range cases {
+		got := coverageResult(RunRequest{Language: c.language, Files: c.files}, []byte(c.report))
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s:\n got %+v\nwant %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestValidateCoverage(t *testing.T) {
+	cases := []struct {
+		name string
+		req  RunRequest
+		ok   bool
+	}{
+		{"run", RunRequest{Language: "c", Coverage: true}, true},
+		{"test", RunRequest{Language: "go", Mode: modeTest, Coverage: true}, true},
+		{"no run coverage", RunRequest{Language: "typescript", Coverage: true}, false},
+		{"no test coverage", RunRequest{Language: "java", Mode: modeTest, Coverage: true}, false},
+		{"check", RunRequest{Language: "go", Mode: modeCheck, Coverage: true}, false},
+		{"steps", RunRequest{Language: "go", Coverage: true, Steps: []RunStep{{Name: "run", Command: "go run ."}}}, false},
+	}
+	for _, c := range cases {
+		if err := validateCoverage(c.req); (err == nil) != c.ok {
+			t.Errorf("%s: err = %v", c.name, err)
+		}
+	}
+}
+
+func TestNativeCoverage(t *testing.T) {
+	res := executeNative(RunRequest{Language: "c", TimeLimit: 10, Coverage: true, Stdin: "2", Files: map[string]string{
+		"main.c": "#include <stdio.h>\nint main(void) {\n  int n;\n  scanf(\"%d\", &n);\n  if (n > 5)\n    puts(\"big\");\n  else\n    puts(\"small\");\n  return 3;\n}\n",
+	}}, nil)
+	if res.Stdout != "small\n" || res.ExitCode != 3 || len(res.Coverage) != 1 {
+		t.Fatalf("run with coverage: %+v", res)
+	}
+	if lines := res.Coverage[0].Lines; lines[6] != 0 || lines[8] != 1 {
+		t.Fatalf("lines: %v", lines)
+	}
+
+	res = executeNative(RunRequest{Language: "go", Mode: modeTest, TimeLimit: 60, Coverage: true, Files: map[string]string{
+		"calc.go":      "package calc\n\nfunc Sign(n int) int {\n\tif n < 0 {\n\t\treturn -1\n\t}\n\treturn 1\n}\n",
+		"calc_test.go": "package calc\n\nimport \"testing\"\n\nfunc TestSign(t *testing.T) {\n\tif Sign(2) != 1 {\n\t\tt.Fatal(\"sign\")\n\t}\n}\n",
+	}}, nil)
+	if !res.Success || len(res.Coverage) != 1 || res.Coverage[0].Path != "calc.go" {
+		t.Fatalf("test with coverage: %+v", res)
+	}
+	if lines := res.Coverage[0].Lines; lines[5] != 0 || lines[7] != 1 {
+		t.Fatalf("lines: %v", lines)
+	}
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/websocket"
+)
+
+var debugSessions = prometheus.NewGauge(prometheus.GaugeOpts{Namespace: "coderipper", Name: "debug_sessions_active", Help: "Debug sessions running"})
+
+func init() {
+	prometheus.MustRegister(debugSessions)
+}
+
+// debugger runs a language's program under a debug adapter, which speaks the Debug Adapter
+// Protocol (DAP) on its stdin and stdout.
+type debugger struct {
+	// build adds debug information to the build command; nil keeps it
+	build func(argv []string) []string
+	// adapter is the command that starts the debug adapter in the workspace
+	adapter func() []string
+	// launch returns the launch arguments the engine sets: the program, built or interpreted
+	// in the workspace root, and the request's args
+	launch func(root, mainFile string, args []string) map[string]any
+}
+
+// dlvBridge starts delve's DAP server, which only listens on TCP, and connects stdin and
+// stdout to it with nc once it listens.
+const dlvBridge = `dlv dap --listen=127.0.0.1:0 > .coderipper-dlv.log 2>&1 &
+for i in $(seq 100); do
+	addr=$(sed -n 's/^DAP server listening at: //p' .coderipper-dlv.log)
+	[ -n "$addr" ] && exec nc "${addr%:*}" "${addr##*:}"
+	sleep 0.1
+done
+cat .coderipper-dlv.log >&2
+exit 1`
+
+var gdbDebugger = debugger{
+	// the flags come last so that they win over the request's optimization level
+	build: func(argv []string) []string { return append(append([]string{}, argv...), "-g", "-O0") },
+	adapter: func() []string {
+		if os.Getenv("DEBUG_NATIVE_ADAPTER") == "lldb-dap" {
+			return []string{"lldb-dap"}
+		}
+		return []string{"gdb", "-q", "-i", "dap"}
+	},
+	launch: func(root, _ string, args []string) map[string]any {
+		return map[string]any{"program": path.Join(root, "a.out"), "args": args, "cwd": root}
+	},
+}
+
+var debuggers = map[string]debugger{
+	"go": {
+		build: func(argv []string) []string {
+			// no optimizations or inlining, so that every variable and line can be inspected
+			return append([]string{argv[0], argv[1], "-gcflags=all=-N -l"}, argv[2:]...)
+		},
+		adapter: func() []string { return []string{"/bin/sh", "-c", dlvBridge} },
+		launch: func(root, _ string, args []string) map[string]any {
+			// outputMode remote sends the program's output as output events
+			return map[string]any{"mode": "exec", "program": path.Join(root, "main"), "args": args, "cwd": root, "outputMode": "remote"}
+		},
+	},
+	"python": {
+		adapter: func() []string { return []string{"python", "-m", "debugpy.adapter"} },
+		launch: func(root, mainFile string, args []string) map[string]any {
+			return map[string]any{"program": path.Join(root, mainFile), "args": args, "cwd": root, "console": "internalConsole"}
+		},
+	},
+	"c":   gdbDebugger,
+	"cpp": gdbDebugger,
+}
+
+// debugSessionLimit is how long a debug session may last, DEBUG_SESSION_SECONDS (600). The
+// program's CPU time is limited by the request's time limit, as in a run.
+func debugSessionLimit() time.Duration {
+	return time.Duration(envInt("DEBUG_SESSION_SECONDS", 600)) * time.Second
+}
+
+// validateDebug checks that a request can be debugged. Sessions have no stdin: the program
+// would share it with the adapter.
+func validateDebug(req RunRequest) error {
+	if _, ok := debuggers[canonicalLanguage(req.Language)]; !ok {
+		return invalid("debugging is not supported for %s (Go, Python, C and C++ are)", req.Language)
+	}
+	if req.Mode != "" || len(req.Steps) > 0 || len(req.Outputs) > 0 || req.Stdin != "" || req.Coverage || req.Benchmark != nil || req.Archive != nil {
+		return invalid("debug requests take language, files, args, env, compileFlags, standard and limits")
+	}
+	return nil
+}
+
+// planDebug replaces the run step of the default pipeline with the debug adapter, which runs
+// until it exits, the client goes away or the session times out. The build gets debug
+// information, and ulimit gives the adapter and the program the CPU time of a run.
+func planDebug(req RunRequest, p *pipelinePlan, limit time.Duration) {
+	d := debuggers[canonicalLanguage(req.Language)]
+	p.steps = p.steps[:len(p.steps)-1]
+	for i := range p.steps {
+		if p.steps[i].name == "build" && d.build != nil {
+			p.steps[i].argv = d.build(p.steps[i].argv)
+		}
+	}
+	session := debugSessionLimit()
+	script := "ulimit -t " + strconv.Itoa(req.TimeLimit) + "\nexec \"$@\""
+	step := planStep{name: "debug", argv: append([]string{"/bin/sh", "-c", script, "sh"}, d.adapter()...), timeout: session}
+	if req.debug != nil {
+		step.stream = req.debug
+	}
+	p.steps = append(p.steps, step)
+	p.total = limit + session
+}
+
+// maxDAPMessage bounds a single DAP message in either direction.
+const maxDAPMessage = 8 << 20
+
+// debugSession relays DAP messages between a WebSocket client, one message per text frame, and
+// the debug adapter, which frames them with a Content-Length header. The engine sets the
+// arguments of the launch request, and source paths are relative to the submission on the
+// client's side.
+type debugSession struct {
+	ws       *websocket.Conn
+	ctx      context.Context
+	debugger debugger
+	files    map[string]string
+	mainFile string
+	args     []string
+
+	root   string        // the workspace, set by open
+	opened chan struct{} // closed by open
+	in     *io.PipeReader
+	inW    *io.PipeWriter
+	out    *io.PipeWriter
+	sent   chan struct{} // closed when send has forwarded the adapter's last message
+}
+
+func newDebugSession(ctx context.Context, ws *websocket.Conn, req RunRequest) *debugSession {
+	s := &debugSession{
+		ws:       ws,
+		ctx:      ctx,
+		debugger: debuggers[canonicalLanguage(req.Language)],
+		files:    req.Files,
+		mainFile: mainFileName(req.Files),
+		args:     req.Args,
+		opened:   make(chan struct{}),
+		sent:     make(chan struct{}),
+	}
+	if s.args == nil {
+		s.args = []string{}
+	}
+	s.in, s.inW = io.Pipe()
+	return s
+}
+
+func (s *debugSession) context() context.Context { return s.ctx }
+
+// open starts forwarding the adapter's stdout to the client.
+func (s *debugSession) open(root string) (io.Reader, io.Writer) {
+	s.root = root
+	close(s.opened)
+	r, w := io.Pipe()
+	s.out = w
+	go s.send(r)
+	return s.in, w
+}
+
+// close waits until the adapter's messages are forwarded and discards what the client sends
+// from then on.
+func (s *debugSession) close() {
+	s.out.Close()
+	<-s.sent
+	s.in.Close()
+}
+
+// receive passes the client's messages to the adapter once it runs, and cancels the session
+// when the client goes away.
+func (s *debugSession) receive(cancel context.CancelFunc) {
+	defer cancel()
+	for {
+		var msg []byte
+		if err := websocket.Message.Receive(s.ws, &msg); err != nil {
+			return
+		}
+		select {
+		case <-s.opened:
+		case <-s.ctx.Done():
+			return
+		}
+		msg, err := s.toAdapter(msg)
+		if err != nil {
+			// answered here; the adapter never sees it
+			websocket.Message.Send(s.ws, string(msg))
+			continue
+		}
+		// this fails once the adapter exited; the session ends with the client, or after it was
+		// told why the adapter exited
+		fmt.Fprintf(s.inW, "Content-Length: %d\r\n\r\n%s", len(msg), msg)
+	}
+}
+
+// send forwards the adapter's messages to the client until the adapter exits.
+func (s *debugSession) send(r *io.PipeReader) {
+	defer close(s.sent)
+	br := bufio.NewReader(r)
+	for {
+		msg, err := readDAPMessage(br)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("debug adapter: %v", err)
+			}
+			break
+		}
+		// a client that went away is noticed by receive
+		websocket.Message.Send(s.ws, string(s.toClient(msg)))
+	}
+	// the adapter must not block on a full pipe
+	io.Copy(io.Discard, r)
+}
+
+// errDebugAttach rejects attach requests: the engine starts the program itself.
+var errDebugAttach = errors.New("attach is not supported, use launch")
+
+// toAdapter sets the engine's launch arguments and makes relative source paths absolute. Attach
+// requests are answered with an error response, returned with errDebugAttach.
+func (s *debugSession) toAdapter(msg []byte) ([]byte, error) {
+	m, ok := decodeDAPMessage(msg)
+	if !ok {
+		return msg, nil
+	}
+	if m["type"] == "request" && m["command"] == "attach" {
+		resp, _ := json.Marshal(map[string]any{"seq": 0, "type": "response", "request_seq": m["seq"], "command": "attach", "success": false, "message": errDebugAttach.Error()})
+		return resp, errDebugAttach
+	}
+	if m["type"] == "request" && m["command"] == "launch" {
+		args, _ := m["arguments"].(map[string]any)
+		if args == nil {
+			args = map[string]any{}
+		}
+		for k, v := range s.debugger.launch(s.root, s.mainFile, s.args) {
+			args[k] = v
+		}
+		m["arguments"] = args
+	}
+	rewriteSourcePaths(m, func(p string) string {
+		if path.IsAbs(p) {
+			return p
+		}
+		return path.Join(s.root, p)
+	})
+	out, err := json.Marshal(m)
+	if err != nil {
+		return msg, nil
+	}
+	return out, nil
+}
+
+// toClient makes source paths in the workspace relative to it.
+func (s *debugSession) toClient(msg []byte) []byte {
+	m, ok := decodeDAPMessage(msg)
+	if !ok {
+		return msg
+	}
+	rewriteSourcePaths(m, func(p string) string {
+		if rel, ok := strings.CutPrefix(p, s.root+"/"); ok {
+			return rel
+		}
+		// the adapter may resolve symlinks in the workspace path
+		return submissionSuffix(s.files, p)
+	})
+	out, err := json.Marshal(m)
+	if err != nil {
+		return msg
+	}
+	return out
+}
+
+// decodeDAPMessage decodes a message object, keeping numbers as they were sent.
+func decodeDAPMessage(msg []byte) (map[string]any, bool) {
+	d := json.NewDecoder(bytes.NewReader(msg))
+	d.UseNumber()
+	var m map[string]any
+	if err := d.Decode(&m); err != nil || m == nil {
+		return nil, false
+	}
+	return m, true
+}
+
+// rewriteSourcePaths applies f to the path of every Source object in a message. DAP nests them
+// under "source" keys, and lists them under "sources".
+func rewriteSourcePaths(v any, f func(string) string) {
+	rewrite := func(src any) {
+		if src, ok := src.(map[string]any); ok {
+			if p, ok := src["path"].(string); ok && p != "" {
+				src["path"] = f(p)
+			}
+		}
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			switch k {
+			case "source":
+				rewrite(e)
+			case "sources":
+				if list, ok := e.([]any); ok {
+					for _, src := range list {
+						rewrite(src)
+					}
+				}
+			}
+			rewriteSourcePaths(e, f)
+		}
+	case []any:
+		for _, e := range v {
+			rewriteSourcePaths(e, f)
+		}
+	}
+}
+
+// readDAPMessage reads one message framed by a Content-Length header.
+func readDAPMessage(br *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && line != "" {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if length >= 0 {
+				break
+			}
+			continue
+		}
+		if v, ok := strings.CutPrefix(line, "Content-Length:"); ok {
+			if length, err = strconv.Atoi(strings.TrimSpace(v)); err != nil || length < 0 {
+				return nil, fmt.Errorf("invalid header %q", line)
+			}
+		}
+	}
+	if length > maxDAPMessage {
+		return nil, fmt.Errorf("message of %d bytes (max %d)", length, maxDAPMessage)
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(br, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// dapEvent is an event the engine sends itself, outside of the adapter's sequence.
+type dapEvent struct {
+	Seq   int    `json:"seq"`
+	Type  string `json:"type"`
+	Event string `json:"event"`
+	Body  any    `json:"body,omitempty"`
+}
+
+// endDebug reports why a session ended to the client, as stderr output, and terminates it.
+func endDebug(ws *websocket.Conn, text string) {
+	websocket.JSON.Send(ws, dapEvent{Type: "event", Event: "output", Body: map[string]string{"category": "stderr", "output": text + "\n"}})
+	websocket.JSON.Send(ws, dapEvent{Type: "event", Event: "terminated"})
+}
+
+// debugHandler serves GET /debug, a WebSocket. Its first message is the run request as JSON;
+// DAP messages follow in both directions. A session holds a place in the run queue, counts
+// toward the caller's concurrent runs and is charged as a run.
+func debugHandler(rs *runners, tp *tierPolicies, q *quotas, limits requestLimits) http.HandlerFunc {
+	handshake := debugHandshake(strings.Split(os.Getenv("DEBUG_ALLOWED_ORIGINS"), ","))
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rs.jobs != nil || rs.mode == "wasm" || rs.mode == "k8s" {
+			// the adapter needs a sandbox here that lives as long as the client's connection
+			http.Error(w, "debug sessions are not supported in "+rs.label()+" mode", http.StatusNotImplemented)
+			return
+		}
+		userID, _ := r.Context().Value("user_id").(string)
+		claimTier, _ := r.Context().Value("tier").(string)
+		tier, policy := tp.resolve(claimTier)
+		if userID != "" {
+			if st, err := q.status(r.Context(), userID, tier, policy); err != nil {
+				log.Println("quota store error:", err)
+			} else if kind := st.exceeded(); kind != "" {
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(time.Until(st.ResetsAt))))
+				http.Error(w, "daily "+kind+" quota exceeded", http.StatusTooManyRequests)
+				return
+			}
+		}
+		if !tp.begin(userID, policy) {
+			http.Error(w, "too many concurrent runs", http.StatusTooManyRequests)
+			return
+		}
+		defer tp.end(userID)
+		websocket.Server{Handshake: handshake, Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			serveDebug(ws, rs, q, limits, userID, tier, policy)
+		}}.ServeHTTP(w, r)
+	}
+}
+
+// debugProtocol is the WebSocket subprotocol of debug sessions. Browsers, which cannot set
+// headers on a WebSocket, offer the token as a second subprotocol, "bearer.<token>".
+const debugProtocol = "coderipper.dap"
+
+// debugHandshake admits browsers from the engine's own origin or an allowed one ("*" for any),
+// so that other web pages cannot open sessions from a visitor's browser. Clients that send no
+// Origin are not browsers. debugProtocol is selected if offered; a token is never echoed.
+func debugHandshake(allowed []string) func(*websocket.Config, *http.Request) error {
+	return func(config *websocket.Config, r *http.Request) error {
+		origin, err := websocket.Origin(config, r)
+		if err != nil {
+			return err
+		}
+		if origin != nil && !strings.EqualFold(origin.Host, r.Host) && !originAllowed(allowed, origin.Scheme+"://"+origin.Host) {
+			return fmt.Errorf("origin %s is not allowed", origin)
+		}
+		offered := config.Protocol
+		config.Protocol = nil
+		if containsString(offered, debugProtocol) {
+			config.Protocol = []string{debugProtocol}
+		}
+		return nil
+	}
+}
+
+func originAllowed(allowed []string, origin string) bool {
+	for _, a := range allowed {
+		a = strings.TrimSpace(a)
+		if a == "*" || strings.EqualFold(strings.TrimSuffix(a, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// protocolTokenMiddleware takes the token of a WebSocket from its "bearer.<token>" subprotocol.
+// Unlike a query parameter, it does not end up in proxy and access logs.
+func protocolTokenMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			for _, v := range r.Header.Values("Sec-WebSocket-Protocol") {
+				for _, p := range strings.Split(v, ",") {
+					if t, ok := strings.CutPrefix(strings.TrimSpace(p), "bearer."); ok && t != "" {
+						r.Header.Set("Authorization", "Bearer "+t)
+					}
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveDebug reads the run request of a session and runs it, relaying DAP messages until the
+// adapter exits, the client goes away or the session times out.
+func serveDebug(ws *websocket.Conn, rs *runners, q *quotas, limits requestLimits, userID, tier string, policy tierPolicy) {
+	ws.MaxPayloadBytes = int(limits.maxBodyBytes)
+	var req RunRequest
+	err := websocket.JSON.Receive(ws, &req)
+	if err == nil {
+		err = limits.validate(req)
+	}
+	if err == nil {
+		err = validateDebug(req)
+	}
+	var ve *validationError
+	switch {
+	case errors.As(err, &ve):
+		endDebug(ws, ve.msg)
+		return
+	case errors.Is(err, websocket.ErrFrameTooLarge):
+		endDebug(ws, fmt.Sprintf("request larger than %d bytes", limits.maxBodyBytes))
+		return
+	case err != nil:
+		endDebug(ws, "bad request")
+		return
+	}
+	ws.MaxPayloadBytes = maxDAPMessage
+	policy.applyLimits(&req)
+	req.Mode = modeDebug
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newDebugSession(ctx, ws, req)
+	go s.receive(cancel)
+	if _, _, err := rs.queue.acquire(ctx, tier, nil); err != nil {
+		if err == errQueueFull {
+			endDebug(ws, "run queue full")
+		}
+		return
+	}
+	debugSessions.Inc()
+	start := time.Now()
+	req.debug = s
+	res, err := rs.execute(req, tier)
+	rs.queue.release(time.Since(start))
+	debugSessions.Dec()
+	if err != nil {
+		log.Printf("debug session: %v", err)
+		endDebug(ws, "failed to start the debug session")
+		return
+	}
+	if userID != "" {
+		if err := q.charge(context.Background(), userID, req, res); err != nil {
+			log.Println("quota store error:", err)
+		}
+	}
+	if !res.Success && ctx.Err() == nil {
+		// a failed build, a missing adapter or the session limit
+		text := strings.TrimSpace(res.Stderr)
+		if text == "" {
+			text = fmt.Sprintf("Debug adapter exited with code %d", res.ExitCode)
+		}
+		endDebug(ws, text)
+	}
+}
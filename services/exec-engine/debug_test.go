@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/net/websocket"
+)
+
+func TestReadDAPMessage(t *testing.T) {
+	br := bufio.NewReader(strings.NewReader("Content-Length: 13\r\n\r\n{\"seq\":1}    Content-Length: 2\r\nContent-Type: application/json\r\n\r\n{}"))
+	for _, want := range []string{`{"seq":1}    `, `{}`} {
+		msg, err := readDAPMessage(br)
+		if err != nil || string(msg) != want {
+			t.Fatalf("got %q, %v; want %q", msg, err, want)
+		}
+	}
+	if _, err := readDAPMessage(bufio.NewReader(strings.NewReader("Content-Length: x\r\n\r\n"))); err == nil {
+		t.Fatal("invalid length accepted")
+	}
+}
+
+func TestDebugMessageRewrite(t *testing.T) {
+	s := newDebugSession(nil, nil, RunRequest{Language: "go", Files: map[string]string{"main.go": "", "pkg/util.go": ""}, Args: []string{"-n", "3"}})
+	s.root = "/workspace"
+
+	msg, err := s.toAdapter([]byte(`{"seq":3,"type":"request","command":"launch","arguments":{"program":"/bin/sh","stopOnEntry":true}}`))
+	var launch struct{ Arguments map[string]any }
+	if err != nil || json.Unmarshal(msg, &launch) != nil {
+		t.Fatalf("launch: %s, %v", msg, err)
+	}
+	if a := launch.Arguments; a["program"] != "/workspace/main" || a["stopOnEntry"] != true || a["mode"] != "exec" || len(a["args"].([]any)) != 2 {
+		t.Fatalf("launch arguments: %v", a)
+	}
+
+	msg, _ = s.toAdapter([]byte(`{"seq":4,"type":"request","command":"setBreakpoints","arguments":{"source":{"path":"pkg/util.go"},"breakpoints":[{"line":12}]}}`))
+	if !strings.Contains(string(msg), `"path":"/workspace/pkg/util.go"`) || !strings.Contains(string(msg), `"seq":4`) {
+		t.Fatalf("setBreakpoints: %s", msg)
+	}
+
+	msg = s.toClient([]byte(`{"seq":9,"type":"response","command":"stackTrace","body":{"stackFrames":[{"id":1000,"source":{"path":"/workspace/pkg/util.go"}},{"id":1001,"source":{"path":"/usr/local/go/src/runtime/proc.go"}}]}}`))
+	if !strings.Contains(string(msg), `"path":"pkg/util.go"`) || !strings.Contains(string(msg), `"path":"/usr/local/go/src/runtime/proc.go"`) {
+		t.Fatalf("stackTrace: %s", msg)
+	}
+	msg = s.toClient([]byte(`{"type":"response","command":"loadedSources","body":{"sources":[{"path":"/private/workspace/main.go"}]}}`))
+	if !strings.Contains(string(msg), `"path":"main.go"`) {
+		t.Fatalf("loadedSources: %s", msg)
+	}
+
+	if msg, err := s.toAdapter([]byte(`{"seq":5,"type":"request","command":"attach","arguments":{"processId":1}}`)); err != errDebugAttach || !strings.Contains(string(msg), `"request_seq":5`) {
+		t.Fatalf("attach: %s, %v", msg, err)
+	}
+}
+
+// fakeAdapter answers every DAP request with the arguments it received, and a stack trace in
+// main.py. With APP_PIDFILE it starts a child and writes both process IDs there.
+const fakeAdapter = `import json, os, subprocess, sys
+if os.environ.get("APP_PIDFILE"):
+    child = subprocess.Popen(["sleep", "300"])
+    with open(os.environ["APP_PIDFILE"], "w") as f:
+        f.write("%d %d" % (os.getpid(), child.pid))
+def read():
+    length = None
+    while True:
+        line = sys.stdin.buffer.readline()
+        if not line:
+            sys.exit(0)
+        line = line.strip()
+        if not line and length is not None:
+            return json.loads(sys.stdin.buffer.read(length))
+        if line.startswith(b"Content-Length:"):
+            length = int(line.split(b":")[1])
+def write(m):
+    b = json.dumps(m).encode()
+    sys.stdout.buffer.write(b"Content-Length: %d\r\n\r\n" % len(b) + b)
+    sys.stdout.buffer.flush()
+while True:
+    m = read()
+    body = {"received": json.dumps(m.get("arguments"))}
+    if m["command"] == "stackTrace":
+        body = {"stackFrames": [{"id": 1, "name": "<module>", "line": 1, "source": {"path": os.path.join(os.getcwd(), "main.py")}}]}
+    write({"seq": 1, "type": "response", "request_seq": m["seq"], "command": m["command"], "success": True, "body": body})
+    if m["command"] == "disconnect":
+        sys.exit(0)
+`
+
+func TestDebugSession(t *testing.T) {
+	python := debuggers["python"]
+	debuggers["python"] = debugger{adapter: func() []string { return []string{"python", "-c", fakeAdapter} }, launch: python.launch}
+	t.Cleanup(func() { debuggers["python"] = python })
+	t.Setenv("RUN_ENV_ALLOWLIST", "APP_*")
+
+	tp := mustTierPolicies(t)
+	rs := &runners{mode: "native", queue: newRunQueue("native", tp.weights())}
+	srv := httptest.NewServer(debugHandler(rs, tp, &quotas{store: newMemoryQuotaStore(), now: time.Now}, loadRequestLimits()))
+	defer srv.Close()
+	dial := func(req string) *websocket.Conn {
+		t.Helper()
+		ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/debug", "", srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := websocket.Message.Send(ws, req); err != nil {
+			t.Fatal(err)
+		}
+		return ws
+	}
+	type message struct {
+		Type    string
+		Command string
+		Event   string
+		Body    map[string]any
+	}
+	recv := func(ws *websocket.Conn) message {
+		t.Helper()
+		var m message
+		ws.SetReadDeadline(time.Now().Add(30 * time.Second))
+		if err := websocket.JSON.Receive(ws, &m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	send := func(ws *websocket.Conn, msg string) {
+		t.Helper()
+		if err := websocket.Message.Send(ws, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ws := dial(`{"language":"python","files":{"main.py":"print(1)\n"},"args":["a"]}`)
+	send(ws, `{"seq":1,"type":"request","command":"launch","arguments":{"program":"/etc/passwd","stopOnEntry":true}}`)
+	var launch map[string]any
+	if m := recv(ws); m.Command != "launch" || json.Unmarshal([]byte(m.Body["received"].(string)), &launch) != nil {
+		t.Fatalf("launch: %+v", m)
+	}
+	if p := launch["program"].(string); !filepath.IsAbs(p) || !strings.HasSuffix(p, "/main.py") || launch["stopOnEntry"] != true || launch["args"].([]any)[0] != "a" {
+		t.Fatalf("launch arguments: %v", launch)
+	}
+	send(ws, `{"seq":2,"type":"request","command":"setBreakpoints","arguments":{"source":{"path":"main.py"},"breakpoints":[{"line":1}]}}`)
+	if m := recv(ws); !strings.Contains(m.Body["received"].(string), `"path": "`+filepath.Dir(launch["program"].(string))+`/main.py"`) {
+		t.Fatalf("setBreakpoints: %+v", m)
+	}
+	send(ws, `{"seq":3,"type":"request","command":"stackTrace","arguments":{"threadId":1}}`)
+	if m := recv(ws); m.Body["stackFrames"].([]any)[0].(map[string]any)["source"].(map[string]any)["path"] != "main.py" {
+		t.Fatalf("stackTrace: %+v", m)
+	}
+	send(ws, `{"seq":4,"type":"request","command":"attach","arguments":{"processId":1}}`)
+	if m := recv(ws); m.Command != "attach" {
+		t.Fatalf("attach: %+v", m)
+	}
+	send(ws, `{"seq":5,"type":"request","command":"disconnect"}`)
+	if m := recv(ws); m.Command != "disconnect" {
+		t.Fatalf("disconnect: %+v", m)
+	}
+	// the adapter exited cleanly, so the engine just closes the connection
+	var rest []byte
+	if err := websocket.Message.Receive(ws, &rest); err == nil {
+		t.Fatalf("after disconnect: %s", rest)
+	}
+	ws.Close()
+
+	ws = dial(`{"language":"c","files":{"main.c":"int main( {"}}`)
+	if m := recv(ws); m.Event != "output" || !strings.Contains(m.Body["output"].(string), "Compilation failed") {
+		t.Fatalf("build failure: %+v", m)
+	}
+	if m := recv(ws); m.Event != "terminated" {
+		t.Fatalf("build failure: %+v", m)
+	}
+	ws.Close()
+
+	ws = dial(`{"language":"python","stdin":"x","files":{"main.py":""}}`)
+	if m := recv(ws); m.Event != "output" || !strings.Contains(m.Body["output"].(string), "debug requests take") {
+		t.Fatalf("stdin: %+v", m)
+	}
+	ws.Close()
+
+	t.Setenv("DEBUG_SESSION_SECONDS", "1")
+	ws = dial(`{"language":"python","files":{"main.py":""}}`)
+	if m := recv(ws); m.Event != "output" || m.Body["output"] != "Debug session timed out after 1 seconds\n" {
+		t.Fatalf("timeout: %+v", m)
+	}
+	ws.Close()
+
+	// leaving tears the session down: the adapter and its children are killed
+	t.Setenv("DEBUG_SESSION_SECONDS", "60")
+	pidFile := filepath.Join(t.TempDir(), "pids")
+	ws = dial(`{"language":"python","files":{"main.py":""},"env":{"APP_PIDFILE":"` + pidFile + `"}}`)
+	var pids []int
+	for deadline := time.Now().Add(30 * time.Second); len(pids) < 2 && time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		b, _ := os.ReadFile(pidFile)
+		pids = nil
+		for _, f := range strings.Fields(string(b)) {
+			var pid int
+			if _, err := fmt.Sscan(f, &pid); err == nil {
+				pids = append(pids, pid)
+			}
+		}
+	}
+	if len(pids) < 2 {
+		t.Fatal("the adapter did not start")
+	}
+	ws.Close()
+	for deadline := time.Now().Add(10 * time.Second); (processAlive(pids[0]) || processAlive(pids[1])) && time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if processAlive(pids[0]) || processAlive(pids[1]) {
+		t.Fatalf("processes %v outlived the session", pids)
+	}
+}
+
+func TestDebugHandshake(t *testing.T) {
+	t.Setenv("DEBUG_ALLOWED_ORIGINS", "https://ide.example.com")
+	tp := mustTierPolicies(t)
+	rs := &runners{mode: "native", queue: newRunQueue("native", tp.weights())}
+	h := debugHandler(rs, tp, &quotas{store: newMemoryQuotaStore(), now: time.Now}, loadRequestLimits())
+	srv := httptest.NewServer(protocolTokenMiddleware(authMiddleware("testsecret", h)))
+	defer srv.Close()
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{Subject: "u1", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))}).SignedString([]byte("testsecret"))
+
+	dial := func(origin string, protocols ...string) (*websocket.Conn, error) {
+		config, err := websocket.NewConfig("ws"+strings.TrimPrefix(srv.URL, "http")+"/debug", origin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Protocol = protocols
+		return websocket.DialConfig(config)
+	}
+	// before any session, which would hold the free tier's only concurrent run
+	if _, err := dial("https://evil.example.com", debugProtocol, "bearer."+token); err == nil {
+		t.Fatal("foreign origin accepted")
+	}
+	if _, err := dial("https://ide.example.com", debugProtocol); err == nil {
+		t.Fatal("session without a token accepted")
+	}
+	ws, err := dial("https://ide.example.com", debugProtocol, "bearer."+token)
+	if err != nil {
+		t.Fatalf("allowed origin: %v", err)
+	}
+	if p := ws.Config().Protocol; len(p) != 1 || p[0] != debugProtocol {
+		t.Fatalf("selected protocols %v", p)
+	}
+	ws.Close()
+}
+
+// processAlive reports whether a process exists and is not a zombie, on Linux.
+func processAlive(pid int) bool {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	_, state, _ := strings.Cut(string(b), ") ")
+	return !strings.HasPrefix(state, "Z")
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	depsCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: "coderipper", Name: "deps_cache_requests_total", Help: "Dependency layer lookups by ecosystem and outcome (hit, miss, error)"}, []string{"ecosystem", "result"})
+	depsCacheBytes    = prometheus.NewGauge(prometheus.GaugeOpts{Namespace: "coderipper", Name: "deps_cache_bytes", Help: "Size of cached dependency layers"})
+)
+
+func init() {
+	prometheus.MustRegister(depsCacheRequests, depsCacheBytes)
+}
+
+// depsEcosystem describes how the dependencies declared by one package manager's manifest are
+// installed into a layer on the engine host, from a mirror, and used from a sandbox that has
+// no network.
+type depsEcosystem struct {
+	manifest  string   // file at the submission root that declares dependencies
+	locks     []string // files installed together with the manifest, if present
+	languages []string // languages whose default pipeline uses the manifest
+	mirrorEnv string   // variable holding the mirror URL
+	version   []string // command printing the installer version, part of the layer key
+	// check rejects manifests that would make the installer fetch from anywhere but the mirror
+	// or run code from the submission
+	check func(files map[string]string) error
+	// stubs returns submission files the installer needs to exist, such as Cargo targets. They
+	// are written empty: installers only see the manifest files, never package manager
+	// configuration such as .npmrc or .cargo/config.toml that would override the mirror.
+	stubs func(submission map[string]string) []string
+	// prepare writes configuration into the layer before install, if needed
+	prepare func(layer, mirror string) error
+	// install returns the command, run in a copy of the submission, that fills layer
+	install func(layer, mirror string) (argv, env []string)
+	// produces is a directory install creates in the submission copy, moved into the layer
+	produces string
+	// env returns the variables that make a sandbox use the layer mounted at root
+	env func(root string) []string
+	// link is a directory of the layer that is linked into the workspace under the same name
+	link string
+}
+
+var depsEcosystems = map[string]*depsEcosystem{
+	"python": {
+		manifest:  "requirements.txt",
+		languages: []string{"python"},
+		mirrorEnv: "DEPS_PIP_INDEX_URL",
+		version:   []string{"python", "--version"},
+		check:     checkRequirements,
+		install: func(layer, mirror string) ([]string, []string) {
+			// wheels only: building an sdist would run its setup.py on the engine host
+			argv := []string{"python", "-m", "pip", "install", "--no-input", "--disable-pip-version-check", "--no-cache-dir", "--progress-bar", "off",
+				"--only-binary=:all:", "--index-url", mirror, "--target", filepath.Join(layer, "site-packages"), "-r", "requirements.txt"}
+			return append(argv, strings.Fields(os.Getenv("DEPS_PIP_ARGS"))...), nil
+		},
+		env: func(root string) []string { return []string{"PYTHONPATH=" + root + "/site-packages"} },
+	},
+	"node": {
+		manifest:  "package.json",
+		locks:     []string{"package-lock.json"},
+		languages: []string{"javascript", "typescript"},
+		mirrorEnv: "DEPS_NPM_REGISTRY",
+		version:   []string{"npm", "--version"},
+		check:     checkPackageJSON,
+		install: func(layer, mirror string) ([]string, []string) {
+			return []string{"npm", "install", "--ignore-scripts", "--no-audit", "--no-fund", "--no-update-notifier", "--registry", mirror,
+				"--cache", ".npm-cache"}, nil
+		},
+		produces: "node_modules",
+		env:      func(string) []string { return nil },
+		link:     "node_modules",
+	},
+	"go": {
+		manifest:  "go.mod",
+		locks:     []string{"go.sum"},
+		languages: []string{"go"},
+		mirrorEnv: "DEPS_GOPROXY",
+		version:   []string{"go", "version"},
+		check:     checkGoMod,
+		install: func(layer, mirror string) ([]string, []string) {
+			// no ",direct": modules the mirror lacks are not fetched from their origin
+			return []string{"go", "mod", "download"}, []string{"GOMODCACHE=" + filepath.Join(layer, "mod"), "GOPROXY=" + mirror,
+				"GOFLAGS=-modcacherw -mod=mod", "GONOPROXY=", "GOPRIVATE=", "GOSUMDB=off", "GOTOOLCHAIN=local", "GOWORK=off"}
+		},
+		env: func(root string) []string {
+			return []string{"GOMODCACHE=" + root + "/mod", "GOFLAGS=-mod=mod", "GOPROXY=off", "GOSUMDB=off", "GOTOOLCHAIN=local"}
+		},
+	},
+	"rust": {
+		manifest:  "Cargo.toml",
+		locks:     []string{"Cargo.lock"},
+		languages: []string{"rust"},
+		mirrorEnv: "DEPS_CARGO_REGISTRY",
+		version:   []string{"cargo", "--version"},
+		check:     checkCargo,
+		stubs:     rustSources,
+		prepare: func(layer, mirror string) error {
+			// the layer is CARGO_HOME, so builds in the sandbox see the same source replacement
+			if !strings.HasPrefix(mirror, "sparse+") {
+				mirror = "sparse+" + mirror
+			}
+			config := fmt.Sprintf("[source.crates-io]\nreplace-with = \"mirror\"\n\n[source.mirror]\nregistry = %q\n", mirror)
+			if err := os.MkdirAll(filepath.Join(layer, "cargo"), 0755); err != nil {
+				return err
+			}
+			return os.WriteFile(filepath.Join(layer, "cargo", "config.toml"), []byte(config), 0644)
+		},
+		install: func(layer, _ string) ([]string, []string) {
+			return []string{"cargo", "fetch"}, []string{"CARGO_HOME=" + filepath.Join(layer, "cargo")}
+		},
+		env: func(root string) []string { return []string{"CARGO_HOME=" + root + "/cargo", "CARGO_NET_OFFLINE=true"} },
+	},
+}
+
+// requirementLine is one requirement specifier: a name with optional extras, version
+// constraints and environment marker. URLs, paths and pip options are not allowed.
+var requirementLine = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*(\[[A-Za-z0-9._, -]+\])?\s*((===?|[<>!~]=|[<>])\s*[A-Za-z0-9.*+!-]+\s*(,\s*(===?|[<>!~]=|[<>])\s*[A-Za-z0-9.*+!-]+\s*)*)?(;[A-Za-z0-9_.<>=!~'" ()-]*)?$`)
+
+// requirementHash matches the hash options pip-compile adds to pinned requirements.
+var requirementHash = regexp.MustCompile(`\s+--hash=sha256:[0-9a-f]{64}`)
+
+func checkRequirements(files map[string]string) error {
+	text := strings.ReplaceAll(files["requirements.txt"], "\\\n", " ")
+	for i, line := range strings.Split(text, "\n") {
+		if c := strings.Index(line, "#"); c >= 0 {
+			line = line[:c]
+		}
+		line = strings.TrimSpace(requirementHash.ReplaceAllString(line, ""))
+		if line != "" && !requirementLine.MatchString(line) {
+			return fmt.Errorf("requirements.txt line %d: only package names with version constraints are supported, not %q", i+1, line)
+		}
+	}
+	return nil
+}
+
+var (
+	npmName  = regexp.MustCompile(`^(@[a-z0-9][a-z0-9._-]*/)?[a-z0-9][a-z0-9._-]*$`)
+	npmRange = regexp.MustCompile(`^[0-9A-Za-z.^~<>=|*+ -]*$`)
+)
+
+// checkPackageJSON allows registry dependencies only, so npm never fetches git, file or URL
+// specs, and a lock file may only point at the public registry, which npm maps to the mirror.
+func checkPackageJSON(files map[string]string) error {
+	var pkg map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(files["package.json"]), &pkg); err != nil {
+		return fmt.Errorf("package.json: %w", err)
+	}
+	for _, section := range []string{"dependencies", "devDependencies", "optionalDependencies", "peerDependencies"} {
+		var deps map[string]string
+		if raw, ok := pkg[section]; ok {
+			if err := json.Unmarshal(raw, &deps); err != nil {
+				return fmt.Errorf("package.json %s: %w", section, err)
+			}
+		}
+		for name, spec := range deps {
+			if !npmName.MatchString(name) || !npmRange.MatchString(spec) {
+				return fmt.Errorf("package.json %s: %q: only registry packages with version ranges are supported, not %q", section, name, spec)
+			}
+		}
+	}
+	if lock, ok := files["package-lock.json"]; ok {
+		for _, m := range regexp.MustCompile(`"resolved"\s*:\s*"([^"]*)"`).FindAllStringSubmatch(lock, -1) {
+			if !strings.HasPrefix(m[1], "https://registry.npmjs.org/") {
+				return fmt.Errorf("package-lock.json: %q is not a registry package", m[1])
+			}
+		}
+		if regexp.MustCompile(`"link"\s*:\s*true`).MatchString(lock) {
+			return errors.New("package-lock.json: linked packages are not supported")
+		}
+	}
+	return nil
+}
+
+// localReplace matches a go.mod replace directive that points at a directory.
+var localReplace = regexp.MustCompile(`=>\s*(\.|/)`)
+
+func checkGoMod(files map[string]string) error {
+	for i, line := range strings.Split(files["go.mod"], "\n") {
+		if localReplace.MatchString(line) {
+			return fmt.Errorf("go.mod line %d: replacements with local directories are not supported", i+1)
+		}
+	}
+	return nil
+}
+
+var (
+	cargoSource    = regexp.MustCompile(`\b(git|path|registry|registry-index)\s*=`)
+	cargoLockEntry = regexp.MustCompile(`(?m)^source = "([^"]*)"`)
+)
+
+// rustSources lists the Rust files of a submission, from which cargo discovers its targets.
+func rustSources(submission map[string]string) []string {
+	var names []string
+	for name := range submission {
+		if strings.HasSuffix(name, ".rs") {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func checkCargo(files map[string]string) error {
+	for i, line := range strings.Split(files["Cargo.toml"], "\n") {
+		if cargoSource.MatchString(line) {
+			return fmt.Errorf("Cargo.toml line %d: only crates.io dependencies are supported", i+1)
+		}
+	}
+	for _, m := range cargoLockEntry.FindAllStringSubmatch(files["Cargo.lock"], -1) {
+		if m[1] != "registry+https://github.com/rust-lang/crates.io-index" && m[1] != "sparse+https://index.crates.io/" {
+			return fmt.Errorf("Cargo.lock: source %q is not crates.io", m[1])
+		}
+	}
+	return nil
+}
+
+// depsLayer is an installed set of dependencies on the engine host.
+type depsLayer struct {
+	ecosystem string
+	path      string // directory in the dependency cache
+}
+
+// depsMount is where a sandbox mounts a layer.
+func (l depsLayer) mount() string { return "/deps/" + l.ecosystem }
+
+// depsEnv returns the variables that point a sandbox at its layers. hostPaths is set for
+// native mode, which uses the layers where they are.
+func depsEnv(layers []depsLayer, hostPaths bool) []string {
+	var env []string
+	for _, l := range layers {
+		root := l.mount()
+		if hostPaths {
+			root = filepath.ToSlash(l.path)
+		}
+		env = append(env, depsEcosystems[l.ecosystem].env(root)...)
+	}
+	return env
+}
+
+// depsLinks returns shell commands that link layer directories into the workspace, unless
+// the submission has its own.
+func depsLinks(layers []depsLayer) string {
+	var b strings.Builder
+	for _, l := range layers {
+		if link := depsEcosystems[l.ecosystem].link; link != "" {
+			fmt.Fprintf(&b, "[ -e %[2]s/%[3]s ] || ln -s %[1]s/%[3]s %[2]s/%[3]s\n", l.mount(), workspaceDir, link)
+		}
+	}
+	return b.String()
+}
+
+// linkDeps links layer directories into a workspace on the host, unless the submission has
+// its own.
+func linkDeps(layers []depsLayer, dir string) error {
+	for _, l := range layers {
+		link := depsEcosystems[l.ecosystem].link
+		if link == "" {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(dir, link)); err == nil {
+			continue
+		}
+		if err := os.Symlink(filepath.Join(l.path, link), filepath.Join(dir, link)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// depsResolver installs the dependencies of submissions from admin-configured mirrors into
+// layers keyed by the hash of the manifest files, installer version and mirror. Sandboxes
+// mount the layers read-only, so runners never need network access. Layers can also be
+// pre-baked into the cache directory, e.g. on a shared volume.
+type depsResolver struct {
+	cache   *buildCache
+	mirrors map[string]string // mirror URL by ecosystem
+	timeout time.Duration
+	locks   sync.Map // *sync.Mutex by layer key, so a layer is installed once
+}
+
+// newDepsResolver opens the dependency cache in DEPS_CACHE_DIR (default: coderipper/deps in
+// the user cache dir), bounded to DEPS_CACHE_MAX_MB (4096). DEPS_CACHE_DIR=off disables
+// dependency installation.
+func newDepsResolver() *depsResolver {
+	cache := openCacheDir(os.Getenv("DEPS_CACHE_DIR"), "deps", int64(envInt("DEPS_CACHE_MAX_MB", 4096))<<20, depsCacheBytes)
+	if cache == nil {
+		return nil
+	}
+	dr := &depsResolver{cache: cache, mirrors: map[string]string{}, timeout: time.Duration(envInt("DEPS_INSTALL_TIMEOUT_SECONDS", 300)) * time.Second}
+	for name, eco := range depsEcosystems {
+		if m := os.Getenv(eco.mirrorEnv); m != "" {
+			dr.mirrors[name] = m
+		}
+	}
+	return dr
+}
+
+// depsError is an installation that failed, with the installer's output.
+type depsError struct {
+	ecosystem string
+	output    string
+}
+
+func (e *depsError) Error() string { return e.ecosystem + " dependency installation failed" }
+
+// resolve returns the layers for the manifests of a submission, installing missing ones.
+// Manifests are used by the matching language, or by any custom pipeline. An ecosystem with
+// no mirror and no cached layer is skipped, leaving the runner image's own packages.
+func (dr *depsResolver) resolve(req RunRequest) ([]depsLayer, error) {
+	var layers []depsLayer
+	for _, name := range sortedKeys(depsEcosystems) {
+		eco := depsEcosystems[name]
+		if _, ok := req.Files[eco.manifest]; !ok || (len(req.Steps) == 0 && !containsString(eco.languages, canonicalLanguage(req.Language))) {
+			continue
+		}
+		files := map[string]string{eco.manifest: req.Files[eco.manifest]}
+		for _, lock := range eco.locks {
+			if content, ok := req.Files[lock]; ok {
+				files[lock] = content
+			}
+		}
+		if err := eco.check(files); err != nil {
+			return nil, invalid("%v", err)
+		}
+		if eco.stubs != nil {
+			for _, stub := range eco.stubs(req.Files) {
+				files[stub] = ""
+			}
+		}
+		path, err := dr.layer(name, eco, files)
+		if err != nil {
+			depsCacheRequests.WithLabelValues(name, "error").Inc()
+			return nil, err
+		}
+		if path != "" {
+			layers = append(layers, depsLayer{ecosystem: name, path: path})
+		}
+	}
+	return layers, nil
+}
+
+// layer returns the cached layer for the manifest files, installing it on a miss. It returns
+// "" if the layer is not cached and there is no mirror to install it from. The installer sees
+// files only, all of which are part of the layer key.
+func (dr *depsResolver) layer(name string, eco *depsEcosystem, files map[string]string) (string, error) {
+	mirror := dr.mirrors[name]
+	key := dr.key(name, eco, mirror, files)
+	mu, _ := dr.locks.LoadOrStore(key, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+	if path, ok := dr.cache.lookup(key); ok {
+		depsCacheRequests.WithLabelValues(name, "hit").Inc()
+		return path, nil
+	}
+	if mirror == "" {
+		return "", nil
+	}
+	depsCacheRequests.WithLabelValues(name, "miss").Inc()
+
+	work, err := os.MkdirTemp("", "coderipper-deps-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(work)
+	if _, err := writeSubmissionFiles(work, files); err != nil {
+		return "", err
+	}
+	layer, err := os.MkdirTemp(dr.cache.dir, key+".tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(layer)
+	if eco.prepare != nil {
+		if err := eco.prepare(layer, mirror); err != nil {
+			return "", err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dr.timeout)
+	defer cancel()
+	argv, env := eco.install(layer, mirror)
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = work
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		return "", &depsError{ecosystem: name, output: fmt.Sprintf("%s\ntimed out after %v", out, dr.timeout)}
+	case errors.As(err, &exitErr):
+		return "", &depsError{ecosystem: name, output: string(out)}
+	case err != nil:
+		return "", fmt.Errorf("run %s: %w", argv[0], err)
+	}
+	if eco.produces != "" {
+		if err := os.Rename(filepath.Join(work, eco.produces), filepath.Join(layer, eco.produces)); err != nil {
+			return "", err
+		}
+	}
+	if err := dr.cache.add(key, layer); err != nil {
+		return "", err
+	}
+	path, _ := dr.cache.lookup(key)
+	return path, nil
+}
+
+// key hashes everything that affects a layer.
+func (dr *depsResolver) key(name string, eco *depsEcosystem, mirror string, files map[string]string) string {
+	version, ok := dr.cache.versions.Load(name)
+	if !ok {
+		out, _ := exec.Command(eco.version[0], eco.version[1:]...).CombinedOutput()
+		first, _, _ := strings.Cut(string(out), "\n")
+		version = strings.TrimSpace(first)
+		dr.cache.versions.Store(name, version)
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00", name, version, mirror, os.Getenv("DEPS_PIP_ARGS"))
+	for _, f := range sortedKeys(files) {
+		fmt.Fprintf(h, "%s\x00%d\x00%s", f, len(files[f]), files[f])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// logConfig reports the configured mirrors at startup.
+func (dr *depsResolver) logConfig() {
+	log.Printf("dependency cache dir=%s mirrors=%v", dr.cache.dir, sortedKeys(dr.mirrors))
+}
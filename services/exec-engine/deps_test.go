@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestManifestChecks(t *testing.T) {
+	cases := []struct {
+		ecosystem string
+		files     map[string]string
+		ok        bool
+	}{
+		{"python", map[string]string{"requirements.txt": "# pinned\nnumpy==1.26.4\nrequests[socks] >=2.31, <3 ; python_version >= '3.8'\nattrs\n"}, true},
+		{"python", map[string]string{"requirements.txt": "six==1.16.0 \\\n    --hash=sha256:" + strings.Repeat("a", 64) + "\n"}, true},
+		{"python", map[string]string{"requirements.txt": "-e git+https://example.com/x.git#egg=x\n"}, false},
+		{"python", map[string]string{"requirements.txt": "--extra-index-url https://example.com/simple\nx\n"}, false},
+		{"python", map[string]string{"requirements.txt": "x @ https://example.com/x.whl\n"}, false},
+		{"python", map[string]string{"requirements.txt": "./local_pkg\n"}, false},
+		{"node", map[string]string{"package.json": `{"name":"app","dependencies":{"lodash":"^4.17.21","@types/node":"20.x"}}`}, true},
+		{"node", map[string]string{"package.json": `{"dependencies":{"x":"git+https://example.com/x.git"}}`}, false},
+		{"node", map[string]string{"package.json": `{"dependencies":{"x":"file:../x"}}`}, false},
+		{"node", map[string]string{"package.json": `{"dependencies":{"x":"1.0.0"}}`, "package-lock.json": `{"packages":{"node_modules/x":{"resolved":"https://evil.example/x.tgz"}}}`}, false},
+		{"go", map[string]string{"go.mod": "module app\n\ngo 1.21\n\nrequire github.com/google/uuid v1.6.0\n"}, true},
+		{"go", map[string]string{"go.mod": "module app\n\nreplace example.com/x => ../x\n"}, false},
+		{"rust", map[string]string{"Cargo.toml": "[package]\nname = \"app\"\n\n[dependencies]\nserde = { version = \"1\", features = [\"derive\"] }\n"}, true},
+		{"rust", map[string]string{"Cargo.toml": "[dependencies]\nx = { git = \"https://example.com/x\" }\n"}, false},
+		{"rust", map[string]string{"Cargo.toml": "[dependencies]\nx = \"1\"\n", "Cargo.lock": "[[package]]\nname = \"x\"\nsource = \"git+https://example.com/x#abc\"\n"}, false},
+	}
+	for i, c := range cases {
+		if err := depsEcosystems[c.ecosystem].check(c.files); (err == nil) != c.ok {
+			t.Errorf("case %d (%s): err = %v", i, c.ecosystem, err)
+		}
+	}
+}
+
+func TestDepsResolverInstallsOnce(t *testing.T) {
+	if _, err := exec.LookPath("python"); err != nil {
+		t.Skip("python not installed")
+	}
+	t.Setenv("DEPS_CACHE_DIR", t.TempDir())
+	t.Setenv("DEPS_PIP_INDEX_URL", "http://mirror.invalid/simple")
+	// stand-in for pip: installs a "greeting" module, fails for anything else and when it sees
+	// more than the manifest
+	orig := depsEcosystems["python"]
+	fake := *orig
+	fake.install = func(layer, _ string) ([]string, []string) {
+		return []string{"/bin/sh", "-c", `[ "$(ls -A)" = requirements.txt ] || { echo "installer saw: $(ls -A)" >&2; exit 1; }
+grep -qx 'greeting==1.0' requirements.txt || { echo 'No matching distribution' >&2; exit 1; }
+mkdir -p "$0/site-packages" && echo 'print("hi from " + __name__)' > "$0/site-packages/greeting.py"`, layer}, nil
+	}
+	depsEcosystems["python"] = &fake
+	t.Cleanup(func() { depsEcosystems["python"] = orig })
+
+	rs := &runners{mode: "native", deps: newDepsResolver()}
+	req := RunRequest{Language: "python", Files: map[string]string{"main.py": "import greeting", "requirements.txt": "greeting==1.0\n", "pip.conf": "[global]\nindex-url = http://attacker.invalid/\n"}, TimeLimit: 5}
+	misses := testutil.ToFloat64(depsCacheRequests.WithLabelValues("python", "miss"))
+	hits := testutil.ToFloat64(depsCacheRequests.WithLabelValues("python", "hit"))
+	for i := 0; i < 2; i++ {
+		if res, _ := rs.execute(req, defaultTier); !res.Success || res.Stdout != "hi from greeting\n" {
+			t.Fatalf("run %d: %+v", i, res)
+		}
+	}
+	if testutil.ToFloat64(depsCacheRequests.WithLabelValues("python", "miss"))-misses != 1 || testutil.ToFloat64(depsCacheRequests.WithLabelValues("python", "hit"))-hits != 1 {
+		t.Fatal("expected one install and one cache hit")
+	}
+
+	req.Files = map[string]string{"main.py": "import greeting", "requirements.txt": "missing==2.0\n"}
+	if res, _ := rs.execute(req, defaultTier); res.Success || !res.InfraError || !strings.Contains(res.Stderr, "No matching distribution") {
+		t.Fatalf("failed install: %+v", res)
+	}
+	req.Files = map[string]string{"main.py": "print(1)", "requirements.txt": "-r other.txt\n"}
+	if res, _ := rs.execute(req, defaultTier); res.Success || res.InfraError || !strings.Contains(res.Stderr, "requirements.txt line 1") {
+		t.Fatalf("unsafe manifest: %+v", res)
+	}
+
+	// without a mirror, uncached manifests are left to the runner image
+	t.Setenv("DEPS_PIP_INDEX_URL", "")
+	rs.deps = newDepsResolver()
+	req.Files = map[string]string{"main.py": "print(1)", "requirements.txt": "other==1.0\n"}
+	if res, _ := rs.execute(req, defaultTier); !res.Success || res.Stdout != "1\n" {
+		t.Fatalf("no mirror: %+v", res)
+	}
+}
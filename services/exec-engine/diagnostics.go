@@ -0,0 +1,530 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Diagnostic is a compiler error, warning or runtime exception located in a submission file,
+// for editor markers. Lines and columns are 1-based; Column is 0 when the tool gives none.
+type Diagnostic struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"` // error, warning or info
+	// Code is the tool's identifier: a compiler error code or warning flag, or an exception type
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+const maxDiagnostics = 100
+
+// submissionPaths maps a path printed by a tool to a submission file name. Tools print paths
+// relative to the workspace or absolute under one of roots (the workspace of the backend);
+// anything else, such as library frames, has no file.
+type submissionPaths func(p string) (string, bool)
+
+func newSubmissionPaths(files map[string]string, roots []string) submissionPaths {
+	return func(p string) (string, bool) {
+		p = strings.TrimPrefix(p, "./")
+		if _, ok := files[p]; ok {
+			return p, true
+		}
+		for _, root := range roots {
+			if root == "" {
+				continue
+			}
+			if rel, ok := strings.CutPrefix(p, strings.TrimSuffix(root, "/")+"/"); ok {
+				if _, ok := files[rel]; ok {
+					return rel, true
+				}
+			}
+		}
+		return "", false
+	}
+}
+
+// diagnosticParser finds diagnostics in the lines of one step's output.
+type diagnosticParser func(lines []string, at submissionPaths, files map[string]string) []Diagnostic
+
+var diagnosticParsers = map[string][]diagnosticParser{
+	"c":          {parseGCC},
+	"cpp":        {parseGCC},
+	"go":         {parseGo, parseGoPanic},
+	"rust":       {parseRustc, parseRustPanic},
+	"java":       {parseJavac, parseJavaException},
+	"python":     {parsePythonTraceback, parsePythonWarning, parseMypy},
+	"javascript": {parseNodeError},
+	"typescript": {parseTSC, parseNodeError},
+	"ruby":       {parseRuby},
+	"php":        {parsePHP},
+	"bash":       {parseBash},
+}
+
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*[A-Za-z]`)
+
+// stepDiagnostics parses the output of steps with the parsers of the request's language. Run
+// and format steps only have their stderr parsed, so program output or formatted source cannot
+// produce markers by accident.
+// Duplicates, e.g. an error printed by two steps, are reported once.
+func stepDiagnostics(req RunRequest, steps []StepResult, roots ...string) []Diagnostic {
+	parsers := diagnosticParsers[canonicalLanguage(req.Language)]
+	if len(parsers) == 0 {
+		return nil
+	}
+	at := newSubmissionPaths(req.Files, roots)
+	var out []Diagnostic
+	seen := map[Diagnostic]bool{}
+	for _, s := range steps {
+		text := s.Stderr
+		if s.Name != "run" && s.Name != "warmup" && s.Name != "format" {
+			text = s.Stdout + "\n" + s.Stderr
+		}
+		lines := strings.Split(ansiEscape.ReplaceAllString(strings.ReplaceAll(text, "\r\n", "\n"), ""), "\n")
+		for _, parse := range parsers {
+			for _, d := range parse(lines, at, req.Files) {
+				if !seen[d] && len(out) < maxDiagnostics {
+					seen[d] = true
+					out = append(out, d)
+				}
+			}
+		}
+	}
+	return out
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// caretColumn returns the 1-based column of the first ^ or ~ marker in line, or 0 when line is
+// not a marker line.
+func caretColumn(line string) int {
+	if !caretLine.MatchString(line) {
+		return 0
+	}
+	return strings.IndexAny(line, "^~") + 1
+}
+
+var caretLine = regexp.MustCompile(`^\s*[~^][~^ ]*$`)
+
+var gccDiagnostic = regexp.MustCompile(`^(.+?):(\d+):(\d+): (fatal error|error|warning|note): (.*?)(?: \[(-W[^\]]+)\])?$`)
+
+// parseGCC reads gcc and g++ (and clang) diagnostics, e.g.
+// "main.c:3:5: warning: unused variable 'x' [-Wunused-variable]".
+func parseGCC(lines []string, at submissionPaths, _ map[string]string) []Diagnostic {
+	var out []Diagnostic
+	for _, l := range lines {
+		m := gccDiagnostic.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		file, ok := at(m[1])
+		if !ok {
+			continue
+		}
+		sev := m[4]
+		switch sev {
+		case "fatal error":
+			sev = "error"
+		case "note":
+			sev = "info"
+		}
+		out = append(out, Diagnostic{File: file, Line: atoi(m[2]), Column: atoi(m[3]), Severity: sev, Code: m[6], Message: m[5]})
+	}
+	return out
+}
+
+var goDiagnostic = regexp.MustCompile(`^(?:vet: )?(\S+\.go):(\d+)(?::(\d+))?: (.*)$`)
+
+// parseGo reads go build and go vet errors, e.g. "./main.go:5:2: declared and not used: x".
+func parseGo(lines []string, at submissionPaths, _ map[string]string) []Diagnostic {
+	var out []Diagnostic
+	for _, l := range lines {
+		m := goDiagnostic.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		if file, ok := at(m[1]); ok {
+			out = append(out, Diagnostic{File: file, Line: atoi(m[2]), Column: atoi(m[3]), Severity: "error", Message: m[4]})
+		}
+	}
+	return out
+}
+
+var (
+	goPanic = regexp.MustCompile(`^(panic|fatal error): (.*)$`)
+	goFrame = regexp.MustCompile(`^\t(\S+\.go):(\d+)(?: \+0x[0-9a-f]+)?$`)
+)
+
+// parseGoPanic locates a panic at the innermost stack frame in the submission.
+func parseGoPanic(lines []string, at submissionPaths, _ map[string]string) []Diagnostic {
+	for i, l := range lines {
+		m := goPanic.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		for _, f := range lines[i+1:] {
+			fm := goFrame.FindStringSubmatch(f)
+			if fm == nil {
+				continue
+			}
+			if file, ok := at(fm[1]); ok {
+				return []Diagnostic{{File: file, Line: atoi(fm[2]), Severity: "error", Code: m[1], Message: l}}
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+var (
+	rustHeader   = regexp.MustCompile(`^(error|warning)(?:\[(\w+)\])?: (.*)$`)
+	rustLocation = regexp.MustCompile(`^\s*--> (.+):(\d+):(\d+)$`)
+)
+
+// parseRustc reads rustc diagnostics: a header such as "error[E0425]: cannot find value `y`"
+// followed by a " --> main.rs:3:20" location. Summaries without a location are dropped.
+func parseRustc(lines []string, at submissionPaths, _ map[string]string) []Diagnostic {
+	var out []Diagnostic
+	var header []string
+	for _, l := range lines {
+		if m := rustHeader.FindStringSubmatch(l); m != nil {
+			header = m
+			continue
+		}
+		m := rustLocation.FindStringSubmatch(l)
+		if m == nil || header == nil {
+			continue
+		}
+		if file, ok := at(m[1]); ok {
+			out = append(out, Diagnostic{File: file, Line: atoi(m[2]), Column: atoi(m[3]), Severity: header[1], Code: header[2], Message: header[3]})
+		}
+		header = nil
+	}
+	return out
+}
+
+var rustPanic = regexp.MustCompile(`^thread '.*' panicked at (?:'(.*)', )?(.+?):(\d+):(\d+):?$`)
+
+// parseRustPanic reads "thread 'main' panicked at main.rs:4:5:" with the message on the next
+// line, or the older form with the message quoted before the location.
+func parseRustPanic(lines []string, at submissionPaths, _ map[string]string) []Diagnostic {
+	for i, l := range lines {
+		m := rustPanic.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		file, ok := at(m[2])
+		if !ok {
+			return nil
+		}
+		msg := m[1]
+		if msg == "" && i+1 < len(lines) {
+			msg = lines[i+1]
+		}
+		return []Diagnostic{{File: file, Line: atoi(m[3]), Column: atoi(m[4]), Severity: "error", Code: "panic", Message: msg}}
+	}
+	return nil
+}
+
+var javacDiagnostic = regexp.MustCompile(`^(.+\.java):(\d+): (error|warning): (.*)$`)
+
+// parseJavac reads javac diagnostics. The column comes from the caret under the quoted source
+// line, and detail lines such as "  symbol:   variable y" are appended to the message.
+func parseJavac(lines []string, at submissionPaths, _ map[string]string) []Diagnostic {
+	var out []Diagnostic
+	for i, l := range lines {
+		m := javacDiagnostic.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		file, ok := at(m[1])
+		if !ok {
+			continue
+		}
+		d := Diagnostic{File: file, Line: atoi(m[2]), Severity: m[3], Message: m[4]}
+		if i+2 < len(lines) {
+			d.Column = caretColumn(lines[i+2])
+		}
+		for j := i + 3; d.Column > 0 && j < len(lines) && strings.HasPrefix(lines[j], "  ") && !javacDiagnostic.MatchString(lines[j]); j++ {
+			d.Message += "\n" + strings.TrimSpace(lines[j])
+		}
+		out = append(out, d)
+	}
+	return out
+}
+
+var (
+	javaException = regexp.MustCompile(`^Exception in thread "[^"]*" ([\w.$]+)(?:: (.*))?$`)
+	javaFrame     = regexp.MustCompile(`^\s+at ([\w.$]+)\.[\w$<>]+\(([\w$]+\.java):(\d+)\)$`)
+)
+
+// parseJavaException locates an uncaught exception at the innermost frame in the submission.
+// Frames only name the source file, so the directory comes from the class's package.
+func parseJavaException(lines []string, at submissionPaths, _ map[string]string) []Diagnostic {
+	for i, l := range lines {
+		m := javaException.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		msg := m[1]
+		if m[2] != "" {
+			msg += ": " + m[2]
+		}
+		for _, f := range lines[i+1:] {
+			fm := javaFrame.FindStringSubmatch(f)
+			if fm == nil {
+				continue
+			}
+			pkg := path.Dir(strings.ReplaceAll(fm[1], ".", "/"))
+			if file, ok := at(path.Join(pkg, fm[2])); ok {
+				return []Diagnostic{{File: file, Line: atoi(fm[3]), Severity: "error", Code: m[1], Message: msg}}
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+var (
+	pythonFrame     = regexp.MustCompile(`^\s*File "(.+)", line (\d+)`)
+	pythonException = regexp.MustCompile(`^([A-Za-z_][\w.]*)(?:: (.*))?$`)
+	pythonWarning   = regexp.MustCompile(`^(.+\.py):(\d+): (\w+Warning): (.*)$`)
+)
+
+// parsePythonTraceback locates the exception that ended a traceback at its innermost frame in
+// the submission. Syntax errors have a single frame and a caret under the offending token.
+func parsePythonTraceback(lines []string, at submissionPaths, files map[string]string) []Diagnostic {
+	var out []Diagnostic
+	var frame *Diagnostic
+	inTrace := false
+	for i, l := range lines {
+		if m := pythonFrame.FindStringSubmatch(l); m != nil {
+			inTrace = true
+			if file, ok := at(m[1]); ok {
+				frame = &Diagnostic{File: file, Line: atoi(m[2])}
+				// the source line follows dedented by Python, then an optional marker line
+				if i+2 < len(lines) {
+					if col := caretColumn(lines[i+2]); col > 0 {
+						code := lines[i+1]
+						frame.Column = col - (len(code) - len(strings.TrimLeft(code, " "))) + sourceIndent(files[file], frame.Line)
+					}
+				}
+			}
+			continue
+		}
+		if !inTrace || l == "" || strings.HasPrefix(l, " ") || strings.HasPrefix(l, "Traceback") {
+			continue
+		}
+		inTrace = false
+		m := pythonException.FindStringSubmatch(l)
+		if m == nil || frame == nil {
+			frame = nil
+			continue
+		}
+		frame.Severity, frame.Code, frame.Message = "error", m[1], l
+		out = append(out, *frame)
+		frame = nil
+	}
+	if len(out) > 1 {
+		// chained exceptions: the last one is what ended the program
+		out = out[len(out)-1:]
+	}
+	return out
+}
+
+// sourceIndent returns the leading whitespace width of a 1-based line of src.
+func sourceIndent(src string, line int) int {
+	lines := strings.Split(src, "\n")
+	if line < 1 || line > len(lines) {
+		return 0
+	}
+	return len(lines[line-1]) - len(strings.TrimLeft(lines[line-1], " \t"))
+}
+
+// parsePythonWarning reads warnings printed by the warnings module, e.g.
+// "main.py:3: DeprecationWarning: ...".
+func parsePythonWarning(lines []string, at submissionPaths, _ map[string]string) []Diagnostic {
+	var out []Diagnostic
+	for _, l := range lines {
+		m := pythonWarning.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		if file, ok := at(m[1]); ok {
+			out = append(out, Diagnostic{File: file, Line: atoi(m[2]), Severity: "warning", Code: m[3], Message: m[4]})
+		}
+	}
+	return out
+}
+
+var mypyDiagnostic = regexp.MustCompile(`^(.+\.pyi?):(\d+)(?::(\d+))?: (error|warning|note): (.*?)(?:  \[([\w-]+)\])?$`)
+
+// parseMypy reads mypy output, e.g. `main.py:3:5: error: Incompatible types ...  [assignment]`.
+func parseMypy(lines []string, at submissionPaths, _ map[string]string) []Diagnostic {
+	var out []Diagnostic
+	for _, l := range lines {
+		m := mypyDiagnostic.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		file, ok := at(m[1])
+		if !ok {
+			continue
+		}
+		sev := m[4]
+		if sev == "note" {
+			sev = "info"
+		}
+		out = append(out, Diagnostic{File: file, Line: atoi(m[2]), Column: atoi(m[3]), Severity: sev, Code: m[6], Message: m[5]})
+	}
+	return out
+}
+
+var (
+	nodeError    = regexp.MustCompile(`^(?:Uncaught )?([A-Z]\w*Error|Error|[A-Z]\w*Exception)(?:: (.*))?$`)
+	nodeFrame    = regexp.MustCompile(`^\s+at (?:.*? \()?(.+?):(\d+):(\d+)\)?$`)
+	nodeLocation = regexp.MustCompile(`^(.+?):(\d+)$`)
+)
+
+// parseNodeError locates an uncaught Node.js error at the innermost stack frame in the
+// submission. Syntax errors only have node internals on the stack; their location is the
+// "file:line" header that Node prints above the source line and caret.
+func parseNodeError(lines []string, at submissionPaths, _ map[string]string) []Diagnostic {
+	for i, l := range lines {
+		m := nodeError.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		d := Diagnostic{Severity: "error", Code: m[1], Message: l}
+		for _, f := range lines[i+1:] {
+			fm := nodeFrame.FindStringSubmatch(f)
+			if fm == nil {
+				continue
+			}
+			if file, ok := at(fm[1]); ok {
+				d.File, d.Line, d.Column = file, atoi(fm[2]), atoi(fm[3])
+				return []Diagnostic{d}
+			}
+		}
+		for j := 0; j+2 < i; j++ {
+			lm := nodeLocation.FindStringSubmatch(lines[j])
+			if lm == nil {
+				continue
+			}
+			if file, ok := at(lm[1]); ok {
+				d.File, d.Line, d.Column = file, atoi(lm[2]), caretColumn(lines[j+2])
+				return []Diagnostic{d}
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+var (
+	tscDiagnostic       = regexp.MustCompile(`^(.+\.tsx?)\((\d+),(\d+)\): (error|warning) (TS\d+): (.*)$`)
+	tscPrettyDiagnostic = regexp.MustCompile(`^(.+\.tsx?):(\d+):(\d+) - (error|warning) (TS\d+): (.*)$`)
+)
+
+// parseTSC reads TypeScript compiler errors in tsc's plain ("main.ts(3,7): error TS2322: ...")
+// and pretty ("main.ts:3:7 - error TS2322: ...", as printed by ts-node) formats.
+func parseTSC(lines []string, at submissionPaths, _ map[string]string) []Diagnostic {
+	var out []Diagnostic
+	for _, l := range lines {
+		m := tscDiagnostic.FindStringSubmatch(l)
+		if m == nil {
+			m = tscPrettyDiagnostic.FindStringSubmatch(l)
+		}
+		if m == nil {
+			continue
+		}
+		if file, ok := at(m[1]); ok {
+			out = append(out, Diagnostic{File: file, Line: atoi(m[2]), Column: atoi(m[3]), Severity: m[4], Code: m[5], Message: m[6]})
+		}
+	}
+	return out
+}
+
+var (
+	rubyException  = regexp.MustCompile(`^(.+?\.rb):(\d+):in [^:]*: (.*) \(([\w:]+)\)$`)
+	rubyDiagnostic = regexp.MustCompile(`^(.+?\.rb):(\d+): (.*?)(?: \((\w+)\))?$`)
+)
+
+// parseRuby reads uncaught exceptions ("main.rb:3:in '<main>': undefined ... (NameError)"),
+// syntax errors and warnings.
+func parseRuby(lines []string, at submissionPaths, _ map[string]string) []Diagnostic {
+	var out []Diagnostic
+	for _, l := range lines {
+		d := Diagnostic{Severity: "error"}
+		var file string
+		if m := rubyException.FindStringSubmatch(l); m != nil {
+			file, d.Line, d.Message, d.Code = m[1], atoi(m[2]), m[3], m[4]
+		} else if m := rubyDiagnostic.FindStringSubmatch(l); m != nil {
+			file, d.Line, d.Message, d.Code = m[1], atoi(m[2]), m[3], m[4]
+			if msg, ok := strings.CutPrefix(d.Message, "warning: "); ok {
+				d.Severity, d.Message = "warning", msg
+			}
+		} else {
+			continue
+		}
+		var ok bool
+		if d.File, ok = at(file); ok {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+var (
+	phpDiagnostic = regexp.MustCompile(`^(?:PHP )?(Parse error|Fatal error|Warning|Notice|Deprecated):\s+(.*) in (.+?) on line (\d+)$`)
+	phpUncaught   = regexp.MustCompile(`^(?:PHP )?Fatal error:\s+Uncaught (([\w\\]+).*) in (.+?):(\d+)$`)
+)
+
+// parsePHP reads PHP errors, e.g. "PHP Parse error:  syntax error, ... in main.php on line 3".
+func parsePHP(lines []string, at submissionPaths, _ map[string]string) []Diagnostic {
+	var out []Diagnostic
+	for _, l := range lines {
+		if m := phpUncaught.FindStringSubmatch(l); m != nil {
+			if file, ok := at(m[3]); ok {
+				out = append(out, Diagnostic{File: file, Line: atoi(m[4]), Severity: "error", Code: m[2], Message: m[1]})
+			}
+			continue
+		}
+		m := phpDiagnostic.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		file, ok := at(m[3])
+		if !ok {
+			continue
+		}
+		sev := "error"
+		if m[1] == "Warning" || m[1] == "Notice" || m[1] == "Deprecated" {
+			sev = "warning"
+		}
+		out = append(out, Diagnostic{File: file, Line: atoi(m[4]), Severity: sev, Code: m[1], Message: m[2]})
+	}
+	return out
+}
+
+var bashDiagnostic = regexp.MustCompile(`^(.+?): line (\d+): (.*)$`)
+
+// parseBash reads bash errors such as "main.sh: line 3: foo: command not found".
+func parseBash(lines []string, at submissionPaths, _ map[string]string) []Diagnostic {
+	var out []Diagnostic
+	for _, l := range lines {
+		m := bashDiagnostic.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		if file, ok := at(m[1]); ok {
+			out = append(out, Diagnostic{File: file, Line: atoi(m[2]), Severity: "error", Message: m[3]})
+		}
+	}
+	return out
+}
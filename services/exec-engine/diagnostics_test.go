@@ -0,0 +1,117 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStepDiagnostics(t *testing.T) {
+	cases := []struct {
+		name     string
+		language string
+		files    map[string]string
+		step     StepResult
+		want     []Diagnostic
+	}{
+		{"gcc", "c", map[string]string{"main.c": ""}, StepResult{Name: "build", Stderr: `main.c: In function 'main':
+main.c:1:27: error: 'y' undeclared (first use in this function)
+    1 | int main(){ int x; return y; }
+      |                           ^
+main.c:1:17: warning: unused variable 'x' [-Wunused-variable]
+/usr/include/stdio.h:3:1: note: declared here
+`}, []Diagnostic{
+			{File: "main.c", Line: 1, Column: 27, Severity: "error", Message: "'y' undeclared (first use in this function)"},
+			{File: "main.c", Line: 1, Column: 17, Severity: "warning", Code: "-Wunused-variable", Message: "unused variable 'x'"},
+		}},
+		{"go build", "go", map[string]string{"main.go": ""}, StepResult{Name: "build", Stderr: "# command-line-arguments\n./main.go:2:14: declared and not used: x\n"}, []Diagnostic{
+			{File: "main.go", Line: 2, Column: 14, Severity: "error", Message: "declared and not used: x"},
+		}},
+		{"go panic", "go", map[string]string{"main.go": ""}, StepResult{Name: "run", Stderr: "panic: runtime error: index out of range [3] with length 0\n\ngoroutine 1 [running]:\nmain.main()\n\t/workspace/main.go:2 +0x9\nexit status 2\n"}, []Diagnostic{
+			{File: "main.go", Line: 2, Severity: "error", Code: "panic", Message: "panic: runtime error: index out of range [3] with length 0"},
+		}},
+		{"rustc", "rust", map[string]string{"main.rs": ""}, StepResult{Name: "build", Stderr: "error[E0425]: cannot find value `y` in this scope\n --> main.rs:1:38\n  |\n\nerror: aborting due to 1 previous error\n"}, []Diagnostic{
+			{File: "main.rs", Line: 1, Column: 38, Severity: "error", Code: "E0425", Message: "cannot find value `y` in this scope"},
+		}},
+		{"rust panic", "rust", map[string]string{"main.rs": ""}, StepResult{Name: "run", Stderr: "thread 'main' panicked at main.rs:1:54:\nindex out of bounds: the len is 0 but the index is 3\n"}, []Diagnostic{
+			{File: "main.rs", Line: 1, Column: 54, Severity: "error", Code: "panic", Message: "index out of bounds: the len is 0 but the index is 3"},
+		}},
+		{"javac", "java", map[string]string{"Main.java": ""}, StepResult{Name: "build", Stderr: "Main.java:3: error: cannot find symbol\n        int x = y;\n                ^\n  symbol:   variable y\n  location: class Main\n1 error\n"}, []Diagnostic{
+			{File: "Main.java", Line: 3, Column: 17, Severity: "error", Message: "cannot find symbol\nsymbol:   variable y\nlocation: class Main"},
+		}},
+		{"java exception", "java", map[string]string{"Main.java": "", "util/Calc.java": ""}, StepResult{Name: "run", Stderr: "Exception in thread \"main\" java.lang.ArithmeticException: / by zero\n\tat util.Calc.div(Calc.java:4)\n\tat Main.main(Main.java:3)\n"}, []Diagnostic{
+			{File: "util/Calc.java", Line: 4, Severity: "error", Code: "java.lang.ArithmeticException", Message: "java.lang.ArithmeticException: / by zero"},
+		}},
+		{"python traceback", "python", map[string]string{"main.py": "", "pkg/util.py": "def f():\n    return 1/0\n"}, StepResult{Name: "run", Stderr: `Traceback (most recent call last):
+  File "/tmp/coderipper-1/main.py", line 5, in <module>
+    main()
+  File "/tmp/coderipper-1/pkg/util.py", line 2, in f
+    return 1/0
+           ~^~
+  File "/usr/lib/python3.12/fractions.py", line 9, in f
+    x
+ZeroDivisionError: division by zero
+`}, []Diagnostic{
+			{File: "pkg/util.py", Line: 2, Column: 12, Severity: "error", Code: "ZeroDivisionError", Message: "ZeroDivisionError: division by zero"},
+		}},
+		{"python syntax error", "python", map[string]string{"main.py": "if True:\n    x = (1,\n"}, StepResult{Name: "run", Stderr: "  File \"/tmp/coderipper-1/main.py\", line 2\n    x = (1,\n        ^\nSyntaxError: '(' was never closed\n"}, []Diagnostic{
+			{File: "main.py", Line: 2, Column: 9, Severity: "error", Code: "SyntaxError", Message: "SyntaxError: '(' was never closed"},
+		}},
+		{"mypy", "python", map[string]string{"main.py": ""}, StepResult{Name: "check", Stdout: "main.py:3:9: error: Incompatible types in assignment (expression has type \"str\", variable has type \"int\")  [assignment]\nmain.py:5: note: Revealed type is \"builtins.int\"\n"}, []Diagnostic{
+			{File: "main.py", Line: 3, Column: 9, Severity: "error", Code: "assignment", Message: "Incompatible types in assignment (expression has type \"str\", variable has type \"int\")"},
+			{File: "main.py", Line: 5, Severity: "info", Message: "Revealed type is \"builtins.int\""},
+		}},
+		{"node", "javascript", map[string]string{"main.js": ""}, StepResult{Name: "run", Stderr: `/tmp/coderipper-1/main.js:1
+function f(){ foo(); }
+              ^
+
+ReferenceError: foo is not defined
+    at f (/tmp/coderipper-1/main.js:1:15)
+    at Module._compile (node:internal/modules/cjs/loader:1521:14)
+`}, []Diagnostic{
+			{File: "main.js", Line: 1, Column: 15, Severity: "error", Code: "ReferenceError", Message: "ReferenceError: foo is not defined"},
+		}},
+		{"node syntax error", "javascript", map[string]string{"main.js": ""}, StepResult{Name: "run", Stderr: "/workspace/main.js:1\nlet x = ;\n        ^\n\nSyntaxError: Unexpected token ';'\n    at wrapSafe (node:internal/modules/cjs/loader:1464:18)\n"}, []Diagnostic{
+			{File: "main.js", Line: 1, Column: 9, Severity: "error", Code: "SyntaxError", Message: "SyntaxError: Unexpected token ';'"},
+		}},
+		{"ts-node", "typescript", map[string]string{"main.ts": ""}, StepResult{Name: "run", Stderr: "TSError: \u2a2f Unable to compile TypeScript:\n\x1b[96mmain.ts\x1b[0m:\x1b[93m1\x1b[0m:\x1b[93m7\x1b[0m - \x1b[91merror\x1b[0m\x1b[90m TS2322: \x1b[0mType 'string' is not assignable to type 'number'.\n"}, []Diagnostic{
+			{File: "main.ts", Line: 1, Column: 7, Severity: "error", Code: "TS2322", Message: "Type 'string' is not assignable to type 'number'."},
+		}},
+		{"ruby", "ruby", map[string]string{"main.rb": ""}, StepResult{Name: "run", Stderr: "main.rb:3:in '<main>': undefined local variable or method 'x' for main (NameError)\nmain.rb:1: warning: assigned but unused variable - y\n"}, []Diagnostic{
+			{File: "main.rb", Line: 3, Severity: "error", Code: "NameError", Message: "undefined local variable or method 'x' for main"},
+			{File: "main.rb", Line: 1, Severity: "warning", Message: "assigned but unused variable - y"},
+		}},
+		{"php", "php", map[string]string{"main.php": ""}, StepResult{Name: "run", Stderr: "PHP Parse error:  syntax error, unexpected token \"}\" in /workspace/main.php on line 3\n"}, []Diagnostic{
+			{File: "main.php", Line: 3, Severity: "error", Code: "Parse error", Message: "syntax error, unexpected token \"}\""},
+		}},
+		{"bash", "sh", map[string]string{"main.sh": ""}, StepResult{Name: "run", Stderr: "main.sh: line 2: foo: command not found\n"}, []Diagnostic{
+			{File: "main.sh", Line: 2, Severity: "error", Message: "foo: command not found"},
+		}},
+		{"run stdout is not parsed", "c", map[string]string{"main.c": ""}, StepResult{Name: "run", Stdout: "main.c:1:1: error: printed by the program\n"}, nil},
+	}
+	for _, c := range cases {
+		got := stepDiagnostics(RunRequest{Language: c.language, Files: c.files}, []StepResult{c.step}, "/tmp/coderipper-1", workspaceDir)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s:\n got %+v\nwant %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestNativeRunReturnsDiagnostics(t *testing.T) {
+	res := executeNative(RunRequest{Language: "c", TimeLimit: 10, Files: map[string]string{"main.c": "int main(void) {\n  return y;\n}\n"}}, nil)
+	want := []Diagnostic{
+		{File: "main.c", Line: 2, Column: 10, Severity: "error", Message: "'y' undeclared (first use in this function)"},
+		{File: "main.c", Line: 2, Column: 10, Severity: "info", Message: "each undeclared identifier is reported only once for each function it appears in"},
+	}
+	if res.Success || !reflect.DeepEqual(res.Diagnostics, want) {
+		t.Fatalf("compile error: %+v", res)
+	}
+
+	res = executeNative(RunRequest{Language: "python", TimeLimit: 10, Files: map[string]string{
+		"main.py":         "from pkg import util\nutil.f()\n",
+		"pkg/__init__.py": "",
+		"pkg/util.py":     "def f():\n    raise ValueError('bad input')\n",
+	}}, nil)
+	if len(res.Diagnostics) != 1 || res.Diagnostics[0].File != "pkg/util.py" || res.Diagnostics[0].Line != 2 || res.Diagnostics[0].Code != "ValueError" {
+		t.Fatalf("traceback: %+v", res)
+	}
+}
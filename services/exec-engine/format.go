@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// formatter runs a language's standard formatter on one file. The command reads the file,
+// passed to the shell as $1, on stdin and writes the formatted source to stdout.
+type formatter struct {
+	extensions []string
+	command    func(req RunRequest) string
+}
+
+var formatters = map[string]formatter{
+	"go":         {[]string{".go"}, func(RunRequest) string { return `gofmt < "$1"` }},
+	"python":     {[]string{".py", ".pyi"}, func(RunRequest) string { return `python -m black -q - < "$1"` }},
+	"javascript": {[]string{".js", ".jsx", ".mjs", ".cjs", ".json"}, prettier},
+	"typescript": {[]string{".ts", ".tsx", ".js", ".jsx", ".json"}, prettier},
+	"rust": {[]string{".rs"}, func(req RunRequest) string {
+		edition := req.Standard
+		if edition == "" {
+			edition = languages["rust"].defaultStandard
+		}
+		return "rustfmt --emit stdout --edition " + edition + ` < "$1"`
+	}},
+	"c":    {[]string{".c", ".h"}, clangFormat},
+	"cpp":  {[]string{".cpp", ".cc", ".cxx", ".hpp", ".hh", ".hxx", ".h"}, clangFormat},
+	"java": {[]string{".java"}, func(RunRequest) string { return `google-java-format - < "$1"` }},
+}
+
+func prettier(RunRequest) string    { return `npx prettier --stdin-filepath "$1" < "$1"` }
+func clangFormat(RunRequest) string { return `clang-format --assume-filename="$1" < "$1"` }
+
+// formatFiles returns the files of a request the language's formatter applies to, sorted.
+func formatFiles(req RunRequest) []string {
+	f, ok := formatters[canonicalLanguage(req.Language)]
+	if !ok {
+		return nil
+	}
+	var out []string
+	for _, name := range sortedFileNames(req.Files) {
+		for _, ext := range f.extensions {
+			if path.Ext(name) == ext {
+				out = append(out, name)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// planFormat formats each file in its own step, in the order of formatFiles.
+func planFormat(req RunRequest, limit time.Duration) pipelinePlan {
+	p := pipelinePlan{deps: req.deps, custom: true, total: limit}
+	command := formatters[canonicalLanguage(req.Language)].command(req)
+	for _, name := range formatFiles(req) {
+		p.steps = append(p.steps, planStep{name: "format", argv: []string{"/bin/sh", "-c", command, "sh", name}, timeout: limit})
+	}
+	return p
+}
+
+// FormatRequest is the payload of POST /format: the files of a run request, and whether to
+// answer with a unified diff instead of the formatted files.
+type FormatRequest struct {
+	RunRequest
+	Diff bool `json:"diff,omitempty"`
+}
+
+// FormatResult is the response of POST /format. Only files the formatter changed are listed.
+type FormatResult struct {
+	Changed []string          `json:"changed"`
+	Files   map[string]string `json:"files,omitempty"`
+	Diff    string            `json:"diff,omitempty"`
+	Success bool              `json:"success"`
+	// FailedFile could not be formatted, usually because of a syntax error; Stderr has the
+	// formatter's output
+	FailedFile string `json:"failedFile,omitempty"`
+	Stderr     string `json:"stderr,omitempty"`
+	InfraError bool   `json:"infraError,omitempty"`
+	WallTimeMs int64  `json:"wallTimeMs"`
+}
+
+// formatResult compares the output of each format step with the submitted file.
+func formatResult(req FormatRequest, res NativeResult) FormatResult {
+	out := FormatResult{Changed: []string{}, Success: res.Success, InfraError: res.InfraError, WallTimeMs: res.WallTimeMs}
+	names := formatFiles(req.RunRequest)
+	if !res.Success {
+		out.Stderr = res.Stderr
+		if n := len(res.Steps); n > 0 && n <= len(names) {
+			out.FailedFile = names[n-1]
+		}
+		return out
+	}
+	var diff strings.Builder
+	for i, step := range res.Steps {
+		name, formatted := names[i], step.Stdout
+		if formatted == req.Files[name] {
+			continue
+		}
+		out.Changed = append(out.Changed, name)
+		if !req.Diff {
+			if out.Files == nil {
+				out.Files = map[string]string{}
+			}
+			out.Files[name] = formatted
+			continue
+		}
+		d, _ := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A: difflib.SplitLines(req.Files[name]), B: difflib.SplitLines(formatted),
+			FromFile: "a/" + name, ToFile: "b/" + name, Context: 3,
+		})
+		diff.WriteString(d)
+	}
+	out.Diff = diff.String()
+	return out
+}
+
+// formatHandler serves POST /format. Formatting runs in the sandbox like a run, under the
+// caller's tier limits and queue share, and is charged CPU time but not a run.
+func formatHandler(rs *runners, tp *tierPolicies, q *quotas, limits requestLimits) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if rs.mode == "wasm" {
+			http.Error(w, "formatting is not supported in wasm mode", http.StatusNotImplemented)
+			return
+		}
+		var req FormatRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err == nil {
+			err = limits.validate(req.RunRequest)
+		}
+		if err == nil && (req.Mode != "" || len(req.Steps) > 0 || len(req.Outputs) > 0 || req.Archive != nil) {
+			err = invalid("format requests take language, files and standard")
+		}
+		if err == nil && len(formatFiles(req.RunRequest)) == 0 {
+			err = invalid("no files to format for %s", req.Language)
+		}
+		if err != nil {
+			writeRequestError(w, err)
+			return
+		}
+		req.Mode = modeFormat
+
+		userID, _ := r.Context().Value("user_id").(string)
+		claimTier, _ := r.Context().Value("tier").(string)
+		tier, policy := tp.resolve(claimTier)
+		policy.applyLimits(&req.RunRequest)
+		if userID != "" {
+			if st, err := q.status(r.Context(), userID, tier, policy); err != nil {
+				log.Println("quota store error:", err)
+			} else if st.exceeded() == "cpu" {
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(time.Until(st.ResetsAt))))
+				http.Error(w, "daily cpu quota exceeded", http.StatusTooManyRequests)
+				return
+			}
+		}
+		if !tp.begin(userID, policy) {
+			http.Error(w, "too many concurrent runs", http.StatusTooManyRequests)
+			return
+		}
+		defer tp.end(userID)
+
+		var res NativeResult
+		if rs.jobs != nil {
+			res, _, _, err = rs.submitJob(r.Context(), req.RunRequest, userID, tier, policy.Weight)
+		} else if _, _, err = rs.queue.acquire(r.Context(), tier, nil); err == nil {
+			start := time.Now()
+			res, err = rs.execute(req.RunRequest, tier)
+			rs.queue.release(time.Since(start))
+		}
+		switch {
+		case err == errQueueFull:
+			w.Header().Set("Retry-After", strconv.Itoa(rs.queue.retryAfter()))
+			http.Error(w, "run queue full", http.StatusServiceUnavailable)
+			return
+		case err == errJobTimeout:
+			http.Error(w, err.Error(), http.StatusGatewayTimeout)
+			return
+		case err != nil && r.Context().Err() != nil:
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if userID != "" {
+			if err := q.charge(r.Context(), userID, req.RunRequest, res); err != nil {
+				log.Println("quota store error:", err)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(formatResult(req, res))
+	}
+}
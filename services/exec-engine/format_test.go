@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatHandler(t *testing.T) {
+	tp := mustTierPolicies(t)
+	rs := &runners{mode: "native", queue: newRunQueue("native", tp.weights())}
+	h := formatHandler(rs, tp, &quotas{store: newMemoryQuotaStore(), now: time.Now}, loadRequestLimits())
+	post := func(body string) (int, FormatResult) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/format", strings.NewReader(body)))
+		var res FormatResult
+		json.NewDecoder(rec.Body).Decode(&res)
+		return rec.Code, res
+	}
+
+	files := `{"main.go":"package main\nfunc main() {\nprintln( 1 )\n}\n","util/u.go":"package util\n","go.mod":"module x\n"}`
+	code, res := post(`{"language":"go","files":` + files + `}`)
+	if code != 200 || !res.Success || len(res.Changed) != 1 || res.Files["main.go"] != "package main\n\nfunc main() {\n\tprintln(1)\n}\n" {
+		t.Fatalf("files: %d %+v", code, res)
+	}
+	code, res = post(`{"language":"go","diff":true,"files":` + files + `}`)
+	if code != 200 || res.Files != nil || !strings.Contains(res.Diff, "+++ b/main.go") || !strings.Contains(res.Diff, "+\tprintln(1)\n") {
+		t.Fatalf("diff: %d %+v", code, res)
+	}
+
+	code, res = post(`{"language":"go","files":{"a.go":"package a\n","b.go":"package b\nfunc {\n"}}`)
+	if code != 200 || res.Success || res.FailedFile != "b.go" || !strings.Contains(res.Stderr, "expected") {
+		t.Fatalf("syntax error: %d %+v", code, res)
+	}
+
+	if code, _ := post(`{"language":"go","files":{"README.md":"x"}}`); code != 400 {
+		t.Fatalf("no go files: got %d, want 400", code)
+	}
+	if code, _ := post(`{"language":"go","mode":"check","files":{"main.go":"package main\n"}}`); code != 400 {
+		t.Fatalf("mode: got %d, want 400", code)
+	}
+}
@@ -3,18 +3,28 @@ module github.com/coderipper/exec-engine
 go 1.21
 
 require (
+	github.com/alicebob/miniredis/v2 v2.31.1
 	github.com/golang-jwt/jwt/v5 v5.3.0
+	github.com/google/pprof v0.0.0-20210720184732-4bb14d4b1be1
+	github.com/lib/pq v1.10.9
 	github.com/minio/minio-go/v7 v7.0.36
+	github.com/pmezard/go-difflib v1.0.0
 	github.com/prometheus/client_golang v1.15.0
+	github.com/redis/go-redis/v9 v9.5.1
+	github.com/tetratelabs/wazero v1.8.2
+	golang.org/x/net v0.15.0
+	golang.org/x/sys v0.12.0
 	k8s.io/api v0.27.4
 	k8s.io/apimachinery v0.27.4
 	k8s.io/client-go v0.27.4
 )
 
 require (
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/dustin/go-humanize v1.0.0 // indirect
 	github.com/emicklei/go-restful/v3 v3.9.0 // indirect
 	github.com/go-logr/logr v1.2.3 // indirect
@@ -45,10 +55,9 @@ require (
 	github.com/rs/xid v1.4.0 // indirect
 	github.com/sirupsen/logrus v1.9.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
+	github.com/yuin/gopher-lua v1.1.0 // indirect
 	golang.org/x/crypto v0.13.0 // indirect
-	golang.org/x/net v0.15.0 // indirect
 	golang.org/x/oauth2 v0.5.0 // indirect
-	golang.org/x/sys v0.12.0 // indirect
 	golang.org/x/term v0.12.0 // indirect
 	golang.org/x/text v0.13.0 // indirect
 	golang.org/x/time v0.0.0-20220210224613-90d013bbcef8 // indirect
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// idempotencyRecord is what is stored under an idempotency key: the request fingerprint
+// and, once the first request has finished, its response.
+type idempotencyRecord struct {
+	Fingerprint string            `json:"fingerprint"`
+	Done        bool              `json:"done"`
+	Status      int               `json:"status,omitempty"`
+	Header      map[string]string `json:"header,omitempty"`
+	Body        []byte            `json:"body,omitempty"`
+}
+
+// idempotencyStore keeps idempotency records until their ttl passes.
+type idempotencyStore interface {
+	// claim stores rec under key if the key is free and reports whether it did. Otherwise it
+	// returns the record already stored.
+	claim(ctx context.Context, key string, rec idempotencyRecord, ttl time.Duration) (bool, *idempotencyRecord, error)
+	get(ctx context.Context, key string) (*idempotencyRecord, error)
+	put(ctx context.Context, key string, rec idempotencyRecord, ttl time.Duration) error
+	release(ctx context.Context, key string) error
+}
+
+// idempotency replays the stored response to retries that carry the same Idempotency-Key,
+// so a retried run is executed, charged and rewarded once.
+type idempotency struct {
+	store idempotencyStore
+	ttl   time.Duration // how long finished responses are kept
+	lock  time.Duration // how long an unfinished claim is honoured, in case its instance dies
+	wait  time.Duration // how long a retry waits for the first request before 409
+
+	maxBody int64            // request bodies are fingerprinted, so they are read in full up to this size
+	clients *rateLimitConfig // finds the address of unauthenticated callers, as rate limiting does
+}
+
+// newIdempotency builds the store selected by IDEMPOTENCY_STORE (memory or redis).
+// Request bodies larger than maxBody are rejected.
+func newIdempotency(maxBody int64, clients *rateLimitConfig) (*idempotency, error) {
+	id := &idempotency{
+		maxBody: maxBody,
+		clients: clients,
+		ttl:     time.Duration(envInt("IDEMPOTENCY_TTL_SECONDS", 86400)) * time.Second,
+		lock:    time.Duration(envInt("IDEMPOTENCY_LOCK_SECONDS", 600)) * time.Second,
+		wait:    time.Duration(envInt("IDEMPOTENCY_WAIT_SECONDS", 30)) * time.Second,
+	}
+	switch os.Getenv("IDEMPOTENCY_STORE") {
+	case "", "memory":
+		id.store = newMemoryIdempotencyStore(int64(envInt("IDEMPOTENCY_MAX_MB", 64)) << 20)
+	case "redis":
+		client, err := newRedisClient()
+		if err != nil {
+			return nil, err
+		}
+		id.store = &redisIdempotencyStore{client: client, prefix: "coderipper:idempotency:"}
+	default:
+		return nil, fmt.Errorf("unknown IDEMPOTENCY_STORE %q", os.Getenv("IDEMPOTENCY_STORE"))
+	}
+	return id, nil
+}
+
+// middleware applies idempotency to requests with an Idempotency-Key header. Keys are scoped
+// to the user (or client address when unauthenticated). Reusing a key with a different body
+// is rejected with 422; a retry while the first request is still running waits for it, then
+// gets 409. Responses that are worth retrying (429 and 5xx) are not stored. Store errors let
+// the request through without idempotency.
+func (id *idempotency) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > 255 {
+			http.Error(w, "idempotency key too long", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, id.maxBody))
+		if err != nil {
+			writeRequestError(w, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+		fingerprint := hex.EncodeToString(sum[:])
+		scope, _ := r.Context().Value("user_id").(string)
+		if scope == "" {
+			scope = "anon:" + id.clients.clientIP(r)
+		}
+		storeKey := scope + ":" + key
+
+		claimed, rec, err := id.store.claim(r.Context(), storeKey, idempotencyRecord{Fingerprint: fingerprint}, id.lock)
+		if err != nil {
+			log.Println("idempotency store error:", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !claimed {
+			if rec.Fingerprint != fingerprint {
+				http.Error(w, "idempotency key reused with a different request", http.StatusUnprocessableEntity)
+				return
+			}
+			if !rec.Done {
+				if rec, err = id.await(r.Context(), storeKey); err != nil || rec == nil || !rec.Done {
+					http.Error(w, "request with this idempotency key is still in progress", http.StatusConflict)
+					return
+				}
+			}
+			for k, v := range rec.Header {
+				w.Header().Set(k, v)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(rec.Status)
+			w.Write(rec.Body)
+			return
+		}
+
+		rw := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r)
+		// keep final answers even if the caller has gone away, since the retry wants exactly
+		// those; throttled and failed requests may be retried, and a request that never got an
+		// answer (cancelled while queued) did not run
+		if !rw.wrote || rw.status == http.StatusTooManyRequests || rw.status >= 500 {
+			if err := id.store.release(context.Background(), storeKey); err != nil {
+				log.Println("idempotency store error:", err)
+			}
+			return
+		}
+		done := idempotencyRecord{Fingerprint: fingerprint, Done: true, Status: rw.status, Header: map[string]string{}, Body: rw.body.Bytes()}
+		for _, h := range []string{"Content-Type", "Location", "X-Queue-Position", "X-Queue-Wait-Ms"} {
+			if v := w.Header().Get(h); v != "" {
+				done.Header[h] = v
+			}
+		}
+		if err := id.store.put(context.Background(), storeKey, done, id.ttl); err != nil {
+			log.Println("idempotency store error:", err)
+		}
+	})
+}
+
+// await polls key until its request finishes, the record disappears or the wait runs out.
+func (id *idempotency) await(ctx context.Context, key string) (*idempotencyRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, id.wait)
+	defer cancel()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+			rec, err := id.store.get(ctx, key)
+			if err != nil || rec == nil || rec.Done {
+				return rec, err
+			}
+		}
+	}
+}
+
+// recordingWriter passes a response through while keeping a copy of it.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	wrote  bool
+	body   bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	rw.status, rw.wrote = status, true
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	rw.wrote = true
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+// memoryIdempotencyStore keeps records in the process. Expired records are dropped lazily in
+// expiry order; when the stored responses exceed maxBytes, the finished records closest to
+// expiry are dropped early.
+type memoryIdempotencyStore struct {
+	mu       sync.Mutex
+	records  map[string]memoryIdempotencyEntry
+	expiry   idempotencyHeap
+	bytes    int64
+	maxBytes int64
+	now      func() time.Time
+}
+
+type memoryIdempotencyEntry struct {
+	rec     idempotencyRecord
+	expires time.Time
+}
+
+func newMemoryIdempotencyStore(maxBytes int64) *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{records: map[string]memoryIdempotencyEntry{}, maxBytes: maxBytes, now: time.Now}
+}
+
+func (m *memoryIdempotencyStore) claim(_ context.Context, key string, rec idempotencyRecord, ttl time.Duration) (bool, *idempotencyRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireLocked()
+	if e, ok := m.records[key]; ok {
+		existing := e.rec
+		return false, &existing, nil
+	}
+	m.setLocked(key, rec, ttl)
+	return true, nil, nil
+}
+
+func (m *memoryIdempotencyStore) get(_ context.Context, key string) (*idempotencyRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.records[key]
+	if !ok || m.now().After(e.expires) {
+		return nil, nil
+	}
+	return &e.rec, nil
+}
+
+func (m *memoryIdempotencyStore) put(_ context.Context, key string, rec idempotencyRecord, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.setLocked(key, rec, ttl)
+	m.expireLocked()
+	return nil
+}
+
+func (m *memoryIdempotencyStore) release(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleteLocked(key)
+	return nil
+}
+
+func (m *memoryIdempotencyStore) setLocked(key string, rec idempotencyRecord, ttl time.Duration) {
+	m.deleteLocked(key)
+	e := memoryIdempotencyEntry{rec: rec, expires: m.now().Add(ttl)}
+	m.records[key] = e
+	m.bytes += int64(len(rec.Body))
+	heap.Push(&m.expiry, idempotencyExpiry{key: key, expires: e.expires})
+}
+
+func (m *memoryIdempotencyStore) deleteLocked(key string) {
+	if e, ok := m.records[key]; ok {
+		m.bytes -= int64(len(e.rec.Body))
+		delete(m.records, key)
+	}
+}
+
+// expireLocked pops heap entries that are expired, or while over the byte budget. Heap
+// entries of records that were replaced or released since are skipped. In-flight claims are
+// never dropped early; they hold no response yet.
+func (m *memoryIdempotencyStore) expireLocked() {
+	now := m.now()
+	var keep []idempotencyExpiry
+	for m.expiry.Len() > 0 {
+		top := m.expiry[0]
+		over := m.bytes > m.maxBytes
+		if !now.After(top.expires) && !over {
+			break
+		}
+		heap.Pop(&m.expiry)
+		e, ok := m.records[top.key]
+		if !ok || !e.expires.Equal(top.expires) {
+			continue
+		}
+		if !now.After(top.expires) && !e.rec.Done {
+			keep = append(keep, top)
+			continue
+		}
+		m.deleteLocked(top.key)
+	}
+	for _, k := range keep {
+		heap.Push(&m.expiry, k)
+	}
+}
+
+type idempotencyExpiry struct {
+	key     string
+	expires time.Time
+}
+
+// idempotencyHeap orders records by expiry, soonest first.
+type idempotencyHeap []idempotencyExpiry
+
+func (h idempotencyHeap) Len() int           { return len(h) }
+func (h idempotencyHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+func (h idempotencyHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *idempotencyHeap) Push(x any)        { *h = append(*h, x.(idempotencyExpiry)) }
+func (h *idempotencyHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// redisIdempotencyStore shares records between replicas; claims use SET NX.
+type redisIdempotencyStore struct {
+	client *redis.Client
+	prefix string
+}
+
+func (s *redisIdempotencyStore) claim(ctx context.Context, key string, rec idempotencyRecord, ttl time.Duration) (bool, *idempotencyRecord, error) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return false, nil, err
+	}
+	ok, err := s.client.SetNX(ctx, s.prefix+key, b, ttl).Result()
+	if err != nil || ok {
+		return ok, nil, err
+	}
+	existing, err := s.get(ctx, key)
+	if err == nil && existing == nil {
+		// expired between the two calls; try once more
+		ok, err = s.client.SetNX(ctx, s.prefix+key, b, ttl).Result()
+		if err != nil || ok {
+			return ok, nil, err
+		}
+		existing, err = s.get(ctx, key)
+	}
+	if err == nil && existing == nil {
+		return false, nil, fmt.Errorf("idempotency key %s vanished", key)
+	}
+	return false, existing, err
+}
+
+func (s *redisIdempotencyStore) get(ctx context.Context, key string) (*idempotencyRecord, error) {
+	b, err := s.client.Get(ctx, s.prefix+key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec idempotencyRecord
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return nil, fmt.Errorf("decode idempotency record: %w", err)
+	}
+	return &rec, nil
+}
+
+func (s *redisIdempotencyStore) put(ctx context.Context, key string, rec idempotencyRecord, ttl time.Duration) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, s.prefix+key, b, ttl).Err()
+}
+
+func (s *redisIdempotencyStore) release(ctx context.Context, key string) error {
+	return s.client.Del(ctx, s.prefix+key).Err()
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestIdempotency(store idempotencyStore) *idempotency {
+	return &idempotency{store: store, ttl: time.Hour, lock: time.Minute, wait: time.Second, maxBody: 1 << 20, clients: &rateLimitConfig{}}
+}
+
+func idempotentRequest(h http.Handler, user, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/run", strings.NewReader(body))
+	req.Header.Set("Idempotency-Key", key)
+	req = req.WithContext(context.WithValue(req.Context(), "user_id", user))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestIdempotencyReplaysResult(t *testing.T) {
+	mr := miniredis.RunT(t)
+	stores := map[string]idempotencyStore{
+		"memory": newMemoryIdempotencyStore(1 << 20),
+		"redis":  &redisIdempotencyStore{client: redis.NewClient(&redis.Options{Addr: mr.Addr()}), prefix: "test:"},
+	}
+	for name, store := range stores {
+		var runs int32
+		h := newTestIdempotency(store).middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&runs, 1)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"run":` + strconv.Itoa(int(n)) + `}`))
+		}))
+
+		first := idempotentRequest(h, "u1", "k1", `{"language":"python"}`)
+		retry := idempotentRequest(h, "u1", "k1", `{"language":"python"}`)
+		if runs != 1 || retry.Body.String() != first.Body.String() || retry.Header().Get("Idempotent-Replayed") != "true" {
+			t.Fatalf("%s: retry was not replayed: runs=%d body=%q", name, runs, retry.Body.String())
+		}
+		if retry.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("%s: headers not replayed", name)
+		}
+		if rec := idempotentRequest(h, "u1", "k1", `{"language":"go"}`); rec.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("%s: reused key with another body: got %d", name, rec.Code)
+		}
+		// keys are scoped per user
+		idempotentRequest(h, "u2", "k1", `{"language":"python"}`)
+		if runs != 2 {
+			t.Fatalf("%s: another user's key was replayed", name)
+		}
+	}
+}
+
+func TestIdempotencyScopesAnonymousCallersBehindProxy(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8")
+	cfg, err := loadRateLimitConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := newTestIdempotency(newMemoryIdempotencyStore(1 << 20))
+	id.clients = cfg
+	var runs int32
+	h := id.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&runs, 1)
+	}))
+	for _, client := range []string{"1.1.1.1", "2.2.2.2"} {
+		req := httptest.NewRequest("POST", "/run", strings.NewReader(`{"language":"python"}`))
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", client)
+		req.Header.Set("Idempotency-Key", "k1")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if runs != 2 {
+		t.Fatal("anonymous callers behind the same proxy share idempotency keys")
+	}
+}
+
+func TestIdempotencyInFlight(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var runs int32
+	id := newTestIdempotency(newMemoryIdempotencyStore(1 << 20))
+	id.wait = 50 * time.Millisecond
+	h := id.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&runs, 1)
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	}))
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- idempotentRequest(h, "u1", "k", "x") }()
+	<-started
+	if rec := idempotentRequest(h, "u1", "k", "x"); rec.Code != http.StatusConflict {
+		t.Fatalf("retry while running: got %d, want 409", rec.Code)
+	}
+
+	// a retry with a longer wait gets the first result
+	id.wait = 2 * time.Second
+	waited := make(chan *httptest.ResponseRecorder)
+	go func() { waited <- idempotentRequest(h, "u1", "k", "x") }()
+	time.Sleep(150 * time.Millisecond)
+	close(release)
+	<-done
+	if rec := <-waited; rec.Body.String() != "done" || runs != 1 {
+		t.Fatalf("waiting retry: body=%q runs=%d", rec.Body.String(), runs)
+	}
+}
+
+func TestIdempotencyDoesNotStoreFailures(t *testing.T) {
+	var runs int32
+	h := newTestIdempotency(newMemoryIdempotencyStore(1 << 20)).middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&runs, 1) == 1 {
+			http.Error(w, "run queue full", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	idempotentRequest(h, "u1", "k", "x")
+	if rec := idempotentRequest(h, "u1", "k", "x"); rec.Body.String() != "ok" || runs != 2 {
+		t.Fatalf("retry after 503 should run again: body=%q runs=%d", rec.Body.String(), runs)
+	}
+}
+
+func TestIdempotencyKeepsResultWhenCallerDisconnects(t *testing.T) {
+	tp := mustTierPolicies(t)
+	rs := &runners{mode: "native", queue: newRunQueue("native", tp.weights())}
+	q := &quotas{store: newMemoryQuotaStore(), now: time.Now}
+	h := newTestIdempotency(newMemoryIdempotencyStore(1 << 20)).middleware(runHandler(rs, tp, q, nil, loadRequestLimits()))
+
+	body := `{"language":"bash","files":{"main.sh":"sleep 0.3; echo done"}}`
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), "user_id", "u1"))
+	req := httptest.NewRequest("POST", "/run", strings.NewReader(body)).WithContext(ctx)
+	req.Header.Set("Idempotency-Key", "k")
+	time.AfterFunc(100*time.Millisecond, cancel) // connection drops while the program runs
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	retry := idempotentRequest(h, "u1", "k", body)
+	if retry.Header().Get("Idempotent-Replayed") != "true" || !strings.Contains(retry.Body.String(), "done") {
+		t.Fatalf("retry should replay the finished run, got %d %q", retry.Code, retry.Body.String())
+	}
+	if u, _ := q.store.usage(context.Background(), "u1", time.Now().UTC().Format("2006-01-02")); u.Runs != 1 {
+		t.Fatalf("run should be charged once, got %d", u.Runs)
+	}
+}
+
+func TestMemoryIdempotencyStoreBounds(t *testing.T) {
+	m := newMemoryIdempotencyStore(10)
+	now := time.Now()
+	m.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	m.claim(ctx, "inflight", idempotencyRecord{}, time.Minute)
+	m.put(ctx, "a", idempotencyRecord{Done: true, Body: []byte("123456")}, time.Hour)
+	m.put(ctx, "b", idempotencyRecord{Done: true, Body: []byte("123456")}, 2*time.Hour)
+	if rec, _ := m.get(ctx, "a"); rec != nil {
+		t.Fatal("record closest to expiry should be dropped when over the byte budget")
+	}
+	if rec, _ := m.get(ctx, "inflight"); rec == nil {
+		t.Fatal("in-flight claims are not dropped early")
+	}
+	if m.bytes != 6 {
+		t.Fatalf("bytes = %d", m.bytes)
+	}
+
+	now = now.Add(3 * time.Hour)
+	m.claim(ctx, "c", idempotencyRecord{}, time.Minute)
+	if len(m.records) != 1 || m.bytes != 0 {
+		t.Fatalf("expired records were not dropped: %d records, %d bytes", len(m.records), m.bytes)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//go:embed migrations/create_run_jobs.sql
+var runJobsSchema string
+
+// errJobTimeout is returned when a job does not finish before the caller's deadline.
+var errJobTimeout = errors.New("run did not finish in time")
+
+// jobQueue hands runs from the API to worker processes through the run_jobs table.
+// Workers claim jobs with FOR UPDATE SKIP LOCKED, so any number of them can poll concurrently.
+type jobQueue struct {
+	db *sql.DB
+
+	capacity  int           // max queued jobs before the API answers 503
+	boost     time.Duration // head start per unit of tier weight
+	heartbeat time.Duration // how often workers touch their running jobs
+	deadAfter time.Duration // running jobs without a heartbeat for this long are re-queued
+	attempts  int           // claims per job before it is failed
+	retention time.Duration // how long finished jobs are kept
+}
+
+// openJobQueue connects to DATABASE_URL and makes sure the run_jobs table exists.
+func openJobQueue() (*jobQueue, error) {
+	db, err := openDatabase(runJobsSchema)
+	if err != nil {
+		return nil, err
+	}
+	return &jobQueue{
+		db:        db,
+		capacity:  envInt("RUN_QUEUE_SIZE", 100),
+		boost:     time.Duration(envInt("JOB_PRIORITY_BOOST_SECONDS", 5)) * time.Second,
+		heartbeat: time.Duration(envInt("JOB_HEARTBEAT_SECONDS", 5)) * time.Second,
+		deadAfter: time.Duration(envInt("JOB_DEAD_AFTER_SECONDS", 30)) * time.Second,
+		attempts:  envInt("JOB_MAX_ATTEMPTS", 3),
+		retention: time.Duration(envInt("JOB_RETENTION_SECONDS", 3600)) * time.Second,
+	}, nil
+}
+
+// submit enqueues a run and returns its id and its position among queued jobs. asyncID names
+// runs accepted with Prefer: respond-async and is empty otherwise.
+// Jobs are ordered by creation time minus a boost proportional to the tier weight, so
+// higher tiers overtake recent free runs but older free runs still get served.
+func (jq *jobQueue) submit(ctx context.Context, req RunRequest, userID, tier string, weight int, asyncID string) (id int64, position int, err error) {
+	var queued int
+	if err := jq.db.QueryRowContext(ctx, `SELECT count(*) FROM run_jobs WHERE status = 'queued'`).Scan(&queued); err != nil {
+		return 0, 0, fmt.Errorf("count jobs: %w", err)
+	}
+	if queued >= jq.capacity {
+		return 0, 0, errQueueFull
+	}
+	if req.Archive != nil {
+		// the files are extracted again on claim rather than stored twice
+		req.Files = nil
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	boost := jq.boost * time.Duration(weight-1)
+	err = jq.db.QueryRowContext(ctx, `
+		INSERT INTO run_jobs (user_id, tier, request, sort_key, async_id)
+		VALUES ($1, $2, $3, now() - $4::double precision * interval '1 millisecond', NULLIF($5, ''))
+		RETURNING id, 1 + (SELECT count(*) FROM run_jobs j WHERE j.status = 'queued' AND j.sort_key <= now() - $4::double precision * interval '1 millisecond')`,
+		userID, tier, body, boost.Milliseconds(), asyncID).Scan(&id, &position)
+	if err != nil {
+		return 0, 0, fmt.Errorf("insert job: %w", err)
+	}
+	return id, position, nil
+}
+
+// wait polls a job until it finishes or timeout passes, and returns the result and how long
+// the job was queued. If ctx is done before a worker claimed the job, the job is cancelled;
+// once claimed it is awaited anyway, so the run that is executing gets recorded and charged.
+func (jq *jobQueue) wait(ctx context.Context, id int64, timeout time.Duration) (NativeResult, time.Duration, error) {
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	done := ctx.Done()
+	for {
+		select {
+		case <-done:
+			if jq.cancelQueued(id) {
+				return NativeResult{}, 0, ctx.Err()
+			}
+			done = nil
+		case <-ticker.C:
+			if time.Now().After(deadline) {
+				jq.cancelQueued(id)
+				return NativeResult{}, 0, errJobTimeout
+			}
+			var status string
+			var result []byte
+			var jobErr sql.NullString
+			var queuedMs int64
+			pollCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			err := jq.db.QueryRowContext(pollCtx, `
+				SELECT status, result, error, COALESCE(EXTRACT(EPOCH FROM claimed_at - created_at) * 1000, 0)::bigint
+				FROM run_jobs WHERE id = $1`, id).Scan(&status, &result, &jobErr, &queuedMs)
+			cancel()
+			if err != nil {
+				return NativeResult{}, 0, fmt.Errorf("poll job: %w", err)
+			}
+			queued := time.Duration(queuedMs) * time.Millisecond
+			switch status {
+			case "done":
+				var res NativeResult
+				if err := json.Unmarshal(result, &res); err != nil {
+					return NativeResult{}, queued, fmt.Errorf("decode result: %w", err)
+				}
+				return res, queued, nil
+			case "failed", "cancelled":
+				return NativeResult{}, queued, fmt.Errorf("job %s: %s", status, jobErr.String)
+			}
+		}
+	}
+}
+
+// asyncRun reads the state of a run accepted with Prefer: respond-async, so that any API
+// replica can answer GET /runs/{id}. Runs of other users are not found.
+func (jq *jobQueue) asyncRun(ctx context.Context, asyncID, userID string) (asyncRun, bool, error) {
+	var id int64
+	var status string
+	var result []byte
+	var jobErr sql.NullString
+	var queuedMs int64
+	err := jq.db.QueryRowContext(ctx, `
+		SELECT id, status, result, error, COALESCE(EXTRACT(EPOCH FROM claimed_at - created_at) * 1000, 0)::bigint
+		FROM run_jobs WHERE async_id = $1 AND user_id = $2`, asyncID, userID).Scan(&id, &status, &result, &jobErr, &queuedMs)
+	if err == sql.ErrNoRows {
+		return asyncRun{}, false, nil
+	}
+	if err != nil {
+		return asyncRun{}, false, fmt.Errorf("read async run: %w", err)
+	}
+	run := asyncRun{ID: asyncID, Status: status, WaitMs: queuedMs}
+	switch status {
+	case "queued":
+		if run.Position, err = jq.position(ctx, id); err != nil {
+			return asyncRun{}, false, err
+		}
+		if run.Position == 0 {
+			// claimed since the row was read
+			run.Status = "running"
+		}
+	case "done":
+		var res NativeResult
+		if err := json.Unmarshal(result, &res); err != nil {
+			return asyncRun{}, false, fmt.Errorf("decode result: %w", err)
+		}
+		run.Result = &res
+	case "failed", "cancelled":
+		run.Status, run.Error = "failed", fmt.Sprintf("job %s: %s", status, jobErr.String)
+	}
+	return run, true, nil
+}
+
+// position returns the place of a queued job in claim order, or 0 once a worker has it.
+func (jq *jobQueue) position(ctx context.Context, id int64) (int, error) {
+	var pos int
+	err := jq.db.QueryRowContext(ctx, `
+		SELECT count(*) FROM run_jobs j, run_jobs me
+		WHERE me.id = $1 AND me.status = 'queued' AND j.status = 'queued' AND j.sort_key <= me.sort_key`, id).Scan(&pos)
+	if err != nil {
+		return 0, fmt.Errorf("job position: %w", err)
+	}
+	return pos, nil
+}
+
+// cancelQueued cancels a job no worker has claimed yet and reports whether it did.
+func (jq *jobQueue) cancelQueued(id int64) bool {
+	res, err := jq.db.Exec(`UPDATE run_jobs SET status = 'cancelled', finished_at = now() WHERE id = $1 AND status = 'queued'`, id)
+	if err != nil {
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n == 1
+}
+
+// claimedJob is a job a worker has taken ownership of.
+type claimedJob struct {
+	ID   int64
+	Tier string
+	Req  RunRequest
+}
+
+// claim takes the next queued job for workerID, or returns nil if there is none.
+func (jq *jobQueue) claim(ctx context.Context, workerID string) (*claimedJob, error) {
+	var job claimedJob
+	var body []byte
+	err := jq.db.QueryRowContext(ctx, `
+		UPDATE run_jobs SET status = 'running', worker_id = $1, attempts = attempts + 1,
+			claimed_at = now(), heartbeat_at = now()
+		WHERE id = (
+			SELECT id FROM run_jobs WHERE status = 'queued'
+			ORDER BY sort_key LIMIT 1 FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, tier, request`, workerID).Scan(&job.ID, &job.Tier, &body)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("claim job: %w", err)
+	}
+	err = json.Unmarshal(body, &job.Req)
+	if err == nil && job.Req.Archive != nil {
+		job.Req.Files, err = job.Req.Archive.extract(loadRequestLimits())
+	}
+	if err != nil {
+		_ = jq.fail(context.Background(), job.ID, workerID, "invalid request: "+err.Error())
+		return nil, nil
+	}
+	return &job, nil
+}
+
+// complete stores the result of a job. It only applies while workerID still owns the job,
+// so a worker that was presumed dead cannot overwrite the result of the retry.
+func (jq *jobQueue) complete(ctx context.Context, id int64, workerID string, res NativeResult) error {
+	body, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	_, err = jq.db.ExecContext(ctx, `
+		UPDATE run_jobs SET status = 'done', result = $3, finished_at = now()
+		WHERE id = $1 AND worker_id = $2 AND status = 'running'`, id, workerID, body)
+	return err
+}
+
+func (jq *jobQueue) fail(ctx context.Context, id int64, workerID, msg string) error {
+	_, err := jq.db.ExecContext(ctx, `
+		UPDATE run_jobs SET status = 'failed', error = $3, finished_at = now()
+		WHERE id = $1 AND worker_id = $2 AND status = 'running'`, id, workerID, msg)
+	return err
+}
+
+// touch refreshes the heartbeat of every job workerID is running.
+func (jq *jobQueue) touch(ctx context.Context, workerID string) error {
+	_, err := jq.db.ExecContext(ctx, `UPDATE run_jobs SET heartbeat_at = now() WHERE worker_id = $1 AND status = 'running'`, workerID)
+	return err
+}
+
+// reap re-queues jobs of workers that stopped heartbeating, fails jobs that ran out of
+// attempts, and deletes finished jobs past the retention period. It returns how many
+// jobs were re-queued.
+func (jq *jobQueue) reap(ctx context.Context) (int64, error) {
+	res, err := jq.db.ExecContext(ctx, `
+		UPDATE run_jobs SET status = 'queued', worker_id = NULL, claimed_at = NULL, heartbeat_at = NULL
+		WHERE status = 'running' AND heartbeat_at < now() - $1::double precision * interval '1 millisecond' AND attempts < $2`,
+		jq.deadAfter.Milliseconds(), jq.attempts)
+	if err != nil {
+		return 0, fmt.Errorf("requeue: %w", err)
+	}
+	requeued, _ := res.RowsAffected()
+	if _, err := jq.db.ExecContext(ctx, `
+		UPDATE run_jobs SET status = 'failed', error = 'worker lost', finished_at = now()
+		WHERE status = 'running' AND heartbeat_at < now() - $1::double precision * interval '1 millisecond' AND attempts >= $2`,
+		jq.deadAfter.Milliseconds(), jq.attempts); err != nil {
+		return requeued, fmt.Errorf("fail lost jobs: %w", err)
+	}
+	if _, err := jq.db.ExecContext(ctx, `
+		DELETE FROM run_jobs WHERE finished_at < now() - $1::double precision * interval '1 millisecond'`,
+		jq.retention.Milliseconds()); err != nil {
+		return requeued, fmt.Errorf("delete old jobs: %w", err)
+	}
+	return requeued, nil
+}
@@ -4,11 +4,14 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -21,7 +24,6 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 
 	minio "github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
 )
 
 // K8sRunResult contains logs and status from a Kubernetes-run job
@@ -29,11 +31,119 @@ type K8sRunResult struct {
 	Stdout   string `json:"stdout"`
 	ExitCode int    `json:"exitCode"`
 	Success  bool   `json:"success"`
+	// Steps are parsed from the step markers in the logs
+	Steps []StepResult `json:"steps,omitempty"`
 }
 
-// submitK8sJob creates a Job that mounts a ConfigMap with the submission files and runs the runner image.
+// Step markers delimit the output of each step in the pod logs, which interleave stdout and
+// stderr. The exit marker is preceded by a newline so output without one stays on its own line.
+// Artifacts follow the last step as a base64 tar between their own markers.
+const (
+	stepMarker         = "::coderipper-step "
+	exitMarker         = "::coderipper-exit "
+	artifactsMarker    = "::coderipper-artifacts"
+	artifactsEndMarker = "::coderipper-artifacts-end"
+)
+
+// stepScript is the shell script that runs a pipeline in a runner pod. Each step runs under
+// timeout(1) when the image has it, which exits with 124 when the step's time is up.
+func stepScript(plan pipelinePlan) string {
+	var b strings.Builder
+	b.WriteString("cp -R /submission/. " + workspaceDir + "/ || exit 125\ncd " + workspaceDir + "\nexport HOME=" + workspaceDir + "\n")
+	b.WriteString(depsLinks(plan.deps))
+	if len(plan.outputs) > 0 {
+		b.WriteString("mkdir -p " + workspaceDir + "/" + outputDir + "\n")
+	}
+	b.WriteString("t=; command -v timeout >/dev/null 2>&1 && t=1\n(\n")
+	for i, step := range plan.steps {
+		cmd := shellJoin(step.argv)
+		fmt.Fprintf(&b, "echo '%s%d'\n", stepMarker, i)
+		fmt.Fprintf(&b, "if [ -n \"$t\" ]; then timeout -k 5 %d %s; else %s; fi\nc=$?\n", int(step.timeout.Seconds()), cmd, cmd)
+		fmt.Fprintf(&b, "printf '\\n%s%d %%d\\n' \"$c\"\n[ \"$c\" -eq 0 ] || exit \"$c\"\n", exitMarker, i)
+	}
+	// the steps run in a subshell so artifacts are collected after a failure too
+	b.WriteString(")\nc=$?\n")
+	if globs := plan.collects(); len(globs) > 0 {
+		fmt.Fprintf(&b, "echo '%s'\n(%s) | base64\necho '%s'\n", artifactsMarker, collectScript(globs), artifactsEndMarker)
+	}
+	b.WriteString("exit \"$c\"\n")
+	return b.String()
+}
+
+// parseArtifactLogs returns the tar of artifacts in the logs of a stepScript pod, or nil.
+func parseArtifactLogs(logs string) ([]byte, error) {
+	// the last one: the steps may print the marker too
+	i := strings.LastIndex(logs, "\n"+artifactsMarker+"\n")
+	if i < 0 {
+		return nil, nil
+	}
+	encoded, _, ok := strings.Cut(logs[i+len(artifactsMarker)+2:], artifactsEndMarker)
+	if !ok {
+		return nil, errors.New("artifacts are cut off")
+	}
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded), ""))
+}
+
+// parseStepLogs splits the logs of a stepScript pod into step results. Output goes to Stdout,
+// since pod logs do not separate the streams. It returns nil if the logs hold no step markers.
+func parseStepLogs(plan pipelinePlan, logs string) []StepResult {
+	var steps []StepResult
+	var cur *StepResult
+	var out strings.Builder
+	for _, line := range strings.SplitAfter(logs, "\n") {
+		trimmed := strings.TrimSuffix(line, "\n")
+		if cur == nil && trimmed == artifactsMarker {
+			break
+		}
+		switch {
+		case strings.HasPrefix(trimmed, stepMarker):
+			i, err := strconv.Atoi(strings.TrimPrefix(trimmed, stepMarker))
+			if err != nil || i < 0 || i >= len(plan.steps) {
+				out.WriteString(line)
+				continue
+			}
+			steps = append(steps, StepResult{Name: plan.steps[i].name})
+			cur = &steps[len(steps)-1]
+			out.Reset()
+		case cur != nil && strings.HasPrefix(trimmed, exitMarker):
+			var i, code int
+			if _, err := fmt.Sscanf(trimmed, exitMarker+"%d %d", &i, &code); err != nil || i < 0 || i >= len(plan.steps) {
+				out.WriteString(line)
+				continue
+			}
+			// drop the newline the marker was printed after
+			cur.Stdout = strings.TrimSuffix(out.String(), "\n")
+			cur.ExitCode = code
+			if code == 124 {
+				cur.TimedOut = true
+				cur.timeoutNote = stepTimeoutNote(plan.steps[i])
+			}
+			cur = nil
+		default:
+			out.WriteString(line)
+		}
+	}
+	if cur != nil {
+		// the pod stopped mid-step, e.g. on the job deadline
+		cur.Stdout = out.String()
+		cur.ExitCode = 137
+	}
+	return steps
+}
+
+// unpackArchive is the shell command that extracts a zip or tar.gz at src into /submission. The
+// archive was validated when the request was decoded.
+func unpackArchive(format, src string) string {
+	if format == "zip" {
+		return "unzip -q " + src + " -d /submission"
+	}
+	return "tar -xzf " + src + " -C /submission"
+}
+
+// submitK8sJob creates a Job that mounts a ConfigMap with the submission files and runs the plan
+// in the runner image, in an emptyDir workspace.
 // NOTE (production): For larger submissions or binaries use object storage (S3/MinIO) and an init container to pull them instead of ConfigMaps.
-func submitK8sJob(req RunRequest, image string, timeout time.Duration, namespace string) (*K8sRunResult, error) {
+func submitK8sJob(req RunRequest, plan pipelinePlan, image string, timeout time.Duration, namespace string) (*K8sRunResult, error) {
 	// create k8s client
 	cfg, err := rest.InClusterConfig()
 	if err != nil {
@@ -56,49 +166,55 @@ func submitK8sJob(req RunRequest, image string, timeout time.Duration, namespace
 		total += len(v)
 	}
 
-	useS3 := total > maxConfigMapSize && os.Getenv("S3_ENDPOINT") != ""
+	// archives are forwarded as uploaded: ConfigMap keys cannot hold their directories
+	useS3 := (total > maxConfigMapSize || req.Archive != nil) && os.Getenv("S3_ENDPOINT") != ""
 
 	var cmName string
 	var volumes []corev1.Volume
 	var initContainers []corev1.Container
 
 	if useS3 {
-		// pack files into a tar and upload to S3/MinIO
-		endpoint := os.Getenv("S3_ENDPOINT")
-		access := os.Getenv("S3_ACCESS_KEY")
-		secret := os.Getenv("S3_SECRET_KEY")
+		// upload the archive, or the files packed into a tar, to S3/MinIO
 		bucket := os.Getenv("S3_BUCKET")
 		if bucket == "" {
 			bucket = "coderipper-submissions"
 		}
-		useSSL := os.Getenv("S3_USE_SSL") != "false"
-
-		minioClient, err := minio.New(endpoint, &minio.Options{Creds: credentials.NewStaticV4(access, secret, ""), Secure: useSSL})
+		minioClient, err := newS3Client()
 		if err != nil {
-			return nil, fmt.Errorf("minio client: %w", err)
+			return nil, err
 		}
 
 		// ensure bucket exists (best-effort)
 		_ = minioClient.MakeBucket(context.Background(), bucket, minio.MakeBucketOptions{})
 
 		objKey := fmt.Sprintf("submission-%d.tar", time.Now().UnixNano())
-
-		// create tar in memory
-		var buf bytes.Buffer
-		tarw := tar.NewWriter(&buf)
-		for name, content := range req.Files {
-			h := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}
-			if err := tarw.WriteHeader(h); err != nil {
-				return nil, fmt.Errorf("tar header: %w", err)
-			}
-			if _, err := tarw.Write([]byte(content)); err != nil {
-				return nil, fmt.Errorf("tar write: %w", err)
+		contentType := "application/x-tar"
+		unpack := "tar -xf /tmp/sub -C /submission"
+		var body []byte
+		if req.Archive != nil {
+			objKey = fmt.Sprintf("submission-%d.%s", time.Now().UnixNano(), req.Archive.Format)
+			contentType = archiveMediaType(req.Archive.Format)
+			unpack = unpackArchive(req.Archive.Format, "/tmp/sub")
+			body = req.Archive.Data
+		} else {
+			// create tar in memory
+			var buf bytes.Buffer
+			tarw := tar.NewWriter(&buf)
+			for name, content := range req.Files {
+				h := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}
+				if err := tarw.WriteHeader(h); err != nil {
+					return nil, fmt.Errorf("tar header: %w", err)
+				}
+				if _, err := tarw.Write([]byte(content)); err != nil {
+					return nil, fmt.Errorf("tar write: %w", err)
+				}
 			}
+			_ = tarw.Close()
+			body = buf.Bytes()
 		}
-		_ = tarw.Close()
 
 		// upload
-		_, err = minioClient.PutObject(context.Background(), bucket, objKey, bytes.NewReader(buf.Bytes()), int64(buf.Len()), minio.PutObjectOptions{ContentType: "application/x-tar"})
+		_, err = minioClient.PutObject(context.Background(), bucket, objKey, bytes.NewReader(body), int64(len(body)), minio.PutObjectOptions{ContentType: contentType})
 		if err != nil {
 			return nil, fmt.Errorf("s3 upload: %w", err)
 		}
@@ -109,11 +225,11 @@ func submitK8sJob(req RunRequest, image string, timeout time.Duration, namespace
 			return nil, fmt.Errorf("presign: %w", err)
 		}
 
-		// init container will fetch and extract the tar into /submission
+		// init container will fetch and extract the upload into /submission
 		initContainers = []corev1.Container{{
 			Name:         "fetch-submission",
 			Image:        "alpine:3.18",
-			Command:      []string{"sh", "-c", fmt.Sprintf("apk add --no-cache curl tar >/dev/null 2>&1 && curl -fsS '%s' -o /tmp/sub.tar && mkdir -p /submission && tar -xf /tmp/sub.tar -C /submission", presigned.String())},
+			Command:      []string{"sh", "-c", fmt.Sprintf("apk add --no-cache curl tar >/dev/null 2>&1 && curl -fsS '%s' -o /tmp/sub && mkdir -p /submission && %s", presigned.String(), unpack)},
 			VolumeMounts: []corev1.VolumeMount{{Name: "submission", MountPath: "/submission"}},
 		}}
 
@@ -125,8 +241,23 @@ func submitK8sJob(req RunRequest, image string, timeout time.Duration, namespace
 			ObjectMeta: metav1.ObjectMeta{Name: cmName, Namespace: namespace},
 			Data:       map[string]string{},
 		}
-		for name, contents := range req.Files {
-			cm.Data[name] = contents
+		if req.Archive != nil {
+			// the archive goes in as is and an init container unpacks it, so directories survive
+			key := "project." + req.Archive.Format
+			cm.BinaryData = map[string][]byte{key: req.Archive.Data}
+			initContainers = []corev1.Container{{
+				Name:    "unpack-submission",
+				Image:   "alpine:3.18",
+				Command: []string{"sh", "-c", unpackArchive(req.Archive.Format, "/archive/"+key)},
+				VolumeMounts: []corev1.VolumeMount{
+					{Name: "archive", MountPath: "/archive", ReadOnly: true},
+					{Name: "submission", MountPath: "/submission"},
+				},
+			}}
+		} else {
+			for name, contents := range req.Files {
+				cm.Data[name] = contents
+			}
 		}
 		_, err = clientset.CoreV1().ConfigMaps(namespace).Create(context.Background(), cm, metav1.CreateOptions{})
 		if err != nil {
@@ -135,7 +266,37 @@ func submitK8sJob(req RunRequest, image string, timeout time.Duration, namespace
 		defer func() {
 			_ = clientset.CoreV1().ConfigMaps(namespace).Delete(context.Background(), cmName, metav1.DeleteOptions{})
 		}()
-		volumes = []corev1.Volume{{Name: "submission", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: cmName}}}}}
+		cmVolume := corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: cmName}}}
+		if req.Archive != nil {
+			volumes = []corev1.Volume{
+				{Name: "archive", VolumeSource: cmVolume},
+				{Name: "submission", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+			}
+		} else {
+			volumes = []corev1.Volume{{Name: "submission", VolumeSource: cmVolume}}
+		}
+	}
+
+	volumes = append(volumes, corev1.Volume{Name: "workspace", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}})
+	mounts := []corev1.VolumeMount{
+		{Name: "submission", MountPath: "/submission", ReadOnly: true},
+		{Name: "workspace", MountPath: workspaceDir},
+	}
+	if len(plan.deps) > 0 {
+		// the engine keeps its dependency cache (DEPS_CACHE_DIR) on this claim, one layer per directory
+		volumes = append(volumes, corev1.Volume{Name: "deps", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: os.Getenv("DEPS_PVC"), ReadOnly: true}}})
+		for _, l := range plan.deps {
+			mounts = append(mounts, corev1.VolumeMount{Name: "deps", MountPath: l.mount(), SubPath: filepath.Base(l.path), ReadOnly: true})
+		}
+	}
+	var env []corev1.EnvVar
+	envList := append(append([]string{}, plan.env...), depsEnv(plan.deps, false)...)
+	if len(plan.outputs) > 0 {
+		envList = append(envList, "CODERIPPER_OUTPUT_DIR="+workspaceDir+"/"+outputDir)
+	}
+	for _, kv := range envList {
+		k, v, _ := strings.Cut(kv, "=")
+		env = append(env, corev1.EnvVar{Name: k, Value: v})
 	}
 
 	jobName := fmt.Sprintf("runner-job-%d", time.Now().UnixNano())
@@ -154,8 +315,10 @@ func submitK8sJob(req RunRequest, image string, timeout time.Duration, namespace
 				{
 					Name:         "runner",
 					Image:        image,
-					Args:         []string{"./run.sh"},
-					VolumeMounts: []corev1.VolumeMount{{Name: "submission", MountPath: "/submission", ReadOnly: true}},
+					Command:      []string{"/bin/sh", "-c", stepScript(plan)},
+					Env:          env,
+					WorkingDir:   workspaceDir,
+					VolumeMounts: mounts,
 					Resources: corev1.ResourceRequirements{
 						Limits: corev1.ResourceList{
 							"cpu":    resourceMustParse("500m"),
@@ -250,7 +413,7 @@ forLoop:
 		}
 	}
 
-	return &K8sRunResult{Stdout: buf.String(), ExitCode: exit, Success: exit == 0}, nil
+	return &K8sRunResult{Stdout: buf.String(), ExitCode: exit, Success: exit == 0, Steps: parseStepLogs(plan, buf.String())}, nil
 }
 
 // small helpers
@@ -5,13 +5,14 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"os"
 	"path/filepath"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
 
 	"os/exec"
@@ -28,38 +29,38 @@ type RunRequest struct {
 	Stdin       string            `json:"stdin,omitempty"`
 	TimeLimit   int               `json:"timeLimitSeconds,omitempty"`
 	MemoryLimit int64             `json:"memoryLimitBytes,omitempty"`
-}
-
-// Simple in-memory rate limiter (per-IP) for demo purposes. Production should use Redis or API gateway rate limiting.
-type clientInfo struct {
-	count     int
-	windowEnd time.Time
-}
-
-type RateLimiter struct {
-	mu    sync.Mutex
-	items map[string]*clientInfo
-	max   int
-}
-
-func newRateLimiter(maxPerMinute int) *RateLimiter {
-	return &RateLimiter{items: map[string]*clientInfo{}, max: maxPerMinute}
-}
-
-func (rl *RateLimiter) allow(ip string) bool {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
-	ci, ok := rl.items[ip]
-	now := time.Now()
-	if !ok || now.After(ci.windowEnd) {
-		rl.items[ip] = &clientInfo{count: 1, windowEnd: now.Add(time.Minute)}
-		return true
-	}
-	if ci.count >= rl.max {
-		return false
-	}
-	ci.count++
-	return true
+	// NoCache skips the result cache, for programs that read the clock or randomness.
+	NoCache bool `json:"noCache,omitempty"`
+	// Args are passed to the program, Env is added to its environment (names must be
+	// allowlisted). CompileFlags go to the compiler, or the interpreter for interpreted
+	// languages, and Standard selects the language standard or edition (c++20, 17, 2021).
+	Args         []string          `json:"args,omitempty"`
+	Env          map[string]string `json:"env,omitempty"`
+	CompileFlags []string          `json:"compileFlags,omitempty"`
+	Standard     string            `json:"standard,omitempty"`
+	// Mode is "run" (the default), "check", which only compiles or type-checks, "test", which
+	// runs the submission's tests, "profile", which runs it under a profiler, or "benchmark",
+	// which runs it repeatedly.
+	Mode string `json:"mode,omitempty"`
+	// Steps replace the language's build and run with a custom pipeline.
+	Steps []RunStep `json:"steps,omitempty"`
+
+	// Outputs are globs of files the run writes that are returned as artifacts.
+	Outputs []string `json:"outputs,omitempty"`
+	// Benchmark configures the runs of mode "benchmark".
+	Benchmark *BenchmarkOptions `json:"benchmark,omitempty"`
+	// Coverage measures which lines of the submission ran, in mode "run" or "test".
+	Coverage bool `json:"coverage,omitempty"`
+	// Archive is the uploaded project, when files came as a zip or tar.gz. Files holds its
+	// contents; k8s mode forwards the archive itself.
+	Archive *ProjectArchive `json:"archive,omitempty"`
+
+	// deps are the dependency layers resolved for the submission by runners.execute
+	deps []depsLayer
+	// profiler is set when runners.execute added the profiler's files to the submission
+	profiler bool
+	// debug is the client of mode "debug"
+	debug *debugSession
 }
 
 var (
@@ -67,7 +68,14 @@ var (
 	runsDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{Namespace: "coderipper", Name: "run_duration_seconds", Help: "Run duration seconds"}, []string{"mode"})
 )
 
-// authMiddleware enforces JWT authentication and injects user_id into request context
+// runClaims are the JWT claims accepted by the exec-engine. Tier is optional and selects
+// tier-specific settings such as the OCI runtime.
+type runClaims struct {
+	Tier string `json:"tier,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// authMiddleware enforces JWT authentication and injects user_id and tier into request context
 func authMiddleware(secret string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		h := r.Header.Get("Authorization")
@@ -81,13 +89,14 @@ func authMiddleware(secret string, next http.Handler) http.Handler {
 			http.Error(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
-		claims := &jwt.RegisteredClaims{}
+		claims := &runClaims{}
 		tkn, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (any, error) { return []byte(secret), nil })
 		if err != nil || !tkn.Valid {
 			http.Error(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
 		ctx := context.WithValue(r.Context(), "user_id", claims.Subject)
+		ctx = context.WithValue(ctx, "tier", claims.Tier)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -96,146 +105,344 @@ func init() {
 	prometheus.MustRegister(runsCounter, runsDuration)
 }
 
-func runHandler(rl *RateLimiter) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		ip, _, _ := net.SplitHostPort(r.RemoteAddr)
-		if ip == "" {
-			ip = r.RemoteAddr
-		}
-		if !rl.allow(ip) {
-			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
-			runsCounter.WithLabelValues(os.Getenv("RUNNER_MODE"), "rate_limited").Inc()
-			return
-		}
+// runners holds the execution backend configured for this process and the queue in front of it.
+type runners struct {
+	mode      string
+	container *containerEngine
+	wasm      *wasmRunner
+	build     *buildCache // native compiled-language artifacts
+	deps      *depsResolver
+	queue     *runQueue
+	jobs      *jobQueue  // set when runs are handed to `exec-engine worker` processes
+	async     *asyncRuns // runs accepted with Prefer: respond-async; nil disables it
+}
 
-		var req RunRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "bad request", http.StatusBadRequest)
-			runsCounter.WithLabelValues(os.Getenv("RUNNER_MODE"), "bad_request").Inc()
-			return
+// newRunners sets up the backend selected by RUNNER_MODE: container engines are probed and
+// the wasm runtime is prepared. With JOB_QUEUE=postgres the API only enqueues runs for workers.
+func newRunners(weights map[string]int) *runners {
+	mode := os.Getenv("RUNNER_MODE")
+	// Default to native mode if not specified (best for local dev without Docker)
+	if mode == "" {
+		mode = "native"
+	}
+	rs := &runners{mode: mode, container: newContainerEngine(mode), queue: newRunQueue(mode, weights)}
+	if mode == "docker" || mode == "podman" {
+		ce := rs.container
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		ce.detect(ctx)
+		cancel()
+		log.Printf("container engine %s available=%v version=%s rootless=%v runtimes=%v", ce.Name, ce.Available, ce.Version, ce.Rootless, ce.Runtimes)
+		for _, w := range ce.Warnings {
+			log.Println("Warning:", w)
 		}
+	}
+	if mode == "native" {
+		rs.build = newBuildCache()
+	}
+	if mode == "wasm" {
+		rs.wasm = newWasmRunner()
+		log.Printf("wasm runner languages=%v", rs.wasm.languages())
+	} else if mode == "k8s" && os.Getenv("DEPS_PVC") == "" {
+		log.Println("dependency installation disabled: k8s mode needs DEPS_PVC to mount the dependency cache")
+	} else if rs.deps = newDepsResolver(); rs.deps != nil {
+		rs.deps.logConfig()
+	}
+	return rs
+}
 
-		// defaults and safety caps
-		if req.TimeLimit <= 0 {
-			req.TimeLimit = 5
+// label is the mode used in metrics; container runs are labelled with the engine name.
+func (rs *runners) label() string {
+	if rs.mode == "docker" || rs.mode == "podman" {
+		return rs.container.Name
+	}
+	return rs.mode
+}
+
+// execute runs a request on the configured backend. An error means the backend could not run
+// the submission at all; failures of the submission itself are reported in the result.
+func (rs *runners) execute(req RunRequest, tier string) (NativeResult, error) {
+	start := time.Now()
+	req = prepareProfile(req)
+	if rs.deps != nil {
+		layers, err := rs.deps.resolve(req)
+		if err != nil {
+			return depsResult(req, err), nil
 		}
-		if req.TimeLimit > 60 {
-			req.TimeLimit = 60
+		req.deps = layers
+	}
+	var res NativeResult
+	switch rs.mode {
+	case "k8s":
+		// Kubernetes path
+		namespace := os.Getenv("K8S_NAMESPACE")
+		if namespace == "" {
+			namespace = "default"
 		}
-		if req.MemoryLimit <= 0 {
-			req.MemoryLimit = 128 * 1024 * 1024
+		if req.Mode == modeBenchmark {
+			// the pod logs have no timings of the steps
+			res = NativeResult{Stderr: "Mode benchmark is not supported in k8s mode", ExitCode: 1, Success: false, Language: req.Language}
+			break
 		}
-
-		mode := os.Getenv("RUNNER_MODE")
-		// Default to native mode if not specified (best for local dev without Docker)
-		if mode == "" {
-			mode = "native"
+		plan, err := planPipeline(req, mainFileName(req.Files))
+		if err != nil {
+			res = NativeResult{Stderr: fmt.Sprintf("Cannot run %s: %v", req.Language, err), ExitCode: 1, Success: false, Language: req.Language}
+			break
 		}
-		start := time.Now()
-		if mode == "k8s" {
-			// Kubernetes path
-			namespace := os.Getenv("K8S_NAMESPACE")
-			if namespace == "" {
-				namespace = "default"
+		kres, err := submitK8sJob(req, plan, runnerImage(req.Language), plan.total, namespace)
+		if err != nil {
+			return NativeResult{}, fmt.Errorf("job submit failed: %w", err)
+		}
+		if kres.Steps != nil {
+			res = pipelineResult(req, plan, kres.Steps, 0, workspaceDir)
+		} else {
+			// the pod failed before the first step, e.g. copying the submission
+			res = NativeResult{Stdout: kres.Stdout, ExitCode: kres.ExitCode, Success: kres.Success, Language: req.Language, InfraError: true}
+		}
+		if len(plan.collects()) > 0 {
+			tarball, err := parseArtifactLogs(kres.Stdout)
+			if err != nil {
+				log.Printf("k8s artifacts: %v", err)
 			}
-			image := "coderipper/runner-python:latest"
-			if req.Language == "go" {
-				image = "coderipper/runner-go:latest"
+			collect := func(c *artifactCollector) error { return c.collectTar(bytes.NewReader(tarball)) }
+			if len(plan.outputs) > 0 {
+				c := newArtifactCollector(plan.outputs)
+				if err := collect(c); err != nil {
+					log.Printf("k8s artifacts: %v", err)
+				}
+				res.Artifacts = c.out
 			}
-			res, err := submitK8sJob(req, image, time.Duration(req.TimeLimit)*time.Second, namespace)
-			if err != nil {
-				http.Error(w, "job submit failed: "+err.Error(), http.StatusInternalServerError)
-				runsCounter.WithLabelValues("k8s", "error").Inc()
-				return
+			if plan.coverage {
+				res.Coverage = collectCoverage(req, collect)
 			}
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(res)
-			runsCounter.WithLabelValues("k8s", mapStatus(res.Success)).Inc()
-			runsDuration.WithLabelValues("k8s").Observe(time.Since(start).Seconds())
-			userID, _ := r.Context().Value("user_id").(string)
-			if userID != "" && res.Success {
-				go triggerBadge(userID, "run_success")
+			if plan.profile {
+				res.Profile = collectProfile(req, collect)
 			}
-			return
 		}
-
+	case "native":
 		// Native mode: execute code directly without Docker (for local dev)
-		if mode == "native" {
-			result := executeNative(req)
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(result)
-			runsCounter.WithLabelValues("native", mapStatus(result.Success)).Inc()
-			runsDuration.WithLabelValues("native").Observe(time.Since(start).Seconds())
-			return
-		}
+		res = executeNative(req, rs.build)
+	case "wasm":
+		// Wasm mode: WASI modules run in-process, no Docker or kernel features needed
+		res = executeWasm(req, rs.wasm)
+	default:
+		// Container mode: docker or podman, optionally under an alternate OCI runtime (e.g. gVisor's runsc)
+		res = executeContainer(req, rs.container, rs.container.runtimeFor(req.Language, tier))
+	}
+	res.WallTimeMs = time.Since(start).Milliseconds()
+	return res, nil
+}
 
-		// Docker mode: use Docker containers
-		image := "coderipper/runner-python:latest"
-		if req.Language == "go" {
-			image = "coderipper/runner-go:latest"
-		}
+// depsResult reports a submission whose dependencies could not be installed.
+func depsResult(req RunRequest, err error) NativeResult {
+	var de *depsError
+	var ve *validationError
+	switch {
+	case errors.As(err, &de):
+		// a mirror outage looks the same as a missing package, so this is never cached
+		return NativeResult{Stderr: "Dependency installation failed:\n" + de.output, ExitCode: 1, Success: false, Language: req.Language, InfraError: true}
+	case errors.As(err, &ve):
+		return NativeResult{Stderr: ve.Error(), ExitCode: 1, Success: false, Language: req.Language}
+	}
+	log.Printf("dependency installation: %v", err)
+	return NativeResult{Stderr: "Failed to install dependencies: " + err.Error(), ExitCode: 1, Success: false, Language: req.Language, InfraError: true}
+}
+
+// submitJob hands a run to the worker pool and waits for its result, for as long as the run
+// may take plus a grace period for queueing. It returns the queue position and wait like acquire.
+func (rs *runners) submitJob(ctx context.Context, req RunRequest, userID, tier string, weight int) (NativeResult, int, time.Duration, error) {
+	id, position, err := rs.jobs.submit(ctx, req, userID, tier, weight, "")
+	if err != nil {
+		return NativeResult{}, 0, 0, err
+	}
+	res, wait, err := rs.jobs.wait(ctx, id, jobWaitTimeout(req))
+	return res, position, wait, err
+}
 
-		// write files - use os.TempDir() for cross-platform compatibility
-		tmpDir, err := os.MkdirTemp("", "submission-*")
+// jobWaitTimeout is how long the API waits for a job: the run's time limit plus a grace
+// period for queueing.
+func jobWaitTimeout(req RunRequest) time.Duration {
+	grace := time.Duration(envInt("JOB_WAIT_GRACE_SECONDS", 60)) * time.Second
+	if req.Mode == modeBenchmark {
+		return time.Duration(benchmarkSeconds(req))*time.Second + grace
+	}
+	return time.Duration(req.TimeLimit)*time.Second + grace
+}
+
+func runHandler(rs *runners, tp *tierPolicies, q *quotas, rc *resultCache, limits requestLimits) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		label := rs.label()
+		req, err := decodeRunRequest(r, limits)
+		if err == nil {
+			err = limits.validate(req)
+		}
 		if err != nil {
-			http.Error(w, "internal error", http.StatusInternalServerError)
-			log.Println("temp dir error:", err)
-			runsCounter.WithLabelValues("docker", "error").Inc()
+			writeRequestError(w, err)
+			runsCounter.WithLabelValues(label, "bad_request").Inc()
 			return
 		}
-		defer os.RemoveAll(tmpDir)
 
-		for name, content := range req.Files {
-			p := filepath.Join(tmpDir, name)
-			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
-				log.Println("mkdir error:", err)
+		// defaults and safety caps come from the caller's tier
+		userID, _ := r.Context().Value("user_id").(string)
+		claimTier, _ := r.Context().Value("tier").(string)
+		tier, policy := tp.resolve(claimTier)
+		policy.applyLimits(&req)
+		if err := checkBenchmarkBudget(req, policy); err != nil {
+			writeRequestError(w, err)
+			runsCounter.WithLabelValues(label, "bad_request").Inc()
+			return
+		}
+		if userID != "" {
+			st, err := q.status(r.Context(), userID, tier, policy)
+			if err != nil {
+				// like the rate limiter, an unavailable store does not block runs
+				log.Println("quota store error:", err)
+			} else if kind := st.exceeded(); kind != "" && (kind != "run" || req.Mode != modeCheck) {
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(time.Until(st.ResetsAt))))
+				http.Error(w, "daily "+kind+" quota exceeded", http.StatusTooManyRequests)
+				runsCounter.WithLabelValues(label, "quota_exceeded").Inc()
+				return
 			}
-			if err := os.WriteFile(p, []byte(content), 0644); err != nil {
-				log.Println("write file error:", err)
+		}
+		// identical deterministic runs are answered from the result cache
+		var cacheKey string
+		if rc != nil {
+			// profiles and benchmarks measure this run, not the program
+			if req.NoCache || req.Mode == modeProfile || req.Mode == modeBenchmark || strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+				w.Header().Set("X-Cache", "BYPASS")
+				resultCacheRequests.WithLabelValues("bypass").Inc()
+			} else {
+				cacheKey = rc.key(rs, req)
+				cached, err := rc.store.get(r.Context(), cacheKey)
+				if err != nil {
+					log.Println("result cache error:", err)
+				} else if cached != nil {
+					cached.Cached = true
+					resultCacheRequests.WithLabelValues("hit").Inc()
+					runsCounter.WithLabelValues(label, "cached").Inc()
+					w.Header().Set("X-Cache", "HIT")
+					w.Header().Set("Content-Type", "application/json")
+					json.NewEncoder(w).Encode(cached)
+					return
+				}
+				w.Header().Set("X-Cache", "MISS")
+				resultCacheRequests.WithLabelValues("miss").Inc()
 			}
 		}
-
-		// build docker run command
-		mem := fmt.Sprintf("%dm", req.MemoryLimit/(1024*1024))
-		ctx2, cancel := context.WithTimeout(context.Background(), time.Duration(req.TimeLimit)*time.Second)
-		defer cancel()
-		cmd := exec.CommandContext(ctx2, "docker", "run", "--rm", "--network", "none", "-v", tmpDir+":/submission:ro", "--memory", mem, "--cpus", "1", image, "./run.sh")
-		out, err := cmd.CombinedOutput()
-		if ctx2.Err() == context.DeadlineExceeded {
-			w.Write([]byte("\n--- run timeout ---\n"))
-			runsCounter.WithLabelValues("docker", "timeout").Inc()
+		if !tp.begin(userID, policy) {
+			http.Error(w, "too many concurrent runs", http.StatusTooManyRequests)
+			runsCounter.WithLabelValues(label, "concurrency_limited").Inc()
 			return
 		}
-		if err != nil {
-			// capture exit code if possible
-			if exitErr, ok := err.(*exec.ExitError); ok {
-				log.Println("container exited with code:", exitErr.ExitCode())
-			} else {
-				log.Println("docker run error:", err)
-			}
+		async := rs.async != nil && preferAsync(r)
+		if !async {
+			defer tp.end(userID)
 		}
 
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write(out)
+		// finish records a run that executed: it is cached, charged and counted
+		finish := func(result NativeResult, start time.Time) {
+			if cacheKey != "" && cacheable(result) {
+				if err := rc.store.set(context.Background(), cacheKey, result, rc.ttl); err != nil {
+					log.Println("result cache error:", err)
+				}
+			}
+			if userID != "" {
+				if err := q.charge(context.Background(), userID, req, result); err != nil {
+					log.Println("quota store error:", err)
+				}
+			}
+			if rs.jobs == nil {
+				// with the job queue, workers count their own runs
+				runsCounter.WithLabelValues(label, mapStatus(result.Success)).Inc()
+				runsDuration.WithLabelValues(label).Observe(time.Since(start).Seconds())
+			}
+			// badge trigger (best-effort)
+			if userID != "" && result.Success {
+				go triggerBadge(userID, "run_success")
+			}
+		}
 
-		// determine exit code from exec result
-		exitCode := 0
-		if err != nil {
-			if exitErr, ok := err.(*exec.ExitError); ok {
-				exitCode = exitErr.ExitCode()
-			} else {
-				exitCode = 1
+		// wait for a worker; callers learn their position from X-Queue-Position, or from
+		// GET /runs/{id} while they wait if they sent Prefer: respond-async
+		start := time.Now()
+		var result NativeResult
+		var accepted asyncRun
+		var position int
+		var wait time.Duration
+		switch {
+		case async:
+			accepted, err = rs.startAsync(r.Context(), req, userID, tier, policy.Weight, finish, func() { tp.end(userID) })
+		case rs.jobs != nil:
+			result, position, wait, err = rs.submitJob(r.Context(), req, userID, tier, policy.Weight)
+		default:
+			position, wait, err = rs.queue.acquire(r.Context(), tier, nil)
+			if err == nil {
+				start = time.Now()
+				result, err = rs.execute(req, tier)
+				rs.queue.release(time.Since(start))
 			}
 		}
+		switch {
+		case err == errQueueFull:
+			w.Header().Set("Retry-After", strconv.Itoa(rs.queue.retryAfter()))
+			http.Error(w, "run queue full", http.StatusServiceUnavailable)
+			runsCounter.WithLabelValues(label, "queue_full").Inc()
+			return
+		case err == errJobTimeout:
+			http.Error(w, err.Error(), http.StatusGatewayTimeout)
+			runsCounter.WithLabelValues(label, "timeout").Inc()
+			return
+		case err != nil && r.Context().Err() != nil:
+			// client went away while queued; runs that did execute are still recorded below
+			runsCounter.WithLabelValues(label, "cancelled").Inc()
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			runsCounter.WithLabelValues(label, "error").Inc()
+			return
+		}
+		if async {
+			w.Header().Set("Location", "/runs/"+accepted.ID)
+			w.Header().Set("X-Queue-Position", strconv.Itoa(accepted.Position))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(accepted)
+			return
+		}
+		finish(result, start)
+		w.Header().Set("X-Queue-Position", strconv.Itoa(position))
+		w.Header().Set("X-Queue-Wait-Ms", strconv.FormatInt(wait.Milliseconds(), 10))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
 
-		success := exitCode == 0
-		runsCounter.WithLabelValues("docker", mapStatus(success)).Inc()
-		runsDuration.WithLabelValues("docker").Observe(time.Since(start).Seconds())
-		// badge trigger (best-effort)
-		userID, _ := r.Context().Value("user_id").(string)
-		if userID != "" && success {
-			go triggerBadge(userID, "run_success")
+// readyHandler reports readiness. With the Postgres job queue it checks the database, since
+// runs execute on workers. Otherwise, in container modes it includes the detected engine
+// capabilities and fails when the engine is unreachable; in wasm mode it lists the
+// languages that can be run.
+func readyHandler(rs *runners) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := map[string]interface{}{"status": "ready", "mode": rs.mode}
+		code := http.StatusOK
+		switch {
+		case rs.jobs != nil:
+			status["jobQueue"] = "postgres"
+			if err := rs.jobs.db.PingContext(r.Context()); err != nil {
+				status["status"] = "unavailable"
+				code = http.StatusServiceUnavailable
+			}
+		case rs.mode == "docker" || rs.mode == "podman":
+			status["container"] = rs.container
+			if !rs.container.Available {
+				status["status"] = "unavailable"
+				code = http.StatusServiceUnavailable
+			}
+		case rs.mode == "wasm":
+			status["wasm"] = map[string]interface{}{"languages": rs.wasm.languages()}
 		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(status)
 	}
 }
 
@@ -278,164 +485,153 @@ type NativeResult struct {
 	ExitCode int    `json:"exitCode"`
 	Success  bool   `json:"success"`
 	Language string `json:"language"`
+	// CPUTimeMs is user+system CPU time of the submission where the backend can measure it
+	// (native); WallTimeMs is always set.
+	CPUTimeMs  int64 `json:"cpuTimeMs,omitempty"`
+	WallTimeMs int64 `json:"wallTimeMs"`
+	// Cached is set when the result was served from the result cache without running.
+	Cached bool `json:"cached,omitempty"`
+	// InfraError is set when the submission could not be run because of the host (missing
+	// toolchain, temp dir or write failure, broken runtime), not because of the code. Such
+	// results are never cached.
+	InfraError bool `json:"infraError,omitempty"`
+	// Steps and FailedStep report a custom pipeline; the fields above are those of its last step.
+	Steps      []StepResult `json:"steps,omitempty"`
+	FailedStep string       `json:"failedStep,omitempty"`
+	Artifacts  []Artifact   `json:"artifacts,omitempty"`
+	// Diagnostics are the errors and warnings found in the output, located in submission files.
+	// Stdout and stderr stay as the tools printed them.
+	Diagnostics []Diagnostic `json:"diagnostics,omitempty"`
+	// Tests and TestSummary are the results of mode "test"
+	Tests       []TestCase   `json:"tests,omitempty"`
+	TestSummary *TestSummary `json:"testSummary,omitempty"`
+	// Coverage is the line coverage of the submission files, when the request asked for it
+	Coverage []FileCoverage `json:"coverage,omitempty"`
+	// Profile holds the CPU and memory profiles of mode "profile"
+	Profile *Profile `json:"profile,omitempty"`
+	// Benchmark has the statistics of mode "benchmark"; the fields above are its last run
+	Benchmark *BenchmarkResult `json:"benchmark,omitempty"`
 }
 
-// executeNative runs code directly on the host machine (for local development)
-func executeNative(req RunRequest) NativeResult {
+// executeNative runs code directly on the host machine (for local development).
+// Compiled languages reuse artifacts from bc when it is not nil.
+func executeNative(req RunRequest, bc *buildCache) NativeResult {
 	// Create temp directory for files
 	tmpDir, err := os.MkdirTemp("", "coderipper-native-*")
 	if err != nil {
-		return NativeResult{Stderr: "Failed to create temp directory: " + err.Error(), ExitCode: 1, Success: false}
+		return NativeResult{Stderr: "Failed to create temp directory: " + err.Error(), ExitCode: 1, Success: false, InfraError: true}
 	}
 	defer os.RemoveAll(tmpDir)
 
 	// Write files to temp directory
-	var mainFile string
-	for name, content := range req.Files {
-		p := filepath.Join(tmpDir, name)
-		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
-			return NativeResult{Stderr: "Failed to create directory: " + err.Error(), ExitCode: 1, Success: false}
-		}
-		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
-			return NativeResult{Stderr: "Failed to write file: " + err.Error(), ExitCode: 1, Success: false}
-		}
-		// Track the main file
-		if mainFile == "" {
-			mainFile = p
-		}
+	mainFile, err := writeSubmissionFiles(tmpDir, req.Files)
+	if err != nil {
+		return NativeResult{Stderr: "Failed to write files: " + err.Error(), ExitCode: 1, Success: false, InfraError: true, Language: req.Language}
 	}
 
-	// Determine command based on language
-	var cmd *exec.Cmd
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(req.TimeLimit)*time.Second)
-	defer cancel()
-
-	switch req.Language {
-	case "python", "python3":
-		cmd = exec.CommandContext(ctx, "python", mainFile)
-	case "javascript", "js", "node":
-		cmd = exec.CommandContext(ctx, "node", mainFile)
-	case "typescript", "ts":
-		// For TypeScript, we need ts-node or compile first
-		cmd = exec.CommandContext(ctx, "npx", "ts-node", mainFile)
-	case "go", "golang":
-		cmd = exec.CommandContext(ctx, "go", "run", mainFile)
-	case "java":
-		// Compile and run Java
-		className := filepath.Base(mainFile)
-		className = className[:len(className)-len(filepath.Ext(className))]
-		compileCmd := exec.CommandContext(ctx, "javac", mainFile)
-		compileCmd.Dir = tmpDir
-		if out, err := compileCmd.CombinedOutput(); err != nil {
-			return NativeResult{Stderr: "Compilation failed:\n" + string(out), ExitCode: 1, Success: false, Language: req.Language}
-		}
-		cmd = exec.CommandContext(ctx, "java", "-cp", tmpDir, className)
-	case "c":
-		outFile := filepath.Join(tmpDir, "a.out")
-		compileCmd := exec.CommandContext(ctx, "gcc", mainFile, "-o", outFile)
-		if out, err := compileCmd.CombinedOutput(); err != nil {
-			return NativeResult{Stderr: "Compilation failed:\n" + string(out), ExitCode: 1, Success: false, Language: req.Language}
-		}
-		cmd = exec.CommandContext(ctx, outFile)
-	case "cpp", "c++":
-		outFile := filepath.Join(tmpDir, "a.out")
-		compileCmd := exec.CommandContext(ctx, "g++", mainFile, "-o", outFile)
-		if out, err := compileCmd.CombinedOutput(); err != nil {
-			return NativeResult{Stderr: "Compilation failed:\n" + string(out), ExitCode: 1, Success: false, Language: req.Language}
-		}
-		cmd = exec.CommandContext(ctx, outFile)
-	case "rust":
-		outFile := filepath.Join(tmpDir, "main")
-		compileCmd := exec.CommandContext(ctx, "rustc", mainFile, "-o", outFile)
-		if out, err := compileCmd.CombinedOutput(); err != nil {
-			return NativeResult{Stderr: "Compilation failed:\n" + string(out), ExitCode: 1, Success: false, Language: req.Language}
-		}
-		cmd = exec.CommandContext(ctx, outFile)
-	case "ruby":
-		cmd = exec.CommandContext(ctx, "ruby", mainFile)
-	case "php":
-		cmd = exec.CommandContext(ctx, "php", mainFile)
-	case "bash", "sh", "shell":
-		cmd = exec.CommandContext(ctx, "bash", mainFile)
-	case "powershell", "ps1":
-		cmd = exec.CommandContext(ctx, "powershell", "-ExecutionPolicy", "Bypass", "-File", mainFile)
-	default:
+	rel, _ := filepath.Rel(tmpDir, mainFile)
+	plan, err := planPipeline(req, filepath.ToSlash(rel))
+	if err == errUnsupportedLanguage {
 		return NativeResult{
-			Stderr:   fmt.Sprintf("Language '%s' is not supported for native execution. Supported: python, javascript, typescript, go, java, c, cpp, rust, ruby, php, bash, powershell", req.Language),
+			Stderr:   fmt.Sprintf("Language '%s' is not supported for native execution. Supported: %s", req.Language, supportedLanguages()),
 			ExitCode: 1,
 			Success:  false,
 			Language: req.Language,
 		}
 	}
-
-	// Set up stdin if provided
-	if req.Stdin != "" {
-		cmd.Stdin = bytes.NewBufferString(req.Stdin)
+	if err != nil {
+		return NativeResult{Stderr: err.Error(), ExitCode: 1, Success: false, Language: req.Language}
+	}
+	if err := linkDeps(req.deps, tmpDir); err != nil {
+		return NativeResult{Stderr: "Failed to link dependencies: " + err.Error(), ExitCode: 1, Success: false, InfraError: true, Language: req.Language}
+	}
+	plan.env = append(plan.env, depsEnv(req.deps, true)...)
+	if len(req.Outputs) > 0 {
+		// a submission file of the same name wins; the run can still create the directory
+		os.Mkdir(filepath.Join(tmpDir, outputDir), 0755)
+		plan.env = append(plan.env, "CODERIPPER_OUTPUT_DIR="+filepath.Join(tmpDir, outputDir))
 	}
+	return runPipeline(context.Background(), &nativeSandbox{dir: tmpDir}, plan, bc, req)
+}
 
-	// Capture stdout and stderr
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	cmd.Dir = tmpDir
+// cpuTime is the user plus system CPU time used by a finished command and the children it waited for.
+func cpuTime(cmd *exec.Cmd) time.Duration {
+	if cmd.ProcessState == nil {
+		return 0
+	}
+	return cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime()
+}
 
-	// Run the command
-	err = cmd.Run()
-	exitCode := 0
+func main() {
+	tp, err := loadTierPolicies()
 	if err != nil {
-		if ctx.Err() == context.DeadlineExceeded {
-			return NativeResult{
-				Stdout:   stdout.String(),
-				Stderr:   "Execution timed out after " + fmt.Sprintf("%d", req.TimeLimit) + " seconds",
-				ExitCode: 124,
-				Success:  false,
-				Language: req.Language,
-			}
-		}
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			exitCode = exitErr.ExitCode()
-		} else {
-			// Command not found or other error
-			return NativeResult{
-				Stdout:   stdout.String(),
-				Stderr:   stderr.String() + "\nError: " + err.Error(),
-				ExitCode: 1,
-				Success:  false,
-				Language: req.Language,
-			}
+		log.Fatal(err)
+	}
+	rs := newRunners(tp.weights())
+	if len(os.Args) > 1 && os.Args[1] == "worker" {
+		runWorker(rs)
+		return
+	}
+	if os.Getenv("JOB_QUEUE") == "postgres" {
+		if rs.jobs, err = openJobQueue(); err != nil {
+			log.Fatal(err)
 		}
+		log.Println("job queue: postgres, runs are executed by exec-engine workers")
+	} else {
+		log.Printf("run queue: %d workers, %d queued max", rs.queue.workers, rs.queue.capacity)
 	}
 
-	return NativeResult{
-		Stdout:   stdout.String(),
-		Stderr:   stderr.String(),
-		ExitCode: exitCode,
-		Success:  exitCode == 0,
-		Language: req.Language,
-	}
-}
+	rs.async = newAsyncRuns(rs.jobs)
 
-func main() {
-	rl := newRateLimiter(60) // 60 runs per minute per IP default
+	rl, err := newRateLimitBackend()
+	if err != nil {
+		log.Fatal(err)
+	}
+	rlc, err := loadRateLimitConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	q, err := newQuotas()
+	if err != nil {
+		log.Fatal(err)
+	}
+	limits := loadRequestLimits()
+	idem, err := newIdempotency(limits.maxBodyBytes, rlc)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rc, err := newResultCache()
+	if err != nil {
+		log.Fatal(err)
+	}
 	http.Handle("/metrics", promhttp.Handler())
 	// health checks
 	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK); w.Write([]byte("ok")) })
-	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK); w.Write([]byte("ready")) })
+	http.HandleFunc("/readyz", readyHandler(rs))
 
 	// wrap run endpoint with auth middleware
 	authSecret := os.Getenv("AUTH_JWT_SECRET")
 	if authSecret == "" {
 		log.Println("Warning: AUTH_JWT_SECRET not set — /run will be unauthenticated")
-		http.HandleFunc("/run", runHandler(rl))
+		http.Handle("/run", bodyLimitMiddleware(limits.maxBodyBytes, rateLimitMiddleware(rl, rlc, "/run", idem.middleware(runHandler(rs, tp, q, rc, limits)))))
+		http.Handle("/format", bodyLimitMiddleware(limits.maxBodyBytes, rateLimitMiddleware(rl, rlc, "/format", formatHandler(rs, tp, q, limits))))
+		http.Handle("/debug", rateLimitMiddleware(rl, rlc, "/debug", debugHandler(rs, tp, q, limits)))
+		http.HandleFunc("/usage", usageHandler(q, tp))
+		http.HandleFunc("/runs/", runStatusHandler(rs.async))
 	} else {
-		http.Handle("/run", authMiddleware(authSecret, runHandler(rl)))
+		// authenticate first so per-user policies see the user ID
+		http.Handle("/run", bodyLimitMiddleware(limits.maxBodyBytes, authMiddleware(authSecret, rateLimitMiddleware(rl, rlc, "/run", idem.middleware(runHandler(rs, tp, q, rc, limits))))))
+		http.Handle("/format", bodyLimitMiddleware(limits.maxBodyBytes, authMiddleware(authSecret, rateLimitMiddleware(rl, rlc, "/format", formatHandler(rs, tp, q, limits)))))
+		http.Handle("/debug", protocolTokenMiddleware(authMiddleware(authSecret, rateLimitMiddleware(rl, rlc, "/debug", debugHandler(rs, tp, q, limits)))))
+		http.Handle("/usage", authMiddleware(authSecret, usageHandler(q, tp)))
+		http.Handle("/runs/", authMiddleware(authSecret, runStatusHandler(rs.async)))
 	}
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8081"
 	}
-	log.Printf("exec-engine listening on :%s (mode=%s)", port, os.Getenv("RUNNER_MODE"))
+	log.Printf("exec-engine listening on :%s (mode=%s)", port, rs.mode)
 	if err := http.ListenAndServe(":"+port, nil); err != nil {
 		log.Fatal(err)
 	}
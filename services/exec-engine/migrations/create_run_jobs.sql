@@ -0,0 +1,24 @@
+-- Run jobs handed from the exec-engine API to `exec-engine worker` processes (JOB_QUEUE=postgres).
+CREATE TABLE IF NOT EXISTS run_jobs (
+  id BIGSERIAL PRIMARY KEY,
+  user_id TEXT NOT NULL DEFAULT '',
+  tier TEXT NOT NULL DEFAULT 'free',
+  request JSONB NOT NULL,
+  status TEXT NOT NULL DEFAULT 'queued', -- queued, running, done, failed, cancelled
+  result JSONB,
+  error TEXT,
+  worker_id TEXT,
+  attempts INT NOT NULL DEFAULT 0,
+  sort_key TIMESTAMPTZ NOT NULL, -- created_at minus the tier's priority boost
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  claimed_at TIMESTAMPTZ,
+  heartbeat_at TIMESTAMPTZ,
+  finished_at TIMESTAMPTZ
+);
+
+-- the id of runs accepted with Prefer: respond-async, for GET /runs/{id} on any API replica
+ALTER TABLE run_jobs ADD COLUMN IF NOT EXISTS async_id TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS run_jobs_async_idx ON run_jobs (async_id) WHERE async_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS run_jobs_queued_idx ON run_jobs (sort_key) WHERE status = 'queued';
+CREATE INDEX IF NOT EXISTS run_jobs_running_idx ON run_jobs (heartbeat_at) WHERE status = 'running';
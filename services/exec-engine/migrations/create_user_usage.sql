@@ -0,0 +1,8 @@
+-- Daily execution usage per user, for tier quotas (QUOTA_STORE=postgres).
+CREATE TABLE IF NOT EXISTS user_usage (
+  user_id TEXT NOT NULL,
+  day DATE NOT NULL, -- UTC
+  runs INT NOT NULL DEFAULT 0,
+  cpu_ms BIGINT NOT NULL DEFAULT 0,
+  PRIMARY KEY (user_id, day)
+);
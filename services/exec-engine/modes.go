@@ -0,0 +1,56 @@
+package main
+
+// Run modes select what a request does with the submission. The default runs it.
+const (
+	modeRun = "run"
+	// modeCheck only compiles or type-checks the submission and reports diagnostics
+	modeCheck = "check"
+	// modeTest runs the submission's tests with their framework and reports each test
+	modeTest = "test"
+	// modeProfile runs the program under the language's profiler and returns its profiles
+	modeProfile = "profile"
+	// modeBenchmark runs the program repeatedly after a single build and returns statistics
+	modeBenchmark = "benchmark"
+	// modeFormat runs the language's formatter on each file; it is set by POST /format only
+	modeFormat = "format"
+	// modeDebug runs the program under a debug adapter connected to a client; it is set by
+	// GET /debug only
+	modeDebug = "debug"
+)
+
+// validateMode checks a request's mode against its language and options.
+func validateMode(req RunRequest) error {
+	switch req.Mode {
+	case "", modeRun:
+		return nil
+	case modeCheck, modeTest:
+		if len(req.Steps) > 0 {
+			return invalid("steps cannot be combined with mode %q", req.Mode)
+		}
+		spec, ok := languages[canonicalLanguage(req.Language)]
+		if !ok {
+			return nil
+		}
+		if req.Mode == modeCheck && spec.check == nil {
+			return invalid("mode %q is not supported for %s", req.Mode, req.Language)
+		}
+		if _, ok := detectTestFramework(req); req.Mode == modeTest && !ok {
+			return invalid("mode %q is not supported for %s (pytest, go test, JUnit, jest and node:test are)", req.Mode, req.Language)
+		}
+		return nil
+	case modeBenchmark:
+		if len(req.Steps) > 0 {
+			return invalid("steps cannot be combined with mode %q", req.Mode)
+		}
+		return nil
+	case modeProfile:
+		if len(req.Steps) > 0 {
+			return invalid("steps cannot be combined with mode %q", req.Mode)
+		}
+		if _, ok := profilers[canonicalLanguage(req.Language)]; !ok {
+			return invalid("mode %q is not supported for %s (Go, Python and JavaScript are)", req.Mode, req.Language)
+		}
+		return nil
+	}
+	return invalid("unknown mode %q (want run, check, test, profile or benchmark)", req.Mode)
+}
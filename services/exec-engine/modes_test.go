@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestValidateMode(t *testing.T) {
+	cases := []struct {
+		name string
+		req  RunRequest
+		ok   bool
+	}{
+		{"default", RunRequest{Language: "python"}, true},
+		{"run", RunRequest{Language: "python", Mode: "run"}, true},
+		{"check", RunRequest{Language: "go", Mode: "check"}, true},
+		{"unknown", RunRequest{Language: "python", Mode: "deploy"}, false},
+		{"check with steps", RunRequest{Language: "bash", Mode: "check", Steps: []RunStep{{Name: "build", Command: "make"}}}, false},
+		{"no checker", RunRequest{Language: "powershell", Mode: "check"}, false},
+		{"test", RunRequest{Language: "python", Mode: "test"}, true},
+		{"test with jest", RunRequest{Language: "typescript", Mode: "test", Files: map[string]string{"package.json": `{"devDependencies": {"jest": "^29"}}`}}, true},
+		{"no test framework", RunRequest{Language: "typescript", Mode: "test"}, false},
+		{"profile", RunRequest{Language: "golang", Mode: "profile"}, true},
+		{"no profiler", RunRequest{Language: "rust", Mode: "profile"}, false},
+		{"benchmark", RunRequest{Language: "c", Mode: "benchmark"}, true},
+		{"benchmark with steps", RunRequest{Language: "c", Mode: "benchmark", Steps: []RunStep{{Name: "run", Command: "./main"}}}, false},
+		{"test with steps", RunRequest{Language: "go", Mode: "test", Steps: []RunStep{{Name: "test", Command: "go test"}}}, false},
+	}
+	for _, c := range cases {
+		if err := validateMode(c.req); (err == nil) != c.ok {
+			t.Errorf("%s: err = %v", c.name, err)
+		}
+	}
+}
+
+func TestNativeCheck(t *testing.T) {
+	res := executeNative(RunRequest{Language: "c", Mode: modeCheck, TimeLimit: 10, Files: map[string]string{"main.c": "#include <stdio.h>\nint main(void) {\n  int unused;\n  puts(\"ran\");\n}\n"}}, nil)
+	if !res.Success || res.Stdout != "" || len(res.Diagnostics) != 1 || res.Diagnostics[0].Code != "-Wunused-variable" {
+		t.Fatalf("check should compile without running: %+v", res)
+	}
+
+	res = executeNative(RunRequest{Language: "javascript", Mode: modeCheck, TimeLimit: 10, Files: map[string]string{"main.js": "console.log('ran')\nlet x = ;\n"}}, nil)
+	if res.Success || res.Stdout != "" || len(res.Diagnostics) != 1 || res.Diagnostics[0].Line != 2 || res.Diagnostics[0].Code != "SyntaxError" {
+		t.Fatalf("syntax error: %+v", res)
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RunStep is one step of a custom pipeline. Command runs with /bin/sh -c in the workspace,
+// which all steps of a run share.
+type RunStep struct {
+	Name string `json:"name"` // setup, build, run or test
+	// Command is e.g. "make", "go build ./..." or "mvn -o package"
+	Command string `json:"command"`
+	// TimeoutSeconds defaults to and is capped at the request's timeLimitSeconds, which also
+	// bounds the whole pipeline
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty"`
+}
+
+// StepResult is the outcome of one pipeline step.
+type StepResult struct {
+	Name       string `json:"name"`
+	Stdout     string `json:"stdout"`
+	Stderr     string `json:"stderr"`
+	ExitCode   int    `json:"exitCode"`
+	TimedOut   bool   `json:"timedOut,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+	// timeoutNote explains a timeout in the response's stderr
+	timeoutNote string
+	// wall and usage are the step's measurements, for benchmarks
+	wall  time.Duration
+	usage stepUsage
+}
+
+// stepUsage is what a sandbox measured of a step. Only native mode measures CPU time and
+// memory; a zero value means unknown.
+type stepUsage struct {
+	cpu        time.Duration
+	peakMemory int64 // peak resident set size, bytes
+	pinned     bool  // the step ran on benchmarkCPU only
+}
+
+// stepTimeoutNote is the timeoutNote of a step that ran out of its own time.
+func stepTimeoutNote(step planStep) string {
+	return fmt.Sprintf("Step %q timed out after %d seconds", step.name, int(step.timeout.Seconds()))
+}
+
+// stepStages orders step names; a pipeline may skip stages but not go back.
+var stepStages = map[string]int{"setup": 0, "build": 1, "run": 2, "test": 3}
+
+const maxSteps = 10
+
+// validateSteps checks the steps of a request.
+func validateSteps(steps []RunStep) error {
+	if len(steps) > maxSteps {
+		return tooLarge("at most %d steps", maxSteps)
+	}
+	last := 0
+	for i, s := range steps {
+		stage, ok := stepStages[s.Name]
+		if !ok {
+			return invalid("step %d: name must be setup, build, run or test", i+1)
+		}
+		if stage < last {
+			return invalid("step %d: %s cannot come after a later stage", i+1, s.Name)
+		}
+		last = stage
+		if strings.TrimSpace(s.Command) == "" {
+			return invalid("step %d: command is required", i+1)
+		}
+		if len(s.Command) > maxOptionSize || strings.ContainsRune(s.Command, 0) {
+			return invalid("step %d: command must be under %d bytes without NUL", i+1, maxOptionSize)
+		}
+		if s.TimeoutSeconds < 0 {
+			return invalid("step %d: timeoutSeconds must not be negative", i+1)
+		}
+	}
+	return nil
+}
+
+// planStep is a command a sandbox runs as part of a pipeline.
+type planStep struct {
+	name    string
+	argv    []string
+	timeout time.Duration
+	stdin   string
+	// pin runs the step on a single CPU where the sandbox can
+	pin bool
+	// stream connects an interactive step to its client; input is its stdin then
+	stream stepStream
+	input  io.Reader
+	// cacheable marks the build of the default pipeline, whose outputs (artifacts, or class
+	// files for Java) the build cache keeps
+	cacheable bool
+	artifacts []string
+}
+
+// stepStream connects an interactive step, such as a debug adapter, to its client.
+type stepStream interface {
+	// open returns the stdin and stdout of the step, which runs in the workspace root
+	open(root string) (stdin io.Reader, stdout io.Writer)
+	// close ends the stream once the step exited
+	close()
+	// context is canceled when the client goes away, which stops the step
+	context() context.Context
+}
+
+// pipelinePlan is everything a backend needs to run a request.
+type pipelinePlan struct {
+	steps   []planStep
+	env     []string
+	deps    []depsLayer   // mounted read-only in container sandboxes
+	outputs []string      // globs of files returned as artifacts
+	custom  bool          // steps came from the request rather than the language defaults
+	total   time.Duration // deadline for the whole pipeline, the request's time limit
+	// coverage is set when the steps write coverageReport, profile when they leave profiles
+	coverage bool
+	profile  bool
+}
+
+// collects returns the globs of the workspace files collected after the pipeline: the outputs,
+// and the coverage report.
+func (p pipelinePlan) collects() []string {
+	globs := p.outputs
+	if p.coverage {
+		globs = append(append([]string{}, globs...), coverageReport)
+	}
+	if p.profile {
+		globs = append(append([]string{}, globs...), profileGlobs...)
+	}
+	return globs
+}
+
+// planPipeline returns the steps for a request: its own steps, or the build and run commands
+// of its language. mainFile is the slash-separated path of the entry point.
+func planPipeline(req RunRequest, mainFile string) (pipelinePlan, error) {
+	limit := time.Duration(req.TimeLimit) * time.Second
+	if len(req.Steps) > 0 {
+		// the time limit covers the whole pipeline, as it does a single run
+		p := pipelinePlan{env: requestEnv(req), deps: req.deps, outputs: req.Outputs, custom: true, total: limit}
+		for _, s := range req.Steps {
+			timeout := limit
+			if s.TimeoutSeconds > 0 && s.TimeoutSeconds < req.TimeLimit {
+				timeout = time.Duration(s.TimeoutSeconds) * time.Second
+			}
+			step := planStep{name: s.Name, argv: []string{"/bin/sh", "-c", s.Command}, timeout: timeout}
+			if s.Name == "run" {
+				step.stdin = req.Stdin
+			}
+			p.steps = append(p.steps, step)
+		}
+		return p, nil
+	}
+	if req.Mode == modeFormat {
+		return planFormat(req, limit), nil
+	}
+	plan, err := planCommands(req, mainFile)
+	if err != nil {
+		return pipelinePlan{}, err
+	}
+	// build and run share the time limit, as a single run always has
+	p := pipelinePlan{env: plan.env, deps: req.deps, outputs: req.Outputs, total: limit}
+	switch req.Mode {
+	case modeCheck:
+		p.steps = []planStep{{name: "check", argv: plan.check, timeout: limit}}
+		return p, nil
+	case modeTest:
+		return planTests(req, plan.env, limit), nil
+	}
+	if plan.build != nil {
+		p.steps = append(p.steps, planStep{name: "build", argv: plan.build, timeout: limit, cacheable: true, artifacts: plan.artifacts})
+	}
+	p.steps = append(p.steps, planStep{name: "run", argv: plan.run, timeout: limit, stdin: req.Stdin})
+	if req.Coverage {
+		instrumentRun(req, &p)
+	}
+	switch req.Mode {
+	case modeProfile:
+		instrumentProfile(req, &p, mainFile)
+	case modeBenchmark:
+		planBenchmark(req, &p, limit)
+	case modeDebug:
+		planDebug(req, &p, limit)
+	}
+	return p, nil
+}
+
+// sandbox is a workspace holding a submission, in which the steps of a pipeline run one after
+// another. Native mode uses a host directory, container modes a long-lived container.
+type sandbox interface {
+	// run executes a step in the workspace. An error means it could not be started.
+	run(ctx context.Context, step planStep, env []string, stdout, stderr io.Writer) (exitCode int, usage stepUsage, err error)
+	// hostDir is the workspace on the host, or "" if it is not reachable from here.
+	hostDir() string
+	// collect passes the workspace files to c.
+	collect(c *artifactCollector) error
+	close()
+}
+
+// nativeSandbox runs steps directly on the host, in a temp directory.
+type nativeSandbox struct{ dir string }
+
+func (s *nativeSandbox) run(ctx context.Context, step planStep, env []string, stdout, stderr io.Writer) (int, stepUsage, error) {
+	// relative program paths such as ./main are resolved against cmd.Dir
+	cmd := exec.CommandContext(ctx, step.argv[0], step.argv[1:]...)
+	cmd.Dir = s.dir
+	cmd.Env = append(os.Environ(), env...)
+	if step.stdin != "" {
+		cmd.Stdin = strings.NewReader(step.stdin)
+	}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	// a step's shell may leave children holding the output pipes after it is killed
+	cmd.WaitDelay = time.Second
+	setProcessGroup(cmd)
+	var usage stepUsage
+	err := pipeInput(cmd, step.input)
+	if err != nil {
+		return 0, stepUsage{}, err
+	}
+	if cpu := benchmarkCPU(); step.pin && cpu >= 0 {
+		err = startPinned(cmd, cpu)
+		usage.pinned = true
+	} else {
+		err = cmd.Start()
+	}
+	if err != nil {
+		return 0, stepUsage{}, err
+	}
+	err = cmd.Wait()
+	usage.cpu, usage.peakMemory = cpuTime(cmd), peakMemory(cmd)
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), usage, nil
+	}
+	if errors.Is(err, exec.ErrWaitDelay) {
+		// the step itself exited cleanly, a background child kept the pipes open
+		err = nil
+	}
+	return 0, usage, err
+}
+
+// pipeInput feeds the input of an interactive step to cmd. Unlike with cmd.Stdin, Wait does
+// not wait for the copy: the client may never send another message. Closing the stream ends it.
+func pipeInput(cmd *exec.Cmd, input io.Reader) error {
+	if input == nil {
+		return nil
+	}
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	go func() {
+		io.Copy(w, input)
+		w.Close()
+	}()
+	return nil
+}
+
+func (s *nativeSandbox) hostDir() string { return s.dir }
+func (s *nativeSandbox) close()          {}
+
+func (s *nativeSandbox) collect(c *artifactCollector) error {
+	c.collectDir(s.dir)
+	return nil
+}
+
+// runPipeline runs the steps of p in sb until one fails. Builds of the default pipeline are
+// restored from and stored in bc when the workspace is on this host.
+func runPipeline(ctx context.Context, sb sandbox, p pipelinePlan, bc *buildCache, req RunRequest) NativeResult {
+	if _, native := sb.(*nativeSandbox); native && p.pinned() && benchmarkCPU() >= 0 {
+		// before the deadline starts, so waiting does not count against the benchmark
+		pinnedBenchmarks.Lock()
+		defer pinnedBenchmarks.Unlock()
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.total)
+	defer cancel()
+	root := sb.hostDir()
+	if root == "" {
+		root = workspaceDir
+	}
+	var steps []StepResult
+	var cpu time.Duration
+	for _, step := range p.steps {
+		cache := bc != nil && step.cacheable && sb.hostDir() != ""
+		var key string
+		if cache {
+			key = bc.key(req.Language, step.argv, req.Files)
+			if bc.restore(req.Language, key, sb.hostDir()) {
+				continue
+			}
+		}
+		stepCtx, stepCancel := context.WithTimeout(ctx, step.timeout)
+		var stdout, stderr bytes.Buffer
+		var out io.Writer = &stdout
+		if step.stream != nil {
+			step.input, out = step.stream.open(root)
+			context.AfterFunc(step.stream.context(), stepCancel)
+		}
+		start := time.Now()
+		code, usage, err := sb.run(stepCtx, step, p.env, out, &stderr)
+		wall := time.Since(start)
+		timedOut := stepCtx.Err() == context.DeadlineExceeded
+		stepCancel()
+		if step.stream != nil {
+			step.stream.close()
+		}
+		cpu += usage.cpu
+		if err != nil && !timedOut {
+			return NativeResult{
+				Stdout:     stdout.String(),
+				Stderr:     fmt.Sprintf("%s\nError: failed to run %s step: %v", stderr.String(), step.name, err),
+				ExitCode:   1,
+				Success:    false,
+				Language:   req.Language,
+				InfraError: true,
+			}
+		}
+		sr := StepResult{Name: step.name, Stdout: stdout.String(), Stderr: stderr.String(), ExitCode: code, TimedOut: timedOut, DurationMs: wall.Milliseconds(), wall: wall, usage: usage}
+		if timedOut {
+			sr.ExitCode = 124
+			sr.timeoutNote = stepTimeoutNote(step)
+			if ctx.Err() != nil {
+				sr.timeoutNote = fmt.Sprintf("Step %q hit the time limit of %d seconds for the whole run", step.name, req.TimeLimit)
+			}
+		}
+		steps = append(steps, sr)
+		if sr.ExitCode != 0 {
+			break
+		}
+		if cache {
+			storeBuild(bc, key, sb.hostDir(), req.Language, step.artifacts)
+		}
+	}
+	res := pipelineResult(req, p, steps, cpu, root)
+	if len(p.outputs) > 0 {
+		// also after a failure: outputs such as test reports matter most then
+		c := newArtifactCollector(p.outputs)
+		if err := sb.collect(c); err != nil {
+			log.Printf("collect artifacts: %v", err)
+		}
+		res.Artifacts = c.out
+	}
+	if p.coverage {
+		res.Coverage = collectCoverage(req, sb.collect)
+	}
+	if p.profile {
+		res.Profile = collectProfile(req, sb.collect)
+	}
+	return res
+}
+
+// storeBuild keeps the outputs of a successful build in the build cache.
+func storeBuild(bc *buildCache, key, dir, language string, artifacts []string) {
+	if canonicalLanguage(language) == "java" {
+		// javac writes one class file per class, next to the sources or in package dirs
+		filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+			if err == nil && !d.IsDir() && strings.HasSuffix(p, ".class") {
+				rel, _ := filepath.Rel(dir, p)
+				artifacts = append(artifacts, rel)
+			}
+			return nil
+		})
+	}
+	if err := bc.store(key, dir, artifacts); err != nil {
+		log.Printf("build cache store: %v", err)
+	}
+}
+
+// pipelineResult turns step results into the response. Custom pipelines report every step and
+// the one that failed; the default pipeline keeps the plain run result, with build failures
+// reported as compilation errors. Diagnostics from every step are located in submission files
+// by paths relative to the workspace, or absolute under root.
+func pipelineResult(req RunRequest, p pipelinePlan, steps []StepResult, cpu time.Duration, root string) NativeResult {
+	res := NativeResult{Language: req.Language, Success: true, CPUTimeMs: cpu.Milliseconds()}
+	if len(steps) == 0 {
+		return res
+	}
+	if req.Mode == modeTest {
+		if res.Tests = testResults(req, &steps[len(steps)-1]); res.Tests != nil {
+			res.TestSummary = summarizeTests(res.Tests)
+		}
+	}
+	if req.Mode == modeBenchmark {
+		res.Benchmark = benchmarkResult(req, steps)
+	}
+	res.Diagnostics = stepDiagnostics(req, steps, root)
+	last := steps[len(steps)-1]
+	// a pipeline stops at the first failure, so the last step decides
+	res.Stdout, res.Stderr, res.ExitCode = last.Stdout, last.Stderr, last.ExitCode
+	res.Success = last.ExitCode == 0
+	if p.custom {
+		res.Steps = steps
+		if !res.Success {
+			res.FailedStep = last.Name
+		}
+		if last.TimedOut {
+			res.Stderr += "\n" + last.timeoutNote
+		}
+		return res
+	}
+	switch {
+	case last.TimedOut && last.Name == "debug":
+		res.Stderr = fmt.Sprintf("Debug session timed out after %d seconds", int(debugSessionLimit().Seconds()))
+	case last.TimedOut:
+		res.Stderr = fmt.Sprintf("Execution timed out after %d seconds", req.TimeLimit)
+	case last.Name == "build" && last.ExitCode != 0:
+		res.Stderr = "Compilation failed:\n" + last.Stdout + last.Stderr
+		res.Stdout = ""
+		res.ExitCode = 1
+	}
+	return res
+}
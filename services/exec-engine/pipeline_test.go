@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateSteps(t *testing.T) {
+	cases := []struct {
+		name  string
+		steps []RunStep
+		ok    bool
+	}{
+		{"full pipeline", []RunStep{{Name: "setup", Command: "pip install -r requirements.txt"}, {Name: "build", Command: "make"}, {Name: "run", Command: "./app"}, {Name: "test", Command: "make test"}}, true},
+		{"repeated stage", []RunStep{{Name: "build", Command: "make deps"}, {Name: "build", Command: "make"}}, true},
+		{"unknown name", []RunStep{{Name: "deploy", Command: "x"}}, false},
+		{"out of order", []RunStep{{Name: "run", Command: "./app"}, {Name: "build", Command: "make"}}, false},
+		{"empty command", []RunStep{{Name: "run", Command: "  "}}, false},
+		{"negative timeout", []RunStep{{Name: "run", Command: "x", TimeoutSeconds: -1}}, false},
+		{"too many", make([]RunStep, maxSteps+1), false},
+	}
+	for _, c := range cases {
+		if err := validateSteps(c.steps); (err == nil) != c.ok {
+			t.Errorf("%s: err = %v", c.name, err)
+		}
+	}
+}
+
+func TestNativePipeline(t *testing.T) {
+	files := map[string]string{"main.sh": "echo unused"}
+	res := executeNative(RunRequest{Language: "bash", Files: files, TimeLimit: 5, Stdin: "in", Steps: []RunStep{
+		{Name: "setup", Command: "echo dep > dep.txt"},
+		{Name: "build", Command: "cat dep.txt > out.txt; echo built"},
+		{Name: "run", Command: "cat out.txt -"},
+	}}, nil)
+	if !res.Success || res.Stdout != "dep\nin" || len(res.Steps) != 3 || res.Steps[1].Stdout != "built\n" || res.FailedStep != "" {
+		t.Fatalf("pipeline: %+v", res)
+	}
+
+	res = executeNative(RunRequest{Language: "bash", Files: files, TimeLimit: 5, Steps: []RunStep{
+		{Name: "build", Command: "echo oops >&2; exit 2"},
+		{Name: "run", Command: "echo unreachable"},
+	}}, nil)
+	if res.Success || res.FailedStep != "build" || res.ExitCode != 2 || len(res.Steps) != 1 || res.Stderr != "oops\n" {
+		t.Fatalf("failed build: %+v", res)
+	}
+
+	res = executeNative(RunRequest{Language: "bash", Files: files, TimeLimit: 5, Steps: []RunStep{
+		{Name: "run", Command: "sleep 5", TimeoutSeconds: 1},
+	}}, nil)
+	if res.Success || res.FailedStep != "run" || !res.Steps[0].TimedOut || res.ExitCode != 124 || !strings.Contains(res.Stderr, "timed out after 1 seconds") {
+		t.Fatalf("step timeout: %+v", res)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// setProcessGroup is a no-op: cancellation kills the step's own process only.
+func setProcessGroup(*exec.Cmd) {}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// Profile is the result of mode "profile": where a run spent its time and what it allocated.
+type Profile struct {
+	CPU    *ProfileData `json:"cpu,omitempty"`
+	Memory *ProfileData `json:"memory,omitempty"`
+}
+
+// ProfileData is one profile, normalized to stacks whatever the language's profiler.
+type ProfileData struct {
+	// Type is what was measured: cpu, wall (sampled wall time), alloc_space (bytes allocated
+	// during the run), inuse_space (bytes still allocated at the end) or peak_rss (bytes the
+	// peak resident memory grew by while the stack ran)
+	Type  string `json:"type"`
+	Unit  string `json:"unit"` // nanoseconds or bytes
+	Total int64  `json:"total"`
+	// Folded has a line per stack, the frames from the root separated by ";" and its value,
+	// the input of flame graph tools. The largest maxProfileStacks stacks are kept.
+	Folded string `json:"folded"`
+	// Functions are the functions with the most self value, the largest first
+	Functions []ProfileFunction `json:"functions"`
+}
+
+// ProfileFunction is a function's share of a profile: Self in the function itself, Total
+// including its callees.
+type ProfileFunction struct {
+	Name  string `json:"name"`
+	Self  int64  `json:"self"`
+	Total int64  `json:"total"`
+}
+
+// profileGlobs match the profiles the profilers leave in profileDir.
+var profileGlobs = []string{profileDir + "/*.pprof", profileDir + "/*.folded", profileDir + "/*.cpuprofile", profileDir + "/*.heapprofile"}
+
+const (
+	// profileDir is where profilers leave their profiles in the workspace
+	profileDir          = ".coderipper-profile"
+	maxProfileStacks    = 5000
+	maxProfileFunctions = 50
+	maxProfileFile      = 32 << 20
+)
+
+// profiler runs a language's programs under its profiler. Each is optional.
+type profiler struct {
+	// files adds files to the submission, or rewrites them; false when the main file cannot be
+	// instrumented, which leaves the build to report why
+	files func(files map[string]string, mainFile string) bool
+	build func(argv []string, mainFile string) []string
+	run   func(argv []string) []string
+	// parse reads one of the files left in profileDir; kind is "cpu" or "memory"
+	parse func(name string, data []byte, files map[string]string) (kind string, p *ProfileData, err error)
+}
+
+var profilers = map[string]profiler{
+	"go": {
+		files: instrumentGoMain,
+		build: func(argv []string, mainFile string) []string {
+			// go build of a file compiles only the files named
+			return append(append([]string{}, argv...), path.Join(path.Dir(mainFile), goProfileFile))
+		},
+		parse: parsePprof,
+	},
+	"python": {
+		files: func(files map[string]string, _ string) bool {
+			files[pythonProfileFile] = pythonProfiler
+			return true
+		},
+		run: func(argv []string) []string {
+			// after the interpreter flags: the profiler runs the main file
+			i := 1
+			for i < len(argv) && strings.HasPrefix(argv[i], "-") {
+				i++
+			}
+			return append(append(append([]string{}, argv[:i]...), pythonProfileFile), argv[i:]...)
+		},
+		parse: parseFoldedProfile,
+	},
+	"javascript": {
+		run: func(argv []string) []string {
+			return append([]string{argv[0], "--cpu-prof", "--cpu-prof-dir=" + profileDir, "--heap-prof", "--heap-prof-dir=" + profileDir}, argv[1:]...)
+		},
+		parse: parseV8Profile,
+	},
+}
+
+// prepareProfile adds the profiler's files to a request in mode "profile". The archive is
+// dropped so k8s mode sends the files.
+func prepareProfile(req RunRequest) RunRequest {
+	p, ok := profilers[canonicalLanguage(req.Language)]
+	if req.Mode != modeProfile || !ok || p.files == nil {
+		return req
+	}
+	files := make(map[string]string, len(req.Files)+1)
+	for name, content := range req.Files {
+		files[name] = content
+	}
+	if p.files(files, mainFileName(req.Files)) {
+		req.Files, req.Archive, req.profiler = files, nil, true
+	}
+	return req
+}
+
+// instrumentProfile runs the build and run steps of the default pipeline under the profiler.
+func instrumentProfile(req RunRequest, p *pipelinePlan, mainFile string) {
+	prof := profilers[canonicalLanguage(req.Language)]
+	if prof.files != nil && !req.profiler {
+		// the main file could not be instrumented; the build reports why
+		return
+	}
+	for i := range p.steps {
+		step := &p.steps[i]
+		switch {
+		case step.name == "build" && prof.build != nil:
+			step.argv = prof.build(step.argv, mainFile)
+		case step.name == "run" && prof.run != nil:
+			step.argv = prof.run(step.argv)
+		}
+	}
+	p.profile = true
+}
+
+// collectProfile reads the profiles the run left in the workspace, the way outputs are collected.
+func collectProfile(req RunRequest, collect func(*artifactCollector) error) *Profile {
+	c := &artifactCollector{globs: profileGlobs, limits: artifactLimits{maxFiles: 4, maxFileBytes: maxProfileFile, maxTotalBytes: 2 * maxProfileFile}}
+	if err := collect(c); err != nil {
+		log.Printf("collect profile: %v", err)
+		return nil
+	}
+	parse := profilers[canonicalLanguage(req.Language)].parse
+	var out Profile
+	for _, a := range c.out {
+		if a.Skipped != "" {
+			log.Printf("collect profile %s: %s", a.Path, a.Skipped)
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(a.Content)
+		if err != nil {
+			continue
+		}
+		kind, p, err := parse(path.Base(a.Path), data, req.Files)
+		if err != nil {
+			log.Printf("parse profile %s: %v", a.Path, err)
+			continue
+		}
+		switch kind {
+		case "cpu":
+			out.CPU = p
+		case "memory":
+			out.Memory = p
+		}
+	}
+	if out.CPU == nil && out.Memory == nil {
+		return nil
+	}
+	return &out
+}
+
+// foldProfile builds a profile from the value of each stack, keyed by its frames from the root
+// joined with ";".
+func foldProfile(typ, unit string, stacks map[string]int64) *ProfileData {
+	p := &ProfileData{Type: typ, Unit: unit, Functions: []ProfileFunction{}}
+	keys := make([]string, 0, len(stacks))
+	fns := map[string]*ProfileFunction{}
+	for stack, v := range stacks {
+		if v <= 0 {
+			continue
+		}
+		keys = append(keys, stack)
+		p.Total += v
+		frames := strings.Split(stack, ";")
+		seen := map[string]bool{}
+		for i, f := range frames {
+			fn := fns[f]
+			if fn == nil {
+				fn = &ProfileFunction{Name: f}
+				fns[f] = fn
+			}
+			if i == len(frames)-1 {
+				fn.Self += v
+			}
+			// recursion counts once per stack
+			if !seen[f] {
+				fn.Total += v
+				seen[f] = true
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if stacks[keys[i]] != stacks[keys[j]] {
+			return stacks[keys[i]] > stacks[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > maxProfileStacks {
+		keys = keys[:maxProfileStacks]
+	}
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k + " " + strconv.FormatInt(stacks[k], 10) + "\n")
+	}
+	p.Folded = b.String()
+	for _, fn := range fns {
+		if fn.Self > 0 {
+			p.Functions = append(p.Functions, *fn)
+		}
+	}
+	sort.Slice(p.Functions, func(i, j int) bool {
+		a, b := p.Functions[i], p.Functions[j]
+		if a.Self != b.Self {
+			return a.Self > b.Self
+		}
+		return a.Name < b.Name
+	})
+	if len(p.Functions) > maxProfileFunctions {
+		p.Functions = p.Functions[:maxProfileFunctions]
+	}
+	return p
+}
+
+// goProfileFile replaces the submission's main function: it runs it, renamed to
+// coderipperMain, between starting and writing the CPU and allocation profiles. A program that
+// calls os.Exit ends before its profiles are written.
+const goProfileFile = "coderipper_profile.go"
+
+const goProfiler = `package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+)
+
+func init() { runtime.MemProfileRate = 4096 }
+
+func main() {
+	wd, _ := os.Getwd()
+	dir := filepath.Join(wd, "` + profileDir + `")
+	os.MkdirAll(dir, 0755)
+	cpu, err := os.Create(filepath.Join(dir, "cpu.pprof"))
+	if err == nil {
+		pprof.StartCPUProfile(cpu)
+	}
+	coderipperMain()
+	pprof.StopCPUProfile()
+	cpu.Close()
+	if heap, err := os.Create(filepath.Join(dir, "allocs.pprof")); err == nil {
+		pprof.Lookup("allocs").WriteTo(heap, 0)
+		heap.Close()
+	}
+}
+`
+
+// profilerFile reports whether a file was added to the submission by prepareProfile.
+func profilerFile(name string) bool {
+	return path.Base(name) == goProfileFile || strings.HasPrefix(name, profileDir+"/")
+}
+
+// instrumentGoMain renames func main of the main file and adds goProfileFile next to it.
+func instrumentGoMain(files map[string]string, mainFile string) bool {
+	src, ok := files[mainFile]
+	if !ok {
+		return false
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, mainFile, src, 0)
+	if err != nil || f.Name.Name != "main" {
+		return false
+	}
+	for _, d := range f.Decls {
+		fn, ok := d.(*ast.FuncDecl)
+		if !ok || fn.Recv != nil || fn.Name.Name != "main" {
+			continue
+		}
+		off := fset.Position(fn.Name.Pos()).Offset
+		files[mainFile] = src[:off] + "coderipperMain" + src[off+len("main"):]
+		files[path.Join(path.Dir(mainFile), goProfileFile)] = goProfiler
+		return true
+	}
+	return false
+}
+
+// parsePprof reads the CPU and allocation profiles written by goProfiler. The wrapper's frames
+// are dropped, so stacks start at the submission's main.main.
+func parsePprof(name string, data []byte, _ map[string]string) (string, *ProfileData, error) {
+	prof, err := profile.Parse(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, err
+	}
+	kind, typ := "cpu", "cpu"
+	if name == "allocs.pprof" {
+		kind, typ = "memory", "alloc_space"
+	}
+	idx := -1
+	for i, st := range prof.SampleType {
+		if st.Type == typ {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return "", nil, fmt.Errorf("profile has no %s samples", typ)
+	}
+	stacks := map[string]int64{}
+	for _, s := range prof.Sample {
+		var frames []string
+		for i := len(s.Location) - 1; i >= 0; i-- {
+			lines := s.Location[i].Line
+			for j := len(lines) - 1; j >= 0; j-- {
+				if lines[j].Function != nil {
+					frames = append(frames, lines[j].Function.Name)
+				}
+			}
+		}
+		frames, ok := goUserFrames(frames)
+		if ok && len(frames) > 0 {
+			stacks[strings.Join(frames, ";")] += s.Value[idx]
+		}
+	}
+	unit := "nanoseconds"
+	if kind == "memory" {
+		unit = "bytes"
+	}
+	return kind, foldProfile(typ, unit, stacks), nil
+}
+
+// goUserFrames drops runtime.main and the wrapper's main.main above the submission's main, and
+// the profiler's own allocations.
+func goUserFrames(frames []string) ([]string, bool) {
+	for _, f := range frames {
+		if strings.HasPrefix(f, "runtime/pprof.") {
+			return nil, false
+		}
+	}
+	if len(frames) >= 3 && frames[0] == "runtime.main" && frames[1] == "main.main" && frames[2] == "main.coderipperMain" {
+		frames = frames[2:]
+	}
+	for i, f := range frames {
+		if f == "main.coderipperMain" {
+			frames[i] = "main.main"
+		}
+	}
+	return frames, true
+}
+
+// pythonProfileFile samples the stack of the main thread every millisecond. It records the
+// wall time between samples and how much the peak resident memory grew since the last sample,
+// both as folded stacks. tracemalloc would slow programs down tenfold or more.
+const pythonProfileFile = profileDir + "/profile.py"
+
+const pythonProfiler = `import os, resource, runpy, sys, threading, time
+
+root = os.getcwd()
+out = os.path.dirname(os.path.abspath(__file__))
+skip = {os.path.abspath(__file__), runpy.__file__, "<frozen runpy>"}
+
+
+def rel(f):
+    return f[len(root) + 1:] if f.startswith(root + os.sep) else f
+
+
+def peak():
+    # kilobytes on Linux
+    return resource.getrusage(resource.RUSAGE_SELF).ru_maxrss * 1024
+
+
+def write(name, stacks):
+    with open(os.path.join(out, name), "w") as w:
+        for stack, v in stacks.items():
+            w.write("%s %d\n" % (stack, v))
+
+
+def main():
+    script = sys.argv[1]
+    sys.argv = sys.argv[1:]
+    sys.path[0] = os.path.dirname(os.path.abspath(script))
+    me = threading.get_ident()
+    wall, memory = {}, {}
+    done = threading.Event()
+
+    def sample():
+        last, high = time.perf_counter_ns(), peak()
+        while not done.wait(0.001):
+            frame = sys._current_frames().get(me)
+            now, rss = time.perf_counter_ns(), peak()
+            names = []
+            while frame is not None:
+                code = frame.f_code
+                if code.co_filename not in skip:
+                    names.append("%s (%s:%d)" % (code.co_name, rel(code.co_filename), code.co_firstlineno))
+                frame = frame.f_back
+            if names:
+                key = ";".join(reversed(names))
+                wall[key] = wall.get(key, 0) + now - last
+                if rss > high:
+                    memory[key] = memory.get(key, 0) + rss - high
+            last, high = now, max(high, rss)
+
+    t = threading.Thread(target=sample, daemon=True)
+    t.start()
+    try:
+        runpy.run_path(script, run_name="__main__")
+    finally:
+        done.set()
+        t.join()
+        write("wall.folded", wall)
+        write("peak_rss.folded", memory)
+
+
+main()
+`
+
+// parseFoldedProfile reads the folded stacks written by pythonProfiler.
+func parseFoldedProfile(name string, data []byte, _ map[string]string) (string, *ProfileData, error) {
+	stacks := map[string]int64{}
+	for _, line := range strings.Split(string(data), "\n") {
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			continue
+		}
+		if v, err := strconv.ParseInt(line[i+1:], 10, 64); err == nil {
+			stacks[line[:i]] += v
+		}
+	}
+	switch name {
+	case "wall.folded":
+		return "cpu", foldProfile("wall", "nanoseconds", stacks), nil
+	case "peak_rss.folded":
+		return "memory", foldProfile("peak_rss", "bytes", stacks), nil
+	}
+	return "", nil, fmt.Errorf("unknown profile %s", name)
+}
+
+// v8Frame is a call frame of node's .cpuprofile and .heapprofile files.
+type v8Frame struct {
+	FunctionName string `json:"functionName"`
+	URL          string `json:"url"`
+	LineNumber   int    `json:"lineNumber"` // zero-based
+}
+
+// name is the frame in flame graphs, with the file relative to the submission.
+func (f v8Frame) name(files map[string]string) string {
+	if f.URL == "" {
+		// (root), (program), (garbage collector) and (idle)
+		return f.FunctionName
+	}
+	fn := f.FunctionName
+	if fn == "" {
+		fn = "(anonymous)"
+	}
+	file := strings.TrimPrefix(f.URL, "file://")
+	if strings.HasPrefix(file, "/") {
+		file = submissionSuffix(files, file)
+	}
+	return fn + " (" + file + ":" + strconv.Itoa(f.LineNumber+1) + ")"
+}
+
+// parseV8Profile reads the CPU profile (.cpuprofile: a call tree, and the node sampled at each
+// tick with the time since the previous one) and the sampling heap profile (.heapprofile: a
+// call tree with the bytes each node still holds) that node writes on exit.
+func parseV8Profile(name string, data []byte, files map[string]string) (string, *ProfileData, error) {
+	switch {
+	case strings.HasSuffix(name, ".cpuprofile"):
+		var cp struct {
+			Nodes []struct {
+				ID        int     `json:"id"`
+				CallFrame v8Frame `json:"callFrame"`
+				Children  []int   `json:"children"`
+			} `json:"nodes"`
+			Samples    []int   `json:"samples"`
+			TimeDeltas []int64 `json:"timeDeltas"` // microseconds
+		}
+		if err := json.Unmarshal(data, &cp); err != nil {
+			return "", nil, err
+		}
+		frames, parent := map[int]string{}, map[int]int{}
+		for _, n := range cp.Nodes {
+			frames[n.ID] = n.CallFrame.name(files)
+			for _, c := range n.Children {
+				parent[c] = n.ID
+			}
+		}
+		stacks := map[string]int64{}
+		for i, id := range cp.Samples {
+			if i+1 >= len(cp.TimeDeltas) {
+				break
+			}
+			// a sample lasts until the next one
+			stacks[v8Stack(id, frames, parent)] += cp.TimeDeltas[i+1] * 1000
+		}
+		return "cpu", foldProfile("cpu", "nanoseconds", stacks), nil
+	case strings.HasSuffix(name, ".heapprofile"):
+		type node struct {
+			CallFrame v8Frame `json:"callFrame"`
+			SelfSize  int64   `json:"selfSize"`
+			Children  []node  `json:"children"`
+		}
+		var hp struct {
+			Head node `json:"head"`
+		}
+		if err := json.Unmarshal(data, &hp); err != nil {
+			return "", nil, err
+		}
+		stacks := map[string]int64{}
+		var walk func(n node, stack string)
+		walk = func(n node, stack string) {
+			if stack != "" {
+				stack += ";"
+			}
+			stack += n.CallFrame.name(files)
+			stacks[stack] += n.SelfSize
+			for _, c := range n.Children {
+				walk(c, stack)
+			}
+		}
+		for _, c := range hp.Head.Children {
+			walk(c, "")
+		}
+		return "memory", foldProfile("inuse_space", "bytes", stacks), nil
+	}
+	return "", nil, fmt.Errorf("unknown profile %s", name)
+}
+
+// v8Stack joins the frames from the root to node id, leaving out the (root) node itself.
+func v8Stack(id int, frames map[int]string, parent map[int]int) string {
+	var stack []string
+	for {
+		p, ok := parent[id]
+		if !ok {
+			break
+		}
+		stack = append(stack, frames[id])
+		id = p
+	}
+	for i, j := 0, len(stack)-1; i < j; i, j = i+1, j-1 {
+		stack[i], stack[j] = stack[j], stack[i]
+	}
+	return strings.Join(stack, ";")
+}
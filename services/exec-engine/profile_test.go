@@ -0,0 +1,90 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFoldProfile(t *testing.T) {
+	p := foldProfile("cpu", "nanoseconds", map[string]int64{
+		"main.main;main.fib;main.fib": 30,
+		"main.main;main.fib":          10,
+		"main.main;fmt.Println":       5,
+		"main.main;main.idle":         0,
+	})
+	if p.Total != 45 || p.Folded != "main.main;main.fib;main.fib 30\nmain.main;main.fib 10\nmain.main;fmt.Println 5\n" {
+		t.Fatalf("folded: %+v", p)
+	}
+	want := []ProfileFunction{{Name: "main.fib", Self: 40, Total: 40}, {Name: "fmt.Println", Self: 5, Total: 5}}
+	if !reflect.DeepEqual(p.Functions, want) {
+		t.Fatalf("functions: %+v", p.Functions)
+	}
+}
+
+func TestParseV8Profile(t *testing.T) {
+	files := map[string]string{"main.js": ""}
+	cpu := `{"nodes": [
+{"id": 1, "callFrame": {"functionName": "(root)", "url": "", "lineNumber": -1}, "children": [2, 4]},
+{"id": 2, "callFrame": {"functionName": "", "url": "file:///tmp/coderipper-native-1/main.js", "lineNumber": 0}, "children": [3]},
+{"id": 3, "callFrame": {"functionName": "fib", "url": "file:///tmp/coderipper-native-1/main.js", "lineNumber": 2}},
+{"id": 4, "callFrame": {"functionName": "(garbage collector)", "url": "", "lineNumber": -1}}],
+"samples": [3, 3, 4, 2], "timeDeltas": [100, 250, 250, 50]}`
+	kind, p, err := parseV8Profile("CPU.20261018.1.cpuprofile", []byte(cpu), files)
+	if err != nil || kind != "cpu" {
+		t.Fatalf("%s, %v", kind, err)
+	}
+	if p.Folded != "(anonymous) (main.js:1);fib (main.js:3) 500000\n(garbage collector) 50000\n" {
+		t.Fatalf("folded: %q", p.Folded)
+	}
+
+	heap := `{"head": {"callFrame": {"functionName": "(root)", "url": ""}, "selfSize": 0, "children": [
+{"callFrame": {"functionName": "", "url": "file:///workspace/main.js", "lineNumber": 0}, "selfSize": 64, "children": [
+{"callFrame": {"functionName": "build", "url": "file:///workspace/main.js", "lineNumber": 9}, "selfSize": 4096, "children": []}]}]}}`
+	kind, p, err = parseV8Profile("Heap.20261018.1.heapprofile", []byte(heap), files)
+	if err != nil || kind != "memory" || p.Total != 4160 || p.Functions[0].Name != "build (main.js:10)" {
+		t.Fatalf("heap: %s %+v %v", kind, p, err)
+	}
+}
+
+func TestNativeProfile(t *testing.T) {
+	rs := &runners{mode: "native"}
+	res, err := rs.execute(RunRequest{Language: "go", Mode: modeProfile, TimeLimit: 60, Files: map[string]string{"solution.go": `package main
+
+import "fmt"
+
+func fib(n int) int {
+	if n < 2 {
+		return n
+	}
+	return fib(n-1) + fib(n-2)
+}
+
+func main() {
+	fmt.Println(fib(32))
+}
+`}}, "")
+	if err != nil || res.Stdout != "2178309\n" || res.Profile == nil || res.Profile.CPU == nil || res.Profile.Memory == nil {
+		t.Fatalf("go profile: %+v, %v", res, err)
+	}
+	if fn := res.Profile.CPU.Functions[0]; fn.Name != "main.fib" || !strings.HasPrefix(res.Profile.CPU.Folded, "main.main;main.fib;") {
+		t.Fatalf("cpu profile: %+v", res.Profile.CPU)
+	}
+
+	res, err = rs.execute(RunRequest{Language: "python", Mode: modeProfile, TimeLimit: 60, Files: map[string]string{
+		"main.py": "import sys\n\ndef busy(n):\n    return sum(i * i for i in range(n))\n\ndef grow():\n    return [bytes(1000) for _ in range(100000)]\n\nkeep = grow()\nprint(busy(2000000), sys.argv[1:])\n",
+	}, Args: []string{"x"}}, "")
+	if err != nil || res.Stdout != "2666664666667000000 ['x']\n" || res.Profile == nil || res.Profile.CPU == nil || res.Profile.Memory == nil {
+		t.Fatalf("python profile: %+v, %v", res, err)
+	}
+	if !strings.Contains(res.Profile.CPU.Folded, "busy (main.py:3)") || !strings.Contains(res.Profile.Memory.Folded, "grow (main.py:6)") {
+		t.Fatalf("python profiles: %+v %+v", res.Profile.CPU, res.Profile.Memory.Functions)
+	}
+
+	res, err = rs.execute(RunRequest{Language: "javascript", Mode: modeProfile, TimeLimit: 60, Files: map[string]string{
+		"main.js": "function busy(n) { let s = 0; for (let i = 0; i < n; i++) s += i % 7; return s }\nconsole.log(busy(50000000))\n",
+	}}, "")
+	if err != nil || res.Profile == nil || res.Profile.CPU == nil || !strings.Contains(res.Profile.CPU.Folded, "busy (main.js:1)") {
+		t.Fatalf("javascript profile: %+v, %v", res, err)
+	}
+}
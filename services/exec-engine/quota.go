@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+//go:embed migrations/create_user_usage.sql
+var userUsageSchema string
+
+// quotaUsage is what a user has consumed on one day.
+type quotaUsage struct {
+	Runs int
+	CPU  time.Duration
+}
+
+// quotaStore keeps daily usage per user. Days are UTC dates formatted as 2006-01-02.
+type quotaStore interface {
+	usage(ctx context.Context, user, day string) (quotaUsage, error)
+	charge(ctx context.Context, user, day string, runs int, cpu time.Duration) error
+}
+
+// quotas enforces the daily run and CPU budgets of each tier. Usage is checked before a run
+// and charged after it, so a user can overshoot by at most their concurrent runs.
+type quotas struct {
+	store quotaStore
+	now   func() time.Time
+}
+
+// newQuotas builds the store selected by QUOTA_STORE: memory (default, per process) or
+// postgres (DATABASE_URL, shared and durable).
+func newQuotas() (*quotas, error) {
+	q := &quotas{now: time.Now}
+	switch os.Getenv("QUOTA_STORE") {
+	case "", "memory":
+		q.store = newMemoryQuotaStore()
+	case "postgres":
+		db, err := openDatabase(userUsageSchema)
+		if err != nil {
+			return nil, err
+		}
+		q.store = &postgresQuotaStore{db: db}
+	default:
+		return nil, fmt.Errorf("unknown QUOTA_STORE %q", os.Getenv("QUOTA_STORE"))
+	}
+	return q, nil
+}
+
+func (q *quotas) day() (string, time.Time) {
+	now := q.now().UTC()
+	y, m, d := now.Date()
+	return now.Format("2006-01-02"), time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
+
+// quotaCounter reports one budget. Limit 0 means unlimited, in which case Remaining is omitted.
+type quotaCounter struct {
+	Used      float64  `json:"used"`
+	Limit     float64  `json:"limit"`
+	Remaining *float64 `json:"remaining,omitempty"`
+}
+
+func newQuotaCounter(used, limit float64) quotaCounter {
+	c := quotaCounter{Used: used, Limit: limit}
+	if limit > 0 {
+		r := limit - used
+		if r < 0 {
+			r = 0
+		}
+		c.Remaining = &r
+	}
+	return c
+}
+
+func (c quotaCounter) exhausted() bool {
+	return c.Remaining != nil && *c.Remaining <= 0
+}
+
+// quotaStatus is the body of GET /usage.
+type quotaStatus struct {
+	Tier       string       `json:"tier"`
+	Day        string       `json:"day"`
+	Runs       quotaCounter `json:"runs"`
+	CPUSeconds quotaCounter `json:"cpuSeconds"`
+	ResetsAt   time.Time    `json:"resetsAt"`
+}
+
+// exceeded names the exhausted budget, or returns "" if the user may run.
+func (s quotaStatus) exceeded() string {
+	switch {
+	case s.Runs.exhausted():
+		return "run"
+	case s.CPUSeconds.exhausted():
+		return "cpu"
+	}
+	return ""
+}
+
+func (q *quotas) status(ctx context.Context, user, tier string, p tierPolicy) (quotaStatus, error) {
+	day, reset := q.day()
+	u, err := q.store.usage(ctx, user, day)
+	if err != nil {
+		return quotaStatus{}, err
+	}
+	return quotaStatus{
+		Tier:       tier,
+		Day:        day,
+		Runs:       newQuotaCounter(float64(u.Runs), float64(p.MaxRunsPerDay)),
+		CPUSeconds: newQuotaCounter(u.CPU.Seconds(), float64(p.MaxCPUSecondsPerDay)),
+		ResetsAt:   reset,
+	}, nil
+}
+
+// charge records a finished run. Backends that cannot measure CPU time are charged wall
+// time, which is an upper bound since runs are limited to one CPU. Checks are charged their
+// CPU time but do not count as runs, nor does formatting; benchmarks count every run.
+func (q *quotas) charge(ctx context.Context, user string, req RunRequest, res NativeResult) error {
+	cpu := res.CPUTimeMs
+	if cpu == 0 && req.Mode != modeDebug {
+		// a debug session mostly waits for its client, so only measured CPU time counts
+		cpu = res.WallTimeMs
+	}
+	day, _ := q.day()
+	runs := 1
+	switch req.Mode {
+	case modeCheck, modeFormat:
+		runs = 0
+	case modeBenchmark:
+		measured, warmup := req.Benchmark.counts()
+		runs = measured + warmup
+	}
+	return q.store.charge(ctx, user, day, runs, time.Duration(cpu)*time.Millisecond)
+}
+
+// usageHandler serves GET /usage: the caller's usage and remaining budget for today.
+func usageHandler(q *quotas, tp *tierPolicies) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		userID, _ := r.Context().Value("user_id").(string)
+		if userID == "" {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		claimTier, _ := r.Context().Value("tier").(string)
+		tier, policy := tp.resolve(claimTier)
+		st, err := q.status(r.Context(), userID, tier, policy)
+		if err != nil {
+			http.Error(w, "usage unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st)
+	}
+}
+
+// memoryQuotaStore keeps today's usage in the process; older days are dropped.
+type memoryQuotaStore struct {
+	mu   sync.Mutex
+	day  string
+	used map[string]quotaUsage
+}
+
+func newMemoryQuotaStore() *memoryQuotaStore {
+	return &memoryQuotaStore{used: map[string]quotaUsage{}}
+}
+
+func (m *memoryQuotaStore) usage(_ context.Context, user, day string) (quotaUsage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if day != m.day {
+		return quotaUsage{}, nil
+	}
+	return m.used[user], nil
+}
+
+func (m *memoryQuotaStore) charge(_ context.Context, user, day string, runs int, cpu time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if day != m.day {
+		m.day, m.used = day, map[string]quotaUsage{}
+	}
+	u := m.used[user]
+	u.Runs += runs
+	u.CPU += cpu
+	m.used[user] = u
+	return nil
+}
+
+// postgresQuotaStore keeps usage in the user_usage table, shared by all replicas.
+type postgresQuotaStore struct {
+	db *sql.DB
+}
+
+func (s *postgresQuotaStore) usage(ctx context.Context, user, day string) (quotaUsage, error) {
+	var u quotaUsage
+	var cpuMs int64
+	err := s.db.QueryRowContext(ctx, `SELECT runs, cpu_ms FROM user_usage WHERE user_id = $1 AND day = $2`, user, day).Scan(&u.Runs, &cpuMs)
+	if err == sql.ErrNoRows {
+		return quotaUsage{}, nil
+	}
+	if err != nil {
+		return quotaUsage{}, fmt.Errorf("read usage: %w", err)
+	}
+	u.CPU = time.Duration(cpuMs) * time.Millisecond
+	return u, nil
+}
+
+func (s *postgresQuotaStore) charge(ctx context.Context, user, day string, runs int, cpu time.Duration) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO user_usage (user_id, day, runs, cpu_ms) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, day) DO UPDATE SET runs = user_usage.runs + $3, cpu_ms = user_usage.cpu_ms + $4`,
+		user, day, runs, cpu.Milliseconds())
+	if err != nil {
+		return fmt.Errorf("charge usage: %w", err)
+	}
+	return nil
+}
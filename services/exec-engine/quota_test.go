@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQuotasDailyBudget(t *testing.T) {
+	now := time.Date(2024, 5, 1, 23, 0, 0, 0, time.UTC)
+	q := &quotas{store: newMemoryQuotaStore(), now: func() time.Time { return now }}
+	p := tierPolicy{MaxRunsPerDay: 2, MaxCPUSecondsPerDay: 10}
+	ctx := context.Background()
+
+	q.charge(ctx, "u1", RunRequest{}, NativeResult{CPUTimeMs: 4000})
+	st, _ := q.status(ctx, "u1", "free", p)
+	if st.exceeded() != "" || *st.Runs.Remaining != 1 || *st.CPUSeconds.Remaining != 6 {
+		t.Fatalf("after one run: %+v", st)
+	}
+	// checks use CPU time but not runs
+	q.charge(ctx, "u1", RunRequest{Mode: modeCheck}, NativeResult{CPUTimeMs: 1000})
+	if st, _ = q.status(ctx, "u1", "free", p); *st.Runs.Remaining != 1 || *st.CPUSeconds.Remaining != 5 {
+		t.Fatalf("after a check: %+v", st)
+	}
+	// benchmarks count every run
+	q.charge(ctx, "u3", RunRequest{Mode: modeBenchmark, Benchmark: &BenchmarkOptions{Runs: 3}}, NativeResult{CPUTimeMs: 1000})
+	if st, _ := q.status(ctx, "u3", "free", p); st.Runs.Used != 4 {
+		t.Fatalf("after a benchmark of 3 runs and 1 warmup: %+v", st)
+	}
+	// backends without CPU accounting are charged wall time
+	q.charge(ctx, "u1", RunRequest{}, NativeResult{WallTimeMs: 1000})
+	if st, _ = q.status(ctx, "u1", "free", p); st.exceeded() != "run" {
+		t.Fatalf("expected run quota exceeded, got %+v", st)
+	}
+	if st, _ = q.status(ctx, "u2", "free", p); st.exceeded() != "" {
+		t.Fatal("other users are not affected")
+	}
+	if !st.ResetsAt.Equal(time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("resets at %v", st.ResetsAt)
+	}
+
+	p.MaxRunsPerDay = 0
+	q.charge(ctx, "u1", RunRequest{}, NativeResult{CPUTimeMs: 6000})
+	if st, _ = q.status(ctx, "u1", "free", p); st.exceeded() != "cpu" || st.Runs.Remaining != nil {
+		t.Fatalf("expected cpu quota exceeded with unlimited runs, got %+v", st)
+	}
+
+	// budgets reset at midnight UTC
+	now = now.Add(2 * time.Hour)
+	if st, _ = q.status(ctx, "u1", "free", p); st.exceeded() != "" || st.CPUSeconds.Used != 0 {
+		t.Fatalf("expected fresh budget on the next day, got %+v", st)
+	}
+}
+
+func TestUsageHandler(t *testing.T) {
+	tp, _ := loadTierPolicies()
+	q := &quotas{store: newMemoryQuotaStore(), now: time.Now}
+	h := usageHandler(q, tp)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/usage", nil))
+	if rec.Code != 401 {
+		t.Fatalf("anonymous: got %d", rec.Code)
+	}
+
+	q.charge(context.Background(), "u1", RunRequest{}, NativeResult{CPUTimeMs: 1500})
+	req := httptest.NewRequest("GET", "/usage", nil)
+	ctx := context.WithValue(req.Context(), "user_id", "u1")
+	ctx = context.WithValue(ctx, "tier", "pro")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req.WithContext(ctx))
+	var st quotaStatus
+	if err := json.NewDecoder(rec.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Tier != "pro" || st.Runs.Used != 1 || st.CPUSeconds.Used != 1.5 || *st.Runs.Remaining != 4999 {
+		t.Fatalf("unexpected usage: %+v", st)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: "coderipper", Name: "rate_limited_total", Help: "Requests rejected by a rate limit policy"}, []string{"route", "policy"})
+
+func init() {
+	prometheus.MustRegister(rateLimited)
+}
+
+// rateLimitPolicy is one limit applied to every rate-limited route.
+type rateLimitPolicy struct {
+	Name string `json:"name"`
+	// Algorithm is token_bucket (bursts up to Limit, refilled evenly over the window)
+	// or sliding_window (at most Limit cost units in any window).
+	Algorithm string `json:"algorithm"`
+	// Key selects who the limit applies to: ip, user or api_key. Requests without a
+	// user or API key fall back to the client IP.
+	Key           string `json:"key"`
+	Limit         int    `json:"limit"`
+	WindowSeconds int    `json:"windowSeconds"`
+}
+
+func (p rateLimitPolicy) window() time.Duration {
+	return time.Duration(p.WindowSeconds) * time.Second
+}
+
+// rateLimitDecision is the outcome of charging a request against one policy.
+type rateLimitDecision struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration // until the full limit is available again
+	RetryAfter time.Duration // until the request would be allowed, when denied
+}
+
+// rateLimitConfig is the parsed rate limit configuration.
+type rateLimitConfig struct {
+	policies   []rateLimitPolicy
+	routeCosts map[string]int
+	trusted    []*net.IPNet
+	apiKeys    map[string]bool // SHA-256 hex digests of known API keys
+}
+
+// loadRateLimitConfig reads RATE_LIMIT_POLICIES (JSON array of policies), RATE_LIMIT_ROUTE_COSTS
+// ("/run=1,/judge=5"), TRUSTED_PROXIES (comma-separated CIDRs or IPs) and RATE_LIMIT_API_KEYS
+// (comma-separated SHA-256 hex digests of the API keys that get their own bucket). Without
+// policies, a single per-IP token bucket of RATE_LIMIT_PER_MINUTE (default 60) applies.
+func loadRateLimitConfig() (*rateLimitConfig, error) {
+	cfg := &rateLimitConfig{routeCosts: map[string]int{}, apiKeys: map[string]bool{}}
+	for _, h := range strings.Split(os.Getenv("RATE_LIMIT_API_KEYS"), ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			cfg.apiKeys[h] = true
+		}
+	}
+	if raw := os.Getenv("RATE_LIMIT_POLICIES"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &cfg.policies); err != nil {
+			return nil, fmt.Errorf("RATE_LIMIT_POLICIES: %w", err)
+		}
+	} else {
+		cfg.policies = []rateLimitPolicy{{Name: "ip", Algorithm: "token_bucket", Key: "ip", Limit: envInt("RATE_LIMIT_PER_MINUTE", 60), WindowSeconds: 60}}
+	}
+	for i, p := range cfg.policies {
+		if p.Limit <= 0 || p.WindowSeconds <= 0 {
+			return nil, fmt.Errorf("rate limit policy %q: limit and windowSeconds must be positive", p.Name)
+		}
+		switch p.Algorithm {
+		case "token_bucket", "sliding_window":
+		default:
+			return nil, fmt.Errorf("rate limit policy %q: unknown algorithm %q", p.Name, p.Algorithm)
+		}
+		switch p.Key {
+		case "ip", "user", "api_key":
+		default:
+			return nil, fmt.Errorf("rate limit policy %q: unknown key %q", p.Name, p.Key)
+		}
+		if p.Name == "" {
+			cfg.policies[i].Name = fmt.Sprintf("%s-%d", p.Key, i)
+		}
+	}
+	for route, c := range parseKeyValueList(os.Getenv("RATE_LIMIT_ROUTE_COSTS")) {
+		n, err := strconv.Atoi(c)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("RATE_LIMIT_ROUTE_COSTS: bad cost %q for %s", c, route)
+		}
+		cfg.routeCosts[route] = n
+	}
+	for _, s := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+		}
+		cfg.trusted = append(cfg.trusted, n)
+	}
+	return cfg, nil
+}
+
+func (cfg *rateLimitConfig) isTrusted(ip net.IP) bool {
+	for _, n := range cfg.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client. X-Forwarded-For is only honoured when the
+// request comes from a trusted proxy; it is read right to left and the first address that
+// is not itself a trusted proxy is the client, so clients cannot spoof it.
+func (cfg *rateLimitConfig) clientIP(r *http.Request) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	ip := net.ParseIP(remote)
+	if ip == nil || !cfg.isTrusted(ip) {
+		return remote
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		hopIP := net.ParseIP(hop)
+		if hopIP == nil {
+			break
+		}
+		if !cfg.isTrusted(hopIP) {
+			return hop
+		}
+		remote = hop
+	}
+	return remote
+}
+
+// key returns the bucket key for a request under a policy. Requests without a user or a known
+// API key are limited by client IP.
+func (cfg *rateLimitConfig) key(p rateLimitPolicy, r *http.Request) string {
+	switch p.Key {
+	case "user":
+		if userID, _ := r.Context().Value("user_id").(string); userID != "" {
+			return "user:" + userID
+		}
+	case "api_key":
+		// only known keys get their own bucket; otherwise a client could send a fresh
+		// random key with every request. The digest is stored, never the key itself.
+		if k := r.Header.Get("X-API-Key"); k != "" {
+			sum := sha256.Sum256([]byte(k))
+			if digest := hex.EncodeToString(sum[:]); cfg.apiKeys[digest] {
+				return "key:" + digest
+			}
+		}
+	}
+	return "ip:" + cfg.clientIP(r)
+}
+
+// rateLimitMiddleware charges each request the route's cost against every policy and
+// rejects it with 429 if any policy is exhausted. RateLimit-Limit, RateLimit-Remaining and
+// RateLimit-Reset describe the most restrictive policy; Retry-After is set on 429.
+// Backend errors let the request through.
+func rateLimitMiddleware(backend rateLimitBackend, cfg *rateLimitConfig, route string, next http.Handler) http.Handler {
+	cost := cfg.routeCosts[route]
+	if cost == 0 {
+		cost = 1
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var tightest *rateLimitDecision
+		var tightestPolicy rateLimitPolicy
+		for _, p := range cfg.policies {
+			d, err := backend.take(r.Context(), p, p.Name+":"+cfg.key(p, r), cost)
+			if err != nil {
+				log.Println("rate limit backend error:", err)
+				continue
+			}
+			if !d.Allowed {
+				setRateLimitHeaders(w, p, d)
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(d.RetryAfter)))
+				http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+				rateLimited.WithLabelValues(route, p.Name).Inc()
+				return
+			}
+			if tightest == nil || d.Remaining < tightest.Remaining {
+				d := d
+				tightest, tightestPolicy = &d, p
+			}
+		}
+		if tightest != nil {
+			setRateLimitHeaders(w, tightestPolicy, *tightest)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func setRateLimitHeaders(w http.ResponseWriter, p rateLimitPolicy, d rateLimitDecision) {
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", p.Limit, p.WindowSeconds))
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.Reset)))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Max(0, math.Ceil(d.Seconds())))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var rateLimitErrors = prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: "coderipper", Name: "rate_limit_backend_errors_total", Help: "Rate limit backend failures (requests are let through)"}, []string{"backend"})
+
+func init() {
+	prometheus.MustRegister(rateLimitErrors)
+}
+
+// rateLimitBackend charges cost units to key under a policy and reports whether the request
+// fits. An error means the backend could not decide; callers let the request through.
+type rateLimitBackend interface {
+	take(ctx context.Context, p rateLimitPolicy, key string, cost int) (rateLimitDecision, error)
+}
+
+// newRateLimitBackend builds the backend selected by RATE_LIMIT_BACKEND (memory or redis).
+func newRateLimitBackend() (rateLimitBackend, error) {
+	switch os.Getenv("RATE_LIMIT_BACKEND") {
+	case "", "memory":
+		return newRateLimiter(), nil
+	case "redis":
+		client, err := newRedisClient()
+		if err != nil {
+			return nil, err
+		}
+		return newRedisRateLimiter(client), nil
+	default:
+		return nil, fmt.Errorf("unknown RATE_LIMIT_BACKEND %q", os.Getenv("RATE_LIMIT_BACKEND"))
+	}
+}
+
+// In-memory rate limiter. Limits are per process and reset on restart; use the redis
+// backend to share them between replicas.
+type clientInfo struct {
+	// token bucket
+	tokens float64
+	// sliding window: counts of the current and previous fixed window
+	windowStart time.Time
+	curr, prev  int
+
+	last   time.Time     // last request, for refills and idle eviction
+	window time.Duration // policy window; the entry carries no state after two of them
+}
+
+type RateLimiter struct {
+	mu    sync.Mutex
+	items map[string]*clientInfo
+	now   func() time.Time
+
+	idle      time.Duration // entries unused for this long are dropped
+	lastSweep time.Time
+}
+
+func newRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		items: map[string]*clientInfo{},
+		now:   time.Now,
+		idle:  time.Duration(envInt("RATE_LIMIT_IDLE_SECONDS", 600)) * time.Second,
+	}
+}
+
+func (rl *RateLimiter) take(_ context.Context, p rateLimitPolicy, key string, cost int) (rateLimitDecision, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := rl.now()
+	rl.sweep(now)
+	ci, ok := rl.items[key]
+	if !ok {
+		ci = &clientInfo{tokens: float64(p.Limit), windowStart: now, last: now, window: p.window()}
+		rl.items[key] = ci
+	}
+	var d rateLimitDecision
+	if p.Algorithm == "sliding_window" {
+		d = ci.slidingWindow(p, now, cost)
+	} else {
+		d = ci.tokenBucket(p, now, cost)
+	}
+	ci.last = now
+	return d, nil
+}
+
+// tokenBucket refills Limit tokens per window, up to a burst of Limit.
+func (ci *clientInfo) tokenBucket(p rateLimitPolicy, now time.Time, cost int) rateLimitDecision {
+	rate := float64(p.Limit) / p.window().Seconds() // tokens per second
+	ci.tokens = math.Min(float64(p.Limit), ci.tokens+now.Sub(ci.last).Seconds()*rate)
+	d := rateLimitDecision{Limit: p.Limit}
+	if ci.tokens >= float64(cost) {
+		ci.tokens -= float64(cost)
+		d.Allowed = true
+	} else {
+		d.RetryAfter = time.Duration((float64(cost) - ci.tokens) / rate * float64(time.Second))
+	}
+	d.Remaining = int(ci.tokens)
+	d.Reset = time.Duration((float64(p.Limit) - ci.tokens) / rate * float64(time.Second))
+	return d
+}
+
+// slidingWindow approximates the count over the last window by weighting the previous fixed
+// window by how much of it still overlaps, which needs two counters instead of a log.
+func (ci *clientInfo) slidingWindow(p rateLimitPolicy, now time.Time, cost int) rateLimitDecision {
+	window := p.window()
+	if elapsed := now.Sub(ci.windowStart); elapsed >= window {
+		n := elapsed / window
+		if n == 1 {
+			ci.prev = ci.curr
+		} else {
+			ci.prev = 0
+		}
+		ci.curr = 0
+		ci.windowStart = ci.windowStart.Add(n * window)
+	}
+	elapsed := now.Sub(ci.windowStart)
+	weight := 1 - float64(elapsed)/float64(window)
+	used := float64(ci.prev)*weight + float64(ci.curr)
+	d := rateLimitDecision{Limit: p.Limit, Reset: window - elapsed}
+	if used+float64(cost) <= float64(p.Limit) {
+		ci.curr += cost
+		used += float64(cost)
+		d.Allowed = true
+	} else {
+		d.RetryAfter = window - elapsed
+	}
+	d.Remaining = int(math.Max(0, float64(p.Limit)-used))
+	return d
+}
+
+// sweep drops idle entries, at most once per idle period so requests stay O(1) on average.
+// Entries are kept for at least two windows, after which a full bucket or an empty window
+// is the same as no entry at all.
+func (rl *RateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < rl.idle {
+		return
+	}
+	rl.lastSweep = now
+	for k, ci := range rl.items {
+		if idle := now.Sub(ci.last); idle >= rl.idle && idle >= 2*ci.window {
+			delete(rl.items, k)
+		}
+	}
+}
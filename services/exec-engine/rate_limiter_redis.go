@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Both scripts run atomically in Redis and use the Redis clock, so replicas with skewed
+// clocks still agree. They return {allowed, remaining, reset ms, retry after ms}.
+
+// slidingWindowScript keeps one sorted-set member per cost unit, scored by request time.
+// KEYS[1] = counter key; ARGV = window (ms), limit, cost, unique member prefix
+var slidingWindowScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local used = redis.call('ZCARD', KEYS[1])
+if used + cost > limit then
+  -- wait until enough of the oldest entries have left the window
+  local oldest = redis.call('ZRANGE', KEYS[1], used + cost - limit - 1, used + cost - limit - 1, 'WITHSCORES')
+  local first = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+  local retry, reset = window, 0
+  if oldest[2] then retry = tonumber(oldest[2]) + window - now end
+  if first[2] then reset = tonumber(first[2]) + window - now end
+  return {0, limit - used, reset, retry}
+end
+for i = 1, cost do
+  redis.call('ZADD', KEYS[1], now, ARGV[4] .. ':' .. i)
+end
+redis.call('PEXPIRE', KEYS[1], window)
+local first = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+return {1, limit - used - cost, tonumber(first[2]) + window - now, 0}
+`)
+
+// tokenBucketScript stores the token count and last refill time in a hash.
+// KEYS[1] = bucket key; ARGV = window (ms), limit, cost
+var tokenBucketScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+local rate = limit / window
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or limit
+local ts = tonumber(state[2]) or now
+tokens = math.min(limit, tokens + (now - ts) * rate)
+local allowed, retry = 0, 0
+if tokens >= cost then
+  tokens = tokens - cost
+  allowed = 1
+else
+  retry = math.ceil((cost - tokens) / rate)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], window)
+return {allowed, math.floor(tokens), math.ceil((limit - tokens) / rate), retry}
+`)
+
+// redisRateLimiter enforces limits shared by every replica using the same Redis.
+// Keys expire on their own once idle, so nothing needs evicting.
+type redisRateLimiter struct {
+	client *redis.Client
+	prefix string
+}
+
+func newRedisRateLimiter(client *redis.Client) *redisRateLimiter {
+	return &redisRateLimiter{client: client, prefix: "coderipper:ratelimit:"}
+}
+
+func (rl *redisRateLimiter) take(ctx context.Context, p rateLimitPolicy, key string, cost int) (rateLimitDecision, error) {
+	window := p.window().Milliseconds()
+	var res []int64
+	var err error
+	if p.Algorithm == "sliding_window" {
+		member := make([]byte, 8)
+		rand.Read(member)
+		res, err = slidingWindowScript.Run(ctx, rl.client, []string{rl.prefix + key}, window, p.Limit, cost, hex.EncodeToString(member)).Int64Slice()
+	} else {
+		res, err = tokenBucketScript.Run(ctx, rl.client, []string{rl.prefix + key}, window, p.Limit, cost).Int64Slice()
+	}
+	if err != nil || len(res) != 4 {
+		rateLimitErrors.WithLabelValues("redis").Inc()
+		return rateLimitDecision{Allowed: true, Limit: p.Limit, Remaining: p.Limit}, err
+	}
+	return rateLimitDecision{
+		Allowed:    res[0] == 1,
+		Limit:      p.Limit,
+		Remaining:  int(res[1]),
+		Reset:      time.Duration(res[2]) * time.Millisecond,
+		RetryAfter: time.Duration(res[3]) * time.Millisecond,
+	}, nil
+}
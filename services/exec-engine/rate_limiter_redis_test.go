@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisRateLimiterSharedAcrossReplicas(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ctx := context.Background()
+	for _, algo := range []string{"token_bucket", "sliding_window"} {
+		p := rateLimitPolicy{Name: algo, Algorithm: algo, Key: "ip", Limit: 2, WindowSeconds: 60}
+		// two replicas pointing at the same Redis share one budget
+		a := newRedisRateLimiter(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+		b := newRedisRateLimiter(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+
+		for i, rl := range []*redisRateLimiter{a, b} {
+			if d, err := rl.take(ctx, p, algo+":1.2.3.4", 1); err != nil || !d.Allowed {
+				t.Fatalf("%s request %d: %+v err=%v", algo, i, d, err)
+			}
+		}
+		d, _ := a.take(ctx, p, algo+":1.2.3.4", 1)
+		if d.Allowed || d.Remaining != 0 || d.RetryAfter <= 0 {
+			t.Fatalf("%s: expected deny after the shared limit is used, got %+v", algo, d)
+		}
+		if d, _ := b.take(ctx, p, algo+":5.6.7.8", 2); !d.Allowed {
+			t.Fatalf("%s: other clients are not affected", algo)
+		}
+	}
+}
+
+func TestRedisRateLimiterFailsOpen(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rl := newRedisRateLimiter(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+	mr.Close()
+	p := rateLimitPolicy{Name: "ip", Algorithm: "token_bucket", Key: "ip", Limit: 1, WindowSeconds: 60}
+	d, err := rl.take(context.Background(), p, "1.2.3.4", 1)
+	if err == nil || !d.Allowed {
+		t.Fatalf("expected allow with error when redis is down, got %+v err=%v", d, err)
+	}
+}
+
+func TestRedisSlidingWindowCostAboveLimit(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rl := newRedisRateLimiter(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+	p := rateLimitPolicy{Name: "sw", Algorithm: "sliding_window", Key: "ip", Limit: 2, WindowSeconds: 60}
+	d, err := rl.take(context.Background(), p, "sw:1.2.3.4", 5)
+	if err != nil || d.Allowed {
+		t.Fatalf("a request costing more than the limit must be denied, got %+v err=%v", d, err)
+	}
+}
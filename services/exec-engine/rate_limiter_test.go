@@ -1,25 +1,147 @@
 package main
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 )
 
 func TestRateLimiterAllow(t *testing.T) {
-	rl := newRateLimiter(2)
-	ip := "1.2.3.4"
-	if !rl.allow(ip) {
-		t.Fatal("expected allow")
+	for _, algo := range []string{"token_bucket", "sliding_window"} {
+		rl := newRateLimiter()
+		now := time.Now()
+		rl.now = func() time.Time { return now }
+		p := rateLimitPolicy{Name: "ip", Algorithm: algo, Key: "ip", Limit: 2, WindowSeconds: 60}
+		ip := "1.2.3.4"
+		allow := func() bool {
+			d, _ := rl.take(context.Background(), p, ip, 1)
+			return d.Allowed
+		}
+		if !allow() {
+			t.Fatalf("%s: expected allow", algo)
+		}
+		if !allow() {
+			t.Fatalf("%s: expected allow second", algo)
+		}
+		if allow() {
+			t.Fatalf("%s: expected deny third", algo)
+		}
+		// after the window has passed
+		now = now.Add(2 * time.Minute)
+		if !allow() {
+			t.Fatalf("%s: expected allow after reset", algo)
+		}
 	}
-	if !rl.allow(ip) {
-		t.Fatal("expected allow second")
+}
+
+func TestRateLimiterTokenBucketRefill(t *testing.T) {
+	rl := newRateLimiter()
+	now := time.Now()
+	rl.now = func() time.Time { return now }
+	p := rateLimitPolicy{Name: "ip", Algorithm: "token_bucket", Limit: 60, WindowSeconds: 60}
+	if d, _ := rl.take(context.Background(), p, "k", 60); !d.Allowed || d.Remaining != 0 {
+		t.Fatalf("full burst: %+v", d)
+	}
+	d, _ := rl.take(context.Background(), p, "k", 5)
+	if d.Allowed || d.RetryAfter != 5*time.Second {
+		t.Fatalf("expected deny with 5s retry, got %+v", d)
+	}
+	// one token per second
+	now = now.Add(5 * time.Second)
+	if d, _ := rl.take(context.Background(), p, "k", 5); !d.Allowed {
+		t.Fatalf("expected allow after refill, got %+v", d)
+	}
+}
+
+func TestRateLimiterEvictsIdleEntries(t *testing.T) {
+	rl := newRateLimiter()
+	now := time.Now()
+	rl.now = func() time.Time { return now }
+	p := rateLimitPolicy{Name: "ip", Algorithm: "token_bucket", Limit: 1, WindowSeconds: 60}
+	rl.take(context.Background(), p, "a", 1)
+	now = now.Add(rl.idle)
+	rl.take(context.Background(), p, "b", 1)
+	if _, ok := rl.items["a"]; ok {
+		t.Fatal("idle entry was not evicted")
+	}
+	if _, ok := rl.items["b"]; !ok {
+		t.Fatal("active entry was evicted")
+	}
+}
+
+func TestClientIPTrustedProxies(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.168.1.1")
+	cfg, err := loadRateLimitConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct{ remote, xff, want string }{
+		{"203.0.113.7:1234", "1.1.1.1", "203.0.113.7"},                // untrusted peer, header ignored
+		{"10.1.2.3:1234", "1.1.1.1", "1.1.1.1"},                       // ingress
+		{"10.1.2.3:1234", "6.6.6.6, 1.1.1.1, 192.168.1.1", "1.1.1.1"}, // spoofed leftmost hop
+		{"10.1.2.3:1234", "", "10.1.2.3"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", "/run", nil)
+		r.RemoteAddr = c.remote
+		if c.xff != "" {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+		if got := cfg.clientIP(r); got != c.want {
+			t.Errorf("remote %s xff %q: got %s, want %s", c.remote, c.xff, got, c.want)
+		}
+	}
+}
+
+func TestRateLimitMiddlewareHeadersAndCosts(t *testing.T) {
+	t.Setenv("RATE_LIMIT_POLICIES", `[{"name":"user","algorithm":"sliding_window","key":"user","limit":10,"windowSeconds":60}]`)
+	t.Setenv("RATE_LIMIT_ROUTE_COSTS", "/judge=4")
+	cfg, err := loadRateLimitConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := rateLimitMiddleware(newRateLimiter(), cfg, "/judge", ok)
+
+	var codes []int
+	var rec *httptest.ResponseRecorder
+	for i := 0; i < 3; i++ {
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/judge", nil))
+		codes = append(codes, rec.Code)
+		if i == 0 && rec.Header().Get("RateLimit-Remaining") != "6" {
+			t.Fatalf("remaining after first request: %q", rec.Header().Get("RateLimit-Remaining"))
+		}
+	}
+	if codes[0] != 200 || codes[1] != 200 || codes[2] != http.StatusTooManyRequests {
+		t.Fatalf("codes = %v, want 200 200 429", codes)
+	}
+	if rec.Header().Get("Retry-After") == "" || rec.Header().Get("RateLimit-Limit") != "10" {
+		t.Fatalf("missing headers on 429: %v", rec.Header())
+	}
+}
+
+func TestRateLimitUnknownAPIKeysShareIPBucket(t *testing.T) {
+	t.Setenv("RATE_LIMIT_POLICIES", `[{"name":"key","algorithm":"token_bucket","key":"api_key","limit":1,"windowSeconds":60}]`)
+	t.Setenv("RATE_LIMIT_API_KEYS", "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b") // sha256("secret")
+	cfg, err := loadRateLimitConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := rateLimitMiddleware(newRateLimiter(), cfg, "/run", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	send := func(key string) int {
+		req := httptest.NewRequest("POST", "/run", nil)
+		req.Header.Set("X-API-Key", key)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
 	}
-	if rl.allow(ip) {
-		t.Fatal("expected deny third")
+	if send("random-1") != 200 || send("random-2") != http.StatusTooManyRequests {
+		t.Fatal("rotating unknown keys must not escape the limit")
 	}
-	// after window reset
-	rl.items[ip].windowEnd = time.Now().Add(-time.Minute)
-	if !rl.allow(ip) {
-		t.Fatal("expected allow after reset")
+	if send("secret") != 200 {
+		t.Fatal("a known key has its own bucket")
 	}
 }
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+var resultCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: "coderipper", Name: "result_cache_requests_total", Help: "Result cache lookups by outcome (hit, miss, bypass)"}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(resultCacheRequests)
+}
+
+// resultCacheStore holds run results by cache key.
+type resultCacheStore interface {
+	get(ctx context.Context, key string) (*NativeResult, error)
+	set(ctx context.Context, key string, res NativeResult, ttl time.Duration) error
+}
+
+// resultCache returns stored results for runs identical to an earlier one: same backend,
+// language, toolchain, files, stdin and limits. Only deterministic programs should be cached;
+// clients opt out per request with "noCache".
+type resultCache struct {
+	store resultCacheStore
+	ttl   time.Duration
+
+	toolchains map[string]string // TOOLCHAIN_VERSIONS overrides by language
+	versions   sync.Map          // probed native toolchain versions by language
+}
+
+// newResultCache builds the cache selected by RESULT_CACHE (off by default): memory, an LRU of
+// RESULT_CACHE_SIZE entries (1000), or redis. Entries live for RESULT_CACHE_TTL_SECONDS (3600).
+func newResultCache() (*resultCache, error) {
+	rc := &resultCache{
+		ttl:        time.Duration(envInt("RESULT_CACHE_TTL_SECONDS", 3600)) * time.Second,
+		toolchains: parseKeyValueList(os.Getenv("TOOLCHAIN_VERSIONS")),
+	}
+	switch os.Getenv("RESULT_CACHE") {
+	case "", "off":
+		return nil, nil
+	case "memory":
+		rc.store = newLRUResultStore(envInt("RESULT_CACHE_SIZE", 1000))
+	case "redis":
+		client, err := newRedisClient()
+		if err != nil {
+			return nil, err
+		}
+		rc.store = &redisResultStore{client: client, prefix: "coderipper:result:"}
+	default:
+		return nil, fmt.Errorf("unknown RESULT_CACHE %q", os.Getenv("RESULT_CACHE"))
+	}
+	return rc, nil
+}
+
+// toolchain identifies the compiler or interpreter a run would use, so upgrading it
+// invalidates cached results. Container and k8s runs are identified by the runner image;
+// pin image tags (or set TOOLCHAIN_VERSIONS) when caching is on.
+func (rc *resultCache) toolchain(rs *runners, language string) string {
+	if v, ok := rc.toolchains[language]; ok {
+		return v
+	}
+	switch rs.mode {
+	case "native":
+		if v, ok := rc.versions.Load(language); ok {
+			return v.(string)
+		}
+		v := nativeToolchainVersion(language)
+		rc.versions.Store(language, v)
+		return v
+	case "wasm":
+		return fmt.Sprintf("%s|%s|%s", rs.wasm.modules[wasmLanguage(language)], rs.wasm.wasiSDK, rs.wasm.rustTarget)
+	default:
+		return runnerImage(language)
+	}
+}
+
+// nativeToolchainVersion asks the host toolchain for its version.
+func nativeToolchainVersion(language string) string {
+	var args []string
+	switch language {
+	case "python", "python3":
+		args = []string{"python", "--version"}
+	case "javascript", "js", "node", "typescript", "ts":
+		args = []string{"node", "--version"}
+	case "go", "golang":
+		args = []string{"go", "version"}
+	case "java":
+		args = []string{"java", "-version"}
+	case "c":
+		args = []string{"gcc", "--version"}
+	case "cpp", "c++":
+		args = []string{"g++", "--version"}
+	case "rust":
+		args = []string{"rustc", "--version"}
+	case "ruby":
+		args = []string{"ruby", "--version"}
+	case "php":
+		args = []string{"php", "--version"}
+	case "bash", "sh", "shell":
+		args = []string{"bash", "--version"}
+	default:
+		return ""
+	}
+	out, _ := exec.Command(args[0], args[1:]...).CombinedOutput()
+	first, _, _ := strings.Cut(string(out), "\n")
+	return strings.TrimSpace(first)
+}
+
+// key hashes everything that determines the result of a run. An archive counts by its files,
+// not its bytes, so re-packing a project does not miss the cache.
+func (rc *resultCache) key(rs *runners, req RunRequest) string {
+	req.Archive = nil
+	if req.Mode == modeCheck || req.Mode == modeTest {
+		// checks and tests do not run the program
+		req.Stdin, req.Args = "", nil
+	}
+	b, _ := json.Marshal(struct {
+		Mode      string
+		Toolchain string
+		Req       RunRequest
+	}{rs.mode, rc.toolchain(rs, req.Language), req})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// cacheable reports whether a result is worth storing. Timeouts depend on load, not on the
+// program, and infrastructure failures say nothing about the submission. Artifact links
+// expire, so results with links are not kept either.
+func cacheable(res NativeResult) bool {
+	for _, a := range res.Artifacts {
+		if a.URL != "" {
+			return false
+		}
+	}
+	return res.ExitCode != 124 && !res.InfraError
+}
+
+// lruResultStore is an in-process LRU cache.
+type lruResultStore struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // front is most recently used
+	entries map[string]*list.Element
+}
+
+type lruResultEntry struct {
+	key     string
+	res     NativeResult
+	expires time.Time
+}
+
+func newLRUResultStore(size int) *lruResultStore {
+	return &lruResultStore{size: size, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (s *lruResultStore) get(_ context.Context, key string) (*NativeResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	e := el.Value.(*lruResultEntry)
+	if time.Now().After(e.expires) {
+		s.order.Remove(el)
+		delete(s.entries, key)
+		return nil, nil
+	}
+	s.order.MoveToFront(el)
+	res := e.res
+	return &res, nil
+}
+
+func (s *lruResultStore) set(_ context.Context, key string, res NativeResult, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.entries[key]; ok {
+		el.Value = &lruResultEntry{key: key, res: res, expires: time.Now().Add(ttl)}
+		s.order.MoveToFront(el)
+		return nil
+	}
+	s.entries[key] = s.order.PushFront(&lruResultEntry{key: key, res: res, expires: time.Now().Add(ttl)})
+	for s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*lruResultEntry).key)
+	}
+	return nil
+}
+
+// redisResultStore shares cached results between replicas.
+type redisResultStore struct {
+	client *redis.Client
+	prefix string
+}
+
+func (s *redisResultStore) get(ctx context.Context, key string) (*NativeResult, error) {
+	b, err := s.client.Get(ctx, s.prefix+key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var res NativeResult
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, fmt.Errorf("decode cached result: %w", err)
+	}
+	return &res, nil
+}
+
+func (s *redisResultStore) set(ctx context.Context, key string, res NativeResult, ttl time.Duration) error {
+	b, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, s.prefix+key, b, ttl).Err()
+}
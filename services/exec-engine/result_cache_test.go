@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestLRUResultStoreEvicts(t *testing.T) {
+	s := newLRUResultStore(2)
+	ctx := context.Background()
+	s.set(ctx, "a", NativeResult{Stdout: "a"}, time.Hour)
+	s.set(ctx, "b", NativeResult{Stdout: "b"}, time.Hour)
+	s.get(ctx, "a") // a is now the most recently used
+	s.set(ctx, "c", NativeResult{Stdout: "c"}, time.Hour)
+	if res, _ := s.get(ctx, "b"); res != nil {
+		t.Fatal("least recently used entry was not evicted")
+	}
+	if res, _ := s.get(ctx, "a"); res == nil || res.Stdout != "a" {
+		t.Fatal("recently used entry was evicted")
+	}
+	s.set(ctx, "d", NativeResult{}, -time.Second)
+	if res, _ := s.get(ctx, "d"); res != nil {
+		t.Fatal("expired entry was returned")
+	}
+}
+
+func TestRedisResultStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	s := &redisResultStore{client: redis.NewClient(&redis.Options{Addr: mr.Addr()}), prefix: "test:"}
+	ctx := context.Background()
+	if res, err := s.get(ctx, "k"); res != nil || err != nil {
+		t.Fatalf("empty cache: %v %v", res, err)
+	}
+	s.set(ctx, "k", NativeResult{Stdout: "hi", Success: true}, time.Minute)
+	if res, err := s.get(ctx, "k"); err != nil || res.Stdout != "hi" {
+		t.Fatalf("got %+v, %v", res, err)
+	}
+}
+
+func TestResultCacheKey(t *testing.T) {
+	rc := &resultCache{toolchains: map[string]string{"python": "3.12.1"}}
+	rs := &runners{mode: "docker"}
+	req := RunRequest{Language: "python", Files: map[string]string{"main.py": "print(1)", "util.py": ""}, TimeLimit: 5}
+	same := RunRequest{Language: "python", Files: map[string]string{"util.py": "", "main.py": "print(1)"}, TimeLimit: 5}
+	if rc.key(rs, req) != rc.key(rs, same) {
+		t.Fatal("key depends on map order")
+	}
+	for _, other := range []RunRequest{
+		{Language: "python", Files: req.Files, TimeLimit: 5, Stdin: "x"},
+		{Language: "python", Files: req.Files, TimeLimit: 6},
+		{Language: "python", Files: map[string]string{"main.py": "print(2)"}, TimeLimit: 5},
+	} {
+		if rc.key(rs, req) == rc.key(rs, other) {
+			t.Fatalf("key ignores a difference: %+v", other)
+		}
+	}
+	before := rc.key(rs, req)
+	rc.toolchains["python"] = "3.13.0"
+	if rc.key(rs, req) == before {
+		t.Fatal("key ignores the toolchain version")
+	}
+}
+
+func TestRunHandlerResultCache(t *testing.T) {
+	tp, _ := loadTierPolicies()
+	rs := &runners{mode: "native", queue: newRunQueue("native", tp.weights())}
+	rc := &resultCache{store: newLRUResultStore(10), ttl: time.Minute, toolchains: map[string]string{}}
+	h := runHandler(rs, tp, &quotas{store: newMemoryQuotaStore(), now: time.Now}, rc, loadRequestLimits())
+
+	run := func(body string) (string, NativeResult) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/run", strings.NewReader(body)))
+		var res NativeResult
+		json.NewDecoder(rec.Body).Decode(&res)
+		return rec.Header().Get("X-Cache"), res
+	}
+	body := `{"language":"bash","files":{"main.sh":"echo hi"}}`
+	if status, res := run(body); status != "MISS" || res.Cached || res.Stdout != "hi\n" {
+		t.Fatalf("first run: %s %+v", status, res)
+	}
+	if status, res := run(body); status != "HIT" || !res.Cached || res.Stdout != "hi\n" {
+		t.Fatalf("second run: %s %+v", status, res)
+	}
+	if status, res := run(`{"language":"bash","files":{"main.sh":"echo hi"},"noCache":true}`); status != "BYPASS" || res.Cached {
+		t.Fatalf("opted out run: %s %+v", status, res)
+	}
+}
+
+func TestInfrastructureFailuresAreNotCached(t *testing.T) {
+	t.Setenv("PATH", t.TempDir()) // no interpreter to be found
+	res := executeNative(RunRequest{Language: "python", Files: map[string]string{"main.py": "print(1)"}, TimeLimit: 5}, nil)
+	if !res.InfraError {
+		t.Fatalf("missing interpreter not flagged: %+v", res)
+	}
+	if cacheable(res) {
+		t.Fatal("infrastructure failure would be cached")
+	}
+	if !cacheable(NativeResult{ExitCode: 1, Stderr: "Traceback"}) {
+		t.Fatal("a failing program is still cacheable")
+	}
+}
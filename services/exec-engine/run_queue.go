@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var errQueueFull = errors.New("run queue full")
+
+var (
+	queueDepth   = prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: "coderipper", Name: "run_queue_depth", Help: "Runs waiting for a worker"}, []string{"mode"})
+	queueRunning = prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: "coderipper", Name: "run_queue_running", Help: "Runs currently executing"}, []string{"mode"})
+	queueWait    = prometheus.NewHistogramVec(prometheus.HistogramOpts{Namespace: "coderipper", Name: "run_queue_wait_seconds", Help: "Time runs spent waiting for a worker", Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 2, 5, 10, 30, 60}}, []string{"mode"})
+)
+
+func init() {
+	prometheus.MustRegister(queueDepth, queueRunning, queueWait)
+}
+
+// runQueue bounds how many runs a backend executes at once. Runs beyond the worker count
+// wait in a queue of limited capacity; once that is full new runs are rejected.
+// Each tier has its own FIFO, and a free worker goes to the next run of the tier picked
+// by smooth weighted round-robin, so higher tiers are served first without starving free users.
+type runQueue struct {
+	mode     string
+	workers  int
+	capacity int
+	weights  map[string]int
+
+	mu      sync.Mutex
+	running int
+	waiting map[string][]*queuedRun // per tier, FIFO
+	queued  int
+	credit  map[string]int // round-robin state per tier
+	avgRun  time.Duration  // moving average of run durations, used for Retry-After
+}
+
+type queuedRun struct {
+	tier  string
+	ready chan struct{}
+	// moved, if set, is told the run's position whenever the queue changes
+	moved func(position int)
+}
+
+// newRunQueue reads the worker pool configuration for a backend from the environment.
+// RUN_WORKERS_<MODE> and RUN_QUEUE_SIZE_<MODE> override RUN_WORKERS and RUN_QUEUE_SIZE.
+func newRunQueue(mode string, weights map[string]int) *runQueue {
+	workers := runtime.NumCPU()
+	if mode == "k8s" {
+		// Jobs run on other nodes; the limit protects the API server and the cluster
+		workers = 20
+	}
+	suffix := "_" + strings.ToUpper(mode)
+	return &runQueue{
+		mode:     mode,
+		workers:  envInt("RUN_WORKERS"+suffix, envInt("RUN_WORKERS", workers)),
+		capacity: envInt("RUN_QUEUE_SIZE"+suffix, envInt("RUN_QUEUE_SIZE", 100)),
+		weights:  weights,
+		waiting:  map[string][]*queuedRun{},
+		credit:   map[string]int{},
+		avgRun:   time.Second,
+	}
+}
+
+// envInt reads a positive integer from the environment, falling back to def.
+func envInt(name string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n > 0 {
+		return n
+	}
+	return def
+}
+
+// acquire waits for a free worker for a run of the given tier. It returns the caller's
+// position in the queue when it arrived (0 if a worker was free) and how long it waited.
+// Positions follow the weighted round-robin order, not arrival. If moved is not nil it is
+// called with the current position whenever that may have changed while the run waits.
+// acquire fails with errQueueFull when the queue is at capacity, or with ctx.Err() if the
+// caller gives up while queued.
+func (q *runQueue) acquire(ctx context.Context, tier string, moved func(position int)) (position int, wait time.Duration, err error) {
+	start := time.Now()
+	q.mu.Lock()
+	if q.running < q.workers && q.queued == 0 {
+		q.running++
+		q.updateGauges()
+		q.mu.Unlock()
+		queueWait.WithLabelValues(q.mode).Observe(0)
+		return 0, 0, nil
+	}
+	if q.queued >= q.capacity {
+		q.mu.Unlock()
+		return 0, 0, errQueueFull
+	}
+	qr := &queuedRun{tier: tier, ready: make(chan struct{}), moved: moved}
+	q.waiting[tier] = append(q.waiting[tier], qr)
+	q.queued++
+	position = q.positionLocked(qr)
+	q.updateGauges()
+	q.notifyLocked()
+	q.mu.Unlock()
+
+	select {
+	case <-qr.ready:
+		wait = time.Since(start)
+		queueWait.WithLabelValues(q.mode).Observe(wait.Seconds())
+		return position, wait, nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		for i, w := range q.waiting[tier] {
+			if w == qr {
+				q.waiting[tier] = append(q.waiting[tier][:i], q.waiting[tier][i+1:]...)
+				q.queued--
+				q.updateGauges()
+				q.notifyLocked()
+				return position, time.Since(start), ctx.Err()
+			}
+		}
+		// a worker was handed to us just as we gave up; pass it on
+		q.releaseLocked()
+		return position, time.Since(start), ctx.Err()
+	}
+}
+
+// release returns a worker after a run that took d, handing it to the next queued run.
+func (q *runQueue) release(d time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.avgRun = (q.avgRun*7 + d) / 8
+	q.releaseLocked()
+}
+
+func (q *runQueue) releaseLocked() {
+	if tier := q.nextTier(); tier != "" {
+		next := q.waiting[tier][0]
+		q.waiting[tier] = q.waiting[tier][1:]
+		q.queued--
+		close(next.ready)
+		q.notifyLocked()
+	} else {
+		q.running--
+	}
+	q.updateGauges()
+}
+
+// nextTier picks the tier to serve next among those with queued runs. Returns "" when
+// nothing is queued.
+func (q *runQueue) nextTier() string {
+	left := make(map[string]int, len(q.waiting))
+	for tier, runs := range q.waiting {
+		left[tier] = len(runs)
+	}
+	return pickTier(left, q.credit, q.weights)
+}
+
+// pickTier is one step of smooth weighted round-robin over the tiers with runs left: every
+// such tier earns its weight in credit, the richest tier is served and pays back the total.
+func pickTier(left, credit, weights map[string]int) string {
+	best, total := "", 0
+	tiers := make([]string, 0, len(left))
+	for tier := range left {
+		tiers = append(tiers, tier)
+	}
+	sort.Strings(tiers)
+	for _, tier := range tiers {
+		if left[tier] == 0 {
+			delete(credit, tier)
+			continue
+		}
+		w := weights[tier]
+		if w <= 0 {
+			w = 1
+		}
+		credit[tier] += w
+		total += w
+		if best == "" || credit[tier] > credit[best] {
+			best = tier
+		}
+	}
+	if best != "" {
+		credit[best] -= total
+	}
+	return best
+}
+
+// positionLocked returns the 1-based place of a queued run in serving order, found by playing
+// the round-robin forward on a copy of its state. Runs that arrive later can still overtake it.
+func (q *runQueue) positionLocked(qr *queuedRun) int {
+	ahead := -1 // runs of the same tier in front of qr
+	for i, w := range q.waiting[qr.tier] {
+		if w == qr {
+			ahead = i
+		}
+	}
+	if ahead < 0 {
+		return 0
+	}
+	left := make(map[string]int, len(q.waiting))
+	for tier, runs := range q.waiting {
+		left[tier] = len(runs)
+	}
+	credit := make(map[string]int, len(q.credit))
+	for tier, c := range q.credit {
+		credit[tier] = c
+	}
+	for pos := 1; ; pos++ {
+		tier := pickTier(left, credit, q.weights)
+		if tier == qr.tier {
+			if ahead == 0 {
+				return pos
+			}
+			ahead--
+		}
+		left[tier]--
+	}
+}
+
+// notifyLocked tells every waiting run that asked for it where it now stands.
+func (q *runQueue) notifyLocked() {
+	for _, runs := range q.waiting {
+		for _, qr := range runs {
+			if qr.moved != nil {
+				qr.moved(q.positionLocked(qr))
+			}
+		}
+	}
+}
+
+func (q *runQueue) updateGauges() {
+	queueDepth.WithLabelValues(q.mode).Set(float64(q.queued))
+	queueRunning.WithLabelValues(q.mode).Set(float64(q.running))
+}
+
+// retryAfter estimates in whole seconds when a rejected caller could expect a free slot.
+func (q *runQueue) retryAfter() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	est := q.avgRun.Seconds() * float64(q.queued+1) / float64(q.workers)
+	return int(math.Max(1, math.Ceil(est)))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunQueueFIFOAndBackpressure(t *testing.T) {
+	q := newTestQueue(1, 1)
+	if pos, _, err := q.acquire(context.Background(), "free", nil); err != nil || pos != 0 {
+		t.Fatalf("first acquire: pos=%d err=%v", pos, err)
+	}
+
+	got := make(chan int)
+	go func() {
+		pos, _, err := q.acquire(context.Background(), "free", nil)
+		if err != nil {
+			t.Error(err)
+		}
+		got <- pos
+	}()
+	waitFor(t, func() bool { q.mu.Lock(); defer q.mu.Unlock(); return q.queued == 1 })
+
+	if _, _, err := q.acquire(context.Background(), "free", nil); err != errQueueFull {
+		t.Fatalf("expected errQueueFull, got %v", err)
+	}
+	if ra := q.retryAfter(); ra < 1 {
+		t.Fatalf("retryAfter = %d", ra)
+	}
+
+	q.release(10 * time.Millisecond)
+	if pos := <-got; pos != 1 {
+		t.Fatalf("queued run position = %d, want 1", pos)
+	}
+	q.release(10 * time.Millisecond)
+	if q.running != 0 {
+		t.Fatalf("running = %d after releases", q.running)
+	}
+}
+
+func TestRunQueueCancelWhileWaiting(t *testing.T) {
+	q := newTestQueue(1, 5)
+	q.acquire(context.Background(), "free", nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, _, err := q.acquire(ctx, "free", nil)
+		done <- err
+	}()
+	waitFor(t, func() bool { q.mu.Lock(); defer q.mu.Unlock(); return q.queued == 1 })
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if q.queued != 0 {
+		t.Fatalf("cancelled run still queued")
+	}
+}
+
+func TestRunQueueWeightedFairness(t *testing.T) {
+	q := newTestQueue(1, 100)
+	q.weights = map[string]int{"free": 1, "pro": 3}
+	q.acquire(context.Background(), "free", nil)
+
+	order := make(chan string, 16)
+	enqueue := func(tier string) {
+		n := q.queued
+		go func() {
+			if _, _, err := q.acquire(context.Background(), tier, nil); err == nil {
+				order <- tier
+			}
+		}()
+		waitFor(t, func() bool { q.mu.Lock(); defer q.mu.Unlock(); return q.queued == n+1 })
+	}
+	for i := 0; i < 4; i++ {
+		enqueue("free")
+		enqueue("pro")
+	}
+
+	served := map[string]int{}
+	for i := 0; i < 4; i++ {
+		q.release(time.Millisecond)
+		served[<-order]++
+	}
+	// with weights 3:1 the first four grants go three to pro and one to free
+	if served["pro"] != 3 || served["free"] != 1 {
+		t.Fatalf("unexpected service order: %v", served)
+	}
+}
+
+func TestRunQueueWeightedPosition(t *testing.T) {
+	q := newTestQueue(1, 100)
+	q.weights = map[string]int{"free": 1, "pro": 3}
+	q.acquire(context.Background(), "free", nil)
+
+	var mu sync.Mutex
+	freePos := 0
+	go q.acquire(context.Background(), "free", func(p int) { mu.Lock(); freePos = p; mu.Unlock() })
+	waitFor(t, func() bool { mu.Lock(); defer mu.Unlock(); return freePos == 1 })
+
+	got := make(chan int)
+	go func() {
+		pos, _, _ := q.acquire(context.Background(), "pro", nil)
+		got <- pos
+	}()
+	// the pro run is served first, so the waiting free run moves back
+	waitFor(t, func() bool { mu.Lock(); defer mu.Unlock(); return freePos == 2 })
+	q.release(time.Millisecond)
+	if pos := <-got; pos != 1 {
+		t.Fatalf("pro position = %d, want 1", pos)
+	}
+	waitFor(t, func() bool { mu.Lock(); defer mu.Unlock(); return freePos == 1 })
+}
+
+func newTestQueue(workers, capacity int) *runQueue {
+	q := newRunQueue("test", map[string]int{"free": 1})
+	q.workers, q.capacity = workers, capacity
+	return q
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// writeSubmissionFiles writes a submission into dir, which must be a fresh directory, and
+// returns the path of the main file. Names are validated again so no backend writes outside
+// dir even if a caller skipped validation; files are created exclusively and never through
+// symlinks.
+func writeSubmissionFiles(dir string, files map[string]string) (string, error) {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range sortedFileNames(files) {
+		if err := validateFileName(name); err != nil {
+			return "", err
+		}
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if rel, err := filepath.Rel(root, p); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", fmt.Errorf("file %q escapes the submission directory", name)
+		}
+		if err := mkdirNoSymlinks(root, filepath.Dir(p)); err != nil {
+			return "", fmt.Errorf("create directory for %q: %w", name, err)
+		}
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return "", fmt.Errorf("write %q: %w", name, err)
+		}
+		_, err = f.WriteString(files[name])
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return "", fmt.Errorf("write %q: %w", name, err)
+		}
+	}
+	return filepath.Join(dir, filepath.FromSlash(mainFileName(files))), nil
+}
+
+// mkdirNoSymlinks creates dir and its parents below root, refusing to pass through symlinks.
+func mkdirNoSymlinks(root, dir string) error {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == "." {
+		return err
+	}
+	cur := root
+	for _, seg := range strings.Split(rel, string(filepath.Separator)) {
+		cur = filepath.Join(cur, seg)
+		info, err := os.Lstat(cur)
+		switch {
+		case os.IsNotExist(err):
+			if err := os.Mkdir(cur, 0755); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case info.Mode()&os.ModeSymlink != 0 || !info.IsDir():
+			return fmt.Errorf("%s is not a directory", seg)
+		}
+	}
+	return nil
+}
+
+// mainFileName picks the entry point of a submission: a file named main.* or Main.* at the top
+// level if there is one, otherwise the first file in name order. Files added by the profiler
+// never are.
+func mainFileName(files map[string]string) string {
+	var names []string
+	for _, name := range sortedFileNames(files) {
+		if profilerFile(name) {
+			continue
+		}
+		if base := strings.TrimSuffix(name, filepath.Ext(name)); base == "main" || base == "Main" {
+			return name
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
+
+func sortedFileNames(files map[string]string) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
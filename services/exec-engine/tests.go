@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TestCase is the result of one test in mode "test".
+type TestCase struct {
+	Name string `json:"name"`
+	// Suite is the test's class, package or file, as the framework reports it
+	Suite      string  `json:"suite,omitempty"`
+	Status     string  `json:"status"` // passed, failed or skipped
+	DurationMs float64 `json:"durationMs"`
+	// Message is the failure message and output of a failed test, or why it was skipped
+	Message string `json:"message,omitempty"`
+}
+
+// TestSummary counts the tests of a run by status.
+type TestSummary struct {
+	Total   int `json:"total"`
+	Passed  int `json:"passed"`
+	Failed  int `json:"failed"`
+	Skipped int `json:"skipped"`
+}
+
+func summarizeTests(tests []TestCase) *TestSummary {
+	s := &TestSummary{Total: len(tests)}
+	for _, t := range tests {
+		switch t.Status {
+		case "passed":
+			s.Passed++
+		case "failed":
+			s.Failed++
+		default:
+			s.Skipped++
+		}
+	}
+	return s
+}
+
+// testReportFile is where test frameworks write their machine-readable report in the
+// workspace. The test step prints it after reportMarker, so every backend returns it on stdout.
+const (
+	testReportFile = ".coderipper-report"
+	reportMarker   = "::coderipper-report"
+)
+
+// testFramework runs a language's tests and reads the report they leave in testReportFile.
+type testFramework struct {
+	name    string
+	command func(req RunRequest) string
+	parse   func(report []byte) (tests []TestCase, output string, err error)
+}
+
+var (
+	pytest = testFramework{"pytest", func(RunRequest) string {
+		return "python -m pytest -q -p no:cacheprovider --junitxml=" + testReportFile
+	}, parseJUnitXML}
+	goTest = testFramework{"go test", func(RunRequest) string {
+		// a single package submission may come without a module
+		return "[ -f go.mod ] || go mod init submission >/dev/null 2>&1\ngo test -json ./... > " + testReportFile
+	}, parseGoTestJSON}
+	junit = testFramework{"junit", func(RunRequest) string {
+		jar := os.Getenv("JUNIT_CONSOLE_JAR")
+		if jar == "" {
+			jar = "/opt/junit/junit-platform-console-standalone.jar"
+		}
+		return "javac -d .coderipper-classes -cp " + jar + " $(find . -name '*.java') &&\n" +
+			"java -jar " + jar + " execute --disable-banner --class-path .coderipper-classes --scan-class-path --reports-dir=.coderipper-reports\n" +
+			"c=$?; cp .coderipper-reports/TEST-junit-jupiter.xml " + testReportFile + " 2>/dev/null; (exit $c)"
+	}, parseJUnitXML}
+	jest = testFramework{"jest", func(RunRequest) string {
+		return "npx jest --ci --json --outputFile=" + testReportFile
+	}, parseJestJSON}
+	nodeTest = testFramework{"node:test", func(RunRequest) string {
+		return "node --test --test-reporter=spec --test-reporter-destination=stdout --test-reporter=junit --test-reporter-destination=" + testReportFile
+	}, parseJUnitXML}
+)
+
+// detectTestFramework picks the test framework of a submission: pytest, go test and JUnit by
+// language, jest for JavaScript and TypeScript projects that depend on it, and otherwise
+// Node's built-in runner for JavaScript.
+func detectTestFramework(req RunRequest) (testFramework, bool) {
+	switch canonicalLanguage(req.Language) {
+	case "python":
+		return pytest, true
+	case "go":
+		return goTest, true
+	case "java":
+		return junit, true
+	case "javascript", "typescript":
+		var pkg struct {
+			Dependencies    map[string]string `json:"dependencies"`
+			DevDependencies map[string]string `json:"devDependencies"`
+		}
+		json.Unmarshal([]byte(req.Files["package.json"]), &pkg)
+		if pkg.Dependencies["jest"] != "" || pkg.DevDependencies["jest"] != "" {
+			return jest, true
+		}
+		if canonicalLanguage(req.Language) == "javascript" {
+			return nodeTest, true
+		}
+	}
+	return testFramework{}, false
+}
+
+// planTests runs the framework in a single "test" step that prints the report after the
+// test output. The step keeps the framework's exit code, non-zero when a test failed.
+func planTests(req RunRequest, env []string, limit time.Duration) pipelinePlan {
+	fw, _ := detectTestFramework(req)
+	cmd, report := fw.command(req), ""
+	if req.Coverage {
+		tool := coverageTools[canonicalLanguage(req.Language)]
+		cmd = "rm -rf " + coverageDir + " && mkdir -p " + coverageDir + "\n" + tool.test(fw, cmd)
+		report = "\n" + tool.report
+	}
+	script := "rm -f " + testReportFile + "\n" + cmd + "\nc=$?" + report + "\nprintf '\\n" + reportMarker + "\\n'\ncat " + testReportFile + " 2>/dev/null\nexit $c"
+	return pipelinePlan{
+		env: env, deps: req.deps, outputs: req.Outputs, coverage: req.Coverage, total: limit,
+		steps: []planStep{{name: "test", argv: []string{"/bin/sh", "-c", script}, timeout: limit}},
+	}
+}
+
+// testResults splits the report off the output of a test step and parses it. Without a report,
+// e.g. when the tests did not compile, there are no test results.
+func testResults(req RunRequest, step *StepResult) []TestCase {
+	i := strings.LastIndex(step.Stdout, "\n"+reportMarker+"\n")
+	if i < 0 {
+		return nil
+	}
+	report := step.Stdout[i+len(reportMarker)+2:]
+	step.Stdout = step.Stdout[:i]
+	fw, _ := detectTestFramework(req)
+	tests, output, err := fw.parse([]byte(report))
+	if err != nil {
+		return nil
+	}
+	if output != "" {
+		// go test -json has the human-readable output inside the report
+		step.Stdout += output
+	}
+	for i, t := range tests {
+		if strings.HasPrefix(t.Suite, "/") {
+			tests[i].Suite = submissionSuffix(req.Files, t.Suite)
+		}
+	}
+	return tests
+}
+
+// submissionSuffix returns the submission file an absolute path in the workspace refers to, or
+// the path itself.
+func submissionSuffix(files map[string]string, p string) string {
+	for i := 0; i < len(p); i++ {
+		if p[i] != '/' {
+			continue
+		}
+		if _, ok := files[p[i+1:]]; ok {
+			return p[i+1:]
+		}
+	}
+	return p
+}
+
+// parseJUnitXML reads the testcase elements of JUnit XML reports (pytest, the JUnit console
+// launcher and node --test), wherever they are nested.
+func parseJUnitXML(report []byte) ([]TestCase, string, error) {
+	type message struct {
+		Message string `xml:"message,attr"`
+		Text    string `xml:",chardata"`
+	}
+	var tests []TestCase
+	d := xml.NewDecoder(strings.NewReader(string(report)))
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return tests, "", nil
+		}
+		if err != nil {
+			return tests, "", err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "testcase" {
+			continue
+		}
+		var tc struct {
+			Name      string   `xml:"name,attr"`
+			ClassName string   `xml:"classname,attr"`
+			Time      string   `xml:"time,attr"`
+			Failure   *message `xml:"failure"`
+			Error     *message `xml:"error"`
+			Skipped   *message `xml:"skipped"`
+			SystemOut string   `xml:"system-out"`
+		}
+		if err := d.DecodeElement(&tc, &start); err != nil {
+			return tests, "", err
+		}
+		t := TestCase{Name: tc.Name, Suite: tc.ClassName, Status: "passed"}
+		if secs, err := strconv.ParseFloat(tc.Time, 64); err == nil {
+			t.DurationMs = secs * 1000
+		}
+		switch {
+		case tc.Failure != nil:
+			t.Status, t.Message = "failed", failureText(tc.Failure.Message, tc.Failure.Text)
+		case tc.Error != nil:
+			t.Status, t.Message = "failed", failureText(tc.Error.Message, tc.Error.Text)
+		case tc.Skipped != nil:
+			t.Status, t.Message = "skipped", failureText(tc.Skipped.Message, tc.Skipped.Text)
+		}
+		tests = append(tests, t)
+	}
+}
+
+// failureText joins a failure's message attribute and body, which often repeats it.
+func failureText(msg, text string) string {
+	msg, text = strings.TrimSpace(msg), strings.TrimSpace(text)
+	if msg == "" || strings.Contains(text, msg) {
+		return text
+	}
+	if text == "" {
+		return msg
+	}
+	return msg + "\n" + text
+}
+
+// parseGoTestJSON reads the event stream of go test -json. The output events make up the
+// readable test output; a failed test's own output is its message.
+func parseGoTestJSON(report []byte) ([]TestCase, string, error) {
+	var tests []TestCase
+	index := map[string]int{}
+	var output strings.Builder
+	sc := bufio.NewScanner(strings.NewReader(string(report)))
+	sc.Buffer(make([]byte, 64*1024), 4<<20)
+	for sc.Scan() {
+		var ev struct {
+			Action  string
+			Package string
+			Test    string
+			Elapsed float64
+			Output  string
+		}
+		if json.Unmarshal(sc.Bytes(), &ev) != nil {
+			// stderr lines mixed into the stream, e.g. in k8s logs
+			continue
+		}
+		output.WriteString(ev.Output)
+		if ev.Test == "" {
+			continue
+		}
+		key := ev.Package + " " + ev.Test
+		i, ok := index[key]
+		if !ok {
+			i = len(tests)
+			index[key] = i
+			tests = append(tests, TestCase{Name: ev.Test, Suite: ev.Package})
+		}
+		t := &tests[i]
+		switch ev.Action {
+		case "output":
+			if !strings.HasPrefix(ev.Output, "=== ") && !strings.HasPrefix(strings.TrimSpace(ev.Output), "--- ") {
+				t.Message += ev.Output
+			}
+		case "pass", "fail", "skip":
+			t.Status = map[string]string{"pass": "passed", "fail": "failed", "skip": "skipped"}[ev.Action]
+			t.DurationMs = ev.Elapsed * 1000
+			if ev.Action == "pass" {
+				t.Message = ""
+			}
+			t.Message = strings.TrimSpace(t.Message)
+		}
+	}
+	// tests cut off by a timeout or panic never finished
+	for i := range tests {
+		if tests[i].Status == "" {
+			tests[i].Status = "failed"
+		}
+	}
+	return tests, output.String(), sc.Err()
+}
+
+// parseJestJSON reads the report of jest --json.
+func parseJestJSON(report []byte) ([]TestCase, string, error) {
+	var r struct {
+		TestResults []struct {
+			Name             string `json:"name"`
+			AssertionResults []struct {
+				FullName        string   `json:"fullName"`
+				Status          string   `json:"status"`
+				Duration        float64  `json:"duration"`
+				FailureMessages []string `json:"failureMessages"`
+			} `json:"assertionResults"`
+		} `json:"testResults"`
+	}
+	if err := json.Unmarshal(report, &r); err != nil {
+		return nil, "", err
+	}
+	var tests []TestCase
+	for _, file := range r.TestResults {
+		for _, a := range file.AssertionResults {
+			t := TestCase{Name: a.FullName, Suite: file.Name, Status: a.Status, DurationMs: a.Duration, Message: strings.Join(a.FailureMessages, "\n")}
+			if t.Status == "pending" || t.Status == "todo" || t.Status == "disabled" {
+				t.Status = "skipped"
+			}
+			tests = append(tests, t)
+		}
+	}
+	return tests, "", nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseJUnitXML(t *testing.T) {
+	// pytest --junitxml
+	report := `<?xml version="1.0" encoding="utf-8"?><testsuites><testsuite name="pytest" errors="0" failures="1" skipped="1" tests="3" time="0.05">
+<testcase classname="test_calc" name="test_add" time="0.001" />
+<testcase classname="test_calc" name="test_div" time="0.002"><failure message="assert 2 == 3">def test_div():
+&gt;       assert 4 / 2 == 3
+E       assert 2.0 == 3</failure></testcase>
+<testcase classname="test_calc" name="test_later" time="0.000"><skipped type="pytest.skip" message="not yet">test_calc.py:9: not yet</skipped></testcase>
+</testsuite></testsuites>`
+	got, _, err := parseJUnitXML([]byte(report))
+	want := []TestCase{
+		{Name: "test_add", Suite: "test_calc", Status: "passed", DurationMs: 1},
+		{Name: "test_div", Suite: "test_calc", Status: "failed", DurationMs: 2, Message: "assert 2 == 3\ndef test_div():\n>       assert 4 / 2 == 3\nE       assert 2.0 == 3"},
+		{Name: "test_later", Suite: "test_calc", Status: "skipped", Message: "test_calc.py:9: not yet"},
+	}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, %v\nwant %+v", got, err, want)
+	}
+}
+
+func TestParseJestJSON(t *testing.T) {
+	report := `{"numTotalTests":2,"testResults":[{"name":"/tmp/coderipper-1/src/sum.test.js","assertionResults":[
+{"fullName":"sum adds","status":"passed","duration":3,"failureMessages":[]},
+{"fullName":"sum overflows","status":"failed","duration":1,"failureMessages":["Error: expect(received).toBe(expected)"]},
+{"fullName":"sum later","status":"todo","duration":null,"failureMessages":[]}]}]}`
+	step := StepResult{Name: "test", Stdout: "PASS src/sum.test.js\n\n" + reportMarker + "\n" + report}
+	req := RunRequest{Language: "javascript", Files: map[string]string{"package.json": `{"devDependencies":{"jest":"29"}}`, "src/sum.test.js": ""}}
+	got := testResults(req, &step)
+	want := []TestCase{
+		{Name: "sum adds", Suite: "src/sum.test.js", Status: "passed", DurationMs: 3},
+		{Name: "sum overflows", Suite: "src/sum.test.js", Status: "failed", DurationMs: 1, Message: "Error: expect(received).toBe(expected)"},
+		{Name: "sum later", Suite: "src/sum.test.js", Status: "skipped"},
+	}
+	if !reflect.DeepEqual(got, want) || step.Stdout != "PASS src/sum.test.js\n" {
+		t.Fatalf("got %+v, stdout %q", got, step.Stdout)
+	}
+}
+
+func TestNativeGoTest(t *testing.T) {
+	res := executeNative(RunRequest{Language: "go", Mode: modeTest, TimeLimit: 60, Files: map[string]string{
+		"calc.go": "package calc\n\nfunc Add(a, b int) int { return a + b }\n",
+		"calc_test.go": `package calc
+
+import "testing"
+
+func TestAdd(t *testing.T) {
+	if Add(1, 2) != 3 {
+		t.Fatal("wrong sum")
+	}
+}
+
+func TestBroken(t *testing.T) {
+	t.Errorf("Add(2, 2) = %d", Add(2, 2))
+}
+
+func TestLater(t *testing.T) { t.Skip("not yet") }
+`,
+	}}, nil)
+	if res.Success || res.TestSummary == nil || *res.TestSummary != (TestSummary{Total: 3, Passed: 1, Failed: 1, Skipped: 1}) {
+		t.Fatalf("summary: %+v", res)
+	}
+	broken := res.Tests[1]
+	if broken.Name != "TestBroken" || broken.Suite != "submission" || broken.Status != "failed" || !strings.Contains(broken.Message, "Add(2, 2) = 4") {
+		t.Fatalf("failed test: %+v", broken)
+	}
+	if !strings.Contains(res.Stdout, "--- FAIL: TestBroken") || strings.Contains(res.Stdout, reportMarker) {
+		t.Fatalf("stdout should be the readable output: %q", res.Stdout)
+	}
+}
+
+func TestNativeNodeTest(t *testing.T) {
+	res := executeNative(RunRequest{Language: "javascript", Mode: modeTest, TimeLimit: 60, Files: map[string]string{
+		"main.js": "exports.add = (a, b) => a + b\n",
+		"main.test.js": `const test = require('node:test')
+const assert = require('node:assert')
+const { add } = require('./main')
+test('adds', () => assert.strictEqual(add(1, 2), 3))
+test('overflows', () => assert.strictEqual(add(1, 1), 3))
+`,
+	}}, nil)
+	if res.Success || res.TestSummary == nil || res.TestSummary.Passed != 1 || res.TestSummary.Failed != 1 {
+		t.Fatalf("summary: %+v", res)
+	}
+	for _, tc := range res.Tests {
+		if tc.Name == "overflows" && (tc.Status != "failed" || tc.Message == "") {
+			t.Fatalf("failed test: %+v", tc)
+		}
+	}
+}
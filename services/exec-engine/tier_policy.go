@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// tierPolicy holds the scheduling weight and run limits for one user tier.
+type tierPolicy struct {
+	// Weight is the tier's share of workers when runs are queued; a tier with weight 4 is
+	// served four times as often as a tier with weight 1, but never starves it.
+	Weight int `json:"weight"`
+	// MaxConcurrent caps the runs one user may have queued or running. 0 means no limit.
+	MaxConcurrent  int   `json:"maxConcurrent"`
+	MaxTimeLimit   int   `json:"maxTimeLimitSeconds"`
+	MaxMemoryLimit int64 `json:"maxMemoryLimitBytes"`
+	// MaxBenchmarkSeconds caps the time limit times the number of runs of a benchmark.
+	MaxBenchmarkSeconds int `json:"maxBenchmarkSeconds"`
+	// Daily budgets per user, reset at midnight UTC. 0 means no limit.
+	MaxRunsPerDay       int `json:"maxRunsPerDay"`
+	MaxCPUSecondsPerDay int `json:"maxCpuSecondsPerDay"`
+}
+
+const defaultTier = "free"
+
+// defaultTierPolicies apply unless overridden by TIER_POLICIES.
+var defaultTierPolicies = map[string]tierPolicy{
+	"free":     {Weight: 1, MaxConcurrent: 1, MaxTimeLimit: 60, MaxMemoryLimit: 128 * 1024 * 1024, MaxBenchmarkSeconds: 120, MaxRunsPerDay: 200, MaxCPUSecondsPerDay: 600},
+	"pro":      {Weight: 4, MaxConcurrent: 4, MaxTimeLimit: 120, MaxMemoryLimit: 512 * 1024 * 1024, MaxBenchmarkSeconds: 600, MaxRunsPerDay: 5000, MaxCPUSecondsPerDay: 7200},
+	"internal": {Weight: 8, MaxConcurrent: 0, MaxTimeLimit: 300, MaxMemoryLimit: 2048 * 1024 * 1024, MaxBenchmarkSeconds: 3600},
+}
+
+// tierPolicies resolves tiers to policies and tracks per-user concurrency.
+type tierPolicies struct {
+	policies map[string]tierPolicy
+
+	mu     sync.Mutex
+	active map[string]int // runs queued or running per user
+}
+
+// loadTierPolicies starts from the defaults and applies TIER_POLICIES, a JSON object of
+// tier name to policy, e.g. {"pro":{"weight":4,"maxConcurrent":2,"maxTimeLimitSeconds":90,"maxMemoryLimitBytes":268435456}}.
+// Fields left out of an override keep the default for that tier; new tiers without time,
+// memory or benchmark maximums get the free tier's.
+func loadTierPolicies() (*tierPolicies, error) {
+	tp := &tierPolicies{policies: map[string]tierPolicy{}, active: map[string]int{}}
+	for name, p := range defaultTierPolicies {
+		tp.policies[name] = p
+	}
+	if raw := os.Getenv("TIER_POLICIES"); raw != "" {
+		var overrides map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(raw), &overrides); err != nil {
+			return nil, fmt.Errorf("TIER_POLICIES: %w", err)
+		}
+		for name, o := range overrides {
+			p := tp.policies[name]
+			if err := json.Unmarshal(o, &p); err != nil {
+				return nil, fmt.Errorf("TIER_POLICIES %s: %w", name, err)
+			}
+			if p.Weight <= 0 {
+				p.Weight = 1
+			}
+			// a run needs a time and memory cap; new tiers without one get the free tier's
+			if p.MaxTimeLimit <= 0 {
+				p.MaxTimeLimit = defaultTierPolicies[defaultTier].MaxTimeLimit
+			}
+			if p.MaxMemoryLimit <= 0 {
+				p.MaxMemoryLimit = defaultTierPolicies[defaultTier].MaxMemoryLimit
+			}
+			if p.MaxBenchmarkSeconds <= 0 {
+				p.MaxBenchmarkSeconds = defaultTierPolicies[defaultTier].MaxBenchmarkSeconds
+			}
+			tp.policies[name] = p
+		}
+	}
+	return tp, nil
+}
+
+// resolve maps a JWT tier claim to a known tier name; unknown or missing tiers are free.
+func (tp *tierPolicies) resolve(tier string) (string, tierPolicy) {
+	if p, ok := tp.policies[tier]; ok {
+		return tier, p
+	}
+	return defaultTier, tp.policies[defaultTier]
+}
+
+// weights returns the scheduling weight of every tier.
+func (tp *tierPolicies) weights() map[string]int {
+	w := map[string]int{}
+	for name, p := range tp.policies {
+		w[name] = p.Weight
+	}
+	return w
+}
+
+// defaultMemoryLimit is the memory limit of runs that do not ask for one.
+const defaultMemoryLimit = 128 * 1024 * 1024
+
+// applyLimits fills in defaults and clamps the requested limits to the tier maximums.
+func (p tierPolicy) applyLimits(req *RunRequest) {
+	if req.TimeLimit <= 0 {
+		req.TimeLimit = 5
+	}
+	if req.TimeLimit > p.MaxTimeLimit {
+		req.TimeLimit = p.MaxTimeLimit
+	}
+	if req.MemoryLimit <= 0 {
+		req.MemoryLimit = defaultMemoryLimit
+	}
+	if req.MemoryLimit > p.MaxMemoryLimit {
+		req.MemoryLimit = p.MaxMemoryLimit
+	}
+}
+
+// begin registers a run for user and reports false if the tier's concurrency cap is reached.
+// Anonymous runs (empty user) are not tracked. Every successful begin must be paired with end.
+func (tp *tierPolicies) begin(user string, p tierPolicy) bool {
+	if user == "" {
+		return true
+	}
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if p.MaxConcurrent > 0 && tp.active[user] >= p.MaxConcurrent {
+		return false
+	}
+	tp.active[user]++
+	return true
+}
+
+func (tp *tierPolicies) end(user string) {
+	if user == "" {
+		return
+	}
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if tp.active[user] <= 1 {
+		delete(tp.active, user)
+		return
+	}
+	tp.active[user]--
+}
@@ -0,0 +1,69 @@
+package main
+
+import "testing"
+
+func TestTierPolicyLimits(t *testing.T) {
+	t.Setenv("TIER_POLICIES", `{"pro":{"maxTimeLimitSeconds":90},"edu":{"weight":2,"maxConcurrent":2,"maxTimeLimitSeconds":20,"maxMemoryLimitBytes":67108864}}`)
+	tp, err := loadTierPolicies()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name, p := tp.resolve("unknown")
+	if name != "free" {
+		t.Fatalf("unknown tier resolved to %q", name)
+	}
+	req := RunRequest{TimeLimit: 600}
+	p.applyLimits(&req)
+	if req.TimeLimit != 60 || req.MemoryLimit != 128*1024*1024 {
+		t.Fatalf("free limits not applied: %+v", req)
+	}
+
+	_, p = tp.resolve("pro")
+	if p.MaxTimeLimit != 90 || p.Weight != 4 {
+		t.Fatalf("pro override should keep unspecified defaults: %+v", p)
+	}
+	req = RunRequest{}
+	p.applyLimits(&req)
+	if req.MemoryLimit != defaultMemoryLimit {
+		t.Fatalf("pro runs without a memory limit got %d, not the default", req.MemoryLimit)
+	}
+	_, p = tp.resolve("edu")
+	req = RunRequest{MemoryLimit: 1 << 30}
+	p.applyLimits(&req)
+	if req.TimeLimit != 5 || req.MemoryLimit != 64*1024*1024 {
+		t.Fatalf("edu limits not applied: %+v", req)
+	}
+}
+
+func TestTierPolicyConcurrency(t *testing.T) {
+	tp, _ := loadTierPolicies()
+	_, free := tp.resolve("free")
+	if !tp.begin("u1", free) {
+		t.Fatal("first run should be allowed")
+	}
+	if tp.begin("u1", free) {
+		t.Fatal("second concurrent free run should be refused")
+	}
+	if !tp.begin("u2", free) || !tp.begin("", free) {
+		t.Fatal("other users and anonymous runs are not affected")
+	}
+	tp.end("u1")
+	if !tp.begin("u1", free) {
+		t.Fatal("run should be allowed after the first ended")
+	}
+}
+
+func TestTierPolicyNewTierGetsDefaultMaximums(t *testing.T) {
+	t.Setenv("TIER_POLICIES", `{"edu":{"weight":2}}`)
+	tp, err := loadTierPolicies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, p := tp.resolve("edu")
+	req := RunRequest{TimeLimit: 10}
+	p.applyLimits(&req)
+	if req.TimeLimit != 10 || req.MemoryLimit != 128*1024*1024 {
+		t.Fatalf("edu without maximums should use the free tier's: %+v", req)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// errUnsupportedLanguage is returned by planCommands for languages without a toolchain.
+var errUnsupportedLanguage = errors.New("unsupported language")
+
+// languageSpec describes how one language is built and run, and which options a request may set.
+// Commands use paths relative to the workspace so every backend can run them unchanged.
+type languageSpec struct {
+	// build returns the compile command for the main file src and the files it produces;
+	// nil for interpreted languages
+	build func(src string, flags []string) (argv, artifacts []string)
+	// run returns the command that starts the program, before the request's args. Interpreted
+	// languages pass the flags to the interpreter; Java reads the class path from them.
+	run func(src string, flags []string) []string
+	// check returns the command that type-checks or compiles the main file without running
+	// it, for mode "check"; nil when the language has no checker
+	check func(src string, flags []string) []string
+	// standards maps a language standard to the flags that select it; defaultStandard applies
+	// when the request names none
+	standards       map[string][]string
+	defaultStandard string
+	// defaultFlags are used unless a request flag matches optimization
+	defaultFlags []string
+	optimization *regexp.Regexp
+	// flags matches the allowed compileFlags; flagsWithValue take the next token as a
+	// workspace-relative path list matching the pattern
+	flags          *regexp.Regexp
+	flagsWithValue map[string]*regexp.Regexp
+}
+
+var gccFlags = regexp.MustCompile(`^(-O[0-3sg]?|-g[0-3]?|-w|-W[a-z][a-z0-9+-]*|-pedantic(-errors)?|-D[A-Za-z_][A-Za-z0-9_]*(=[A-Za-z0-9_.+-]*)?|-U[A-Za-z_][A-Za-z0-9_]*|-lm|-pthread|-f(no-)?(exceptions|rtti|wrapv|trapv|stack-protector)|-fsanitize=(address|undefined|address,undefined))$`)
+
+// classPath matches a list of relative jar or directory paths, such as "lib/*:classes".
+var classPath = regexp.MustCompile(`^[A-Za-z0-9_.*-]+(/[A-Za-z0-9_.*-]+)*(:[A-Za-z0-9_.*-]+(/[A-Za-z0-9_.*-]+)*)*$`)
+
+var languages = map[string]*languageSpec{
+	"python": {
+		run: interpreter("python"),
+		check: func(src string, _ []string) []string {
+			return []string{"python", "-m", "mypy", "--show-column-numbers", "--no-error-summary", "--no-color-output", src}
+		},
+		flags: regexp.MustCompile(`^(-O|-OO|-B|-u|-W(error|ignore|default)|-X(dev|utf8|importtime))$`),
+	},
+	"javascript": {
+		run:   interpreter("node"),
+		check: func(src string, _ []string) []string { return []string{"node", "--check", src} },
+		flags: regexp.MustCompile(`^(--enable-source-maps|--no-warnings|--trace-uncaught|--stack-size=[0-9]+|--max-old-space-size=[0-9]+)$`),
+	},
+	"typescript": {
+		run: func(src string, _ []string) []string { return []string{"npx", "ts-node", src} },
+		check: func(src string, _ []string) []string {
+			return []string{"npx", "tsc", "--noEmit", "--pretty", "false", src}
+		},
+	},
+	"go": {
+		build: func(src string, flags []string) ([]string, []string) {
+			return append(append([]string{"go", "build"}, flags...), "-o", "main", src), []string{"main"}
+		},
+		run: binary("./main"),
+		check: func(src string, flags []string) []string {
+			// vet type-checks like build; of the build flags only build tags apply
+			argv := []string{"go", "vet"}
+			for _, f := range flags {
+				if strings.HasPrefix(f, "-tags=") {
+					argv = append(argv, f)
+				}
+			}
+			return append(argv, src)
+		},
+		flags: regexp.MustCompile(`^(-race|-trimpath|-tags=[A-Za-z0-9_.,]+|-gcflags=(all=)?-N -l|-ldflags=-s -w)$`),
+	},
+	"java": {
+		build: func(src string, flags []string) ([]string, []string) {
+			// class files are collected after the build, javac writes one per class
+			return append(append([]string{"javac"}, flags...), src), nil
+		},
+		run: func(src string, flags []string) []string {
+			cp := "."
+			for i, f := range flags {
+				if (f == "-cp" || f == "-classpath" || f == "--class-path") && i+1 < len(flags) {
+					cp += ":" + flags[i+1]
+				}
+			}
+			return []string{"java", "-cp", cp, strings.TrimSuffix(path.Base(src), path.Ext(src))}
+		},
+		check: func(src string, flags []string) []string {
+			return append(append([]string{"javac"}, flags...), src)
+		},
+		standards: map[string][]string{"8": {"--release", "8"}, "11": {"--release", "11"}, "17": {"--release", "17"}, "21": {"--release", "21"}},
+		flags:     regexp.MustCompile(`^(-g|-g:none|-nowarn|-Werror|-deprecation|-parameters|-Xlint(:[a-z,-]+)?)$`),
+		flagsWithValue: map[string]*regexp.Regexp{
+			"-cp": classPath, "-classpath": classPath, "--class-path": classPath,
+		},
+	},
+	"c": {
+		build: func(src string, flags []string) ([]string, []string) {
+			return append(append([]string{"gcc"}, flags...), src, "-o", "a.out", "-lm"), []string{"a.out"}
+		},
+		run: binary("./a.out"),
+		check: func(src string, flags []string) []string {
+			return append(append([]string{"gcc"}, flags...), "-fsyntax-only", src)
+		},
+		standards:       map[string][]string{"c99": {"-std=c99"}, "c11": {"-std=c11"}, "c17": {"-std=c17"}, "c23": {"-std=c2x"}},
+		defaultStandard: "c17",
+		defaultFlags:    []string{"-O2", "-Wall"},
+		optimization:    regexp.MustCompile(`^-O`),
+		flags:           gccFlags,
+	},
+	"cpp": {
+		build: func(src string, flags []string) ([]string, []string) {
+			return append(append([]string{"g++"}, flags...), src, "-o", "a.out"), []string{"a.out"}
+		},
+		run: binary("./a.out"),
+		check: func(src string, flags []string) []string {
+			return append(append([]string{"g++"}, flags...), "-fsyntax-only", src)
+		},
+		standards:       map[string][]string{"c++11": {"-std=c++11"}, "c++14": {"-std=c++14"}, "c++17": {"-std=c++17"}, "c++20": {"-std=c++20"}, "c++23": {"-std=c++2b"}},
+		defaultStandard: "c++17",
+		defaultFlags:    []string{"-O2", "-Wall"},
+		optimization:    regexp.MustCompile(`^-O`),
+		flags:           gccFlags,
+	},
+	"rust": {
+		build: func(src string, flags []string) ([]string, []string) {
+			return append(append([]string{"rustc"}, flags...), src, "-o", "main"), []string{"main"}
+		},
+		run: binary("./main"),
+		check: func(src string, flags []string) []string {
+			// metadata needs type and borrow checking but no code generation
+			return append(append([]string{"rustc"}, flags...), "--emit=metadata", src, "-o", "main.rmeta")
+		},
+		standards:       map[string][]string{"2015": {"--edition", "2015"}, "2018": {"--edition", "2018"}, "2021": {"--edition", "2021"}},
+		defaultStandard: "2021",
+		defaultFlags:    []string{"-O"},
+		optimization:    regexp.MustCompile(`^(-O|-Copt-level=.*)$`),
+		flags:           regexp.MustCompile(`^(-O|-g|-Copt-level=[0-3sz]|-Cdebuginfo=[0-2]|-C(overflow-checks|debug-assertions)=(on|off)|-[AWD][a-z_]+|--cfg=[a-z_][a-z0-9_]*)$`),
+	},
+	"ruby": {
+		run:   interpreter("ruby"),
+		check: func(src string, _ []string) []string { return []string{"ruby", "-wc", src} },
+		flags: regexp.MustCompile(`^(-w|-W[0-2]|--disable-gems|--yjit)$`),
+	},
+	"php": {
+		run:   interpreter("php"),
+		check: func(src string, _ []string) []string { return []string{"php", "-l", src} },
+	},
+	"bash": {
+		run:   interpreter("bash"),
+		check: func(src string, _ []string) []string { return []string{"bash", "-n", src} },
+		flags: regexp.MustCompile(`^-[eux]$`),
+	},
+	"powershell": {
+		run: func(src string, _ []string) []string {
+			return []string{"powershell", "-ExecutionPolicy", "Bypass", "-File", src}
+		},
+	},
+}
+
+// languageAliases maps the names clients send to the keys of languages.
+var languageAliases = map[string]string{
+	"python3": "python", "js": "javascript", "node": "javascript", "ts": "typescript",
+	"golang": "go", "c++": "cpp", "sh": "bash", "shell": "bash", "ps1": "powershell",
+}
+
+func canonicalLanguage(lang string) string {
+	if l, ok := languageAliases[lang]; ok {
+		return l
+	}
+	return lang
+}
+
+func interpreter(name string) func(string, []string) []string {
+	return func(src string, flags []string) []string {
+		return append(append([]string{name}, flags...), src)
+	}
+}
+
+func binary(name string) func(string, []string) []string {
+	return func(string, []string) []string { return []string{name} }
+}
+
+// options returns the compiler (or interpreter) flags for a request: the defaults, the
+// selected standard and the request's own flags, in that order.
+func (s *languageSpec) options(req RunRequest) ([]string, error) {
+	var out []string
+	std := req.Standard
+	if std == "" {
+		std = s.defaultStandard
+	}
+	if std != "" {
+		f, ok := s.standards[std]
+		if !ok {
+			if len(s.standards) == 0 {
+				return nil, invalid("%s does not support selecting a standard", req.Language)
+			}
+			return nil, invalid("%s has no standard %q (supported: %s)", req.Language, std, strings.Join(sortedKeys(s.standards), ", "))
+		}
+		out = append(out, f...)
+	}
+	optimized := false
+	for i := 0; i < len(req.CompileFlags); i++ {
+		f := req.CompileFlags[i]
+		if pattern, ok := s.flagsWithValue[f]; ok {
+			if i+1 == len(req.CompileFlags) {
+				return nil, invalid("compile flag %q needs a value", f)
+			}
+			v := req.CompileFlags[i+1]
+			if !pattern.MatchString(v) || escapesWorkspace(v) {
+				return nil, invalid("compile flag %q: value %q must be relative paths inside the submission", f, v)
+			}
+			out = append(out, f, v)
+			i++
+			continue
+		}
+		if s.flags == nil || !s.flags.MatchString(f) {
+			return nil, invalid("compile flag %q is not allowed for %s", f, req.Language)
+		}
+		if s.optimization != nil && s.optimization.MatchString(f) {
+			optimized = true
+		}
+		out = append(out, f)
+	}
+	if !optimized {
+		out = append(append([]string{}, s.defaultFlags...), out...)
+	}
+	return out, nil
+}
+
+// escapesWorkspace reports whether a ":"-separated list of relative paths leaves the workspace.
+func escapesWorkspace(list string) bool {
+	for _, p := range strings.Split(list, ":") {
+		for _, seg := range strings.Split(p, "/") {
+			if seg == ".." {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// commandPlan is how a submission is built and run, with paths relative to the workspace.
+type commandPlan struct {
+	build     []string // nil for interpreted languages
+	artifacts []string // files the build produces, for the build cache
+	run       []string
+	check     []string // nil when the language has no checker
+	env       []string // KEY=VALUE pairs from the request, sorted
+}
+
+// planCommands turns a request into the commands that build and run it. mainFile is the
+// slash-separated path of the entry point inside the workspace.
+func planCommands(req RunRequest, mainFile string) (commandPlan, error) {
+	spec, ok := languages[canonicalLanguage(req.Language)]
+	if !ok {
+		return commandPlan{}, errUnsupportedLanguage
+	}
+	flags, err := spec.options(req)
+	if err != nil {
+		return commandPlan{}, err
+	}
+	var p commandPlan
+	if spec.build != nil {
+		p.build, p.artifacts = spec.build(mainFile, flags)
+	}
+	p.run = append(spec.run(mainFile, flags), req.Args...)
+	if spec.check != nil {
+		p.check = spec.check(mainFile, flags)
+	}
+	p.env = requestEnv(req)
+	return p, nil
+}
+
+// requestEnv returns the request's environment as sorted KEY=VALUE pairs.
+func requestEnv(req RunRequest) []string {
+	var env []string
+	for _, k := range sortedKeys(req.Env) {
+		env = append(env, k+"="+req.Env[k])
+	}
+	return env
+}
+
+// supportedLanguages lists the languages planCommands knows, for error messages.
+func supportedLanguages() string {
+	return strings.Join(sortedKeys(languages), ", ")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
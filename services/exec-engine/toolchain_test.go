@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestPlanCommands(t *testing.T) {
+	cases := []struct {
+		name       string
+		req        RunRequest
+		build, run string
+	}{
+		{"c defaults", RunRequest{Language: "c"}, "gcc -O2 -Wall -std=c17 main.c -o a.out -lm", "./a.out"},
+		{"cpp standard and flags", RunRequest{Language: "c++", Standard: "c++20", CompileFlags: []string{"-O0", "-g", "-DDEBUG=1"}, Args: []string{"a b"}}, "g++ -std=c++20 -O0 -g -DDEBUG=1 main.c -o a.out", "./a.out a b"},
+		{"rust own optimization", RunRequest{Language: "rust", CompileFlags: []string{"-Copt-level=1"}}, "rustc --edition 2021 -Copt-level=1 main.c -o main", "./main"},
+		{"java release and classpath", RunRequest{Language: "java", Standard: "17", CompileFlags: []string{"-cp", "lib/*"}}, "javac --release 17 -cp lib/* main.c", "java -cp .:lib/* main"},
+		{"python flags", RunRequest{Language: "python3", CompileFlags: []string{"-OO"}, Args: []string{"x"}}, "", "python -OO main.c x"},
+	}
+	for _, c := range cases {
+		p, err := planCommands(c.req, "main.c")
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if got := strings.Join(p.build, " "); got != c.build {
+			t.Errorf("%s: build %q, want %q", c.name, got, c.build)
+		}
+		if got := strings.Join(p.run, " "); got != c.run {
+			t.Errorf("%s: run %q, want %q", c.name, got, c.run)
+		}
+	}
+}
+
+func TestPlanCommandsRejectsOptions(t *testing.T) {
+	for _, req := range []RunRequest{
+		{Language: "c", CompileFlags: []string{"-o", "/etc/passwd"}},
+		{Language: "c", CompileFlags: []string{"-Wl,-rpath,/tmp"}},
+		{Language: "cpp", Standard: "c++98"},
+		{Language: "python", Standard: "3.12"},
+		{Language: "java", CompileFlags: []string{"-cp", "../secrets"}},
+		{Language: "java", CompileFlags: []string{"-cp", "lib:.."}},
+		{Language: "java", CompileFlags: []string{"-cp", "/usr/share/java"}},
+		{Language: "php", CompileFlags: []string{"-d", "disable_functions="}},
+	} {
+		if _, err := planCommands(req, "main"); err == nil {
+			t.Errorf("%+v: accepted", req)
+		}
+	}
+}
+
+func TestValidateRunOptions(t *testing.T) {
+	limits := loadRequestLimits()
+	ok := RunRequest{Language: "python", Files: map[string]string{"main.py": ""}, Env: map[string]string{"APP_MODE": "x", "TZ": "UTC"}, Args: []string{"--flag"}}
+	if err := limits.validate(ok); err != nil {
+		t.Fatal(err)
+	}
+	for _, env := range []map[string]string{{"LD_PRELOAD": "/tmp/x.so"}, {"PATH": "/tmp"}, {"APP-X": "y"}, {"APP_X": "a\x00b"}} {
+		req := ok
+		req.Env = env
+		if err := limits.validate(req); err == nil {
+			t.Errorf("env %v accepted", env)
+		}
+	}
+	req := ok
+	req.Args = make([]string, maxArgs+1)
+	if err := limits.validate(req); err == nil {
+		t.Error("too many args accepted")
+	}
+}
+
+func TestNativeAppliesRunOptions(t *testing.T) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not installed")
+	}
+	src := "#include <stdio.h>\n#include <stdlib.h>\nint main(int argc, char **argv) { printf(\"%s %s %ld\\n\", argv[1], getenv(\"APP_NAME\"), __STDC_VERSION__); return 0; }\n"
+	res := executeNative(RunRequest{
+		Language: "c", Files: map[string]string{"main.c": src}, TimeLimit: 20,
+		Args: []string{"hello world"}, Env: map[string]string{"APP_NAME": "demo"}, Standard: "c11",
+	}, nil)
+	if !res.Success || res.Stdout != "hello world demo 201112\n" {
+		t.Fatalf("got %+v", res)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// requestLimits bound what a single run request may contain.
+type requestLimits struct {
+	maxFiles      int
+	maxFileBytes  int64
+	maxTotalBytes int64
+	maxBodyBytes  int64
+	envAllow      []string // environment variable names runs may set; "X_*" allows a prefix
+}
+
+// defaultEnvAllowlist keeps runs away from variables that change how the host loads or finds
+// programs (PATH, LD_*, JAVA_TOOL_OPTIONS, NODE_OPTIONS...).
+const defaultEnvAllowlist = "APP_*,DEBUG,LOG_LEVEL,TZ,LANG,LC_ALL,NODE_ENV,PYTHONHASHSEED,PYTHONUNBUFFERED,RUST_BACKTRACE,GOMAXPROCS"
+
+// loadRequestLimits reads MAX_FILES (50), MAX_FILE_BYTES (1 MiB), MAX_TOTAL_BYTES (5 MiB),
+// MAX_BODY_BYTES (8 MiB) and RUN_ENV_ALLOWLIST from the environment.
+func loadRequestLimits() requestLimits {
+	allow := os.Getenv("RUN_ENV_ALLOWLIST")
+	if allow == "" {
+		allow = defaultEnvAllowlist
+	}
+	l := requestLimits{
+		maxFiles:      envInt("MAX_FILES", 50),
+		maxFileBytes:  int64(envInt("MAX_FILE_BYTES", 1<<20)),
+		maxTotalBytes: int64(envInt("MAX_TOTAL_BYTES", 5<<20)),
+		maxBodyBytes:  int64(envInt("MAX_BODY_BYTES", 8<<20)),
+	}
+	for _, name := range strings.Split(allow, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			l.envAllow = append(l.envAllow, name)
+		}
+	}
+	return l
+}
+
+// validationError is a request problem reported to the client with its own status code.
+type validationError struct {
+	status int
+	msg    string
+}
+
+func (e *validationError) Error() string { return e.msg }
+
+func invalid(format string, args ...any) error {
+	return &validationError{status: http.StatusBadRequest, msg: fmt.Sprintf(format, args...)}
+}
+
+func tooLarge(format string, args ...any) error {
+	return &validationError{status: http.StatusRequestEntityTooLarge, msg: fmt.Sprintf(format, args...)}
+}
+
+// writeRequestError answers with the status of a validationError, 413 for bodies cut off by
+// http.MaxBytesReader and 400 otherwise.
+func writeRequestError(w http.ResponseWriter, err error) {
+	var ve *validationError
+	var mbe *http.MaxBytesError
+	switch {
+	case errors.As(err, &ve):
+		http.Error(w, ve.msg, ve.status)
+	case errors.As(err, &mbe):
+		http.Error(w, fmt.Sprintf("request body larger than %d bytes", mbe.Limit), http.StatusRequestEntityTooLarge)
+	default:
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}
+}
+
+// bodyLimitMiddleware caps request bodies at max bytes before anything reads them.
+func bodyLimitMiddleware(max int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, max)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validate checks a decoded run request before any backend sees it.
+func (l requestLimits) validate(req RunRequest) error {
+	if req.Language == "" {
+		return invalid("language is required")
+	}
+	if len(req.Files) == 0 {
+		return invalid("at least one file is required")
+	}
+	if len(req.Files) > l.maxFiles {
+		return tooLarge("too many files: %d (max %d)", len(req.Files), l.maxFiles)
+	}
+	var total int64
+	seen := map[string]string{}
+	for name, content := range req.Files {
+		if err := validateFileName(name); err != nil {
+			return err
+		}
+		if int64(len(content)) > l.maxFileBytes {
+			return tooLarge("file %q is larger than %d bytes", name, l.maxFileBytes)
+		}
+		total += int64(len(content))
+		// names that only differ in case collide on case-insensitive filesystems
+		if other, ok := seen[strings.ToLower(name)]; ok {
+			return invalid("file names %q and %q collide", name, other)
+		}
+		seen[strings.ToLower(name)] = name
+	}
+	if total > l.maxTotalBytes {
+		return tooLarge("files total %d bytes (max %d)", total, l.maxTotalBytes)
+	}
+	// a file cannot also be a directory of another file
+	for name := range req.Files {
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if _, ok := seen[strings.ToLower(dir)]; ok {
+				return invalid("file %q is inside file %q", name, dir)
+			}
+		}
+	}
+	return l.validateRunOptions(req)
+}
+
+const (
+	maxArgs       = 256
+	maxEnvVars    = 64
+	maxFlags      = 64
+	maxOptionSize = 4096
+)
+
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validateRunOptions checks args, env, compileFlags, standard, mode, steps and outputs. Flags and standards are
+// checked against the language's allowlist so every backend can apply them unchanged.
+func (l requestLimits) validateRunOptions(req RunRequest) error {
+	if len(req.Args) > maxArgs || len(req.Env) > maxEnvVars || len(req.CompileFlags) > maxFlags {
+		return tooLarge("at most %d args, %d env vars and %d compile flags", maxArgs, maxEnvVars, maxFlags)
+	}
+	for _, list := range [][]string{req.Args, req.CompileFlags} {
+		for _, s := range list {
+			if len(s) > maxOptionSize || strings.ContainsRune(s, 0) {
+				return invalid("args and compile flags must be under %d bytes without NUL", maxOptionSize)
+			}
+		}
+	}
+	for name, v := range req.Env {
+		if !envName.MatchString(name) {
+			return invalid("invalid environment variable name %q", name)
+		}
+		if !l.envAllowed(name) {
+			return invalid("environment variable %q is not allowed", name)
+		}
+		if len(v) > maxOptionSize || strings.ContainsRune(v, 0) {
+			return invalid("environment variable %q must be under %d bytes without NUL", name, maxOptionSize)
+		}
+	}
+	if err := validateMode(req); err != nil {
+		return err
+	}
+	if err := validateSteps(req.Steps); err != nil {
+		return err
+	}
+	if err := validateOutputs(req.Outputs); err != nil {
+		return err
+	}
+	if err := validateCoverage(req); err != nil {
+		return err
+	}
+	if err := validateBenchmark(req); err != nil {
+		return err
+	}
+	if spec, ok := languages[canonicalLanguage(req.Language)]; ok {
+		_, err := spec.options(req)
+		return err
+	}
+	if len(req.CompileFlags) > 0 || req.Standard != "" {
+		return invalid("compile flags and standards are not supported for %s", req.Language)
+	}
+	return nil
+}
+
+func (l requestLimits) envAllowed(name string) bool {
+	for _, a := range l.envAllow {
+		if a == name || (strings.HasSuffix(a, "*") && strings.HasPrefix(name, strings.TrimSuffix(a, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// reservedNames cannot be used as a path segment: Windows device names (with any extension),
+// which break Windows hosts and tooling.
+var reservedNames = map[string]bool{"con": true, "prn": true, "aux": true, "nul": true}
+
+func init() {
+	for i := 1; i <= 9; i++ {
+		reservedNames[fmt.Sprintf("com%d", i)] = true
+		reservedNames[fmt.Sprintf("lpt%d", i)] = true
+	}
+}
+
+// validateFileName accepts relative slash-separated paths that stay inside the submission
+// directory. Segments may not be empty, ".", "..", reserved names, or start with "-" (file
+// names are passed to compilers and interpreters as arguments).
+func validateFileName(name string) error {
+	if name == "" {
+		return invalid("empty file name")
+	}
+	if len(name) > 255 {
+		return invalid("file name %q is too long", name[:32]+"...")
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return invalid("file name %q contains control characters", name)
+		}
+	}
+	if strings.ContainsAny(name, `\:`) {
+		return invalid("file name %q: use / as the path separator and no drive letters", name)
+	}
+	if strings.HasPrefix(name, "/") {
+		return invalid("file name %q must be relative", name)
+	}
+	for _, seg := range strings.Split(name, "/") {
+		switch {
+		case seg == "" || seg == ".":
+			return invalid("file name %q has an empty path segment", name)
+		case seg == "..":
+			return invalid("file name %q escapes the submission directory", name)
+		case strings.HasPrefix(seg, "-"):
+			return invalid("file name %q: segments may not start with -", name)
+		}
+		base, _, _ := strings.Cut(strings.ToLower(seg), ".")
+		if reservedNames[base] {
+			return invalid("file name %q uses a reserved name", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateRequest(t *testing.T) {
+	limits := requestLimits{maxFiles: 3, maxFileBytes: 10, maxTotalBytes: 15, maxBodyBytes: 100}
+	cases := []struct {
+		name   string
+		files  map[string]string
+		status int // 0 = valid
+	}{
+		{"simple", map[string]string{"main.py": "x"}, 0},
+		{"nested", map[string]string{"main.py": "x", "pkg/util.py": "y"}, 0},
+		{"dotfile", map[string]string{"main.py": "x", ".env": "y"}, 0},
+		{"no files", map[string]string{}, 400},
+		{"parent dir", map[string]string{"../../etc/cron.d/x": "x"}, 400},
+		{"parent dir inside", map[string]string{"a/../../x": "x"}, 400},
+		{"absolute", map[string]string{"/etc/passwd": "x"}, 400},
+		{"backslash", map[string]string{`..\x`: "x"}, 400},
+		{"drive letter", map[string]string{"C:x": "x"}, 400},
+		{"empty segment", map[string]string{"a//b": "x"}, 400},
+		{"dot segment", map[string]string{"./a": "x"}, 400},
+		{"empty name", map[string]string{"": "x"}, 400},
+		{"control char", map[string]string{"a\nb": "x"}, 400},
+		{"option-like", map[string]string{"-o": "x"}, 400},
+		{"reserved", map[string]string{"CON": "x"}, 400},
+		{"reserved with extension", map[string]string{"dir/nul.txt": "x"}, 400},
+		{"case collision", map[string]string{"Main.py": "x", "main.py": "y"}, 400},
+		{"file inside file", map[string]string{"a": "x", "a/b": "y"}, 400},
+		{"too many files", map[string]string{"a": "", "b": "", "c": "", "d": ""}, 413},
+		{"file too large", map[string]string{"a": strings.Repeat("x", 11)}, 413},
+		{"total too large", map[string]string{"a": strings.Repeat("x", 8), "b": strings.Repeat("x", 8)}, 413},
+	}
+	for _, c := range cases {
+		err := limits.validate(RunRequest{Language: "python", Files: c.files})
+		rec := httptest.NewRecorder()
+		if err != nil {
+			writeRequestError(rec, err)
+		}
+		switch {
+		case c.status == 0 && err != nil:
+			t.Errorf("%s: unexpected error %v", c.name, err)
+		case c.status != 0 && rec.Code != c.status:
+			t.Errorf("%s: got %d (%v), want %d", c.name, rec.Code, err, c.status)
+		}
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	limits := requestLimits{maxFiles: 10, maxFileBytes: 1 << 20, maxTotalBytes: 1 << 20, maxBodyBytes: 64}
+	h := bodyLimitMiddleware(limits.maxBodyBytes, runHandler(&runners{mode: "native"}, mustTierPolicies(t), nil, nil, limits))
+	body := `{"language":"python","files":{"main.py":"` + strings.Repeat("x", 100) + `"}}`
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/run", strings.NewReader(body)))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got %d, want 413", rec.Code)
+	}
+}
+
+func mustTierPolicies(t *testing.T) *tierPolicies {
+	tp, err := loadTierPolicies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tp
+}
+
+func TestWriteSubmissionFiles(t *testing.T) {
+	dir := t.TempDir()
+	main, err := writeSubmissionFiles(dir, map[string]string{"util.py": "u", "pkg/main.py": "m", "main.py": "print(1)"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if main != filepath.Join(dir, "main.py") {
+		t.Fatalf("main file = %s", main)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "pkg", "main.py")); string(b) != "m" {
+		t.Fatal("nested file not written")
+	}
+
+	// names are checked even without validate
+	if _, err := writeSubmissionFiles(t.TempDir(), map[string]string{"../escape": "x"}); err == nil {
+		t.Fatal("expected traversal to be refused")
+	}
+
+	// an existing symlink is never written through
+	outside := t.TempDir()
+	dir = t.TempDir()
+	os.Symlink(outside, filepath.Join(dir, "link"))
+	os.Symlink(filepath.Join(outside, "target"), filepath.Join(dir, "file"))
+	for _, name := range []string{"link/x", "file"} {
+		if _, err := writeSubmissionFiles(dir, map[string]string{name: "x"}); err == nil {
+			t.Errorf("%s: expected write through symlink to be refused", name)
+		}
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Fatal("a file was written outside the submission directory")
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// wasmPageSize is the size of one WebAssembly memory page.
+const wasmPageSize = 64 * 1024
+
+// wasmRunner executes WASI modules in-process with wazero. Compiled interpreter modules are
+// shared across runs through a compilation cache; user modules are compiled per run and freed
+// afterwards. Every run gets its own runtime so that the memory limit and the deadline apply
+// to that run only.
+type wasmRunner struct {
+	cache wazero.CompilationCache
+
+	wasiSDK    string            // WASI_SDK_PATH: clang toolchain with a wasi sysroot for C/C++
+	rustTarget string            // WASM_RUST_TARGET: rustc target triple
+	modules    map[string]string // interpreter modules by language (python, javascript)
+	mounts     map[string]string // extra read-only mounts, guest path -> host path
+}
+
+// newWasmRunner reads the wasm configuration from the environment.
+func newWasmRunner() *wasmRunner {
+	wr := &wasmRunner{
+		wasiSDK:    os.Getenv("WASI_SDK_PATH"),
+		rustTarget: os.Getenv("WASM_RUST_TARGET"),
+		modules:    map[string]string{},
+		mounts:     parseKeyValueList(os.Getenv("WASM_MOUNTS")),
+	}
+	if wr.rustTarget == "" {
+		wr.rustTarget = "wasm32-wasip1"
+	}
+	if p := os.Getenv("WASM_PYTHON_MODULE"); p != "" {
+		wr.modules["python"] = p
+	}
+	if p := os.Getenv("WASM_JS_MODULE"); p != "" {
+		wr.modules["javascript"] = p
+	}
+	if dir := os.Getenv("WASM_CACHE_DIR"); dir != "" {
+		cache, err := wazero.NewCompilationCacheWithDir(dir)
+		if err != nil {
+			log.Println("Warning: wasm compilation cache dir:", err)
+		} else {
+			wr.cache = cache
+		}
+	}
+	if wr.cache == nil {
+		wr.cache = wazero.NewCompilationCache()
+	}
+	return wr
+}
+
+// languages lists the languages this runner can execute with the current configuration.
+func (wr *wasmRunner) languages() []string {
+	langs := []string{"wasm"}
+	if wr.wasiSDK != "" {
+		langs = append(langs, "c", "cpp")
+	}
+	if _, err := exec.LookPath("rustc"); err == nil {
+		langs = append(langs, "rust")
+	}
+	for lang := range wr.modules {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// wasmLanguage normalizes language aliases to the names used by the wasm runner.
+func wasmLanguage(lang string) string {
+	switch lang {
+	case "python", "python3":
+		return "python"
+	case "javascript", "js", "node":
+		return "javascript"
+	case "cpp", "c++":
+		return "cpp"
+	case "wasm", "wasi":
+		return "wasm"
+	}
+	return lang
+}
+
+// executeWasm builds the submission to a WASI module if needed and runs it in-process.
+func executeWasm(req RunRequest, wr *wasmRunner) NativeResult {
+	if len(req.Steps) > 0 {
+		// there is no shell in the guest to run step commands with
+		return NativeResult{Stderr: "Custom steps are not supported in wasm mode", ExitCode: 1, Success: false, Language: req.Language}
+	}
+	if req.Mode == modeCheck || req.Mode == modeTest || req.Mode == modeProfile || req.Mode == modeBenchmark {
+		// the checkers, test frameworks and profilers are host toolchains, not WASI modules;
+		// benchmarks would measure the interpreter's compilation cache
+		return NativeResult{Stderr: fmt.Sprintf("Mode %s is not supported in wasm mode", req.Mode), ExitCode: 1, Success: false, Language: req.Language}
+	}
+	if req.Coverage {
+		return NativeResult{Stderr: "Coverage is not supported in wasm mode", ExitCode: 1, Success: false, Language: req.Language}
+	}
+	tmpDir, err := os.MkdirTemp("", "coderipper-wasm-*")
+	if err != nil {
+		return NativeResult{Stderr: "Failed to create temp directory: " + err.Error(), ExitCode: 1, Success: false, InfraError: true}
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if _, err := writeSubmissionFiles(tmpDir, req.Files); err != nil {
+		return NativeResult{Stderr: "Failed to write files: " + err.Error(), ExitCode: 1, Success: false, InfraError: true, Language: req.Language}
+	}
+	mainFile := mainFileName(req.Files)
+	if len(req.Outputs) > 0 {
+		os.Mkdir(filepath.Join(tmpDir, outputDir), 0755)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(req.TimeLimit)*time.Second)
+	defer cancel()
+
+	// module is the WASI binary to run; args[0] is the program name seen by the guest
+	var module []byte
+	var args []string
+	lang := wasmLanguage(req.Language)
+	switch lang {
+	case "wasm":
+		for name := range req.Files {
+			if strings.HasSuffix(name, ".wasm") {
+				mainFile = name
+			}
+		}
+		module, err = decodeWasm(req.Files[mainFile])
+		args = []string{mainFile}
+	case "c", "cpp":
+		if wr.wasiSDK == "" {
+			return NativeResult{Stderr: "C/C++ in wasm mode requires WASI_SDK_PATH", ExitCode: 1, Success: false, Language: req.Language, InfraError: true}
+		}
+		compiler := "clang"
+		if lang == "cpp" {
+			compiler = "clang++"
+		}
+		flags, ferr := languages[lang].options(req)
+		if ferr != nil {
+			return NativeResult{Stderr: ferr.Error(), ExitCode: 1, Success: false, Language: req.Language}
+		}
+		cmd := append([]string{"--target=wasm32-wasi", "--sysroot=" + filepath.Join(wr.wasiSDK, "share", "wasi-sysroot")}, flags...)
+		module, err = wr.compile(ctx, tmpDir, filepath.Join(wr.wasiSDK, "bin", compiler), append(cmd, mainFile, "-o", "main.wasm")...)
+		args = []string{"main"}
+	case "rust":
+		flags, ferr := languages[lang].options(req)
+		if ferr != nil {
+			return NativeResult{Stderr: ferr.Error(), ExitCode: 1, Success: false, Language: req.Language}
+		}
+		module, err = wr.compile(ctx, tmpDir, "rustc", append(append([]string{"--target", wr.rustTarget}, flags...), mainFile, "-o", "main.wasm")...)
+		args = []string{"main"}
+	case "python", "javascript":
+		path, ok := wr.modules[lang]
+		if !ok {
+			return NativeResult{Stderr: fmt.Sprintf("No %s interpreter module configured for wasm mode", lang), ExitCode: 1, Success: false, Language: req.Language, InfraError: true}
+		}
+		module, err = os.ReadFile(path)
+		args = []string{lang, "/" + filepath.ToSlash(mainFile)}
+	default:
+		return NativeResult{
+			Stderr:   fmt.Sprintf("Language '%s' is not supported for wasm execution. Supported: %s", req.Language, strings.Join(wr.languages(), ", ")),
+			ExitCode: 1,
+			Success:  false,
+			Language: req.Language,
+		}
+	}
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			// the time limit covers the build too
+			return NativeResult{Stderr: fmt.Sprintf("Execution timed out after %d seconds", req.TimeLimit), ExitCode: 124, Success: false, Language: req.Language}
+		}
+		var ce *compileError
+		if errors.As(err, &ce) {
+			return NativeResult{Stderr: "Compilation failed:\n" + ce.output, ExitCode: 1, Success: false, Language: req.Language,
+				Diagnostics: stepDiagnostics(req, []StepResult{{Name: "build", Stderr: ce.output}}, tmpDir)}
+		}
+		return NativeResult{Stderr: "Failed to load module: " + err.Error(), ExitCode: 1, Success: false, InfraError: true, Language: req.Language}
+	}
+
+	_, interpreter := wr.modules[lang]
+	res := wr.run(ctx, module, append(args, req.Args...), tmpDir, req, interpreter)
+	res.Language = req.Language
+	if ctx.Err() == context.DeadlineExceeded {
+		res.Stderr = fmt.Sprintf("Execution timed out after %d seconds", req.TimeLimit)
+		res.ExitCode = 124
+		res.Success = false
+	}
+	// the submission is mounted at "/"
+	res.Diagnostics = stepDiagnostics(req, []StepResult{{Name: "run", Stderr: res.Stderr}}, "/")
+	if len(req.Outputs) > 0 {
+		c := newArtifactCollector(req.Outputs)
+		c.collectDir(tmpDir)
+		res.Artifacts = c.out
+	}
+	return res
+}
+
+// compileError carries the output of a failed toolchain invocation.
+type compileError struct{ output string }
+
+func (e *compileError) Error() string { return "compilation failed" }
+
+// compile runs a host toolchain that emits main.wasm in dir and returns the module bytes.
+func (wr *wasmRunner) compile(ctx context.Context, dir, compiler string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, compiler, args...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if ctx.Err() != nil {
+			// killed by the deadline, not a compilation error
+			return nil, fmt.Errorf("run %s: %w", compiler, ctx.Err())
+		}
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("run %s: %w", compiler, err)
+		}
+		return nil, &compileError{output: string(out)}
+	}
+	return os.ReadFile(filepath.Join(dir, "main.wasm"))
+}
+
+// run instantiates a WASI module with the submission directory mounted at "/".
+// Memory is capped via the page limit and execution is interrupted when ctx expires.
+func (wr *wasmRunner) run(ctx context.Context, module []byte, args []string, dir string, req RunRequest, shared bool) NativeResult {
+	pages := uint32(65536)
+	if p := req.MemoryLimit / wasmPageSize; p > 0 && p < int64(pages) {
+		pages = uint32(p)
+	}
+	cfg := wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(pages).
+		WithCloseOnContextDone(true)
+	if shared {
+		// configured interpreter modules are compiled once and kept for the life of the process;
+		// user modules are unique, so they get a throwaway engine that is freed with the runtime
+		cfg = cfg.WithCompilationCache(wr.cache)
+	}
+	rt := wazero.NewRuntimeWithConfig(ctx, cfg)
+	defer rt.Close(context.Background())
+	wasi_snapshot_preview1.MustInstantiate(ctx, rt)
+
+	compiled, err := rt.CompileModule(ctx, module)
+	if err != nil {
+		return NativeResult{Stderr: "Invalid wasm module: " + err.Error(), ExitCode: 1, Success: false}
+	}
+	if !shared {
+		defer compiled.Close(context.Background())
+	}
+
+	fs := wazero.NewFSConfig().WithDirMount(dir, "/")
+	for guest, host := range wr.mounts {
+		fs = fs.WithReadOnlyDirMount(host, guest)
+	}
+	var stdout, stderr bytes.Buffer
+	modCfg := wazero.NewModuleConfig().
+		WithArgs(args...).
+		WithStdin(strings.NewReader(req.Stdin)).
+		WithStdout(&stdout).
+		WithStderr(&stderr).
+		WithFSConfig(fs).
+		WithSysWalltime().
+		WithSysNanotime().
+		WithRandSource(rand.Reader)
+	for _, k := range sortedKeys(req.Env) {
+		modCfg = modCfg.WithEnv(k, req.Env[k])
+	}
+	if len(req.Outputs) > 0 {
+		modCfg = modCfg.WithEnv("CODERIPPER_OUTPUT_DIR", "/"+outputDir)
+	}
+
+	exitCode := 0
+	mod, err := rt.InstantiateModule(ctx, compiled, modCfg)
+	if mod != nil {
+		mod.Close(context.Background())
+	}
+	if err != nil {
+		var exitErr *sys.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = int(exitErr.ExitCode())
+		} else {
+			stderr.WriteString("\nError: " + err.Error())
+			exitCode = 1
+		}
+	}
+	return NativeResult{
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		ExitCode: exitCode,
+		Success:  exitCode == 0,
+	}
+}
+
+// decodeWasm accepts a module either as raw bytes or base64 text, since files travel as JSON strings.
+func decodeWasm(content string) ([]byte, error) {
+	if strings.HasPrefix(content, "\x00asm") {
+		return []byte(content), nil
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(content))
+	if err != nil {
+		return nil, fmt.Errorf("module is neither wasm binary nor base64: %w", err)
+	}
+	return b, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// helloWasm is a minimal WASI module that writes "hi\n" to stdout and calls proc_exit(3).
+const helloWasm = "AGFzbQEAAAABEANgBH9/f38Bf2ABfwBgAAACRgIWd2FzaV9zbmFwc2hvdF9wcmV2aWV3MQhmZF93cml0ZQAAFndhc2lfc25hcHNob3RfcHJldmlldzEJcHJvY19leGl0AAEDAgECBQMBAAEHEwIGbWVtb3J5AgAGX3N0YXJ0AAIKIQEfAEEAQRA2AgBBBEEDNgIAQQFBAEEBQQgQABpBAxABCwsJAQBBEAsDaGkK"
+
+func TestExecuteWasmModule(t *testing.T) {
+	wr := newWasmRunner()
+	req := RunRequest{Language: "wasm", Files: map[string]string{"hello.wasm": helloWasm}, TimeLimit: 5, MemoryLimit: 1 << 20}
+	res := executeWasm(req, wr)
+	if res.Stdout != "hi\n" || res.ExitCode != 3 || res.Success {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+}
+
+func TestExecuteWasmUnsupportedLanguage(t *testing.T) {
+	wr := newWasmRunner()
+	res := executeWasm(RunRequest{Language: "cobol", Files: map[string]string{"main.cob": ""}, TimeLimit: 1}, wr)
+	if res.Success || res.ExitCode != 1 {
+		t.Fatalf("expected failure, got %+v", res)
+	}
+}
+
+func TestExecuteWasmCompileTimeout(t *testing.T) {
+	sdk := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(sdk, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sdk, "bin", "clang"), []byte("#!/bin/sh\nexec sleep 10\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	wr := newWasmRunner()
+	wr.wasiSDK = sdk
+	res := executeWasm(RunRequest{Language: "c", Files: map[string]string{"main.c": "int main(){}"}, TimeLimit: 1}, wr)
+	if res.ExitCode != 124 || res.Stderr != "Execution timed out after 1 seconds" {
+		t.Fatalf("expected a timeout, got %+v", res)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// runWorker is the `exec-engine worker` command. It claims runs from the Postgres job queue,
+// executes them on the backend selected by RUNNER_MODE and writes the results back, so the
+// API can stay stateless and runners can live on dedicated sandbox nodes.
+func runWorker(rs *runners) {
+	jq, err := openJobQueue()
+	if err != nil {
+		log.Fatal(err)
+	}
+	host, _ := os.Hostname()
+	workerID := fmt.Sprintf("%s-%d", host, os.Getpid())
+	concurrency := rs.queue.workers
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	go workerHTTP()
+	// heartbeats continue after SIGTERM until the jobs in progress have drained; otherwise
+	// other workers would re-queue them and run them a second time
+	hbCtx, stopHeartbeat := context.WithCancel(context.Background())
+	go func() {
+		// heartbeat our jobs and re-queue jobs of workers that stopped heartbeating
+		ticker := time.NewTicker(jq.heartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-hbCtx.Done():
+				return
+			case <-ticker.C:
+				if err := jq.touch(context.Background(), workerID); err != nil {
+					log.Println("heartbeat failed:", err)
+				}
+				if n, err := jq.reap(context.Background()); err != nil {
+					log.Println("reap failed:", err)
+				} else if n > 0 {
+					log.Printf("re-queued %d jobs from dead workers", n)
+				}
+			}
+		}
+	}()
+
+	log.Printf("exec-engine worker %s started (mode=%s, concurrency=%d)", workerID, rs.mode, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			workLoop(ctx, jq, rs, workerID)
+		}()
+	}
+	wg.Wait()
+	stopHeartbeat()
+	log.Printf("exec-engine worker %s stopped", workerID)
+}
+
+// workLoop claims and executes jobs until ctx is cancelled. A job in progress is finished
+// before returning, so SIGTERM drains the worker instead of abandoning runs.
+func workLoop(ctx context.Context, jq *jobQueue, rs *runners, workerID string) {
+	poll := time.Duration(envInt("JOB_POLL_MILLIS", 500)) * time.Millisecond
+	label := rs.label()
+	for ctx.Err() == nil {
+		job, err := jq.claim(ctx, workerID)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Println("claim failed:", err)
+			}
+		}
+		if job == nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(poll):
+			}
+			continue
+		}
+
+		start := time.Now()
+		res, err := rs.execute(job.Req, job.Tier)
+		if err != nil {
+			runsCounter.WithLabelValues(label, "error").Inc()
+			if err := jq.fail(context.Background(), job.ID, workerID, err.Error()); err != nil {
+				log.Printf("job %d: record failure: %v", job.ID, err)
+			}
+			continue
+		}
+		runsCounter.WithLabelValues(label, mapStatus(res.Success)).Inc()
+		runsDuration.WithLabelValues(label).Observe(time.Since(start).Seconds())
+		if err := jq.complete(context.Background(), job.ID, workerID, res); err != nil {
+			log.Printf("job %d: record result: %v", job.ID, err)
+		}
+	}
+}
+
+// workerHTTP serves health and metrics endpoints for worker pods.
+func workerHTTP() {
+	port := os.Getenv("WORKER_PORT")
+	if port == "" {
+		port = "8091"
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK); w.Write([]byte("ok")) })
+	if err := http.ListenAndServe(":"+port, mux); err != nil {
+		log.Println("worker http:", err)
+	}
+}